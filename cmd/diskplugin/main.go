@@ -7,7 +7,9 @@ import (
 	ebsClient "csi-plugin/pkg/ebs-client"
 	snapClientset "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned"
 
+	"context"
 	"flag"
+	"net/http"
 	"os"
 	"strings"
 	"sync"
@@ -17,6 +19,9 @@ import (
 
 	"csi-plugin/util"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
 	k8sclient "k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -57,6 +62,28 @@ var (
 	metric            = flag.Bool("metric", false, "Enable monitoring volume statistics")
 	driverName        = flag.String("driver", DiskNFSKS3MultiDriverName, "CSI Driver, support multi driver and  separated by ','")
 	maxVolumesPerNode = flag.Int64("max-volumes-pernode", 8, "Only EBS: maximum number of volumes that can be attached to node")
+	clusterID         = flag.String("cluster-id", "", "Only EBS: cluster identifier tagged on the created volumes, defaults to the uid of the kube-system namespace")
+	volumeModifier    = flag.Bool("enable-volume-modifier", false, "Only EBS: modify the volume type of the PVCs annotated with storage.ksyun.com/target-performance-level")
+	metricsAddress    = flag.String("metrics-address", "", "The address to serve prometheus metrics on, e.g. :8095, disabled when empty")
+	//orphan collector
+	orphanCollector            = flag.Bool("enable-orphan-collector", false, "Only EBS: find the volumes created by the driver in this cluster without a PV")
+	orphanCollectorInterval    = flag.Duration("orphan-collector-interval", time.Hour, "Only EBS: how often the volumes are compared with the PVs")
+	orphanCollectorGracePeriod = flag.Duration("orphan-collector-grace-period", 24*time.Hour, "Only EBS: how long a volume stays orphaned before the orphan action is taken")
+	orphanCollectorAction      = flag.String("orphan-collector-action", ebs.OrphanActionReport, "Only EBS: action on the orphaned volumes after the grace period, one of report, quarantine and delete")
+	orphanCollectorDryRun      = flag.Bool("orphan-collector-dry-run", false, "Only EBS: report the orphan action without taking it")
+	snapshotTracker            = flag.Bool("enable-snapshot-tracker", false, "Only EBS: report the status and progress of the pending snapshots on the VolumeSnapshots")
+	snapshotTrackerMinBackoff  = flag.Duration("snapshot-tracker-min-backoff", 5*time.Second, "Only EBS: the first interval between the polls of a pending snapshot, doubled each poll")
+	snapshotTrackerMaxBackoff  = flag.Duration("snapshot-tracker-max-backoff", 5*time.Minute, "Only EBS: the maximum interval between the polls of a pending snapshot")
+	snapshotReadySLA           = flag.Duration("snapshot-ready-sla", time.Hour, "Only EBS: warn about the snapshots not ready in this duration, disabled when 0")
+	snapshotPolicy             = flag.Bool("enable-snapshot-policy", false, "Only EBS: create and prune the VolumeSnapshots of the SnapshotPolicy custom resources")
+	detachNotReadyGracePeriod  = flag.Duration("detach-notready-grace-period", 5*time.Minute, "Only EBS: how long a node stays NotReady before its volumes are force detached")
+	attachTimeout              = flag.Duration("attach-timeout", 2*time.Minute, "Only EBS: how long an attach may take across the retries of ControllerPublishVolume")
+	detachTimeout              = flag.Duration("detach-timeout", 2*time.Minute, "Only EBS: how long a detach may take across the retries of ControllerUnpublishVolume")
+	resizeTimeout              = flag.Duration("resize-timeout", 5*time.Minute, "Only EBS: how long a resize may take across the retries of ControllerExpandVolume")
+	operationMinBackoff        = flag.Duration("operation-min-backoff", time.Second, "Only EBS: the first interval between the polls of an attach, detach or resize, doubled each poll")
+	operationMaxBackoff        = flag.Duration("operation-max-backoff", 10*time.Second, "Only EBS: the maximum interval between the polls of an attach, detach or resize")
+	volumeMigration            = flag.Bool("enable-volume-migration", false, "Only EBS: move the disks of the VolumeMigration custom resources to another zone")
+	snapshotStoreConfigMap     = flag.String("snapshot-store-configmap", "", "Only EBS: namespace/name of the ConfigMap saving the snapshot requests across restarts, kept in memory when empty")
 	//nfs
 	mountPermissions             = flag.Uint64("mount-permissions", 0, "mounted folder permissions")
 	workingMountDir              = flag.String("working-mount-dir", "/tmp", "working directory for provisioner to mount nfs shares temporarily")
@@ -106,13 +133,48 @@ func newSnapClient() *snapClientset.Clientset {
 	return clientset
 }
 
+func newDynamicClient() dynamic.Interface {
+	var config *rest.Config
+	var err error
+	if *master != "" || *kubeconfig != "" {
+		klog.V(2).Infof("Either master or kubeconfig specified. building kube config from that..")
+		config, err = clientcmd.BuildConfigFromFlags(*master, *kubeconfig)
+	} else {
+		klog.V(5).Infof("Building kube configs for running in cluster...")
+		config, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		klog.Fatalf("Failed to create config: %v", err)
+	}
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		klog.Fatalf("Failed to create client: %v", err)
+	}
+
+	return client
+}
+
+// getClusterID returns the cluster-id flag, or the uid of the kube-system
+// namespace which stays the same for the lifetime of the cluster
+func getClusterID(client *k8sclient.Clientset) string {
+	if *clusterID != "" {
+		return *clusterID
+	}
+	ns, err := client.CoreV1().Namespaces().Get(context.Background(), "kube-system", metav1.GetOptions{})
+	if err != nil {
+		klog.Warningf("failed to get kube-system namespace as cluster id: %v", err)
+		return ""
+	}
+	return string(ns.UID)
+}
+
 type ClusterInfo struct {
 	AccountID int64  `json:"user_id"`
 	UUID      string `json:"cluster_uuid"`
 	Region    string `json:"region"`
 }
 
-func getEBSDriver(epName string) *ebs.Driver {
+func getEBSDriver(epName string) (*ebs.Driver, error) {
 	ebs.GlobalConfigVar.OpenApiConfig = &api.ClientConfig{
 		AccessKeyId:     *accessKeyId,
 		AccessKeySecret: *accessKeySecret,
@@ -124,18 +186,47 @@ func getEBSDriver(epName string) *ebs.Driver {
 	ebs.GlobalConfigVar.K8sClient = newK8SClient()
 	ebs.GlobalConfigVar.EbsClient = ebsClient.New(ebs.GlobalConfigVar.OpenApiConfig)
 	ebs.GlobalConfigVar.SnapClient = newSnapClient()
+	ebs.GlobalConfigVar.DynamicClient = newDynamicClient()
 	cfg := &ebs.Config{
-		EndPoint:               epName,
-		EnableNodeServer:       *nodeServer,
-		EnableControllerServer: *controllerServer,
-		EnableVolumeExpansion:  *volumeExpansion,
-		MaxVolumeSize:          *maxVolumeSize,
-		DriverName:             EBSdriverName,
-		K8sClient:              ebs.GlobalConfigVar.K8sClient,
-		EbsClient:              ebs.GlobalConfigVar.EbsClient,
-		MetricEnabled:          *metric,
-		Version:                version,
-		MaxVolumesPerNode:      *maxVolumesPerNode,
+		EndPoint:                  epName,
+		EnableNodeServer:          *nodeServer,
+		EnableControllerServer:    *controllerServer,
+		EnableVolumeExpansion:     *volumeExpansion,
+		MaxVolumeSize:             *maxVolumeSize,
+		DriverName:                EBSdriverName,
+		K8sClient:                 ebs.GlobalConfigVar.K8sClient,
+		EbsClient:                 ebs.GlobalConfigVar.EbsClient,
+		MetricEnabled:             *metric,
+		Version:                   version,
+		MaxVolumesPerNode:         *maxVolumesPerNode,
+		DetachNotReadyGracePeriod: *detachNotReadyGracePeriod,
+		Operations: ebs.OperationTrackerConfig{
+			AttachTimeout: *attachTimeout,
+			DetachTimeout: *detachTimeout,
+			ResizeTimeout: *resizeTimeout,
+			MinBackoff:    *operationMinBackoff,
+			MaxBackoff:    *operationMaxBackoff,
+		},
+		EnableVolumeModifier:  *volumeModifier,
+		EnableOrphanCollector: *orphanCollector,
+		OrphanCollector: ebs.OrphanCollectorConfig{
+			Interval:    *orphanCollectorInterval,
+			GracePeriod: *orphanCollectorGracePeriod,
+			Action:      *orphanCollectorAction,
+			DryRun:      *orphanCollectorDryRun,
+		},
+		SnapshotStoreConfigMap: *snapshotStoreConfigMap,
+		EnableSnapshotTracker:  *snapshotTracker,
+		EnableSnapshotPolicy:   *snapshotPolicy,
+		EnableVolumeMigration:  *volumeMigration,
+		SnapshotTracker: ebs.SnapshotTrackerConfig{
+			MinBackoff: *snapshotTrackerMinBackoff,
+			MaxBackoff: *snapshotTrackerMaxBackoff,
+			SLA:        *snapshotReadySLA,
+		},
+	}
+	if *controllerServer {
+		cfg.ClusterID = getClusterID(ebs.GlobalConfigVar.K8sClient)
 	}
 	klog.V(5).Infof("disk driver config: %+v", cfg)
 
@@ -163,6 +254,16 @@ func getNFSDriver(epName string) *nfs.Driver {
 
 }
 
+// serveMetrics serves the prometheus metrics of the registered collectors
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	klog.Infof("serving metrics on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		klog.Errorf("failed to serve metrics on %s: %v", addr, err)
+	}
+}
+
 func replaceEndpoint(driverType, endpointName string) string {
 	return strings.Replace(endpointName, TypePluginVar, driverType, -1)
 }
@@ -179,6 +280,9 @@ func main() {
 	if err != nil {
 		klog.Warningf("nodeid is empty, err: %v", err)
 	}
+	if *metricsAddress != "" {
+		go serveMetrics(*metricsAddress)
+	}
 	var epName = *endpoint
 	var wg sync.WaitGroup
 	for _, driverName := range driverNames {
@@ -192,7 +296,10 @@ func main() {
 		case EBSdriverName:
 			go func(ep string) {
 				defer wg.Done()
-				d := getEBSDriver(ep)
+				d, err := getEBSDriver(ep)
+				if err != nil {
+					klog.Fatalf("Failed to create the disk driver: %v", err)
+				}
 				if err := d.Run(); err != nil {
 					klog.Fatal(err)
 					d.Stop()
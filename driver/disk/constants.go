@@ -22,6 +22,11 @@ const (
 	DISK_PERFORMANCE_LEVEL2 = "PL2"
 	DISK_PERFORMANCE_LEVEL3 = "PL3"
 
+	// EncryptedKey in storage class creates encrypted volumes, with the KMS
+	// key of KmsKeyIDKey or the default key of the account
+	EncryptedKey = "encrypted"
+	KmsKeyIDKey  = "kmsKeyId"
+
 	// NodeSchedueTag in annotations
 	NodeSchedueTag = "volume.kubernetes.io/selected-node"
 
@@ -57,12 +62,71 @@ const (
 	SnapshotRequestTag = "SNAPSHOT_REQUEST_INTERVAL"
 	// DefaultVolumeSnapshotClass ...
 	DefaultVolumeSnapshotClass = "ksyun-disk-snapshot"
+
+	// CsiTagPrefix is the prefix of the volume tags set by the driver, the
+	// keys are kept to letters, digits and "." of the EBS tag key charset
+	CsiTagPrefix = "csi."
+	// CsiRequestNameTag is the volume tag of the CreateVolume request name
+	CsiRequestNameTag = CsiTagPrefix + "requestName"
+	// CsiClusterIDTag is the volume tag of the cluster that created the volume
+	CsiClusterIDTag = CsiTagPrefix + "clusterId"
+	// CsiPVNameTag, CsiPVCNameTag and CsiPVCNamespaceTag are the volume tags
+	// of the PV and PVC, known when --extra-create-metadata is set
+	CsiPVNameTag       = CsiTagPrefix + "pvName"
+	CsiPVCNameTag      = CsiTagPrefix + "pvcName"
+	CsiPVCNamespaceTag = CsiTagPrefix + "pvcNamespace"
+
+	// AnnDiskTags on a PVC adds tags to its disk in the same format as the
+	// tags parameter of storage class, "key1:value1,key2:value2"
+	AnnDiskTags = "storage.ksyun.com/disk-tags"
+
+	// maxDiskTags is the number of tags EBS allows on a volume
+	maxDiskTags = 50
+)
+
+// constants of keys in CreateVolume parameters added by --extra-create-metadata
+const (
+	pvcNameKey      = "csi.storage.k8s.io/pvc/name"
+	pvcNamespaceKey = "csi.storage.k8s.io/pvc/namespace"
+	pvNameKey       = "csi.storage.k8s.io/pv/name"
+)
+
+// annotations of the PVCs whose volume type is modified online
+const (
+	// AnnTargetPerformanceLevel is set by the user to the performance level
+	// (PL0-PL3 of ESSD) or the volume type the volume is modified to
+	AnnTargetPerformanceLevel = "storage.ksyun.com/target-performance-level"
+	// AnnPerformanceLevel is the volume type the volume was last modified to
+	AnnPerformanceLevel = "storage.ksyun.com/performance-level"
+	// AnnModifyStatus is the state of the modification to AnnModifyTarget
+	AnnModifyStatus = "storage.ksyun.com/modify-status"
+	// AnnModifyTarget is the target performance level AnnModifyStatus is of
+	AnnModifyTarget = "storage.ksyun.com/modify-target"
+	// AnnModifyStartTime is when the volume started Modifying, in RFC 3339
+	AnnModifyStartTime = "storage.ksyun.com/modify-start-time"
+
+	ModifyStatusModifying = "Modifying"
+	ModifyStatusCompleted = "Completed"
+	ModifyStatusFailed    = "Failed"
+)
+
+// annotations of the VolumeSnapshots and VolumeSnapshotContents whose disk
+// snapshot is polled by the snapshot tracker
+const (
+	// AnnSnapshotStatus is the status of the disk snapshot, creating,
+	// available or error
+	AnnSnapshotStatus = "storage.ksyun.com/snapshot-status"
+	// AnnSnapshotProgress is the progress of the disk snapshot, such as "45%"
+	AnnSnapshotProgress = "storage.ksyun.com/snapshot-progress"
 )
 
 // constants of keys in volume snapshot parameters
 const (
 	VolumeSnapshotNamespaceKey = "csi.storage.k8s.io/volumesnapshot/namespace"
 	VolumeSnapshotNameKey      = "csi.storage.k8s.io/volumesnapshot/name"
+
+	VolumeGroupSnapshotNamespaceKey = "csi.storage.k8s.io/volumegroupsnapshot/namespace"
+	VolumeGroupSnapshotNameKey      = "csi.storage.k8s.io/volumegroupsnapshot/name"
 )
 
 // keys used in CreateSnapshotRequest.Parameters
@@ -85,4 +149,58 @@ const (
 	snapshotDeleteError string = "SnapshotDeleteError"
 	//snapshotDeletedSuccessfully means that the delete snapshot success
 	snapshotDeletedSuccessfully string = "SnapshotDeletedSuccessfully"
+	//groupSnapshotAlreadyExist means that the group snapshot already exists with other volumes
+	groupSnapshotAlreadyExist string = "GroupSnapshotAlreadyExist"
+	//groupSnapshotCreateError means that the create group snapshot error occurred, the created snapshots are rolled back
+	groupSnapshotCreateError string = "GroupSnapshotCreateError"
+	//groupSnapshotCreatedSuccessfully means that the snapshots of all the volumes of the group are ready
+	groupSnapshotCreatedSuccessfully string = "GroupSnapshotCreatedSuccessfully"
+	//groupSnapshotDeleteError means that the delete group snapshot error occurred
+	groupSnapshotDeleteError string = "GroupSnapshotDeleteError"
+	//groupSnapshotDeletedSuccessfully means that the delete group snapshot success
+	groupSnapshotDeletedSuccessfully string = "GroupSnapshotDeletedSuccessfully"
+	//diskTypeFallback means that the volume is created with a later disk type of the storage class
+	diskTypeFallback string = "DiskTypeFallback"
+	//volumeModifying means that the volume type modification is started
+	volumeModifying string = "VolumeModifying"
+	//volumeModified means that the volume type modification is finished
+	volumeModified string = "VolumeModified"
+	//volumeModifyFailed means that the volume type modification failed
+	volumeModifyFailed string = "VolumeModifyFailed"
+	//orphanedVolumeFound means that a volume created by the driver has no persistent volume
+	orphanedVolumeFound string = "OrphanedVolumeFound"
+	//orphanedVolumeDryRun means that the action on an orphaned volume is skipped in dry run
+	orphanedVolumeDryRun string = "OrphanedVolumeDryRun"
+	//orphanedVolumeQuarantined means that an orphaned volume is tagged as quarantined
+	orphanedVolumeQuarantined string = "OrphanedVolumeQuarantined"
+	//orphanedVolumeDeleted means that an orphaned volume is deleted
+	orphanedVolumeDeleted string = "OrphanedVolumeDeleted"
+	//orphanedVolumeActionFailed means that the action on an orphaned volume failed
+	orphanedVolumeActionFailed string = "OrphanedVolumeActionFailed"
+	//snapshotFailed means that a disk snapshot is in error status
+	snapshotFailed string = "SnapshotFailed"
+	//snapshotSLAExceeded means that a disk snapshot is not ready within the sla
+	snapshotSLAExceeded string = "SnapshotSLAExceeded"
+	//snapshotPolicyInvalid means that the schedule or the retention of a snapshot policy is invalid
+	snapshotPolicyInvalid string = "SnapshotPolicyInvalid"
+	//scheduledSnapshotCreated means that the volume snapshots of a schedule are created
+	scheduledSnapshotCreated string = "ScheduledSnapshotCreated"
+	//scheduledSnapshotFailed means that the volume snapshots of a schedule failed to create, they are retried
+	scheduledSnapshotFailed string = "ScheduledSnapshotFailed"
+	//scheduledSnapshotPruned means that the volume snapshots out of the retention are deleted
+	scheduledSnapshotPruned string = "ScheduledSnapshotPruned"
+	//volumeMigrating means that a volume migration moves to the next step
+	volumeMigrating string = "VolumeMigrating"
+	//volumeMigrated means that a disk is moved to the target zone and its pvc is bound to it
+	volumeMigrated string = "VolumeMigrated"
+	//volumeMigrationFailed means that a volume migration stopped with an error
+	volumeMigrationFailed string = "VolumeMigrationFailed"
+	//volumeDetachWaiting means that a disk is not detached from a node yet, such as a NotReady node in the grace period
+	volumeDetachWaiting string = "VolumeDetachWaiting"
+	//volumeForceDetached means that a disk is detached from a NotReady or deleted node
+	volumeForceDetached string = "VolumeForceDetached"
+	//volumeDetachFailed means that a disk failed to detach
+	volumeDetachFailed string = "VolumeDetachFailed"
+	//volumeDetachInconsistent means that a disk is in-use without attachments, the detach is retried
+	volumeDetachInconsistent string = "VolumeDetachInconsistent"
 )
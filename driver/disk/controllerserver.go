@@ -7,17 +7,21 @@ import (
 	"fmt"
 	"google.golang.org/protobuf/types/known/timestamppb"
 	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/record"
 	"os"
 	"regexp"
 	"strings"
-	"sync"
 	"time"
 
 	"strconv"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/ptypes/wrappers"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -25,6 +29,7 @@ import (
 	//k8s_v1 "k8s.io/api/core/v1"
 
 	"k8s.io/klog/v2"
+	azcache "sigs.k8s.io/cloud-provider-azure/pkg/cache"
 )
 
 const (
@@ -37,18 +42,53 @@ const (
 	// createdByDO is used to tag volumes that are created by this CSI plugin
 	createdByDO = "Created by KSC  CSI driver"
 
+	// cloneSnapshotPrefix is the name prefix of the temporary snapshots taken
+	// from the source volume when cloning a volume
+	cloneSnapshotPrefix = "clone-"
+	cloneSnapshotDesc   = "Created by KSC CSI driver for volume clone"
+
+	// cloneSnapshotTimeout is how long CreateVolume waits for the temporary
+	// snapshot to become available before asking the provisioner to retry
+	cloneSnapshotTimeout = 1 * time.Minute
+	// cloneCleanupTimeout is how long the cloned volume may take to leave the
+	// creating state before the temporary snapshot is deleted, it is polled
+	// every cloneCleanupInterval
+	cloneCleanupTimeout  = 10 * time.Minute
+	cloneCleanupInterval = 5 * time.Second
+
+	// diskQuotaCacheKey is the only key of the disk quota cache, the whole
+	// zone/type matrix is fetched by a single DescribeInstanceTypeConfigs call
+	diskQuotaCacheKey = "disk-quota"
+	diskQuotaCacheTTL = 5 * time.Minute
+
+	// listVolumesPageSize is the page size of DescribeVolumes used by ListVolumes
+	listVolumesPageSize = 100
+
 	defaultChargeType   = ebsClient.DAILY_CHARGE_TYPE
 	defaultVolumeType   = ebsClient.SSD3_0
 	defaultPurchaseTime = "0"
 )
 
 type KscEBSControllerServer struct {
+	csi.UnimplementedControllerServer
+	csi.UnimplementedGroupControllerServer
+
 	config   Config
 	recorder record.EventRecorder
 
-	mutex     sync.Mutex
-	k8sClient K8sClientWrapper
-	ebsClient ebsClient.StorageService
+	k8sClient    K8sClientWrapper
+	ebsClient    ebsClient.StorageService
+	zoneSelector ZoneSelector
+
+	diskQuotaCache azcache.Resource
+	// volumeLocks guards the volume IDs and request names being operated on
+	volumeLocks *util.VolumeLocks
+	// snapshotStore limits the rate of CreateSnapshot and remembers the
+	// created snapshots
+	snapshotStore *SnapshotStore
+	// operations tracks the attach, detach and resize of the volumes across
+	// the retries of the calls
+	operations *OperationTracker
 }
 
 // volume parameters
@@ -60,32 +100,49 @@ type volumeArgs struct {
 	DiskTags         map[string]string `json:"diskTags"`
 	NodeSelected     string            `json:"nodeSelected"`
 	FsType           string            `json:"fsType"`
+	Encrypted        bool              `json:"encrypted"`
+	KmsKeyID         string            `json:"kmsKeyId"`
 }
 
-// the map of req.Name and csi.Snapshot
-var createdSnapshotMap = map[string]*csi.Snapshot{}
-
-// SnapshotRequestMap snapshot request limit
-var SnapshotRequestMap = map[string]int64{}
-
-// SnapshotRequestInterval snapshot request limit
-var SnapshotRequestInterval = int64(10)
+// defaultSnapshotRequestInterval is the minimum seconds between the
+// CreateSnapshot requests of the same name
+const defaultSnapshotRequestInterval = int64(10)
 
 func GetControllerServer(cfg *Config) *KscEBSControllerServer {
 	// parse input snapshot request interval
+	snapshotRequestInterval := defaultSnapshotRequestInterval
 	intervalStr := os.Getenv(SnapshotRequestTag)
 	if intervalStr != "" {
 		interval, err := strconv.ParseInt(intervalStr, 10, 64)
-		if err != nil {
+		if err != nil || interval < 0 {
 			klog.Fatalf("Input SnapshotRequestTag is illegal: %s", intervalStr)
-			SnapshotRequestInterval = interval
 		}
+		snapshotRequestInterval = interval
+	}
+	var snapshotPersister snapshotStatePersister
+	if cfg.SnapshotStoreConfigMap != "" {
+		namespace, name, err := cache.SplitMetaNamespaceKey(cfg.SnapshotStoreConfigMap)
+		if err != nil || namespace == "" || name == "" {
+			klog.Fatalf("Invalid snapshot store configmap %q, expect namespace/name", cfg.SnapshotStoreConfigMap)
+		}
+		snapshotPersister = NewConfigMapSnapshotPersister(cfg.K8sClient, namespace, name)
+	}
+	getter := func(key string) (interface{}, error) { return GetDiskQuotaByZone() }
+	diskQuotaCache, err := azcache.NewTimedCache(diskQuotaCacheTTL, getter, false)
+	if err != nil {
+		klog.Fatalf("Failed to create disk quota cache: %v", err)
 	}
+	k8sClient := GetK8sClientWrapper(cfg.K8sClient)
 	return &KscEBSControllerServer{
-		recorder:  util.NewEventRecorder(),
-		config:    *cfg,
-		ebsClient: cfg.EbsClient,
-		k8sClient: GetK8sClientWrapper(cfg.K8sClient),
+		recorder:       util.NewEventRecorder(),
+		config:         *cfg,
+		ebsClient:      cfg.EbsClient,
+		k8sClient:      k8sClient,
+		zoneSelector:   NewZoneSelector(k8sClient),
+		diskQuotaCache: diskQuotaCache,
+		volumeLocks:    util.NewVolumeLocks(),
+		snapshotStore:  NewSnapshotStore(time.Duration(snapshotRequestInterval)*time.Second, defaultSnapshotStoreTTL, snapshotPersister),
+		operations:     NewOperationTracker(cfg.Operations, cfg.EbsClient),
 	}
 }
 
@@ -95,12 +152,15 @@ func (cs *KscEBSControllerServer) getControllerServiceCapabilities() []*csi.Cont
 	cl = []csi.ControllerServiceCapability_RPC_Type{
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
-		//csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
 		csi.ControllerServiceCapability_RPC_GET_VOLUME,
 		csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
 		csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
 		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+		csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
 	}
 	if cs.config.EnableVolumeExpansion {
 		cl = append(cl, csi.ControllerServiceCapability_RPC_EXPAND_VOLUME)
@@ -150,19 +210,28 @@ func (cs *KscEBSControllerServer) CreateVolume(ctx context.Context, req *csi.Cre
 
 	// check parameters
 	snapshotID := ""
+	sourceVolumeID := ""
 	volumeSource := req.GetVolumeContentSource()
 	if volumeSource != nil {
-		if _, ok := volumeSource.GetType().(*csi.VolumeContentSource_Snapshot); !ok {
+		switch volumeSource.GetType().(type) {
+		case *csi.VolumeContentSource_Snapshot:
+			sourceSnapshot := volumeSource.GetSnapshot()
+			if sourceSnapshot == nil {
+				return nil, status.Error(codes.InvalidArgument, "CreateVolume: get empty snapshot from volumeContentSource")
+			}
+			snapshotID = sourceSnapshot.GetSnapshotId()
+		case *csi.VolumeContentSource_Volume:
+			sourceVolume := volumeSource.GetVolume()
+			if sourceVolume == nil || sourceVolume.GetVolumeId() == "" {
+				return nil, status.Error(codes.InvalidArgument, "CreateVolume: get empty volume from volumeContentSource")
+			}
+			sourceVolumeID = sourceVolume.GetVolumeId()
+		default:
 			return nil, status.Error(codes.InvalidArgument, "CreateVolume: unsupported VolumeContentSource type")
 		}
-		sourceSnapshot := volumeSource.GetSnapshot()
-		if sourceSnapshot == nil {
-			return nil, status.Error(codes.InvalidArgument, "CreateVolume: get empty snapshot from volumeContentSource")
-		}
-		snapshotID = sourceSnapshot.GetSnapshotId()
 	}
 	// set snapshotId if pvc labels/annotation set it.
-	if snapshotID == "" {
+	if snapshotID == "" && sourceVolumeID == "" {
 		if value, ok := req.GetParameters()[DiskSnapshotID]; ok && value != "" {
 			snapshotID = value
 		}
@@ -171,12 +240,34 @@ func (cs *KscEBSControllerServer) CreateVolume(ctx context.Context, req *csi.Cre
 	if req.Name == "" {
 		return nil, status.Error(codes.InvalidArgument, "CreateVolume: Volume name must be provided")
 	}
+	if acquired := cs.volumeLocks.TryAcquire(req.Name); !acquired {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, req.Name)
+	}
+	defer cs.volumeLocks.Release(req.Name)
 	if req.VolumeCapabilities == nil || len(req.VolumeCapabilities) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "CreateVolume: volume capabilities must be provided")
 	}
 
 	if !validateCapabilities(req.VolumeCapabilities) {
-		return nil, status.Error(codes.InvalidArgument, "CreateVolume: invalid volume capabilities requestecs . Only SINGLE_NODE_WRITER is supported ('accessModes.ReadWriteOnce' on Kubernetes)")
+		return nil, status.Error(codes.InvalidArgument, "CreateVolume: invalid volume capabilities, only the single node access modes and ReadOnlyMany are supported ('accessModes' ReadWriteOnce, ReadWriteOncePod or ReadOnlyMany on Kubernetes), a ReadOnlyMany volume is published to a single node at a time")
+	}
+
+	// the format options are used by NodeStageVolume, a storage class with
+	// invalid ones fails here instead of at the first mount
+	for _, volCap := range req.VolumeCapabilities {
+		if mnt := volCap.GetMount(); mnt != nil {
+			fsType := mnt.GetFsType()
+			if fsType == "" {
+				fsType = "ext4"
+			}
+			if _, err := getMkfsArgs(fsType, req.GetParameters()); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "CreateVolume: invalid format options: %v", err)
+			}
+			// NodeExpandVolume can not grow ext2 online
+			if fsType == "ext2" && cs.config.EnableVolumeExpansion {
+				return nil, status.Error(codes.InvalidArgument, "CreateVolume: filesystem ext2 can not be expanded, use ext3, ext4, xfs or btrfs when volume expansion is enabled")
+			}
+		}
 	}
 
 	size, err := extractStorage(req.CapacityRange)
@@ -190,85 +281,98 @@ func (cs *KscEBSControllerServer) CreateVolume(ctx context.Context, req *csi.Cre
 		return nil, status.Errorf(codes.InvalidArgument, "CreateVolume: Invalid parameters from input: %v, with error: %v", req.Name, err)
 	}
 
-	volumeName := req.GetName()
+	var sourceVol *ebsClient.Volume
+	if sourceVolumeID != "" {
+		sourceVol, err = cs.ebsClient.GetVolume(&ebsClient.ListVolumesReq{
+			VolumeIds: []string{sourceVolumeID},
+		})
+		if err != nil {
+			return nil, status.Errorf(codes.NotFound, "CreateVolume: source volume %s not found: %v", sourceVolumeID, err)
+		}
+		if size < sourceVol.Size*GB {
+			return nil, status.Errorf(codes.OutOfRange, "CreateVolume: requested size %v is smaller than source volume %s size %v", formatBytes(size), sourceVolumeID, formatBytes(sourceVol.Size*GB))
+		}
+	}
 
-	// 给 ebs 创建硬盘的时间
-	time.Sleep(5 * time.Second)
+	volumeName := req.GetName()
 
-	// get volume first, if it's created do nothing
-	listVolumesResp, err := cs.ebsClient.GetVolumeByName(&ebsClient.ListVolumesReq{
-		VolumeExactName: volumeName,
-		VolumeCategory:  "data",
-	})
+	// get volume first, if it's created by a previous attempt of this request do nothing
+	existVol, err := cs.getVolumeByRequestName(volumeName)
 	if err != nil {
 		return nil, err
 	}
-
-	// volume already exist, do nothing
-	if listVolumesResp.TotalCount > 0 && len(listVolumesResp.Volumes) > 0 {
-		klog.V(2).Infoln("Query the hard disk list volume already exists")
-		if listVolumesResp.TotalCount > 1 {
-			// external-provisioner 调用了三次 rpc createvolume
-			// 目前解决办法是，需要用户手动去控制台删除一块ebs盘
-			// TODO 是否需要csi 删除一块
-			if listVolumesResp.TotalCount == 2 {
-				if cs.delvolume(listVolumesResp.Volumes[0], size) {
-					return &csi.CreateVolumeResponse{
-						Volume: &csi.Volume{
-							VolumeId:      listVolumesResp.Volumes[1].VolumeId,
-							CapacityBytes: size,
-						},
-					}, nil
-				} else if cs.delvolume(listVolumesResp.Volumes[1], size) {
-					return &csi.CreateVolumeResponse{
-						Volume: &csi.Volume{
-							VolumeId:      listVolumesResp.Volumes[0].VolumeId,
-							CapacityBytes: size,
-						},
-					}, nil
-				} else {
-					return nil, fmt.Errorf("fatal issue: duplicate volume %q exists", volumeName)
-				}
-			}
+	if existVol != nil {
+		klog.V(2).Infof("CreateVolume: volume %s of request %s already exists", existVol.VolumeId, volumeName)
+		if err := checkExistingVolume(existVol, req, size, volArg, snapshotID, sourceVol); err != nil {
+			return nil, err
 		}
-		vol := listVolumesResp.Volumes[0]
-		if vol.VolumeStatus == "creating" || vol.VolumeStatus == "available" {
-			if vol.Size*GB != size {
-				return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("invalid option requested size: %d", size))
+		volumeContext := req.GetParameters()
+		if volumeContext == nil {
+			volumeContext = make(map[string]string)
+		}
+		volumeContext["type"] = existVol.VolumeType
+		setEncryptionContext(volumeContext, existVol.Encrypted, existVol.KmsKeyId)
+		var src *csi.VolumeContentSource
+		if sourceVol != nil {
+			cs.startCloneSnapshotCleanup(existVol.VolumeId, volumeName)
+			src = &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Volume{
+					Volume: &csi.VolumeContentSource_VolumeSource{
+						VolumeId: sourceVol.VolumeId,
+					},
+				},
 			}
-			klog.V(2).Info("volume already created")
-			return &csi.CreateVolumeResponse{
-				Volume: &csi.Volume{
-					VolumeId:      vol.VolumeId,
-					CapacityBytes: size,
+		} else if snapshotID != "" {
+			src = &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Snapshot{
+					Snapshot: &csi.VolumeContentSource_SnapshotSource{
+						SnapshotId: snapshotID,
+					},
 				},
-			}, nil
+			}
 		}
+		tmpVol := getCsiVolumeInfo(existVol.VolumeType, existVol.VolumeId, existVol.Size*GB, volumeContext, existVol.AvailabilityZone, src)
+		return &csi.CreateVolumeResponse{Volume: tmpVol}, nil
 	}
 	// todo
 	// checking volume limit
 	// 是否检查每个账号可以创建的最多 volume 数量
 	parameters := SuperMapString(req.Parameters)
 
-	//var region string
-	volArg.Zone = parameters.Get("zone", "")
-	isZoneSpecified := true
-	if len(volArg.Zone) == 0 {
-		isZoneSpecified = false
-		if len(req.AccessibilityRequirements.Preferred) != 0 {
-			// choose the most preffer zone
-			segments := req.AccessibilityRequirements.Preferred[0]
-			volArg.Zone = segments.Segments[util.NodeZoneKey]
-		} else {
-			_, volArg.Zone, err = cs.k8sClient.GetNodeRegionZone()
-			if err != nil {
-				return nil, err
-			}
-			klog.V(5).Info(fmt.Sprintf("rand region and zone: %s, %s", "", volArg.Zone))
+	var zones []string
+	if sourceVol != nil {
+		// the cloned volume is restored in the zone of the source volume
+		requisite := topologyZones(req.GetAccessibilityRequirements().GetRequisite())
+		if len(requisite) != 0 && !containsString(requisite, sourceVol.AvailabilityZone) {
+			return nil, status.Errorf(codes.ResourceExhausted, "CreateVolume: zone %s of source volume %s is not in the accessible topology %v", sourceVol.AvailabilityZone, sourceVol.VolumeId, requisite)
+		}
+		zones = []string{sourceVol.AvailabilityZone}
+		snapshotID, err = cs.prepareCloneSnapshot(volumeName, sourceVol)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		zones, err = cs.zoneSelector.SelectZones(req)
+		if err != nil {
+			return nil, err
 		}
 	}
+	volArg.Zone = zones[0]
 
-	createVolumeReq, diskType, err := preCreateVolume(req.GetName(), snapshotID, size, volArg, parameters)
+	if snapshotID != "" {
+		if err := cs.applySnapshotEncryption(snapshotID, volArg); err != nil {
+			return nil, err
+		}
+	}
+
+	createVolumeReq, diskTypes, err := preCreateVolume(req.GetName(), snapshotID, size, volArg, parameters)
+	if err != nil {
+		return nil, err
+	}
+	createVolumeReq.Tags, err = cs.getDiskTags(req, volArg.DiskTags)
+	if err != nil {
+		return nil, err
+	}
 
 	purchaseTime, err := strconv.Atoi(parameters.Get("purchasetime", defaultPurchaseTime))
 	if err != nil {
@@ -283,35 +387,61 @@ func (cs *KscEBSControllerServer) CreateVolume(ctx context.Context, req *csi.Cre
 	if volumeContext == nil {
 		volumeContext = make(map[string]string)
 	}
-	if diskType != "" {
-		volumeContext["type"] = diskType
-	}
 	klog.V(5).Infof("CreateVolume: volume: %s", req.GetName())
 
+	// every zone tries the disk types in the order of the storage class, the
+	// next type is only tried when the previous one is unavailable in the zone
 	var createVolumeResp *ebsClient.CreateVolumeResp
-
-	for i := 0; i < len(req.AccessibilityRequirements.Preferred); i++ {
-		if !isZoneSpecified {
-			segments := req.AccessibilityRequirements.Preferred[i]
-			createVolumeReq.AvailabilityZone = segments.Segments[util.NodeZoneKey]
-			volArg.Zone = createVolumeReq.AvailabilityZone
-			klog.V(2).Infof("CreateVolume::Zone be selected for the %d-th time, Zone is %s", i, volArg.Zone)
-		}
-		createVolumeResp, err = cs.ebsClient.CreateVolume(createVolumeReq)
-		// if createVolume success
-		if err == nil {
-			break
+	var diskType string
+	var fallbackReasons []string
+zoneLoop:
+	for i, zone := range zones {
+		createVolumeReq.AvailabilityZone = zone
+		volArg.Zone = zone
+		klog.V(2).Infof("CreateVolume::Zone be selected for the %d-th time, Zone is %s", i, volArg.Zone)
+		for _, dType := range diskTypes {
+			createVolumeReq.VolumeType = dType
+			createVolumeResp, err = cs.ebsClient.CreateVolume(createVolumeReq)
+			// if createVolume success
+			if err == nil {
+				diskType = dType
+				break zoneLoop
+			}
+			// the volume may be created by a timed out or failed request, the
+			// retry finds it by the request name instead of creating another
+			// one of another type or zone
+			if !ebsClient.IsVolumeTypeUnavailable(err) {
+				klog.Errorf("CreateVolume::createvolume in Zone %s failed, error is %v", volArg.Zone, err)
+				return nil, err
+			}
+			klog.Warningf("CreateVolume:: disk type %s is unavailable in zone %s: %v", dType, zone, err)
+			fallbackReasons = append(fallbackReasons, fmt.Sprintf("%s in %s: %v", dType, zone, err))
 		}
-		// if createVolume err and zoneSelection or last preffered
-		if (err != nil && isZoneSpecified) || (err != nil && i == len(req.AccessibilityRequirements.Preferred)-1) {
+		// if createVolume err and last zone
+		if i == len(zones)-1 {
 			klog.Errorf("CreateVolume::createvolume in Zone %s failed, error is %v", volArg.Zone, err)
-			return nil, err
+			return nil, status.Errorf(codes.ResourceExhausted, "CreateVolume: no disk type of %v is available in zones %v: %v", diskTypes, zones, err)
 		}
 	}
+	volumeContext["type"] = diskType
+	setEncryptionContext(volumeContext, createVolumeReq.Encrypted, createVolumeReq.KmsKeyId)
+	if len(fallbackReasons) != 0 {
+		cs.createPVCEvent(req.GetParameters(), v1.EventTypeNormal, diskTypeFallback,
+			fmt.Sprintf("disk type %s is chosen in zone %s, unavailable: %s", diskType, volArg.Zone, strings.Join(fallbackReasons, "; ")))
+	}
 
 	// Set VolumeContentSource
 	var src *csi.VolumeContentSource
-	if snapshotID != "" {
+	if sourceVol != nil {
+		src = &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{
+				Volume: &csi.VolumeContentSource_VolumeSource{
+					VolumeId: sourceVol.VolumeId,
+				},
+			},
+		}
+		cs.startCloneSnapshotCleanup(createVolumeResp.VolumeId, volumeName)
+	} else if snapshotID != "" {
 		src = &csi.VolumeContentSource{
 			Type: &csi.VolumeContentSource_Snapshot{
 				Snapshot: &csi.VolumeContentSource_SnapshotSource{
@@ -321,20 +451,346 @@ func (cs *KscEBSControllerServer) CreateVolume(ctx context.Context, req *csi.Cre
 		}
 	}
 
-	tmpVol := getCsiVolumeInfo(diskType, createVolumeResp.VolumeId, size, volumeContext, volArg.Zone, src)
+	tmpVol := getCsiVolumeInfo(diskType, createVolumeResp.VolumeId, volumeSizeGB(size)*GB, volumeContext, volArg.Zone, src)
 
 	return &csi.CreateVolumeResponse{Volume: tmpVol}, nil
 }
 
-func preCreateVolume(diskName string, snapshotID string, size int64, volArg *volumeArgs, parameters SuperMapString) (*ebsClient.CreateVolumeReq, string, error) {
+// getDiskTags merges the tags of a new volume. The CSI tags identifying the
+// request, cluster, PV and PVC win over the tags of the PVC annotation
+// AnnDiskTags, which win over the tags parameter of the storage class.
+func (cs *KscEBSControllerServer) getDiskTags(req *csi.CreateVolumeRequest, storageClassTags map[string]string) (map[string]string, error) {
+	params := req.GetParameters()
+	tags := make(map[string]string)
+	for k, v := range storageClassTags {
+		tags[k] = v
+	}
+
+	pvcName, pvcNamespace := params[pvcNameKey], params[pvcNamespaceKey]
+	if cs.k8sClient != nil && pvcName != "" && pvcNamespace != "" {
+		pvc, err := cs.k8sClient.GetPersistentVolumeClaim(pvcNamespace, pvcName)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "CreateVolume: failed to get pvc %s/%s: %v", pvcNamespace, pvcName, err)
+		}
+		if value := pvc.Annotations[AnnDiskTags]; value != "" {
+			pvcTags, err := parseDiskTags(value)
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "CreateVolume: invalid %s of pvc %s/%s: %v", AnnDiskTags, pvcNamespace, pvcName, err)
+			}
+			for k, v := range pvcTags {
+				tags[k] = v
+			}
+		}
+	}
+
+	csiTags := map[string]string{
+		CsiRequestNameTag:  req.GetName(),
+		CsiClusterIDTag:    cs.config.ClusterID,
+		CsiPVNameTag:       params[pvNameKey],
+		CsiPVCNameTag:      pvcName,
+		CsiPVCNamespaceTag: pvcNamespace,
+	}
+	for k, v := range csiTags {
+		if v == "" {
+			continue
+		}
+		if old, ok := tags[k]; ok && old != v {
+			klog.Warningf("CreateVolume:: tag %s=%s of volume %s is overridden by %s", k, old, req.GetName(), v)
+		}
+		tags[k] = v
+	}
+	if len(tags) > maxDiskTags {
+		return nil, status.Errorf(codes.InvalidArgument, "CreateVolume: volume %s has %d tags, the limit is %d including the %s tags", req.GetName(), len(tags), maxDiskTags, CsiTagPrefix)
+	}
+	return tags, nil
+}
+
+// applySnapshotEncryption makes the volume restored from snapshotID inherit
+// the encryption of the snapshot. A storage class asking for an encryption
+// the snapshot does not have is rejected rather than silently ignored.
+func (cs *KscEBSControllerServer) applySnapshotEncryption(snapshotID string, volArg *volumeArgs) error {
+	snapshot, err := cs.ebsClient.GetSnapshot(&ebsClient.DescribeSnapshotsReq{SnapshotId: snapshotID})
+	if err != nil {
+		return status.Errorf(codes.Internal, "CreateVolume: failed to get snapshot %s: %v", snapshotID, err)
+	}
+	if snapshot == nil {
+		return status.Errorf(codes.NotFound, "CreateVolume: snapshot %s not found", snapshotID)
+	}
+	if volArg.Encrypted && !snapshot.Encrypted {
+		return status.Errorf(codes.InvalidArgument, "CreateVolume: snapshot %s is not encrypted, it can not be restored to an encrypted volume", snapshotID)
+	}
+	if volArg.KmsKeyID != "" && volArg.KmsKeyID != snapshot.KmsKeyId {
+		return status.Errorf(codes.InvalidArgument, "CreateVolume: snapshot %s is encrypted with kms key %q, requested kms key %q", snapshotID, snapshot.KmsKeyId, volArg.KmsKeyID)
+	}
+	if snapshot.Encrypted && !volArg.Encrypted {
+		klog.V(2).Infof("CreateVolume:: volume restored from encrypted snapshot %s is encrypted with kms key %q", snapshotID, snapshot.KmsKeyId)
+	}
+	volArg.Encrypted = snapshot.Encrypted
+	volArg.KmsKeyID = snapshot.KmsKeyId
+	return nil
+}
+
+// setEncryptionContext shows the encryption of the volume in its context
+func setEncryptionContext(volumeContext map[string]string, encrypted bool, kmsKeyID string) {
+	volumeContext[EncryptedKey] = strconv.FormatBool(encrypted)
+	delete(volumeContext, KmsKeyIDKey)
+	if encrypted && kmsKeyID != "" {
+		volumeContext[KmsKeyIDKey] = kmsKeyID
+	}
+}
+
+// createPVCEvent records an event on the PVC of a CreateVolume request, the
+// PVC is known from the parameters added by --extra-create-metadata
+func (cs *KscEBSControllerServer) createPVCEvent(parameters map[string]string, eventType, reason, message string) {
+	pvcName, pvcNamespace := parameters[pvcNameKey], parameters[pvcNamespaceKey]
+	if cs.recorder == nil || pvcName == "" || pvcNamespace == "" {
+		return
+	}
+	ref := &v1.ObjectReference{
+		Kind:      "PersistentVolumeClaim",
+		Name:      pvcName,
+		Namespace: pvcNamespace,
+	}
+	util.CreateEvent(cs.recorder, ref, eventType, reason, message)
+}
+
+// getVolumeByRequestName returns the volume named and tagged with the
+// CreateVolume request name by this cluster, or nil if there is none. The tags
+// of the volumes listed are checked again, a volume of the same name created
+// by someone else is not taken as a previous attempt of the request.
+func (cs *KscEBSControllerServer) getVolumeByRequestName(requestName string) (*ebsClient.Volume, error) {
+	tags := map[string]string{
+		CsiRequestNameTag: requestName,
+	}
+	if cs.config.ClusterID != "" {
+		tags[CsiClusterIDTag] = cs.config.ClusterID
+	}
+	listVolumesResp, err := cs.ebsClient.ListVolumes(&ebsClient.ListVolumesReq{
+		VolumeExactName: requestName,
+		VolumeCategory:  ebsClient.DATA_VOlUME_CATE,
+		Tags:            tags,
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "CreateVolume: failed to get volume of request %s: %v", requestName, err)
+	}
+	var volumes []*ebsClient.Volume
+	for _, vol := range listVolumesResp.Volumes {
+		tagsResp, err := cs.ebsClient.DescribeVolumeTags(&ebsClient.DescribeVolumeTagsReq{VolumeId: vol.VolumeId})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "CreateVolume: failed to get tags of volume %s: %v", vol.VolumeId, err)
+		}
+		volumeTags := tagsResp.Tags(vol.VolumeId)
+		matched := true
+		for k, v := range tags {
+			if volumeTags[k] != v {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			klog.V(2).Infof("CreateVolume: volume %s named %s is not created by this cluster for the request, skipped", vol.VolumeId, requestName)
+			continue
+		}
+		volumes = append(volumes, vol)
+	}
+	switch len(volumes) {
+	case 0:
+		return nil, nil
+	case 1:
+		return volumes[0], nil
+	default:
+		return nil, status.Errorf(codes.Internal, "CreateVolume: duplicate volume of request %s exists", requestName)
+	}
+}
+
+// checkExistingVolume makes sure the volume created by a previous attempt of
+// the request matches the size, type, zone and source of this one
+func checkExistingVolume(vol *ebsClient.Volume, req *csi.CreateVolumeRequest, size int64, volArg *volumeArgs, snapshotID string, sourceVol *ebsClient.Volume) error {
+	if vol.VolumeStatus == ebsClient.ERROR_STATUS {
+		return status.Errorf(codes.Internal, "CreateVolume: volume %s of request %s is in error status", vol.VolumeId, req.GetName())
+	}
+	if vol.Size != volumeSizeGB(size) {
+		return status.Errorf(codes.AlreadyExists, "CreateVolume: volume %s already exists with size %v, requested size %v", vol.VolumeId, formatBytes(vol.Size*GB), formatBytes(volumeSizeGB(size)*GB))
+	}
+
+	typeMatched := false
+	for _, diskType := range deleteEmpty(strings.Split(volArg.Type, ",")) {
+		if strings.HasPrefix(vol.VolumeType, diskType) {
+			typeMatched = true
+			break
+		}
+	}
+	if !typeMatched {
+		return status.Errorf(codes.AlreadyExists, "CreateVolume: volume %s already exists with type %s, requested type %s", vol.VolumeId, vol.VolumeType, volArg.Type)
+	}
+
+	var zones []string
+	switch {
+	case sourceVol != nil:
+		zones = []string{sourceVol.AvailabilityZone}
+	case req.GetParameters()["zone"] != "":
+		zones = deleteEmpty(strings.Split(req.GetParameters()["zone"], ","))
+	default:
+		for _, topology := range append(req.GetAccessibilityRequirements().GetRequisite(), req.GetAccessibilityRequirements().GetPreferred()...) {
+			if zone := topology.GetSegments()[util.NodeZoneKey]; zone != "" {
+				zones = append(zones, zone)
+			}
+		}
+	}
+	zoneMatched := len(zones) == 0
+	for _, zone := range zones {
+		if zone == vol.AvailabilityZone {
+			zoneMatched = true
+			break
+		}
+	}
+	if !zoneMatched {
+		return status.Errorf(codes.AlreadyExists, "CreateVolume: volume %s already exists in zone %s, requested zones %v", vol.VolumeId, vol.AvailabilityZone, zones)
+	}
+
+	if volArg.Encrypted && !vol.Encrypted {
+		return status.Errorf(codes.AlreadyExists, "CreateVolume: volume %s already exists unencrypted, requested an encrypted volume", vol.VolumeId)
+	}
+	if volArg.KmsKeyID != "" && vol.KmsKeyId != volArg.KmsKeyID {
+		return status.Errorf(codes.AlreadyExists, "CreateVolume: volume %s already exists with kms key %q, requested kms key %q", vol.VolumeId, vol.KmsKeyId, volArg.KmsKeyID)
+	}
+
+	// the snapshot of a cloned volume is a temporary one, and the snapshot
+	// can only be compared when DescribeVolumes reports it
+	if sourceVol == nil && vol.SnapshotId != "" && vol.SnapshotId != snapshotID {
+		return status.Errorf(codes.AlreadyExists, "CreateVolume: volume %s already exists with snapshot %q, requested snapshot %q", vol.VolumeId, vol.SnapshotId, snapshotID)
+	}
+	return nil
+}
+
+// prepareCloneSnapshot takes a temporary snapshot of the source volume and
+// waits until it is available, the cloned volume is then created from it.
+// An existing snapshot left by a previous attempt is reused.
+func (cs *KscEBSControllerServer) prepareCloneSnapshot(volumeName string, sourceVol *ebsClient.Volume) (string, error) {
+	snapshotName := cloneSnapshotPrefix + volumeName
+	snapshotResp, snapNum, err := cs.ebsClient.GetSnapshotsByName(&ebsClient.DescribeSnapshotsReq{
+		SnapshotName: snapshotName,
+	})
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "CreateVolume: failed to get clone snapshot %s: %v", snapshotName, err)
+	}
+
+	snapshotID := ""
+	switch {
+	case snapNum > 1:
+		return "", status.Errorf(codes.Internal, "CreateVolume: get clone snapshot %s more than 1 instance", snapshotName)
+	case snapNum == 1:
+		existsSnapshot := snapshotResp.Snapshots[0]
+		if existsSnapshot.VolumeID != sourceVol.VolumeId {
+			return "", status.Errorf(codes.AlreadyExists, "CreateVolume: clone snapshot %s already exists with different source volume %s", snapshotName, existsSnapshot.VolumeID)
+		}
+		snapshotID = existsSnapshot.SnapshotID
+		klog.V(2).Infof("CreateVolume: clone snapshot %s of volume %s already created: %s", snapshotName, sourceVol.VolumeId, snapshotID)
+	default:
+		snapshotResponse, err := cs.ebsClient.CreateSnapshot(&ebsClient.CreateSnapshotReq{
+			VolumeId:     sourceVol.VolumeId,
+			SnapshotName: snapshotName,
+			SnapshotDesc: cloneSnapshotDesc,
+		})
+		if err != nil {
+			return "", status.Errorf(codes.Internal, "CreateVolume: failed to create clone snapshot of volume %s: %v", sourceVol.VolumeId, err)
+		}
+		if snapshotResponse.SnapshotID == "" {
+			return "", status.Errorf(codes.Internal, "CreateVolume: empty snapshot id when creating clone snapshot of volume %s", sourceVol.VolumeId)
+		}
+		snapshotID = snapshotResponse.SnapshotID
+		klog.V(2).Infof("CreateVolume: clone snapshot %s of volume %s created: %s", snapshotName, sourceVol.VolumeId, snapshotID)
+	}
+
+	if err := ebsClient.WaitSnapshotStatus(cs.ebsClient, snapshotID, ebsClient.SNAPSHOT_AVAILABLE_STATUS, cloneSnapshotTimeout); err != nil {
+		return "", status.Errorf(codes.Aborted, "CreateVolume: clone snapshot %s is not ready: %v", snapshotID, err)
+	}
+	return snapshotID, nil
+}
+
+// startCloneSnapshotCleanup runs deleteCloneSnapshot for the cloned volume in
+// the background, unless it is running already for a previous attempt of the
+// request
+func (cs *KscEBSControllerServer) startCloneSnapshotCleanup(volumeID, volumeName string) {
+	key := cloneSnapshotPrefix + volumeID
+	if acquired := cs.volumeLocks.TryAcquire(key); !acquired {
+		klog.V(4).Infof("startCloneSnapshotCleanup: clone snapshot of volume %s is being cleaned up", volumeID)
+		return
+	}
+	go func() {
+		defer cs.volumeLocks.Release(key)
+		cs.deleteCloneSnapshot(volumeID, volumeName)
+	}()
+}
+
+// deleteCloneSnapshot deletes the temporary clone snapshot once the cloned
+// volume has left the creating state and no longer depends on it, whether it
+// is available, already attached or failed. The snapshots left by a restart
+// of the controller or a failed delete are deleted by the orphan collector.
+func (cs *KscEBSControllerServer) deleteCloneSnapshot(volumeID, volumeName string) {
+	snapshotName := cloneSnapshotPrefix + volumeName
+	err := wait.PollImmediate(cloneCleanupInterval, cloneCleanupTimeout, func() (bool, error) {
+		vol, err := cs.ebsClient.GetVolume(&ebsClient.ListVolumesReq{VolumeIds: []string{volumeID}})
+		if err != nil {
+			klog.Errorf("deleteCloneSnapshot: failed to get cloned volume %s: %v", volumeID, err)
+			return false, nil
+		}
+		return vol.VolumeStatus != ebsClient.CREATING_STATUS, nil
+	})
+	if err != nil {
+		klog.Errorf("deleteCloneSnapshot: cloned volume %s is still creating, keep clone snapshot %s: %v", volumeID, snapshotName, err)
+		return
+	}
+	if err := deleteCloneSnapshots(cs.ebsClient, snapshotName); err != nil {
+		klog.Errorf("deleteCloneSnapshot: %v", err)
+		return
+	}
+	klog.V(2).Infof("deleteCloneSnapshot: clone snapshot %s of volume %s deleted", snapshotName, volumeID)
+}
+
+// deleteCloneSnapshots deletes the clone snapshots named snapshotName
+func deleteCloneSnapshots(storageService ebsClient.StorageService, snapshotName string) error {
+	snapshotResp, _, err := storageService.GetSnapshotsByName(&ebsClient.DescribeSnapshotsReq{
+		SnapshotName: snapshotName,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get clone snapshot %s: %v", snapshotName, err)
+	}
+	for _, snapshot := range snapshotResp.Snapshots {
+		if _, err := storageService.DeleteSnapshots(&ebsClient.DeleteSnapshotsReq{
+			SnapshotId: snapshot.SnapshotID,
+		}); err != nil {
+			return fmt.Errorf("failed to delete clone snapshot %s(%s): %v", snapshotName, snapshot.SnapshotID, err)
+		}
+	}
+	return nil
+}
+
+// volumeSizeGB returns the size in GB of the volume created for size bytes,
+// rounded up to whole GB and clamped to the sizes EBS creates as
+// CreateVolumeReq.ToQuery does
+func volumeSizeGB(size int64) int64 {
+	sizeGB := (size + GB - 1) / GB
+	if sizeGB < ebsClient.MIN_VOLUME_SIZE {
+		return ebsClient.MIN_VOLUME_SIZE
+	}
+	if sizeGB > ebsClient.MAX_VOLUME_SIZE {
+		return ebsClient.MAX_VOLUME_SIZE
+	}
+	return sizeGB
+}
+
+func preCreateVolume(diskName string, snapshotID string, size int64, volArg *volumeArgs, parameters SuperMapString) (*ebsClient.CreateVolumeReq, []string, error) {
 	createVolumeRequest := &ebsClient.CreateVolumeReq{}
 	createVolumeRequest.VolumeName = diskName
-	createVolumeRequest.Size = size / GB
+	createVolumeRequest.Size = volumeSizeGB(size)
 	createVolumeRequest.AvailabilityZone = volArg.Zone
 	createVolumeRequest.VolumeDesc = createdByDO
 	createVolumeRequest.Tags = volArg.DiskTags
 	createVolumeRequest.ChargeType = parameters.Get("chargetype", defaultChargeType)
 	createVolumeRequest.ProjectId = parameters.Get("projectid", "")
+	createVolumeRequest.Encrypted = volArg.Encrypted
+	createVolumeRequest.KmsKeyId = volArg.KmsKeyID
 
 	if snapshotID != "" {
 		createVolumeRequest.SnapshotId = snapshotID
@@ -343,16 +799,16 @@ func preCreateVolume(diskName string, snapshotID string, size int64, volArg *vol
 	diskTypes, diskPLs, err := getDiskType(volArg)
 	klog.V(5).Infof("createDisk: diskName: %s, valid disktype: %v, valid diskpls: %v", diskName, diskTypes, diskPLs)
 	if err != nil {
-		return nil, "", err
+		return nil, nil, err
 	}
 
-	// TODO:支持多diskTypes
-	for _, dType := range diskTypes {
-		createVolumeRequest.VolumeType = dType
-		return createVolumeRequest, dType, nil
+	// the disk types are tried in order by CreateVolume
+	if len(diskTypes) != 0 {
+		createVolumeRequest.VolumeType = diskTypes[0]
+		return createVolumeRequest, diskTypes, nil
 	}
 
-	return nil, "", status.Errorf(codes.Internal, "createDisk: err: %v, the zone:[%s] is not support specific disk type, please change the request disktype: %s or disk pl: %s", err, volArg.Zone, diskTypes, diskPLs)
+	return nil, nil, status.Errorf(codes.Internal, "createDisk: err: %v, the zone:[%s] is not support specific disk type, please change the request disktype: %s or disk pl: %s", err, volArg.Zone, diskTypes, diskPLs)
 }
 
 func getDiskType(volArg *volumeArgs) ([]string, []string, error) {
@@ -383,8 +839,8 @@ cusDiskType:
 	provisionDiskTypes := []string{}
 	allTypes := deleteEmpty(strings.Split(volArg.Type, ","))
 	for arr, disktype := range allTypes {
-		if disktype == "ESSD" && provisionPerformanceLevel != nil {
-			allTypes[arr] = allTypes[arr] + provisionPerformanceLevel[0]
+		if disktype == ESSD && len(provisionPerformanceLevel) != 0 {
+			allTypes[arr] = ESSD + "_" + strings.TrimPrefix(provisionPerformanceLevel[0], "_")
 		}
 	}
 	if len(nodeSupportDiskType) != 0 {
@@ -402,27 +858,12 @@ cusDiskType:
 	return provisionDiskTypes, provisionPerformanceLevel, nil
 }
 
-// delvolume For CreateVolume rpc timeout error
-func (cs *KscEBSControllerServer) delvolume(delVol *ebsClient.Volume, size int64) bool {
-	createTime, _ := time.Parse("2006-01-02 15:04:05", delVol.CreateTime)
-	if delVol.VolumeDesc == createdByDO && delVol.Size == size/GB && time.Since(createTime).Seconds() < 60 {
-		_, err := cs.ebsClient.DeleteVolume(&ebsClient.DeleteVolumeReq{
-			VolumeId: delVol.VolumeId,
-		})
-		if err != nil {
-			klog.Errorf("Error deleting volume on duplicate createvolume, volume id: %s", delVol.VolumeId)
-		}
-		return true
-	}
-	return false
-}
-
 func parseTags(p string) (map[string]string, error) {
 	res := make(map[string]string)
 	parts := strings.Split(p, ";")
 	//fmt.Println(parts)
-	if len(parts) > 5 {
-		return nil, errors.New("the number of labels cannot exceed 5")
+	if len(parts) > maxDiskTags {
+		return nil, fmt.Errorf("the number of labels cannot exceed %d", maxDiskTags)
 	}
 	for _, label := range parts {
 		temp := strings.Split(label, "~")
@@ -445,6 +886,10 @@ func (cs *KscEBSControllerServer) DeleteVolume(ctx context.Context, req *csi.Del
 	if req.VolumeId == "" {
 		return nil, status.Error(codes.InvalidArgument, "DeleteVolume Volume ID must be provided")
 	}
+	if acquired := cs.volumeLocks.TryAcquire(req.VolumeId); !acquired {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, req.VolumeId)
+	}
+	defer cs.volumeLocks.Release(req.VolumeId)
 
 	deleteVolumeReq := &ebsClient.DeleteVolumeReq{
 		VolumeId: req.VolumeId,
@@ -456,14 +901,20 @@ func (cs *KscEBSControllerServer) DeleteVolume(ctx context.Context, req *csi.Del
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
-// ControllerUnpublishVolume deattaches the given volume from the node
+// ControllerUnpublishVolume deattaches the given volume from the node.
+// The volume is detached from a NotReady node only after the NotReady grace
+// period, as the node may still be writing to it.
 func (cs *KscEBSControllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
 	if req.VolumeId == "" {
-		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume Volume ID must be provided")
+		return nil, status.Error(codes.InvalidArgument, "ControllerUnpublishVolume Volume ID must be provided")
 	}
 	if req.NodeId == "" {
-		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume Node ID must be provided")
+		return nil, status.Error(codes.InvalidArgument, "ControllerUnpublishVolume Node ID must be provided")
 	}
+	if acquired := cs.volumeLocks.TryAcquire(req.VolumeId); !acquired {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, req.VolumeId)
+	}
+	defer cs.volumeLocks.Release(req.VolumeId)
 
 	// check if volume exist before trying to detach it
 	listVolumesReq := &ebsClient.ListVolumesReq{
@@ -471,37 +922,66 @@ func (cs *KscEBSControllerServer) ControllerUnpublishVolume(ctx context.Context,
 	}
 	ebs, err := cs.ebsClient.GetVolume(listVolumesReq)
 	if err != nil {
-		if err.Error() == "not found volume" {
+		if isVolumeNotFound(err) {
 			klog.Errorf("volume id: %s error: %v. volume is deleted", req.VolumeId, err)
 			return &csi.ControllerUnpublishVolumeResponse{}, nil
 		}
 		return nil, status.Errorf(codes.Internal, err.Error())
 	}
-	if ebs.VolumeStatus != "in-use" {
+	detachOp := &volumeOperation{action: operationDetach, volumeID: req.VolumeId, nodeID: req.NodeId}
+	if ebs.VolumeStatus == ebsClient.DETACHING_STATUS {
+		// a detach of a previous call, or of the controller before a restart
+		if err := cs.operations.Run(ctx, detachOp, nil); err != nil {
+			return nil, err
+		}
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+	if ebs.VolumeStatus != ebsClient.INUSE_STATUS {
 		klog.V(2).Infof("volume id: %s, volume status %s. volume is detached ", req.VolumeId, ebs.VolumeStatus)
 		return &csi.ControllerUnpublishVolumeResponse{}, nil
 	}
 
-	if len(ebs.Attachments) > 0 {
-		if ebs.Attachments[0].InstanceId != req.NodeId {
-			klog.V(2).Infof("volume id: %s, volume status %s, target node id: %s. volume is used by other node: %s.", req.VolumeId, ebs.VolumeStatus, req.NodeId, ebs.Attachments[0].InstanceId)
-			return &csi.ControllerUnpublishVolumeResponse{}, nil
-		}
-	} else {
-		klog.Fatalf("volume id: %s, volume status %s, target node id: %s. volume is not used. please contact ebs", req.VolumeId, ebs.VolumeStatus, req.NodeId)
+	if len(ebs.Attachments) == 0 {
+		// the attachments may lag behind the status, it is retried by the
+		// attacher instead of guessing the node
+		err := status.Errorf(codes.Unavailable, "ControllerUnpublishVolume: volume %s is in-use without attachments, retry later", req.VolumeId)
+		cs.createVolumeAttachmentEvent(req.VolumeId, "", v1.EventTypeWarning, volumeDetachInconsistent, err.Error())
+		return nil, err
 	}
-
-	detachVolumeReq := &ebsClient.DetachVolumeReq{
-		VolumeId:   req.VolumeId,
-		InstanceId: req.NodeId,
+	if ebs.Attachments[0].InstanceId != req.NodeId {
+		// the volume is not published to the node, as the spec asks it is
+		// done
+		klog.V(2).Infof("volume id: %s, volume status %s, target node id: %s. volume is used by other node: %s.", req.VolumeId, ebs.VolumeStatus, req.NodeId, ebs.Attachments[0].InstanceId)
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
 	}
-	if _, err := cs.ebsClient.Detach(detachVolumeReq); err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+
+	nodeName, forceReason, err := cs.checkNodeDetachable(req.NodeId)
+	if err != nil {
+		cs.createVolumeAttachmentEvent(req.VolumeId, nodeName, v1.EventTypeWarning, volumeDetachWaiting, err.Error())
+		return nil, err
 	}
 
-	// waiting until volume is detached
-	if err := ebsClient.WaitVolumeStatus(cs.ebsClient, req.VolumeId, ebsClient.AVAILABLE_STATUS, req.NodeId, time.Second*10, "detach"); err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+	// the retries of a pending detach wait for it without detaching again
+	err = cs.operations.Run(ctx, detachOp, func() error {
+		detachVolumeReq := &ebsClient.DetachVolumeReq{
+			VolumeId:   req.VolumeId,
+			InstanceId: req.NodeId,
+		}
+		if _, err := cs.ebsClient.Detach(detachVolumeReq); err != nil {
+			return status.Errorf(codes.Internal, "ControllerUnpublishVolume: failed to detach volume %s from node %s: %v", req.VolumeId, req.NodeId, err)
+		}
+		if forceReason != "" {
+			msg := fmt.Sprintf("volume %s is force detached from node %s, %s", req.VolumeId, req.NodeId, forceReason)
+			klog.Warningf("ControllerUnpublishVolume:: %s", msg)
+			cs.createVolumeAttachmentEvent(req.VolumeId, nodeName, v1.EventTypeWarning, volumeForceDetached, msg)
+		}
+		return nil
+	})
+	if err != nil {
+		if status.Code(err) != codes.Aborted {
+			cs.createVolumeAttachmentEvent(req.VolumeId, nodeName, v1.EventTypeWarning, volumeDetachFailed, err.Error())
+		}
+		return nil, err
 	}
 
 	klog.V(2).Info("volume is detached")
@@ -509,6 +989,59 @@ func (cs *KscEBSControllerServer) ControllerUnpublishVolume(ctx context.Context,
 	return &csi.ControllerUnpublishVolumeResponse{}, nil
 }
 
+// checkNodeDetachable checks a volume can be detached from the node of
+// instance nodeID: at once if the node is ready or gone, and only after the
+// NotReady grace period if it is NotReady. It returns the name of the node,
+// and the reason if the detach is forced.
+func (cs *KscEBSControllerServer) checkNodeDetachable(nodeID string) (string, string, error) {
+	node, err := cs.k8sClient.GetNodeByInstanceID(nodeID)
+	if apierrors.IsNotFound(err) {
+		return "", "the node is gone", nil
+	}
+	if errors.Is(err, errNodeUnknown) {
+		// the node may be ready, the volume is left to the attacher to
+		// detach like from a ready node
+		klog.Warningf("checkNodeDetachable:: the node of instance %s is unknown: %v", nodeID, err)
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", status.Errorf(codes.Unavailable, "checkNodeDetachable: failed to get node %s: %v", nodeID, err)
+	}
+	cond := getNodeReadyCondition(node)
+	if cond != nil && cond.Status == v1.ConditionTrue {
+		return node.Name, "", nil
+	}
+	notReadySince := node.CreationTimestamp.Time
+	if cond != nil {
+		notReadySince = cond.LastTransitionTime.Time
+	}
+	if left := cs.config.DetachNotReadyGracePeriod - time.Since(notReadySince); left > 0 {
+		return node.Name, "", status.Errorf(codes.Unavailable, "checkNodeDetachable: node %s is NotReady since %s, its volumes are detached after the grace period %v, %v left",
+			node.Name, notReadySince.Format(time.RFC3339), cs.config.DetachNotReadyGracePeriod, left.Round(time.Second))
+	}
+	return node.Name, fmt.Sprintf("node %s is NotReady since %s", node.Name, notReadySince.Format(time.RFC3339)), nil
+}
+
+// createVolumeAttachmentEvent creates an event on the VolumeAttachment of
+// volumeID on node nodeName, on any node when nodeName is empty
+func (cs *KscEBSControllerServer) createVolumeAttachmentEvent(volumeID, nodeName, eventType, reason, message string) {
+	if cs.recorder == nil {
+		return
+	}
+	va, err := cs.k8sClient.GetVolumeAttachment(cs.config.DriverName, volumeID, nodeName)
+	if err != nil || va == nil {
+		klog.Warningf("createVolumeAttachmentEvent:: no volume attachment of volume %s for event %s: %v", volumeID, reason, err)
+		return
+	}
+	ref := &v1.ObjectReference{
+		APIVersion: storagev1.SchemeGroupVersion.String(),
+		Kind:       "VolumeAttachment",
+		Name:       va.Name,
+		UID:        va.UID,
+	}
+	util.CreateEvent(cs.recorder, ref, eventType, reason, message)
+}
+
 // ControllerPublishVolume attaches the given volume to the node
 func (cs *KscEBSControllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
 	//publishInfoVolumeName := cs.config.DriverName + "/volume-name"
@@ -525,14 +1058,20 @@ func (cs *KscEBSControllerServer) ControllerPublishVolume(ctx context.Context, r
 		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume Volume capability must be provided")
 	}
 
-	if req.Readonly {
-		// TODO(arslan): we should return codes.InvalidArgument, but the CSI
-		// test fails, because according to the CSI Spec, this flag cannot be
-		// changed on the same volume. However we don't use this flag at all,
-		// as there are no `readonly` attachable volumes.
-		return nil, status.Error(codes.AlreadyExists, "read only Volumes are not supported")
+	if !validateCapabilities([]*csi.VolumeCapability{req.VolumeCapability}) {
+		return nil, status.Errorf(codes.InvalidArgument, "ControllerPublishVolume: unsupported volume capability %v", req.VolumeCapability)
 	}
 
+	// EBS has no read-only attachment, a read-only volume is attached as
+	// usual and mounted with "ro" by NodePublishVolume
+	if req.Readonly || isReadOnlyCapability(req.VolumeCapability) {
+		klog.V(2).Infof("ControllerPublishVolume:: volume %s is published read-only to node %s", req.VolumeId, req.NodeId)
+	}
+	if acquired := cs.volumeLocks.TryAcquire(req.VolumeId); !acquired {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, req.VolumeId)
+	}
+	defer cs.volumeLocks.Release(req.VolumeId)
+
 	// check if volume exist before trying to attach it
 	listVolumesReq := &ebsClient.ListVolumesReq{
 		VolumeIds: []string{req.VolumeId},
@@ -555,59 +1094,96 @@ func (cs *KscEBSControllerServer) ControllerPublishVolume(ctx context.Context, r
 			}, nil
 		}
 	}
-	// node is attached to a different node, return an error
-	if len(attachedID) > 0 && vol.VolumeStatus == "in-use" {
-		detachVolumeReq := &ebsClient.DetachVolumeReq{
-			VolumeId:   req.VolumeId,
-			InstanceId: vol.InstanceId,
+	attachOp := &volumeOperation{action: operationAttach, volumeID: req.VolumeId, nodeID: req.NodeId}
+	if pending := cs.operations.Pending(req.VolumeId); pending == nil || !pending.sameAs(attachOp) {
+		// node is attached to a different node, return an error
+		if len(attachedID) > 0 && vol.VolumeStatus == "in-use" {
+			// the pods reading a ReadOnlyMany volume on the other node keep
+			// it, the volume is not moved to this node
+			if req.VolumeCapability.GetAccessMode().GetMode() == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY {
+				return nil, status.Errorf(codes.FailedPrecondition,
+					"ControllerPublishVolume: read-only volume %s is attached to node %q, a disk can only be attached to one node", req.VolumeId, attachedID)
+			}
+			// the volume is only taken from a node which is gone or NotReady
+			// past the grace period, the attacher detaches it from a ready
+			// node once its pods are gone
+			nodeName, forceReason, err := cs.checkNodeDetachable(attachedID)
+			if err != nil {
+				cs.createVolumeAttachmentEvent(req.VolumeId, nodeName, v1.EventTypeWarning, volumeDetachWaiting, err.Error())
+				return nil, err
+			}
+			if forceReason == "" {
+				return nil, status.Errorf(codes.FailedPrecondition,
+					"ControllerPublishVolume: volume %s is attached to node %s, it is attached to node %s after it is detached", req.VolumeId, nodeName, req.NodeId)
+			}
+			detachVolumeReq := &ebsClient.DetachVolumeReq{
+				VolumeId:   req.VolumeId,
+				InstanceId: attachedID,
+			}
+			if _, err := cs.ebsClient.Detach(detachVolumeReq); err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+			msg := fmt.Sprintf("volume %s is force detached from node %s to be attached to node %s, %s", req.VolumeId, attachedID, req.NodeId, forceReason)
+			klog.Warningf("ControllerPublishVolume:: %s", msg)
+			cs.createVolumeAttachmentEvent(req.VolumeId, nodeName, v1.EventTypeWarning, volumeForceDetached, msg)
+			return nil, status.Errorf(codes.FailedPrecondition,
+				"volume is attached to the wrong node(%q), dettach the volume to fix it", attachedID)
 		}
-		if _, err := cs.ebsClient.Detach(detachVolumeReq); err != nil {
-			return nil, status.Error(codes.Internal, err.Error())
+
+		// validate attach instance
+		validateAttachInstanceResp, err := cs.ebsClient.ValidateAttachInstance(&ebsClient.ValidateAttachInstanceReq{
+			VolumeType: vol.VolumeType,
+			InstanceId: req.NodeId,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !validateAttachInstanceResp.InstanceEnable {
+			return nil, status.Errorf(codes.ResourceExhausted, "attach volume limit has been reached on node %v", req.NodeId)
+		}
+
+		// the retry attaches the volume once it is available, such as after
+		// a detach from another node
+		switch vol.VolumeStatus {
+		case ebsClient.AVAILABLE_STATUS:
+		case ebsClient.ERROR_STATUS:
+			return nil, status.Errorf(codes.FailedPrecondition, "ControllerPublishVolume: volume %s is in error status", req.VolumeId)
+		default:
+			return nil, status.Errorf(codes.Aborted, "ControllerPublishVolume: volume %s is %s, retry later", req.VolumeId, vol.VolumeStatus)
 		}
-		return nil, status.Errorf(codes.FailedPrecondition,
-			"volume is attached to the wrong node(%q), dettach the volume to fix it", attachedID)
 	}
 
-	// validate attach instance
-	validateAttachInstanceResp, err := cs.ebsClient.ValidateAttachInstance(&ebsClient.ValidateAttachInstanceReq{
-		VolumeType: vol.VolumeType,
-		InstanceId: req.NodeId,
+	// attach the volume to the correct node, the retries of a pending attach
+	// wait for it without attaching again
+	err = cs.operations.Run(ctx, attachOp, func() error {
+		attachVolumeReq := &ebsClient.AttachVolumeReq{
+			VolumeId:   req.VolumeId,
+			InstanceId: req.NodeId,
+		}
+		if _, err := cs.ebsClient.Attach(attachVolumeReq); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
-	if !validateAttachInstanceResp.InstanceEnable {
-		return nil, status.Errorf(codes.ResourceExhausted, "attach volume limit has been reached on node %v", req.NodeId)
-	}
-
-	// waiting until volume is available
-	if vol.VolumeStatus != ebsClient.AVAILABLE_STATUS {
-		if err := ebsClient.WaitVolumeStatus(cs.ebsClient, vol.VolumeId, ebsClient.AVAILABLE_STATUS, req.NodeId, time.Minute, "attach"); err != nil {
-			return nil, status.Error(codes.Internal, err.Error())
-		}
-	}
+	klog.V(5).Info("volume attached")
 
-	// attach the volume to the correct node
-	attachVolumeReq := &ebsClient.AttachVolumeReq{
-		VolumeId:   req.VolumeId,
-		InstanceId: req.NodeId,
-	}
-	resp, err := cs.ebsClient.Attach(attachVolumeReq)
+	vol, err = cs.ebsClient.GetVolume(listVolumesReq)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
-
-	// waiting until volume is attached
-	if err := ebsClient.WaitVolumeStatus(cs.ebsClient, req.VolumeId, ebsClient.INUSE_STATUS, req.NodeId, time.Minute, "attach"); err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+	var mountPoint string
+	for _, attachment := range vol.Attachments {
+		if attachment.InstanceId == req.NodeId {
+			mountPoint = attachment.MountPoint
+		}
 	}
-	klog.V(5).Info("volume attached")
-	// 给openapi和cinder异步任务执行时间
-	time.Sleep(5 * time.Second)
 	return &csi.ControllerPublishVolumeResponse{
 		PublishContext: map[string]string{
 			//publishInfoVolumeName: vol.VolumeName,
-			"MountPoint": resp.MountPoint,
+			"MountPoint": mountPoint,
 		},
 	}, nil
 }
@@ -620,9 +1196,6 @@ func (cs *KscEBSControllerServer) ValidateVolumeCapabilities(ctx context.Context
 	if req.VolumeCapabilities == nil {
 		return nil, status.Error(codes.InvalidArgument, "ValidateVolumeCapabilities Volume Capabilities must be provided")
 	}
-	if !validateCapabilities(req.VolumeCapabilities) {
-		return nil, status.Error(codes.InvalidArgument, "invalid volume capabilities requestecs . Only SINGLE_NODE_WRITER is supported ('accessModes.ReadWriteOnce' on Kubernetes)")
-	}
 
 	listVolumesReq := &ebsClient.ListVolumesReq{
 		VolumeIds: []string{req.VolumeId},
@@ -632,6 +1205,13 @@ func (cs *KscEBSControllerServer) ValidateVolumeCapabilities(ctx context.Context
 		return nil, status.Errorf(codes.NotFound, err.Error())
 	}
 
+	// unsupported capabilities are reported without Confirmed as the spec asks
+	if !validateCapabilities(req.VolumeCapabilities) {
+		return &csi.ValidateVolumeCapabilitiesResponse{
+			Message: "only the single node access modes and ReadOnlyMany are supported, an EBS disk is attached to one node at a time so a ReadOnlyMany volume is published to a single node",
+		}, nil
+	}
+
 	// if it's not supported (i.e: wrong region), we shouldn't override it
 	resp := &csi.ValidateVolumeCapabilitiesResponse{
 		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
@@ -642,32 +1222,144 @@ func (cs *KscEBSControllerServer) ValidateVolumeCapabilities(ctx context.Context
 	return resp, nil
 }
 
+// ListVolumes lists the data volumes created by this driver. The starting
+// token is the DescribeVolumes marker of the first volume not returned yet,
+// so a page may scan more volumes than it returns. The entries carry the
+// condition of the volumes, so that the external health monitor lists them
+// instead of getting each volume.
 func (cs *KscEBSControllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	listVolumesResp, err := cs.ebsClient.ListVolumes(&ebsClient.ListVolumesReq{})
-	if err != nil {
-		return nil, err
+	if req.GetMaxEntries() < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "ListVolumes: invalid max entries %d", req.GetMaxEntries())
+	}
+	marker := 0
+	if token := req.GetStartingToken(); token != "" {
+		m, err := strconv.Atoi(token)
+		if err != nil || m < 0 {
+			return nil, status.Errorf(codes.Aborted, "ListVolumes: invalid starting token %q", token)
+		}
+		marker = m
 	}
-	volumes := make([]*ebsClient.Volume, len(listVolumesResp.Volumes))
-	copy(volumes, listVolumesResp.Volumes)
-	// for _, volume := range listVolumesResp.Volumes {
-	// 	volumes = append(volumes, volume)
-	// }
+	maxEntries := int(req.GetMaxEntries())
 
 	var entries []*csi.ListVolumesResponse_Entry
-	for _, vol := range volumes {
-		entries = append(entries, &csi.ListVolumesResponse_Entry{
-			Volume: &csi.Volume{
-				VolumeId:      vol.VolumeId,
-				CapacityBytes: int64(vol.Size * GB),
-			},
-		})
+	for {
+		listVolumesReq := &ebsClient.ListVolumesReq{
+			VolumeCategory: ebsClient.DATA_VOlUME_CATE,
+			Marker:         marker,
+			MaxResults:     listVolumesPageSize,
+		}
+		listVolumesResp, err := cs.ebsClient.ListVolumes(listVolumesReq)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "ListVolumes: describe volumes failed: %v", err)
+		}
+		for i, vol := range listVolumesResp.Volumes {
+			if vol.VolumeDesc != createdByDO {
+				continue
+			}
+			if maxEntries > 0 && len(entries) == maxEntries {
+				return &csi.ListVolumesResponse{
+					Entries:   entries,
+					NextToken: strconv.Itoa(marker + i),
+				}, nil
+			}
+			condition, err := volumeCondition(vol, cs.k8sClient.GetNodeByInstanceID)
+			if err != nil {
+				return nil, status.Errorf(codes.Internal, "ListVolumes: failed to get the condition of volume %s: %v", vol.VolumeId, err)
+			}
+			entries = append(entries, listVolumesEntry(vol, condition))
+		}
+		next, ok := listVolumesResp.NextMarker(listVolumesReq)
+		if !ok {
+			break
+		}
+		marker = next
 	}
+	klog.V(5).Infof("ListVolumes:: list %d volumes", len(entries))
 
-	resp := &csi.ListVolumesResponse{
+	return &csi.ListVolumesResponse{
 		Entries: entries,
+	}, nil
+}
+
+func listVolumesEntry(vol *ebsClient.Volume, condition *csi.VolumeCondition) *csi.ListVolumesResponse_Entry {
+	return &csi.ListVolumesResponse_Entry{
+		Volume: &csi.Volume{
+			VolumeId:      vol.VolumeId,
+			CapacityBytes: vol.Size * GB,
+		},
+		Status: &csi.ListVolumesResponse_VolumeStatus{
+			PublishedNodeIds: attachedInstanceIDs(vol),
+			VolumeCondition:  condition,
+		},
+	}
+}
+
+// attachedInstanceIDs returns the instances vol is attached to, attaching
+// to or detaching from
+func attachedInstanceIDs(vol *ebsClient.Volume) []string {
+	var instanceIDs []string
+	for _, attachment := range vol.Attachments {
+		if attachment.InstanceId != "" {
+			instanceIDs = append(instanceIDs, attachment.InstanceId)
+		}
+	}
+	if len(instanceIDs) == 0 && vol.InstanceId != "" {
+		instanceIDs = append(instanceIDs, vol.InstanceId)
 	}
+	return instanceIDs
+}
 
-	return resp, nil
+// volumeCondition maps the EBS status of vol to its condition. The
+// operations in progress are normal, a volume being deleted or in error
+// status is abnormal, and so is an attached volume whose node is NotReady
+// or gone, a node which cannot be told is unknown but not abnormal. getNode
+// returns the node of an instance like nodeByInstanceID.
+func volumeCondition(vol *ebsClient.Volume, getNode func(instanceID string) (*v1.Node, error)) (*csi.VolumeCondition, error) {
+	instances := strings.Join(attachedInstanceIDs(vol), ",")
+	switch vol.VolumeStatus {
+	case ebsClient.CREATING_STATUS:
+		return &csi.VolumeCondition{Message: "volume is being created"}, nil
+	case ebsClient.AVAILABLE_STATUS:
+		return &csi.VolumeCondition{Message: "volume is available"}, nil
+	case ebsClient.ATTACHING_STATUS:
+		return &csi.VolumeCondition{Message: fmt.Sprintf("volume is attaching to instance %s", instances)}, nil
+	case ebsClient.DETACHING_STATUS:
+		return &csi.VolumeCondition{Message: fmt.Sprintf("volume is detaching from instance %s", instances)}, nil
+	case ebsClient.EXTENDING_STATUS:
+		return &csi.VolumeCondition{Message: fmt.Sprintf("volume is being extended to %dGB", vol.Size)}, nil
+	case ebsClient.DELETING_STATUS:
+		return &csi.VolumeCondition{Abnormal: true, Message: "volume is being deleted"}, nil
+	case ebsClient.ERROR_STATUS:
+		return &csi.VolumeCondition{Abnormal: true, Message: "volume is in error status"}, nil
+	case ebsClient.INUSE_STATUS:
+		// the nodes attached to are checked below
+	default:
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("volume is in unknown status %q", vol.VolumeStatus)}, nil
+	}
+
+	var unknown []string
+	for _, instanceID := range attachedInstanceIDs(vol) {
+		node, err := getNode(instanceID)
+		if apierrors.IsNotFound(err) {
+			return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("volume is attached to instance %s without a node", instanceID)}, nil
+		}
+		// some nodes are not annotated with their instance, the node of the
+		// instance may be one of them
+		if errors.Is(err, errNodeUnknown) {
+			unknown = append(unknown, instanceID)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if cond := getNodeReadyCondition(node); cond == nil || cond.Status != v1.ConditionTrue {
+			return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("volume is attached to node %s which is not ready", node.Name)}, nil
+		}
+	}
+	if len(unknown) > 0 {
+		return &csi.VolumeCondition{Message: fmt.Sprintf("volume is attached to instance %s, the node of instance %s is unknown", instances, strings.Join(unknown, ","))}, nil
+	}
+	return &csi.VolumeCondition{Message: fmt.Sprintf("volume is attached to instance %s", instances)}, nil
 }
 
 func (cs *KscEBSControllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
@@ -689,10 +1381,10 @@ func (cs *KscEBSControllerServer) ControllerExpandVolume(ctx context.Context, re
 		return nil, status.Errorf(codes.OutOfRange, "Requested capacity %d exceeds maximum allowed %d", capacity, cs.config.MaxVolumeSize)
 	}
 
-	// Lock before acting on global state. A production-quality
-	// driver might use more fine-grained locking.
-	cs.mutex.Lock()
-	defer cs.mutex.Unlock()
+	if acquired := cs.volumeLocks.TryAcquire(volID); !acquired {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volID)
+	}
+	defer cs.volumeLocks.Release(volID)
 
 	listVolumesReq := &ebsClient.ListVolumesReq{
 		VolumeIds: []string{volID},
@@ -703,25 +1395,115 @@ func (cs *KscEBSControllerServer) ControllerExpandVolume(ctx context.Context, re
 		return nil, err
 	}
 
-	if exVol.Size < capacity {
-		var expandVolResp *ebsClient.ExpandVolumeResp
-		var expandVolReq = &ebsClient.ExpandVolumeReq{Size: capacity, OnlineResize: true, VolumeId: volID}
-		if expandVolResp, err = cs.ebsClient.ExpandVolume(expandVolReq); err != nil {
-			klog.V(2).Infof("Expand volume-%s failed response: %v , error: %v", volID, expandVolResp, err)
+	resizeOp := &volumeOperation{action: operationResize, volumeID: volID, size: capacity}
+	if pending := cs.operations.Pending(volID); exVol.Size < capacity || (pending != nil && pending.sameAs(resizeOp)) {
+		// the retries of a pending resize wait for it without resizing again
+		err = cs.operations.Run(ctx, resizeOp, func() error {
+			var expandVolReq = &ebsClient.ExpandVolumeReq{Size: capacity, OnlineResize: true, VolumeId: volID}
+			if expandVolResp, err := cs.ebsClient.ExpandVolume(expandVolReq); err != nil {
+				klog.V(2).Infof("Expand volume-%s failed response: %v , error: %v", volID, expandVolResp, err)
+				return err
+			}
+			return nil
+		})
+		if err != nil {
 			return nil, err
-		} else {
-			klog.V(5).Infof("volume-%s expanded success.", volID)
 		}
+		klog.V(5).Infof("volume-%s expanded success.", volID)
 	}
 
 	return &csi.ControllerExpandVolumeResponse{
-		CapacityBytes:         capRange.GetRequiredBytes(),
-		NodeExpansionRequired: true,
+		CapacityBytes: capRange.GetRequiredBytes(),
+		// block volumes have no filesystem to resize on the node
+		NodeExpansionRequired: !isBlockCapability(req.GetVolumeCapability()),
 	}, nil
 }
 
+// GetCapacity reports the capacity of the first disk type of the storage class
+// available in the zone of the accessible topology, it is the largest single
+// volume that can be created there, further limited by the remaining account
+// quota of the disk type
 func (cs *KscEBSControllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	klog.V(5).Infof("GetCapacity:: req: %v", req)
+	diskTypes, err := getCapacityDiskTypes(req.GetParameters())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "GetCapacity: %v", err)
+	}
+	zone := req.GetAccessibleTopology().GetSegments()[util.NodeZoneKey]
+
+	cached, err := cs.diskQuotaCache.Get(diskQuotaCacheKey, azcache.CacheReadTypeDefault)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "GetCapacity: describe disk quota failed: %v", err)
+	}
+	var diskType string
+	var quota DataDiskQuotaSet
+	for _, dType := range diskTypes {
+		if q, ok := findDiskQuota(cached.(map[string]map[string]DataDiskQuotaSet), zone, dType); ok {
+			diskType, quota = dType, q
+			break
+		}
+	}
+	if diskType == "" {
+		klog.V(2).Infof("GetCapacity:: disk types %v are not available in zone %q", diskTypes, zone)
+		return &csi.GetCapacityResponse{AvailableCapacity: 0}, nil
+	}
+
+	var volumeQuota *ebsClient.VolumeQuota
+	quotaResp, err := cs.ebsClient.DescribeVolumeQuota(&ebsClient.DescribeVolumeQuotaReq{
+		VolumeType:       diskType,
+		AvailabilityZone: zone,
+	})
+	if err != nil {
+		klog.Warningf("GetCapacity:: describe volume quota of %s in zone %q failed: %v", diskType, zone, err)
+	} else if len(quotaResp.QuotaSet) != 0 {
+		volumeQuota = quotaResp.QuotaSet[0]
+	}
+
+	resp := computeCapacity(quota, volumeQuota, cs.config.MaxVolumeSize)
+	klog.V(5).Infof("GetCapacity:: disk type %s zone %q capacity: %v", diskType, zone, resp)
+	return resp, nil
+}
+
+// findDiskQuota returns the quota of the disk type in the zone, or the one
+// with the largest max size of all zones when zone is empty
+func findDiskQuota(quotas map[string]map[string]DataDiskQuotaSet, zone, diskType string) (DataDiskQuotaSet, bool) {
+	var found DataDiskQuotaSet
+	var ok bool
+	for z, types := range quotas {
+		if zone != "" && z != zone {
+			continue
+		}
+		quota, exist := types[diskType]
+		if exist && (!ok || quota.DataDiskMaxsize > found.DataDiskMaxsize) {
+			found, ok = quota, true
+		}
+	}
+	return found, ok
+}
+
+// computeCapacity turns the size range of a disk type and the account quota
+// into a GetCapacityResponse, maxVolumeSize is in GB
+func computeCapacity(quota DataDiskQuotaSet, volumeQuota *ebsClient.VolumeQuota, maxVolumeSize int64) *csi.GetCapacityResponse {
+	maxBytes := int64(quota.DataDiskMaxsize) * GB
+	if maxVolumeSize > 0 && maxVolumeSize*GB < maxBytes {
+		maxBytes = maxVolumeSize * GB
+	}
+	available := maxBytes
+	if volumeQuota != nil && volumeQuota.TotalCapacity > 0 {
+		remaining := (volumeQuota.TotalCapacity - volumeQuota.UsedCapacity) * GB
+		if remaining < 0 || (volumeQuota.TotalCount > 0 && volumeQuota.UsedCount >= volumeQuota.TotalCount) {
+			remaining = 0
+		}
+		available = remaining
+		if remaining < maxBytes {
+			maxBytes = remaining
+		}
+	}
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: available,
+		MaximumVolumeSize: &wrappers.Int64Value{Value: maxBytes},
+		MinimumVolumeSize: &wrappers.Int64Value{Value: int64(quota.DataDiskMinSize) * GB},
+	}
 }
 
 func (cs *KscEBSControllerServer) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
@@ -798,15 +1580,23 @@ func parseSnapshotAnnotations(annotations map[string]string, ebsParams *ebsClien
 }
 
 func (cs *KscEBSControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	if req.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "CreateSnapshot: snapshot name must be provided")
+	}
+	if acquired := cs.volumeLocks.TryAcquire(req.Name); !acquired {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, req.Name)
+	}
+	defer cs.volumeLocks.Release(req.Name)
+
 	// request limit
-	cur := time.Now().Unix()
-	if initTime, ok := SnapshotRequestMap[req.Name]; ok {
-		if cur-initTime < SnapshotRequestInterval {
-			err := fmt.Errorf("CreateSnapshot: Repeatedly sending the same creation request within a short period of time, filter this request %s", req.Name)
-			return nil, err
+	if !cs.snapshotStore.AllowRequest(req.Name) {
+		// the snapshot created by the last request is still being prepared
+		if snapshot := cs.snapshotStore.GetSnapshot(req.Name); snapshot != nil && snapshot.SourceVolumeId == req.GetSourceVolumeId() {
+			return &csi.CreateSnapshotResponse{Snapshot: snapshot}, nil
 		}
+		err := fmt.Errorf("CreateSnapshot: Repeatedly sending the same creation request within a short period of time, filter this request %s", req.Name)
+		return nil, err
 	}
-	SnapshotRequestMap[req.Name] = cur
 
 	// Used for snapshot events
 	snapshotName := req.Parameters[VolumeSnapshotNameKey]
@@ -845,8 +1635,9 @@ func (cs *KscEBSControllerServer) CreateSnapshot(ctx context.Context, req *csi.C
 			if csiSnapshot.ReadyToUse {
 				str := fmt.Sprintf("VolumeSnapshot: name: %s, id: %s is ready to use.", existsSnapshot.SnapshotName, existsSnapshot.SnapshotID)
 				util.CreateEvent(cs.recorder, ref, v1.EventTypeNormal, snapshotCreatedSuccessfully, str)
-				delete(SnapshotRequestMap, req.Name)
+				cs.snapshotStore.ForgetRequest(req.Name)
 			}
+			cs.snapshotStore.SetSnapshot(req.Name, csiSnapshot)
 			return &csi.CreateSnapshotResponse{
 				Snapshot: csiSnapshot,
 			}, nil
@@ -856,7 +1647,7 @@ func (cs *KscEBSControllerServer) CreateSnapshot(ctx context.Context, req *csi.C
 		util.CreateEvent(cs.recorder, ref, v1.EventTypeWarning, snapshotAlreadyExist, err.Error())
 		return nil, err
 	case snapNum > 1:
-		klog.Error("CreateSnapshot:: Find Snapshot name[%s], but get more than 1 instance", req.Name)
+		klog.Errorf("CreateSnapshot:: Find Snapshot name[%s], but get more than 1 instance", req.Name)
 		err := status.Error(codes.Internal, "CreateSnapshot: get snapshot more than 1 instance")
 		util.CreateEvent(cs.recorder, ref, v1.EventTypeWarning, snapshotTooMany, err.Error())
 		return nil, err
@@ -894,7 +1685,7 @@ func (cs *KscEBSControllerServer) CreateSnapshot(ctx context.Context, req *csi.C
 		SizeBytes:      util.Gi2Bytes(disks.Size),
 	}
 
-	createdSnapshotMap[req.Name] = csiSnapshot
+	cs.snapshotStore.SetSnapshot(req.Name, csiSnapshot)
 	util.CreateEvent(cs.recorder, ref, v1.EventTypeNormal, snapshotCreatedSuccessfully, str)
 	return &csi.CreateSnapshotResponse{
 		Snapshot: csiSnapshot,
@@ -934,6 +1725,10 @@ func (cs *KscEBSControllerServer) DeleteSnapshot(ctx context.Context, req *csi.D
 	// Check arguments
 	snapshotID := req.GetSnapshotId()
 	klog.Infof("DeleteSnapshot:: starting delete snapshot %s", snapshotID)
+	if acquired := cs.volumeLocks.TryAcquire(snapshotID); !acquired {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, snapshotID)
+	}
+	defer cs.volumeLocks.Release(snapshotID)
 
 	// Check Snapshot exist
 	snapshot, err := cs.ebsClient.GetSnapshot(&ebsClient.DescribeSnapshotsReq{
@@ -964,7 +1759,7 @@ func (cs *KscEBSControllerServer) DeleteSnapshot(ctx context.Context, req *csi.D
 		return nil, err
 	}
 
-	delete(createdSnapshotMap, snapshot.SnapshotName)
+	cs.snapshotStore.DeleteSnapshot(snapshot.SnapshotName)
 	str := fmt.Sprintf("DeleteSnapshot:: Successfully delete snapshot %s, requestId: %s", snapshotID, response.RequestId)
 	klog.Info(str)
 	util.CreateEvent(cs.recorder, ref, v1.EventTypeNormal, snapshotDeletedSuccessfully, str)
@@ -1022,7 +1817,7 @@ func newListSnapshotsResponse(snapshots []*ebsClient.Snapshot) (*csi.ListSnapsho
 func (cs *KscEBSControllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
 	//return nil, status.Error(codes.Unimplemented, "")
 	if req.VolumeId == "" {
-		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume Volume ID must be provided")
+		return nil, status.Error(codes.InvalidArgument, "ControllerGetVolume Volume ID must be provided")
 	}
 
 	listVolumesReq := &ebsClient.ListVolumesReq{
@@ -1032,38 +1827,27 @@ func (cs *KscEBSControllerServer) ControllerGetVolume(ctx context.Context, req *
 	if err != nil {
 		return nil, status.Errorf(codes.NotFound, err.Error())
 	}
-	if vol.VolumeStatus == "error" {
-		return &csi.ControllerGetVolumeResponse{Status: &csi.ControllerGetVolumeResponse_VolumeStatus{VolumeCondition: &csi.VolumeCondition{Abnormal: false, Message: "ebs volume status error"}}}, nil
-	}
-	if vol.VolumeStatus != "in-use" {
-		klog.V(5).Info("volume is already attached")
-		return &csi.ControllerGetVolumeResponse{}, nil
-	}
 
-	res := &csi.ControllerGetVolumeResponse{
+	condition, err := volumeCondition(vol, cs.k8sClient.GetNodeByInstanceID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "ControllerGetVolume: failed to get the condition of volume %s: %v", vol.VolumeId, err)
+	}
+	return &csi.ControllerGetVolumeResponse{
 		Volume: &csi.Volume{
 			VolumeId:      vol.VolumeId,
 			CapacityBytes: int64(vol.Size * GB),
 		},
 		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
-			PublishedNodeIds: []string{vol.InstanceId},
-			VolumeCondition:  &csi.VolumeCondition{},
+			PublishedNodeIds: attachedInstanceIDs(vol),
+			VolumeCondition:  condition,
 		},
-	}
-
-	nodeReady, err := cs.k8sClient.IsNodeStatusReady(vol.InstanceId)
-	if err != nil {
-		return nil, err
-	}
-	res.Status.VolumeCondition.Abnormal = !nodeReady
-	if !nodeReady {
-		res.Status.VolumeCondition.Message = "node notready: " + vol.InstanceId
-	}
-
-	return res, nil
+	}, nil
 }
 
 type K8sClientWrapper interface {
-	GetNodeRegionZone() (string, string, error)
+	GetPersistentVolumeClaim(namespace, name string) (*v1.PersistentVolumeClaim, error)
+	GetZoneNodeCounts() (map[string]int, error)
 	IsNodeStatusReady(nodename string) (bool, error)
+	GetNodeByInstanceID(instanceID string) (*v1.Node, error)
+	GetVolumeAttachment(driverName, volumeID, nodeName string) (*storagev1.VolumeAttachment, error)
 }
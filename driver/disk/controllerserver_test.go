@@ -1,8 +1,27 @@
 package driver
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	ebsClient "csi-plugin/pkg/ebs-client"
+	"csi-plugin/util"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/record"
+	azcache "sigs.k8s.io/cloud-provider-azure/pkg/cache"
 )
 
 func Test_parseTags(t *testing.T) {
@@ -23,8 +42,8 @@ func Test_parseTags(t *testing.T) {
 			want: map[string]string{
 				"dfa":   "daffd",
 				"fdasf": "d12223=",
-				"ff":"",
-				
+				"ff":    "",
+
 				// "":"",
 				// "":"",
 			},
@@ -44,3 +63,991 @@ func Test_parseTags(t *testing.T) {
 		})
 	}
 }
+
+func Test_parseDiskTagsOfDriver(t *testing.T) {
+	// the tags set by the driver are in the charset of the user tags
+	for _, key := range []string{CsiRequestNameTag, CsiClusterIDTag, CsiPVNameTag, CsiPVCNameTag, CsiPVCNamespaceTag, CsiQuarantinedTag} {
+		if _, err := parseDiskTags(key + ":value"); err != nil {
+			t.Errorf("parseDiskTags() of driver tag %s error = %v", key, err)
+		}
+	}
+}
+
+func Test_validateCapabilities(t *testing.T) {
+	mountCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	blockCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	noAccessTypeCap := &csi.VolumeCapability{
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	multiWriterBlockCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+	}
+	singleWriterCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER},
+	}
+	readerOnlyCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY},
+	}
+	multiReaderCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY},
+	}
+	tests := []struct {
+		name string
+		caps []*csi.VolumeCapability
+		want bool
+	}{
+		{name: "mount", caps: []*csi.VolumeCapability{mountCap}, want: true},
+		{name: "block", caps: []*csi.VolumeCapability{blockCap}, want: true},
+		{name: "mount and block", caps: []*csi.VolumeCapability{mountCap, blockCap}, want: true},
+		{name: "no access type", caps: []*csi.VolumeCapability{noAccessTypeCap}, want: false},
+		{name: "unsupported access mode", caps: []*csi.VolumeCapability{multiWriterBlockCap}, want: false},
+		{name: "single node single writer", caps: []*csi.VolumeCapability{singleWriterCap}, want: true},
+		{name: "single node reader only", caps: []*csi.VolumeCapability{readerOnlyCap}, want: true},
+		{name: "multi node reader only", caps: []*csi.VolumeCapability{mountCap, multiReaderCap}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validateCapabilities(tt.caps); got != tt.want {
+				t.Errorf("validateCapabilities() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrepareCloneSnapshot(t *testing.T) {
+	fakeClient := NewFakeStorageClient()
+	cs := &KscEBSControllerServer{ebsClient: fakeClient}
+	sourceVol := &ebsClient.Volume{
+		VolumeId:         "c4d5e2f0-1a2b-4c3d-8e9f-0a1b2c3d4e5f",
+		Size:             20,
+		AvailabilityZone: "cn-beijing-6a",
+	}
+
+	snapshotID, err := cs.prepareCloneSnapshot("disk-clone", sourceVol)
+	if err != nil {
+		t.Fatalf("prepareCloneSnapshot() error = %v", err)
+	}
+	snapshot := fakeClient.snapshots[snapshotID]
+	if snapshot == nil || snapshot.VolumeID != sourceVol.VolumeId || snapshot.SnapshotName != cloneSnapshotPrefix+"disk-clone" {
+		t.Fatalf("prepareCloneSnapshot() created unexpected snapshot %+v", snapshot)
+	}
+
+	// a retried request reuses the snapshot of the previous attempt
+	retryID, err := cs.prepareCloneSnapshot("disk-clone", sourceVol)
+	if err != nil {
+		t.Fatalf("prepareCloneSnapshot() retry error = %v", err)
+	}
+	if retryID != snapshotID || len(fakeClient.snapshots) != 1 {
+		t.Errorf("prepareCloneSnapshot() retry = %s, want %s with 1 snapshot, got %d", retryID, snapshotID, len(fakeClient.snapshots))
+	}
+
+	// the same name cannot be reused for a different source volume
+	otherVol := &ebsClient.Volume{VolumeId: "d4d5e2f0-1a2b-4c3d-8e9f-0a1b2c3d4e5f", Size: 20}
+	if _, err := cs.prepareCloneSnapshot("disk-clone", otherVol); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("prepareCloneSnapshot() with different source error = %v, want AlreadyExists", err)
+	}
+}
+
+func TestDeleteCloneSnapshot(t *testing.T) {
+	fakeClient := NewFakeStorageClient()
+	cs := &KscEBSControllerServer{ebsClient: fakeClient}
+	resp, err := fakeClient.CreateVolume(&ebsClient.CreateVolumeReq{VolumeName: "disk-clone", VolumeType: SSD3_0, Size: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the clone is attached before the snapshot is deleted
+	fakeClient.volumes[resp.VolumeId].VolumeStatus = ebsClient.INUSE_STATUS
+	if _, err := fakeClient.CreateSnapshot(&ebsClient.CreateSnapshotReq{VolumeId: "c4d5e2f0-1a2b-4c3d-8e9f-0a1b2c3d4e5f", SnapshotName: cloneSnapshotPrefix + "disk-clone"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the cleanup of a previous attempt is running, no other one is started
+	cs.volumeLocks = util.NewVolumeLocks()
+	key := cloneSnapshotPrefix + resp.VolumeId
+	cs.volumeLocks.TryAcquire(key)
+	cs.startCloneSnapshotCleanup(resp.VolumeId, "disk-clone")
+	if len(fakeClient.snapshots) != 1 {
+		t.Errorf("startCloneSnapshotCleanup() during another cleanup left %d snapshots, want 1", len(fakeClient.snapshots))
+	}
+	cs.volumeLocks.Release(key)
+
+	cs.startCloneSnapshotCleanup(resp.VolumeId, "disk-clone")
+	err = wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		if cs.volumeLocks.TryAcquire(key) {
+			cs.volumeLocks.Release(key)
+			return true, nil
+		}
+		return false, nil
+	})
+	if err != nil {
+		t.Fatalf("startCloneSnapshotCleanup() is not finished: %v", err)
+	}
+	if len(fakeClient.snapshots) != 0 {
+		t.Errorf("deleteCloneSnapshot() kept %d snapshots of an attached clone", len(fakeClient.snapshots))
+	}
+}
+
+func TestGetCapacity(t *testing.T) {
+	configSet := []InstanceTypeConfigSet{
+		{InstanceType: "S6.2A", DataDiskQuotaSet: []DataDiskQuotaSet{
+			{DataDiskType: SSD3_0, DataDiskMinSize: 10, DataDiskMaxsize: 16000, AvailabilityZoneSet: []AvailabilityZoneSet{{AzCode: "cn-beijing-6a"}, {AzCode: "cn-beijing-6b"}}},
+			{DataDiskType: ESSD_PL1, DataDiskMinSize: 20, DataDiskMaxsize: 32000, AvailabilityZoneSet: []AvailabilityZoneSet{{AzCode: "cn-beijing-6a"}}},
+		}},
+		{InstanceType: "N3.2A", DataDiskQuotaSet: []DataDiskQuotaSet{
+			{DataDiskType: SSD3_0, DataDiskMinSize: 20, DataDiskMaxsize: 32000, AvailabilityZoneSet: []AvailabilityZoneSet{{AzCode: "cn-beijing-6b"}}},
+		}},
+	}
+	getter := func(key string) (interface{}, error) { return aggregateDiskQuota(configSet), nil }
+	quotaCache, _ := azcache.NewTimedCache(time.Minute, getter, false)
+	cs := &KscEBSControllerServer{
+		config:         Config{MaxVolumeSize: 20000},
+		ebsClient:      NewFakeStorageClient(),
+		diskQuotaCache: quotaCache,
+	}
+
+	tests := []struct {
+		name          string
+		params        map[string]string
+		zone          string
+		wantAvailable int64
+		wantMin       int64
+	}{
+		{name: "ssd in zone a", params: map[string]string{"type": SSD3_0}, zone: "cn-beijing-6a", wantAvailable: 16000 * GB, wantMin: 10 * GB},
+		{name: "ssd in zone b is limited by max-volume-size", params: map[string]string{"type": SSD3_0}, zone: "cn-beijing-6b", wantAvailable: 20000 * GB, wantMin: 10 * GB},
+		{name: "essd defaults to PL1", params: map[string]string{"type": ESSD}, zone: "cn-beijing-6a", wantAvailable: 20000 * GB, wantMin: 20 * GB},
+		{name: "essd sold out in zone b", params: map[string]string{"type": ESSD}, zone: "cn-beijing-6b", wantAvailable: 0},
+		{name: "essd falls back to ssd in zone b", params: map[string]string{"type": "ESSD,SSD3.0"}, zone: "cn-beijing-6b", wantAvailable: 20000 * GB, wantMin: 10 * GB},
+		{name: "any zone", params: map[string]string{"type": "SSD3.0,ESSD"}, wantAvailable: 20000 * GB, wantMin: 10 * GB},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &csi.GetCapacityRequest{Parameters: tt.params}
+			if tt.zone != "" {
+				req.AccessibleTopology = &csi.Topology{Segments: map[string]string{util.NodeZoneKey: tt.zone}}
+			}
+			resp, err := cs.GetCapacity(context.Background(), req)
+			if err != nil {
+				t.Fatalf("GetCapacity() error = %v", err)
+			}
+			if resp.AvailableCapacity != tt.wantAvailable {
+				t.Errorf("GetCapacity() available = %d, want %d", resp.AvailableCapacity, tt.wantAvailable)
+			}
+			if resp.GetMinimumVolumeSize().GetValue() != tt.wantMin {
+				t.Errorf("GetCapacity() minimum = %d, want %d", resp.GetMinimumVolumeSize().GetValue(), tt.wantMin)
+			}
+		})
+	}
+
+	if _, err := cs.GetCapacity(context.Background(), &csi.GetCapacityRequest{Parameters: map[string]string{"type": "HDD"}}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("GetCapacity() with unknown type error = %v, want InvalidArgument", err)
+	}
+}
+
+func Test_computeCapacity(t *testing.T) {
+	quota := DataDiskQuotaSet{DataDiskType: SSD3_0, DataDiskMinSize: 10, DataDiskMaxsize: 16000}
+	resp := computeCapacity(quota, &ebsClient.VolumeQuota{TotalCapacity: 1000, UsedCapacity: 400}, 32000)
+	if resp.AvailableCapacity != 600*GB || resp.GetMaximumVolumeSize().GetValue() != 600*GB {
+		t.Errorf("computeCapacity() with quota = %v, want 600GB", resp)
+	}
+	resp = computeCapacity(quota, &ebsClient.VolumeQuota{TotalCapacity: 1000, UsedCapacity: 10, TotalCount: 5, UsedCount: 5}, 32000)
+	if resp.AvailableCapacity != 0 {
+		t.Errorf("computeCapacity() with exhausted count = %d, want 0", resp.AvailableCapacity)
+	}
+}
+
+func TestListVolumes(t *testing.T) {
+	fakeClient := NewFakeStorageClient()
+	for i := 0; i < 5; i++ {
+		id := fmt.Sprintf("vol-%d", i)
+		fakeClient.volumes[id] = &ebsClient.Volume{VolumeId: id, Size: 20, VolumeDesc: createdByDO, VolumeStatus: ebsClient.AVAILABLE_STATUS}
+	}
+	fakeClient.volumes["vol-2"].VolumeDesc = "created by user"
+	fakeClient.volumes["vol-3"].Attachments = []*ebsClient.Attachment{{InstanceId: "i-node", VolumeId: "vol-3"}}
+	fakeClient.volumes["vol-3"].VolumeStatus = ebsClient.INUSE_STATUS
+	fakeClient.volumes["vol-4"].VolumeStatus = ebsClient.ERROR_STATUS
+	cs := &KscEBSControllerServer{ebsClient: fakeClient, k8sClient: &fakeK8sClientWrap{}}
+
+	var got []string
+	token := ""
+	for page := 0; ; page++ {
+		resp, err := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{MaxEntries: 2, StartingToken: token})
+		if err != nil {
+			t.Fatalf("ListVolumes() error = %v", err)
+		}
+		if len(resp.Entries) > 2 {
+			t.Fatalf("ListVolumes() returned %d entries, want at most 2", len(resp.Entries))
+		}
+		for _, entry := range resp.Entries {
+			got = append(got, entry.Volume.VolumeId)
+			if entry.Volume.VolumeId == "vol-3" && !reflect.DeepEqual(entry.Status.PublishedNodeIds, []string{"i-node"}) {
+				t.Errorf("ListVolumes() published nodes of vol-3 = %v", entry.Status.PublishedNodeIds)
+			}
+			wantAbnormal := entry.Volume.VolumeId == "vol-3" || entry.Volume.VolumeId == "vol-4"
+			if entry.Status.VolumeCondition == nil || entry.Status.VolumeCondition.Abnormal != wantAbnormal {
+				t.Errorf("ListVolumes() condition of %s = %v, want abnormal %v", entry.Volume.VolumeId, entry.Status.VolumeCondition, wantAbnormal)
+			}
+		}
+		if token = resp.NextToken; token == "" {
+			break
+		}
+		if page > 5 {
+			t.Fatalf("ListVolumes() does not terminate, token %q", token)
+		}
+	}
+	if want := []string{"vol-0", "vol-1", "vol-3", "vol-4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ListVolumes() = %v, want %v", got, want)
+	}
+
+	if _, err := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{StartingToken: "bad"}); status.Code(err) != codes.Aborted {
+		t.Errorf("ListVolumes() with invalid token error = %v, want Aborted", err)
+	}
+}
+
+func TestControllerVolumeLocks(t *testing.T) {
+	cs := &KscEBSControllerServer{
+		config:      Config{EnableVolumeExpansion: true, MaxVolumeSize: 32000},
+		ebsClient:   NewFakeStorageClient(),
+		volumeLocks: util.NewVolumeLocks(),
+	}
+	volumeID := "c4d5e2f0-1a2b-4c3d-8e9f-0a1b2c3d4e5f"
+	cs.volumeLocks.TryAcquire("disk-pvc")
+	cs.volumeLocks.TryAcquire(volumeID)
+
+	_, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{Name: "disk-pvc"})
+	if status.Code(err) != codes.Aborted {
+		t.Errorf("CreateVolume() in flight error = %v, want Aborted", err)
+	}
+	_, err = cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volumeID})
+	if status.Code(err) != codes.Aborted {
+		t.Errorf("DeleteVolume() in flight error = %v, want Aborted", err)
+	}
+	_, err = cs.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{
+		VolumeId:      volumeID,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 20 * GB},
+	})
+	if status.Code(err) != codes.Aborted {
+		t.Errorf("ControllerExpandVolume() in flight error = %v, want Aborted", err)
+	}
+
+	cs.volumeLocks.Release(volumeID)
+	if _, err = cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volumeID}); err != nil {
+		t.Errorf("DeleteVolume() after release error = %v", err)
+	}
+}
+
+func TestCreateVolumeIdempotent(t *testing.T) {
+	fakeClient := NewFakeStorageClient()
+	cs := &KscEBSControllerServer{
+		config:       Config{ClusterID: "cluster-a"},
+		ebsClient:    fakeClient,
+		zoneSelector: NewZoneSelector(&fakeK8sClientWrap{}),
+		volumeLocks:  util.NewVolumeLocks(),
+	}
+	newRequest := func(size int64, diskType string) *csi.CreateVolumeRequest {
+		return &csi.CreateVolumeRequest{
+			Name:          "disk-pvc-1",
+			CapacityRange: &csi.CapacityRange{RequiredBytes: size},
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+			Parameters: map[string]string{"type": diskType, "zone": "cn-beijing-6a"},
+			AccessibilityRequirements: &csi.TopologyRequirement{
+				Preferred: []*csi.Topology{{Segments: map[string]string{util.NodeZoneKey: "cn-beijing-6a"}}},
+			},
+		}
+	}
+
+	resp, err := cs.CreateVolume(context.Background(), newRequest(20*GB, SSD3_0))
+	if err != nil {
+		t.Fatalf("CreateVolume() error = %v", err)
+	}
+	volumeID := resp.Volume.VolumeId
+	wantTags := map[string]string{CsiRequestNameTag: "disk-pvc-1", CsiClusterIDTag: "cluster-a"}
+	if !reflect.DeepEqual(fakeClient.volumeTags[volumeID], wantTags) {
+		t.Errorf("CreateVolume() tags = %v, want %v", fakeClient.volumeTags[volumeID], wantTags)
+	}
+
+	// a retried request returns the volume created before
+	resp, err = cs.CreateVolume(context.Background(), newRequest(20*GB, SSD3_0))
+	if err != nil {
+		t.Fatalf("CreateVolume() retry error = %v", err)
+	}
+	if resp.Volume.VolumeId != volumeID || len(fakeClient.volumes) != 1 {
+		t.Errorf("CreateVolume() retry = %s, want %s with 1 volume, got %d", resp.Volume.VolumeId, volumeID, len(fakeClient.volumes))
+	}
+
+	// the same request name with different arguments
+	if _, err := cs.CreateVolume(context.Background(), newRequest(30*GB, SSD3_0)); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("CreateVolume() with different size error = %v, want AlreadyExists", err)
+	}
+	if _, err := cs.CreateVolume(context.Background(), newRequest(20*GB, EHDD)); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("CreateVolume() with different type error = %v, want AlreadyExists", err)
+	}
+
+	// the size of a retried request is compared with the size created,
+	// rounded up to whole GB and at least 10GB
+	for _, size := range []int64{5 * GB, 20*GB + 512*MB} {
+		req := newRequest(size, SSD3_0)
+		req.Name = fmt.Sprintf("disk-pvc-%d", size)
+		first, err := cs.CreateVolume(context.Background(), req)
+		if err != nil {
+			t.Fatalf("CreateVolume() of %v error = %v", formatBytes(size), err)
+		}
+		if retry, err := cs.CreateVolume(context.Background(), req); err != nil || retry.Volume.VolumeId != first.Volume.VolumeId || retry.Volume.CapacityBytes != first.Volume.CapacityBytes {
+			t.Errorf("CreateVolume() retry of %v = %v, %v, want %v", formatBytes(size), retry, err, first)
+		}
+	}
+
+	// the request name of another cluster does not match
+	other := &KscEBSControllerServer{
+		config:       Config{ClusterID: "cluster-b"},
+		ebsClient:    fakeClient,
+		zoneSelector: NewZoneSelector(&fakeK8sClientWrap{}),
+		volumeLocks:  util.NewVolumeLocks(),
+	}
+	if resp, err = other.CreateVolume(context.Background(), newRequest(20*GB, SSD3_0)); err != nil || resp.Volume.VolumeId == volumeID {
+		t.Errorf("CreateVolume() in another cluster = %v, %v, want a new volume", resp, err)
+	}
+
+	// the volumes of the same name listed regardless of the tags are checked
+	// by their own tags, the volume created by a user is not taken
+	fakeClient.ignoreTagFilter = true
+	if _, err := fakeClient.CreateVolume(&ebsClient.CreateVolumeReq{VolumeName: "disk-pvc-1", VolumeType: SSD3_0, Size: 20}); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err = cs.CreateVolume(context.Background(), newRequest(20*GB, SSD3_0)); err != nil || resp.Volume.VolumeId != volumeID {
+		t.Errorf("CreateVolume() retry with a volume of the same name = %v, %v, want %s", resp, err, volumeID)
+	}
+}
+
+func TestCreateVolumeExt2(t *testing.T) {
+	for _, expansion := range []bool{true, false} {
+		fakeClient := NewFakeStorageClient()
+		cs := &KscEBSControllerServer{
+			config:       Config{EnableVolumeExpansion: expansion},
+			ebsClient:    fakeClient,
+			zoneSelector: NewZoneSelector(&fakeK8sClientWrap{}),
+			volumeLocks:  util.NewVolumeLocks(),
+		}
+		_, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:          "disk-pvc-ext2",
+			CapacityRange: &csi.CapacityRange{RequiredBytes: 20 * GB},
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "ext2"}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+			Parameters: map[string]string{"type": SSD3_0, "zone": "cn-beijing-6a"},
+		})
+		wantCode := codes.OK
+		if expansion {
+			wantCode = codes.InvalidArgument
+		}
+		if status.Code(err) != wantCode {
+			t.Errorf("CreateVolume() of ext2 with volume expansion %v error = %v, want %v", expansion, err, wantCode)
+		}
+	}
+}
+
+func TestCreateVolumeDiskTypeFallback(t *testing.T) {
+	fakeClient := NewFakeStorageClient()
+	recorder := record.NewFakeRecorder(10)
+	cs := &KscEBSControllerServer{
+		recorder:     recorder,
+		ebsClient:    fakeClient,
+		zoneSelector: NewZoneSelector(&fakeK8sClientWrap{}),
+		volumeLocks:  util.NewVolumeLocks(),
+	}
+	newRequest := func(name string) *csi.CreateVolumeRequest {
+		return &csi.CreateVolumeRequest{
+			Name:          name,
+			CapacityRange: &csi.CapacityRange{RequiredBytes: 20 * GB},
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+			Parameters: map[string]string{
+				"type":          "SSD3.0,SATA3.0",
+				"zone":          "cn-beijing-6a",
+				pvcNameKey:      "data",
+				pvcNamespaceKey: "default",
+			},
+		}
+	}
+
+	resp, err := cs.CreateVolume(context.Background(), newRequest("disk-pvc-1"))
+	if err != nil {
+		t.Fatalf("CreateVolume() error = %v", err)
+	}
+	if got := resp.Volume.VolumeContext["type"]; got != SSD3_0 {
+		t.Errorf("CreateVolume() type = %s, want %s", got, SSD3_0)
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("CreateVolume() without fallback recorded event %s", <-recorder.Events)
+	}
+
+	fakeClient.unavailableTypes = map[string]bool{SSD3_0: true}
+	resp, err = cs.CreateVolume(context.Background(), newRequest("disk-pvc-2"))
+	if err != nil {
+		t.Fatalf("CreateVolume() with fallback error = %v", err)
+	}
+	if got := resp.Volume.VolumeContext["type"]; got != SATA3_0 {
+		t.Errorf("CreateVolume() with fallback type = %s, want %s", got, SATA3_0)
+	}
+	if vol := fakeClient.volumes[resp.Volume.VolumeId]; vol.VolumeType != SATA3_0 {
+		t.Errorf("CreateVolume() with fallback created %s volume", vol.VolumeType)
+	}
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, diskTypeFallback) {
+			t.Errorf("CreateVolume() with fallback recorded event %s", event)
+		}
+	default:
+		t.Errorf("CreateVolume() with fallback recorded no event")
+	}
+
+	fakeClient.unavailableTypes = map[string]bool{SSD3_0: true, SATA3_0: true}
+	if _, err = cs.CreateVolume(context.Background(), newRequest("disk-pvc-3")); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("CreateVolume() without available type error = %v, want ResourceExhausted", err)
+	}
+
+	// other errors are returned without trying the next type
+	fakeClient.unavailableTypes = nil
+	fakeClient.createErrors = map[string]error{SSD3_0: errors.New("request timeout")}
+	count := len(fakeClient.volumes)
+	if _, err = cs.CreateVolume(context.Background(), newRequest("disk-pvc-4")); err == nil || status.Code(err) == codes.ResourceExhausted || len(fakeClient.volumes) != count {
+		t.Errorf("CreateVolume() with a timeout error = %v with %d volumes, want the timeout with %d volumes", err, len(fakeClient.volumes), count)
+	}
+}
+
+func TestCreateVolumeEncryption(t *testing.T) {
+	fakeClient := NewFakeStorageClient()
+	cs := &KscEBSControllerServer{
+		ebsClient:    fakeClient,
+		zoneSelector: NewZoneSelector(&fakeK8sClientWrap{}),
+		volumeLocks:  util.NewVolumeLocks(),
+	}
+	encryptedSnapshot := "snapshot-encrypted"
+	fakeClient.snapshots[encryptedSnapshot] = &ebsClient.Snapshot{SnapshotID: encryptedSnapshot, Encrypted: true, KmsKeyId: "key-1"}
+	plainSnapshot := "snapshot-plain"
+	fakeClient.snapshots[plainSnapshot] = &ebsClient.Snapshot{SnapshotID: plainSnapshot}
+
+	tests := []struct {
+		name        string
+		params      map[string]string
+		snapshotID  string
+		wantCode    codes.Code
+		wantEncrypt bool
+		wantKmsKey  string
+	}{
+		{name: "plain", params: map[string]string{}},
+		{name: "default key", params: map[string]string{EncryptedKey: "true"}, wantEncrypt: true},
+		{name: "kms key", params: map[string]string{EncryptedKey: "true", KmsKeyIDKey: "key-2"}, wantEncrypt: true, wantKmsKey: "key-2"},
+		{name: "kms key without encrypted", params: map[string]string{KmsKeyIDKey: "key-2"}, wantCode: codes.InvalidArgument},
+		{name: "invalid encrypted", params: map[string]string{EncryptedKey: "yes please"}, wantCode: codes.InvalidArgument},
+		{name: "inherit snapshot", params: map[string]string{}, snapshotID: encryptedSnapshot, wantEncrypt: true, wantKmsKey: "key-1"},
+		{name: "encrypt plain snapshot", params: map[string]string{EncryptedKey: "true"}, snapshotID: plainSnapshot, wantCode: codes.InvalidArgument},
+		{name: "other kms key", params: map[string]string{EncryptedKey: "true", KmsKeyIDKey: "key-2"}, snapshotID: encryptedSnapshot, wantCode: codes.InvalidArgument},
+		{name: "missing snapshot", params: map[string]string{}, snapshotID: "snapshot-missing", wantCode: codes.NotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.params["type"] = SSD3_0
+			tt.params["zone"] = "cn-beijing-6a"
+			req := &csi.CreateVolumeRequest{
+				Name:          "disk-" + strings.ReplaceAll(tt.name, " ", "-"),
+				CapacityRange: &csi.CapacityRange{RequiredBytes: 20 * GB},
+				VolumeCapabilities: []*csi.VolumeCapability{{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+				}},
+				Parameters: tt.params,
+			}
+			if tt.snapshotID != "" {
+				req.VolumeContentSource = &csi.VolumeContentSource{
+					Type: &csi.VolumeContentSource_Snapshot{
+						Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: tt.snapshotID},
+					},
+				}
+			}
+			resp, err := cs.CreateVolume(context.Background(), req)
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("CreateVolume() error = %v, want code %v", err, tt.wantCode)
+			}
+			if err != nil {
+				return
+			}
+			vol := fakeClient.volumes[resp.Volume.VolumeId]
+			if vol.Encrypted != tt.wantEncrypt || vol.KmsKeyId != tt.wantKmsKey {
+				t.Errorf("CreateVolume() encrypted = %v with key %q, want %v with key %q", vol.Encrypted, vol.KmsKeyId, tt.wantEncrypt, tt.wantKmsKey)
+			}
+			ctx := resp.Volume.VolumeContext
+			if ctx[EncryptedKey] != strconv.FormatBool(tt.wantEncrypt) || ctx[KmsKeyIDKey] != tt.wantKmsKey {
+				t.Errorf("CreateVolume() volume context = %v", ctx)
+			}
+		})
+	}
+}
+
+func TestGetDiskTags(t *testing.T) {
+	k8sClient := &fakeK8sClientWrap{pvcs: []*v1.PersistentVolumeClaim{{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "data",
+			Namespace:   "default",
+			Annotations: map[string]string{AnnDiskTags: "team:storage,env:prod"},
+		},
+	}}}
+	cs := &KscEBSControllerServer{
+		config:    Config{ClusterID: "cluster-a"},
+		k8sClient: k8sClient,
+	}
+	newRequest := func(pvcName string) *csi.CreateVolumeRequest {
+		return &csi.CreateVolumeRequest{
+			Name: "disk-pv",
+			Parameters: map[string]string{
+				pvNameKey:       "disk-pv",
+				pvcNameKey:      pvcName,
+				pvcNamespaceKey: "default",
+			},
+		}
+	}
+
+	storageClassTags := map[string]string{"env": "test", "owner": "ops", CsiPVCNameTag: "other"}
+	got, err := cs.getDiskTags(newRequest("data"), storageClassTags)
+	if err != nil {
+		t.Fatalf("getDiskTags() error = %v", err)
+	}
+	want := map[string]string{
+		"team":             "storage",
+		"env":              "prod",
+		"owner":            "ops",
+		CsiRequestNameTag:  "disk-pv",
+		CsiClusterIDTag:    "cluster-a",
+		CsiPVNameTag:       "disk-pv",
+		CsiPVCNameTag:      "data",
+		CsiPVCNamespaceTag: "default",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("getDiskTags() = %v, want %v", got, want)
+	}
+	if storageClassTags["env"] != "test" {
+		t.Errorf("getDiskTags() modified the storage class tags %v", storageClassTags)
+	}
+
+	if _, err := cs.getDiskTags(newRequest("missing"), nil); status.Code(err) != codes.Internal {
+		t.Errorf("getDiskTags() of missing pvc error = %v, want Internal", err)
+	}
+
+	tooMany := map[string]string{}
+	for i := 0; i < maxDiskTags; i++ {
+		tooMany[fmt.Sprintf("key%d", i)] = "value"
+	}
+	if _, err := cs.getDiskTags(newRequest("data"), tooMany); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("getDiskTags() with %d tags error = %v, want InvalidArgument", len(tooMany), err)
+	}
+}
+
+func TestReadOnlyManyVolume(t *testing.T) {
+	storageClient := NewFakeStorageClient()
+	cs := &KscEBSControllerServer{
+		ebsClient:    storageClient,
+		zoneSelector: NewZoneSelector(&fakeK8sClientWrap{}),
+		volumeLocks:  util.NewVolumeLocks(),
+		operations:   NewOperationTracker(testOperationTrackerConfig, storageClient),
+	}
+	roxCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY},
+	}
+
+	resp, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "disk-pvc-rox",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 20 * GB},
+		VolumeCapabilities: []*csi.VolumeCapability{roxCap},
+		Parameters:         map[string]string{"type": SSD3_0, "zone": "cn-beijing-6a"},
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume() with ReadOnlyMany error = %v", err)
+	}
+	volumeID := resp.Volume.VolumeId
+
+	validated, err := cs.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           volumeID,
+		VolumeCapabilities: []*csi.VolumeCapability{roxCap},
+	})
+	if err != nil || validated.GetConfirmed() == nil {
+		t.Errorf("ValidateVolumeCapabilities() with ReadOnlyMany = %v, %v, want confirmed", validated, err)
+	}
+
+	// the volume attached to a node is not moved to a second one
+	if _, err := storageClient.Attach(&ebsClient.AttachVolumeReq{VolumeId: volumeID, InstanceId: "instance-1"}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = cs.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         volumeID,
+		NodeId:           "instance-2",
+		VolumeCapability: roxCap,
+		Readonly:         true,
+	})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("ControllerPublishVolume() to a second node error = %v, want FailedPrecondition", err)
+	}
+	if vol := storageClient.volumes[volumeID]; vol.VolumeStatus != ebsClient.INUSE_STATUS || vol.Attachments[0].InstanceId != "instance-1" {
+		t.Errorf("ControllerPublishVolume() to a second node detached the volume from instance-1")
+	}
+}
+
+func TestControllerPublishVolumeAttachedElsewhere(t *testing.T) {
+	const (
+		volumeID = "vol-attach"
+		nodeID   = "instance-1"
+	)
+	newNode := func(ready v1.ConditionStatus, since time.Time) *v1.Node {
+		return &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "node-1", Annotations: map[string]string{InstanceUuid: nodeID}},
+			Status: v1.NodeStatus{Conditions: []v1.NodeCondition{{
+				Type:               v1.NodeReady,
+				Status:             ready,
+				LastTransitionTime: metav1.NewTime(since),
+			}}},
+		}
+	}
+	tests := []struct {
+		name       string
+		node       *v1.Node
+		wantCode   codes.Code
+		wantStatus ebsClient.VolumeStatusType
+		wantReason string
+	}{
+		{
+			name:       "ready node",
+			node:       newNode(v1.ConditionTrue, time.Now().Add(-time.Hour)),
+			wantCode:   codes.FailedPrecondition,
+			wantStatus: ebsClient.INUSE_STATUS,
+		},
+		{
+			name:       "node NotReady in the grace period",
+			node:       newNode(v1.ConditionUnknown, time.Now().Add(-time.Minute)),
+			wantCode:   codes.Unavailable,
+			wantStatus: ebsClient.INUSE_STATUS,
+			wantReason: volumeDetachWaiting,
+		},
+		{
+			name:       "node NotReady after the grace period",
+			node:       newNode(v1.ConditionFalse, time.Now().Add(-10*time.Minute)),
+			wantCode:   codes.FailedPrecondition,
+			wantStatus: ebsClient.AVAILABLE_STATUS,
+			wantReason: volumeForceDetached,
+		},
+		{
+			name:       "node gone",
+			wantCode:   codes.FailedPrecondition,
+			wantStatus: ebsClient.AVAILABLE_STATUS,
+			wantReason: volumeForceDetached,
+		},
+		{
+			name: "node not annotated found by provider id",
+			node: func() *v1.Node {
+				node := newNode(v1.ConditionFalse, time.Now().Add(-10*time.Minute))
+				node.Annotations = nil
+				node.Spec.ProviderID = "ksc://cn-beijing-6/" + nodeID
+				return node
+			}(),
+			wantCode:   codes.FailedPrecondition,
+			wantStatus: ebsClient.AVAILABLE_STATUS,
+			wantReason: volumeForceDetached,
+		},
+		{
+			name: "node unknown",
+			node: func() *v1.Node {
+				node := newNode(v1.ConditionFalse, time.Now().Add(-10*time.Minute))
+				node.Annotations = nil
+				return node
+			}(),
+			wantCode:   codes.FailedPrecondition,
+			wantStatus: ebsClient.INUSE_STATUS,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storageClient := NewFakeStorageClient()
+			storageClient.volumes[volumeID] = &ebsClient.Volume{
+				VolumeId:     volumeID,
+				VolumeStatus: ebsClient.INUSE_STATUS,
+				InstanceId:   nodeID,
+				Attachments:  []*ebsClient.Attachment{{InstanceId: nodeID, VolumeId: volumeID}},
+			}
+			k8sClient := &fakeK8sClientWrap{volumeAttachments: []*storagev1.VolumeAttachment{{
+				ObjectMeta: metav1.ObjectMeta{Name: "csi-va"},
+				Spec:       storagev1.VolumeAttachmentSpec{Attacher: driverName, NodeName: "node-1"},
+			}}}
+			if tt.node != nil {
+				k8sClient.nodes = []*v1.Node{tt.node}
+			}
+			recorder := record.NewFakeRecorder(10)
+			cs := &KscEBSControllerServer{
+				config:      Config{DriverName: driverName, DetachNotReadyGracePeriod: 5 * time.Minute},
+				recorder:    recorder,
+				ebsClient:   storageClient,
+				k8sClient:   k8sClient,
+				volumeLocks: util.NewVolumeLocks(),
+				operations:  NewOperationTracker(testOperationTrackerConfig, storageClient),
+			}
+
+			_, err := cs.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+				VolumeId: volumeID,
+				NodeId:   "instance-2",
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+				},
+			})
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("ControllerPublishVolume() error = %v, want code %v", err, tt.wantCode)
+			}
+			if got := storageClient.volumes[volumeID].VolumeStatus; got != tt.wantStatus {
+				t.Errorf("volume status = %s, want %s", got, tt.wantStatus)
+			}
+			var reason string
+			select {
+			case event := <-recorder.Events:
+				reason = strings.Fields(event)[1]
+			default:
+			}
+			if reason != tt.wantReason {
+				t.Errorf("event reason = %q, want %q", reason, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestControllerUnpublishVolume(t *testing.T) {
+	const (
+		volumeID = "vol-detach"
+		nodeID   = "instance-1"
+	)
+	newNode := func(ready v1.ConditionStatus, since time.Time) *v1.Node {
+		return &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "node-1", Annotations: map[string]string{InstanceUuid: nodeID}},
+			Status: v1.NodeStatus{Conditions: []v1.NodeCondition{{
+				Type:               v1.NodeReady,
+				Status:             ready,
+				LastTransitionTime: metav1.NewTime(since),
+			}}},
+		}
+	}
+	tests := []struct {
+		name        string
+		status      ebsClient.VolumeStatusType
+		attachments []*ebsClient.Attachment
+		node        *v1.Node
+		wantCode    codes.Code
+		wantStatus  ebsClient.VolumeStatusType
+		wantReason  string
+	}{
+		{
+			name:       "detached",
+			status:     ebsClient.AVAILABLE_STATUS,
+			wantStatus: ebsClient.AVAILABLE_STATUS,
+		},
+		{
+			name:       "in-use without attachments",
+			status:     ebsClient.INUSE_STATUS,
+			wantCode:   codes.Unavailable,
+			wantStatus: ebsClient.INUSE_STATUS,
+			wantReason: volumeDetachInconsistent,
+		},
+		{
+			name:        "attached to another node",
+			status:      ebsClient.INUSE_STATUS,
+			attachments: []*ebsClient.Attachment{{InstanceId: "instance-2", VolumeId: volumeID}},
+			wantStatus:  ebsClient.INUSE_STATUS,
+		},
+		{
+			name:        "ready node",
+			status:      ebsClient.INUSE_STATUS,
+			attachments: []*ebsClient.Attachment{{InstanceId: nodeID, VolumeId: volumeID}},
+			node:        newNode(v1.ConditionTrue, time.Now().Add(-time.Hour)),
+			wantStatus:  ebsClient.AVAILABLE_STATUS,
+		},
+		{
+			name:        "node gone",
+			status:      ebsClient.INUSE_STATUS,
+			attachments: []*ebsClient.Attachment{{InstanceId: nodeID, VolumeId: volumeID}},
+			wantStatus:  ebsClient.AVAILABLE_STATUS,
+			wantReason:  volumeForceDetached,
+		},
+		{
+			name:        "node NotReady in the grace period",
+			status:      ebsClient.INUSE_STATUS,
+			attachments: []*ebsClient.Attachment{{InstanceId: nodeID, VolumeId: volumeID}},
+			node:        newNode(v1.ConditionUnknown, time.Now().Add(-time.Minute)),
+			wantCode:    codes.Unavailable,
+			wantStatus:  ebsClient.INUSE_STATUS,
+			wantReason:  volumeDetachWaiting,
+		},
+		{
+			name:        "node NotReady after the grace period",
+			status:      ebsClient.INUSE_STATUS,
+			attachments: []*ebsClient.Attachment{{InstanceId: nodeID, VolumeId: volumeID}},
+			node:        newNode(v1.ConditionFalse, time.Now().Add(-10*time.Minute)),
+			wantStatus:  ebsClient.AVAILABLE_STATUS,
+			wantReason:  volumeForceDetached,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storageClient := NewFakeStorageClient()
+			storageClient.volumes[volumeID] = &ebsClient.Volume{
+				VolumeId:     volumeID,
+				VolumeStatus: tt.status,
+				Attachments:  tt.attachments,
+			}
+			k8sClient := &fakeK8sClientWrap{volumeAttachments: []*storagev1.VolumeAttachment{{
+				ObjectMeta: metav1.ObjectMeta{Name: "csi-va"},
+				Spec:       storagev1.VolumeAttachmentSpec{Attacher: driverName, NodeName: "node-1"},
+			}}}
+			if tt.node != nil {
+				k8sClient.nodes = []*v1.Node{tt.node}
+			}
+			recorder := record.NewFakeRecorder(10)
+			cs := &KscEBSControllerServer{
+				config:      Config{DriverName: driverName, DetachNotReadyGracePeriod: 5 * time.Minute},
+				recorder:    recorder,
+				ebsClient:   storageClient,
+				k8sClient:   k8sClient,
+				volumeLocks: util.NewVolumeLocks(),
+				operations:  NewOperationTracker(testOperationTrackerConfig, storageClient),
+			}
+
+			_, err := cs.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{VolumeId: volumeID, NodeId: nodeID})
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("ControllerUnpublishVolume() error = %v, want code %v", err, tt.wantCode)
+			}
+			if got := storageClient.volumes[volumeID].VolumeStatus; got != tt.wantStatus {
+				t.Errorf("volume status = %s, want %s", got, tt.wantStatus)
+			}
+			var reason string
+			select {
+			case event := <-recorder.Events:
+				reason = strings.Fields(event)[1]
+			default:
+			}
+			if reason != tt.wantReason {
+				t.Errorf("event reason = %q, want %q", reason, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestControllerExpandVolume(t *testing.T) {
+	const volumeID = "vol-expand"
+	storageClient := NewFakeStorageClient()
+	storageClient.volumes[volumeID] = &ebsClient.Volume{VolumeId: volumeID, Size: 20, VolumeStatus: ebsClient.INUSE_STATUS}
+	cs := &KscEBSControllerServer{
+		config:      Config{EnableVolumeExpansion: true, MaxVolumeSize: 32000},
+		ebsClient:   storageClient,
+		volumeLocks: util.NewVolumeLocks(),
+		operations:  NewOperationTracker(testOperationTrackerConfig, storageClient),
+	}
+	req := &csi.ControllerExpandVolumeRequest{
+		VolumeId:      volumeID,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 30 * GB},
+	}
+	resp, err := cs.ControllerExpandVolume(context.Background(), req)
+	if err != nil {
+		t.Fatalf("ControllerExpandVolume() error = %v", err)
+	}
+	if resp.CapacityBytes != 30*GB || !resp.NodeExpansionRequired || storageClient.volumes[volumeID].Size != 30 {
+		t.Errorf("ControllerExpandVolume() = %+v, volume size %d", resp, storageClient.volumes[volumeID].Size)
+	}
+
+	// a volume in error status fails the resize at once
+	storageClient.volumes[volumeID].VolumeStatus = ebsClient.ERROR_STATUS
+	req.CapacityRange.RequiredBytes = 40 * GB
+	if _, err := cs.ControllerExpandVolume(context.Background(), req); status.Code(err) != codes.Internal {
+		t.Errorf("ControllerExpandVolume() of a volume in error status error = %v, want Internal", err)
+	}
+}
+
+func TestControllerGetVolume(t *testing.T) {
+	const volumeID = "vol-get"
+	readyNode := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-1", Annotations: map[string]string{InstanceUuid: "instance-1"}},
+		Status:     v1.NodeStatus{Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}},
+	}
+	notReadyNode := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-2", Annotations: map[string]string{InstanceUuid: "instance-2"}},
+		Status:     v1.NodeStatus{Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionFalse}}},
+	}
+	attachedTo := func(instanceID string) []*ebsClient.Attachment {
+		return []*ebsClient.Attachment{{InstanceId: instanceID, VolumeId: volumeID}}
+	}
+	unannotatedNode := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-4"},
+		Status:     v1.NodeStatus{Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}},
+	}
+	tests := []struct {
+		status      ebsClient.VolumeStatusType
+		attachments []*ebsClient.Attachment
+		// unannotated adds a node not annotated with its instance
+		unannotated   bool
+		wantAbnormal  bool
+		wantPublished []string
+	}{
+		{status: ebsClient.CREATING_STATUS},
+		{status: ebsClient.AVAILABLE_STATUS},
+		{status: ebsClient.ATTACHING_STATUS, attachments: attachedTo("instance-1"), wantPublished: []string{"instance-1"}},
+		{status: ebsClient.INUSE_STATUS, attachments: attachedTo("instance-1"), wantPublished: []string{"instance-1"}},
+		{status: ebsClient.INUSE_STATUS, attachments: attachedTo("instance-2"), wantAbnormal: true, wantPublished: []string{"instance-2"}},
+		{status: ebsClient.INUSE_STATUS, attachments: attachedTo("instance-3"), wantAbnormal: true, wantPublished: []string{"instance-3"}},
+		{status: ebsClient.INUSE_STATUS, attachments: attachedTo("instance-3"), unannotated: true, wantPublished: []string{"instance-3"}},
+		{status: ebsClient.INUSE_STATUS, attachments: attachedTo("instance-2"), unannotated: true, wantAbnormal: true, wantPublished: []string{"instance-2"}},
+		{status: ebsClient.DETACHING_STATUS, attachments: attachedTo("instance-2"), wantPublished: []string{"instance-2"}},
+		{status: ebsClient.EXTENDING_STATUS, attachments: attachedTo("instance-1"), wantPublished: []string{"instance-1"}},
+		{status: ebsClient.DELETING_STATUS, wantAbnormal: true},
+		{status: ebsClient.ERROR_STATUS, attachments: attachedTo("instance-1"), wantAbnormal: true, wantPublished: []string{"instance-1"}},
+		{status: "unknown", wantAbnormal: true},
+	}
+	for _, tt := range tests {
+		fakeClient := NewFakeStorageClient()
+		fakeClient.volumes[volumeID] = &ebsClient.Volume{VolumeId: volumeID, Size: 20, VolumeStatus: tt.status, Attachments: tt.attachments}
+		nodes := []*v1.Node{readyNode, notReadyNode}
+		if tt.unannotated {
+			nodes = append(nodes, unannotatedNode)
+		}
+		cs := &KscEBSControllerServer{
+			ebsClient: fakeClient,
+			k8sClient: &fakeK8sClientWrap{nodes: nodes},
+		}
+		resp, err := cs.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: volumeID})
+		if err != nil {
+			t.Fatalf("ControllerGetVolume() of %s volume error = %v", tt.status, err)
+		}
+		if resp.Volume.GetCapacityBytes() != 20*GB {
+			t.Errorf("ControllerGetVolume() of %s volume = %v, want 20GB", tt.status, resp.Volume)
+		}
+		condition := resp.Status.GetVolumeCondition()
+		if condition == nil || condition.Abnormal != tt.wantAbnormal || condition.Message == "" {
+			t.Errorf("ControllerGetVolume() condition of %s volume attached to %v = %v, want abnormal %v", tt.status, tt.wantPublished, condition, tt.wantAbnormal)
+		}
+		if !reflect.DeepEqual(resp.Status.PublishedNodeIds, tt.wantPublished) {
+			t.Errorf("ControllerGetVolume() published nodes of %s volume = %v, want %v", tt.status, resp.Status.PublishedNodeIds, tt.wantPublished)
+		}
+	}
+
+	cs := &KscEBSControllerServer{ebsClient: NewFakeStorageClient(), k8sClient: &fakeK8sClientWrap{}}
+	if _, err := cs.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: "vol-missing"}); status.Code(err) != codes.NotFound {
+		t.Errorf("ControllerGetVolume() of a missing volume error = %v, want NotFound", err)
+	}
+}
@@ -3,11 +3,13 @@ package driver
 import (
 	ebsClient "csi-plugin/pkg/ebs-client"
 	api "csi-plugin/pkg/open-api"
+	"csi-plugin/util"
 	"fmt"
 	"net"
 	"os"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"k8s.io/klog/v2"
@@ -18,6 +20,7 @@ import (
 
 	snapClientset "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned"
 	"google.golang.org/grpc"
+	"k8s.io/client-go/dynamic"
 	k8sclient "k8s.io/client-go/kubernetes"
 )
 
@@ -27,9 +30,16 @@ type Driver struct {
 	readyMu  sync.Mutex
 	ready    bool
 
-	controllerServer csi.ControllerServer
-	identityServer   csi.IdentityServer
-	nodeServer       csi.NodeServer
+	controllerServer      csi.ControllerServer
+	groupControllerServer csi.GroupControllerServer
+	identityServer        csi.IdentityServer
+	nodeServer            csi.NodeServer
+
+	volumeModifier  *VolumeModifier
+	orphanCollector *OrphanCollector
+	snapshotTracker *SnapshotTracker
+	snapshotPolicy  *SnapshotPolicyController
+	volumeMigration *VolumeMigrationController
 }
 
 type Config struct {
@@ -44,6 +54,35 @@ type Config struct {
 	K8sClient              *k8sclient.Clientset
 	MetricEnabled          bool
 	MaxVolumesPerNode      int64
+	// DetachNotReadyGracePeriod is how long a node stays NotReady before
+	// its volumes are force detached
+	DetachNotReadyGracePeriod time.Duration
+	// Operations configures the timeouts of the attach, detach and resize
+	// of the volumes
+	Operations OperationTrackerConfig
+	// ClusterID is tagged on the volumes created by the controller, together
+	// with the request name it identifies the volume of a CreateVolume request
+	ClusterID string
+	// EnableVolumeModifier modifies the volume type of the PVCs annotated
+	// with AnnTargetPerformanceLevel in the leader controller
+	EnableVolumeModifier bool
+	// EnableOrphanCollector reports, and optionally quarantines or deletes,
+	// the volumes of ClusterID without a PV in the leader controller
+	EnableOrphanCollector bool
+	OrphanCollector       OrphanCollectorConfig
+	// SnapshotStoreConfigMap is the namespace/name of the ConfigMap saving
+	// the snapshot requests and the created snapshots, kept in memory when
+	// empty
+	SnapshotStoreConfigMap string
+	// EnableSnapshotTracker reports the status and progress of the pending
+	// snapshots in the leader controller
+	EnableSnapshotTracker bool
+	SnapshotTracker       SnapshotTrackerConfig
+	// EnableSnapshotPolicy runs the SnapshotPolicies in the leader controller
+	EnableSnapshotPolicy bool
+	// EnableVolumeMigration runs the VolumeMigrations in the leader
+	// controller
+	EnableVolumeMigration bool
 }
 
 // GlobalConfig save global values for plugin
@@ -52,21 +91,22 @@ type GlobalConfig struct {
 	EbsClient     ebsClient.StorageService
 	OpenApiConfig *api.ClientConfig
 	SnapClient    *snapClientset.Clientset
+	DynamicClient dynamic.Interface
 }
 
 var (
 	GlobalConfigVar GlobalConfig
 )
 
-func NewDriver(config *Config) *Driver {
+// NewDriver creates the servers and controllers enabled in config, it fails
+// when config is not valid
+func NewDriver(config *Config) (*Driver, error) {
 	if config.DriverName == "" {
-		klog.Errorf("Driver name missing")
-		return nil
+		return nil, fmt.Errorf("driver name missing")
 	}
 	// TODO version format and validation
 	if len(config.Version) == 0 {
-		klog.Errorf("Version argument missing")
-		return nil
+		return nil, fmt.Errorf("version argument missing")
 	}
 	driver := &Driver{
 		endpoint:       config.EndPoint,
@@ -74,13 +114,51 @@ func NewDriver(config *Config) *Driver {
 		ready:          false,
 	}
 	if config.EnableControllerServer {
-		driver.controllerServer = GetControllerServer(config)
+		if err := config.Operations.Validate(); err != nil {
+			return nil, err
+		}
+		controllerServer := GetControllerServer(config)
+		driver.controllerServer = controllerServer
+		driver.groupControllerServer = controllerServer
+		if config.EnableVolumeModifier {
+			driver.volumeModifier = NewVolumeModifier(config.DriverName, config.K8sClient, config.EbsClient, util.NewEventRecorder())
+		}
+		if config.EnableOrphanCollector {
+			if err := config.OrphanCollector.Validate(); err != nil {
+				return nil, err
+			}
+			if config.ClusterID == "" {
+				return nil, fmt.Errorf("cluster id missing, the orphan collector needs it to find the volumes of the cluster")
+			}
+			driver.orphanCollector = NewOrphanCollector(config.DriverName, config.ClusterID, config.OrphanCollector, config.K8sClient, config.EbsClient, util.NewEventRecorder())
+		}
+		if config.EnableSnapshotTracker {
+			if err := config.SnapshotTracker.Validate(); err != nil {
+				return nil, err
+			}
+			if GlobalConfigVar.SnapClient == nil {
+				return nil, fmt.Errorf("snapshot client missing, the snapshot tracker needs it to watch the volume snapshot contents")
+			}
+			driver.snapshotTracker = NewSnapshotTracker(config.DriverName, config.SnapshotTracker, config.K8sClient, GlobalConfigVar.SnapClient, config.EbsClient, util.NewEventRecorder())
+		}
+		if config.EnableSnapshotPolicy {
+			if GlobalConfigVar.SnapClient == nil || GlobalConfigVar.DynamicClient == nil {
+				return nil, fmt.Errorf("snapshot or dynamic client missing, the snapshot policy controller needs them to watch the policies and create the snapshots")
+			}
+			driver.snapshotPolicy = NewSnapshotPolicyController(config.DriverName, config.K8sClient, GlobalConfigVar.SnapClient, GlobalConfigVar.DynamicClient, util.NewEventRecorder())
+		}
+		if config.EnableVolumeMigration {
+			if GlobalConfigVar.DynamicClient == nil {
+				return nil, fmt.Errorf("dynamic client missing, the volume migration controller needs it to watch the migrations")
+			}
+			driver.volumeMigration = NewVolumeMigrationController(config.DriverName, config.ClusterID, config.K8sClient, GlobalConfigVar.DynamicClient, config.EbsClient, util.NewEventRecorder())
+		}
 	}
 	if config.EnableNodeServer {
 		driver.nodeServer = GetNodeServer(config)
 	}
 
-	return driver
+	return driver, nil
 }
 
 func (d *Driver) Run() error {
@@ -113,10 +191,29 @@ func (d *Driver) Run() error {
 	if d.controllerServer != nil {
 		csi.RegisterControllerServer(d.srv, d.controllerServer)
 	}
+	if d.groupControllerServer != nil {
+		csi.RegisterGroupControllerServer(d.srv, d.groupControllerServer)
+	}
 	if d.nodeServer != nil {
 		csi.RegisterNodeServer(d.srv, d.nodeServer)
 	}
 
+	if d.volumeModifier != nil {
+		go util.RunWithLeaderElection(context.Background(), d.volumeModifier.k8sClient, VolumeModifierLeaseName, d.volumeModifier.Run)
+	}
+	if d.orphanCollector != nil {
+		go util.RunWithLeaderElection(context.Background(), d.orphanCollector.k8sClient, OrphanCollectorLeaseName, d.orphanCollector.Run)
+	}
+	if d.snapshotTracker != nil {
+		go util.RunWithLeaderElection(context.Background(), d.snapshotTracker.k8sClient, SnapshotTrackerLeaseName, d.snapshotTracker.Run)
+	}
+	if d.snapshotPolicy != nil {
+		go util.RunWithLeaderElection(context.Background(), d.snapshotPolicy.k8sClient, SnapshotPolicyLeaseName, d.snapshotPolicy.Run)
+	}
+	if d.volumeMigration != nil {
+		go util.RunWithLeaderElection(context.Background(), d.volumeMigration.k8sClient, VolumeMigrationLeaseName, d.volumeMigration.Run)
+	}
+
 	klog.V(2).Infof("Listening for connections on address: %#v", listener.Addr())
 	return d.srv.Serve(listener)
 }
@@ -6,12 +6,20 @@ import (
 	"fmt"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"sort"
+	"sync"
 	"testing"
 	"time"
 
 	ebsClient "csi-plugin/pkg/ebs-client"
+	"csi-plugin/util"
 
 	"github.com/kubernetes-csi/csi-test/pkg/sanity"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	mountutils "k8s.io/mount-utils"
 )
 
 func init() {
@@ -55,7 +63,11 @@ func getControllerServer(config *Config) *fakeControllerServer {
 		KscEBSControllerServer: &KscEBSControllerServer{
 			ebsClient: config.EbsClient,
 			// kecClient:  config.KecClient,
-			k8sClient: &fakeK8sClientWrap{},
+			k8sClient:     &fakeK8sClientWrap{},
+			zoneSelector:  NewZoneSelector(&fakeK8sClientWrap{}),
+			volumeLocks:   util.NewVolumeLocks(),
+			snapshotStore: NewSnapshotStore(time.Duration(defaultSnapshotRequestInterval)*time.Second, defaultSnapshotStoreTTL, nil),
+			operations:    NewOperationTracker(testOperationTrackerConfig, config.EbsClient),
 		},
 	}
 }
@@ -77,13 +89,44 @@ func getIdentityServer(config *Config) *fakeIdentityServer {
 	}
 }
 
-type fakeK8sClientWrap struct{}
+type fakeK8sClientWrap struct {
+	pvcs              []*v1.PersistentVolumeClaim
+	nodes             []*v1.Node
+	volumeAttachments []*storagev1.VolumeAttachment
+}
 
-func (fk *fakeK8sClientWrap) GetNodeRegionZone() (string, string, error) {
-	return "test-region", "test-zone", nil
+func (fk *fakeK8sClientWrap) GetPersistentVolumeClaim(namespace, name string) (*v1.PersistentVolumeClaim, error) {
+	for _, pvc := range fk.pvcs {
+		if pvc.Namespace == namespace && pvc.Name == name {
+			return pvc, nil
+		}
+	}
+	return nil, fmt.Errorf("pvc %s/%s not found", namespace, name)
+}
+
+func (fk *fakeK8sClientWrap) GetZoneNodeCounts() (map[string]int, error) {
+	return map[string]int{"test-zone": 1}, nil
 }
 func (fk *fakeK8sClientWrap) IsNodeStatusReady(nodename string) (bool, error) {
-	return false, nil
+	node, err := fk.GetNodeByInstanceID(nodename)
+	if err != nil {
+		return false, nil
+	}
+	cond := getNodeReadyCondition(node)
+	return cond != nil && cond.Status == v1.ConditionTrue, nil
+}
+
+func (fk *fakeK8sClientWrap) GetNodeByInstanceID(instanceID string) (*v1.Node, error) {
+	return nodeByInstanceID(fk.nodes, instanceID)
+}
+
+func (fk *fakeK8sClientWrap) GetVolumeAttachment(driverName, volumeID, nodeName string) (*storagev1.VolumeAttachment, error) {
+	for _, va := range fk.volumeAttachments {
+		if va.Spec.Attacher == driverName && (nodeName == "" || va.Spec.NodeName == nodeName) {
+			return va, nil
+		}
+	}
+	return nil, nil
 }
 func getDriver(t *testing.T) *Driver {
 	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
@@ -112,12 +155,12 @@ func TestDriverSuite(t *testing.T) {
 	go d.Run()
 	defer d.Stop()
 
-	mntDir := os.TempDir()
+	mntDir := filepath.Join(os.TempDir(), "csi-disk-target-"+randString(8))
 
 	fmt.Println("mntDir:", mntDir)
 	defer os.RemoveAll(mntDir)
 
-	mntStageDir := os.TempDir()
+	mntStageDir := filepath.Join(os.TempDir(), "csi-disk-staging-"+randString(8))
 
 	fmt.Println("mntStageDir:", mntStageDir)
 	defer os.RemoveAll(mntStageDir)
@@ -132,7 +175,19 @@ func TestDriverSuite(t *testing.T) {
 }
 
 type FakeStorageClient struct {
-	volumes map[string]*ebsClient.Volume
+	// mu guards the snapshots created concurrently by group snapshots
+	mu         sync.Mutex
+	volumes    map[string]*ebsClient.Volume
+	volumeTags map[string]map[string]string
+	snapshots  map[string]*ebsClient.Snapshot
+	// unavailableTypes are the volume types CreateVolume fails with stock errors
+	unavailableTypes map[string]bool
+	// createErrors are the other errors CreateVolume fails with by volume type
+	createErrors map[string]error
+	// snapshotErrVolumes are the volumes CreateSnapshot fails on
+	snapshotErrVolumes map[string]bool
+	// ignoreTagFilter makes ListVolumes return the volumes of any tags
+	ignoreTagFilter bool
 }
 
 func (cli *FakeStorageClient) DescribeInstanceVolumes(describeInstanceVolumesReq *ebsClient.DescribeInstanceVolumesReq) (*ebsClient.InstanceVolumes, error) {
@@ -142,14 +197,20 @@ func (cli *FakeStorageClient) DescribeInstanceVolumes(describeInstanceVolumesReq
 
 func NewFakeStorageClient() *FakeStorageClient {
 	volumes := make(map[string]*ebsClient.Volume)
+	snapshots := make(map[string]*ebsClient.Snapshot)
 	return &FakeStorageClient{
-		volumes: volumes,
+		volumes:    volumes,
+		volumeTags: make(map[string]map[string]string),
+		snapshots:  snapshots,
 	}
 }
 
 // TODO
 func (cli *FakeStorageClient) ExpandVolume(expandVolumeReq *ebsClient.ExpandVolumeReq) (*ebsClient.ExpandVolumeResp, error) {
-	return nil, nil
+	if vol, ok := cli.volumes[expandVolumeReq.VolumeId]; ok {
+		vol.Size = expandVolumeReq.Size
+	}
+	return &ebsClient.ExpandVolumeResp{}, nil
 	//listVolumesResp, err := cli.ListVolumes(expandVolumeReq)
 	//if err != nil {
 	//	return nil, err
@@ -160,14 +221,71 @@ func (cli *FakeStorageClient) ExpandVolume(expandVolumeReq *ebsClient.ExpandVolu
 	//return listVolumesResp.Volumes[0], nil
 }
 
+func (f *FakeStorageClient) ModifyVolume(req *ebsClient.ModifyVolumeReq) (*ebsClient.ModifyVolumeResp, error) {
+	vol, ok := f.volumes[req.VolumeId]
+	if !ok {
+		return nil, fmt.Errorf("vol %v not found", req.VolumeId)
+	}
+	if f.unavailableTypes[req.VolumeType] {
+		return nil, fmt.Errorf("volume type %s is sold out", req.VolumeType)
+	}
+	vol.VolumeType = req.VolumeType
+	return &ebsClient.ModifyVolumeResp{RequestId: randString(32), Return: true}, nil
+}
+
+func (f *FakeStorageClient) TagVolume(req *ebsClient.TagVolumeReq) (*ebsClient.TagVolumeResp, error) {
+	if _, ok := f.volumes[req.VolumeId]; !ok {
+		return nil, fmt.Errorf("vol %v not found", req.VolumeId)
+	}
+	if f.volumeTags[req.VolumeId] == nil {
+		f.volumeTags[req.VolumeId] = make(map[string]string)
+	}
+	for k, v := range req.Tags {
+		f.volumeTags[req.VolumeId][k] = v
+	}
+	return &ebsClient.TagVolumeResp{RequestId: randString(32), Return: true}, nil
+}
+
+func (f *FakeStorageClient) DescribeVolumeTags(req *ebsClient.DescribeVolumeTagsReq) (*ebsClient.DescribeVolumeTagsResp, error) {
+	if _, ok := f.volumes[req.VolumeId]; !ok {
+		return nil, fmt.Errorf("vol %v not found", req.VolumeId)
+	}
+	resp := &ebsClient.DescribeVolumeTagsResp{RequestId: randString(32)}
+	for k, v := range f.volumeTags[req.VolumeId] {
+		resp.TagSet = append(resp.TagSet, &ebsClient.ResourceTag{ResourceType: "volume", ResourceId: req.VolumeId, Key: k, Value: v})
+	}
+	return resp, nil
+}
+
 func (f *FakeStorageClient) ListVolumes(listVolumesReq *ebsClient.ListVolumesReq) (*ebsClient.ListVolumesResp, error) {
 	volumes := make([]*ebsClient.Volume, 0)
+Loop:
 	for _, volume := range f.volumes {
+		if listVolumesReq.VolumeExactName != "" && volume.VolumeName != listVolumesReq.VolumeExactName {
+			continue
+		}
+		for k, v := range listVolumesReq.Tags {
+			if !f.ignoreTagFilter && f.volumeTags[volume.VolumeId][k] != v {
+				continue Loop
+			}
+		}
 		volumes = append(volumes, volume)
 	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].VolumeId < volumes[j].VolumeId })
+	total := len(volumes)
+	if marker := listVolumesReq.Marker; marker > 0 {
+		if marker > total {
+			marker = total
+		}
+		volumes = volumes[marker:]
+	}
+	if listVolumesReq.MaxResults > 0 && len(volumes) > listVolumesReq.MaxResults {
+		volumes = volumes[:listVolumesReq.MaxResults]
+	}
 	listVolumesResp := &ebsClient.ListVolumesResp{
-		RequestId: randString(32),
-		Volumes:   volumes,
+		RequestId:  randString(32),
+		Volumes:    volumes,
+		TotalCount: total,
 	}
 	return listVolumesResp, nil
 }
@@ -175,7 +293,7 @@ func (f *FakeStorageClient) ListVolumes(listVolumesReq *ebsClient.ListVolumesReq
 func (f *FakeStorageClient) GetVolume(listVolumesReq *ebsClient.ListVolumesReq) (*ebsClient.Volume, error) {
 	vol, ok := f.volumes[listVolumesReq.VolumeIds[0]]
 	if !ok {
-		return nil, errors.New("volume not found")
+		return nil, errors.New("not found volume")
 	}
 
 	return vol, nil
@@ -186,6 +304,17 @@ func (f *FakeStorageClient) GetVolumeByName(listVolumesReq *ebsClient.ListVolume
 }
 
 func (f *FakeStorageClient) CreateVolume(createVolumeReq *ebsClient.CreateVolumeReq) (*ebsClient.CreateVolumeResp, error) {
+	if f.unavailableTypes[createVolumeReq.VolumeType] {
+		return nil, &ebsClient.VolumeTypeUnavailableError{
+			VolumeType:       createVolumeReq.VolumeType,
+			AvailabilityZone: createVolumeReq.AvailabilityZone,
+			Code:             "InsufficientStock",
+			Message:          "stock is insufficient",
+		}
+	}
+	if err := f.createErrors[createVolumeReq.VolumeType]; err != nil {
+		return nil, err
+	}
 	id := randString(32)
 	vol := &ebsClient.Volume{
 		VolumeId:         id,
@@ -193,9 +322,14 @@ func (f *FakeStorageClient) CreateVolume(createVolumeReq *ebsClient.CreateVolume
 		VolumeName:       createVolumeReq.VolumeName,
 		VolumeDesc:       createVolumeReq.VolumeDesc,
 		Size:             createVolumeReq.Size,
+		VolumeType:       createVolumeReq.VolumeType,
+		SnapshotId:       createVolumeReq.SnapshotId,
+		Encrypted:        createVolumeReq.Encrypted,
+		KmsKeyId:         createVolumeReq.KmsKeyId,
 		VolumeStatus:     ebsClient.AVAILABLE_STATUS,
 	}
 	f.volumes[id] = vol
+	f.volumeTags[id] = createVolumeReq.Tags
 
 	return &ebsClient.CreateVolumeResp{
 		RequestId: randString(32),
@@ -214,6 +348,7 @@ func (f *FakeStorageClient) Attach(attachVolumeReq *ebsClient.AttachVolumeReq) (
 		return nil, fmt.Errorf("vol %v not found", attachVolumeReq.VolumeId)
 	}
 	vol.VolumeStatus = ebsClient.INUSE_STATUS
+	vol.Attachments = []*ebsClient.Attachment{{InstanceId: attachVolumeReq.InstanceId, VolumeId: vol.VolumeId}}
 	f.volumes[vol.VolumeId] = vol
 
 	return &ebsClient.AttachVolumeResp{
@@ -228,6 +363,7 @@ func (f *FakeStorageClient) Detach(detachVolumeReq *ebsClient.DetachVolumeReq) (
 		return nil, fmt.Errorf("vol %v not found", detachVolumeReq.VolumeId)
 	}
 	vol.VolumeStatus = ebsClient.AVAILABLE_STATUS
+	vol.Attachments = nil
 	f.volumes[vol.VolumeId] = vol
 
 	return &ebsClient.DetachVolumeResp{
@@ -236,6 +372,63 @@ func (f *FakeStorageClient) Detach(detachVolumeReq *ebsClient.DetachVolumeReq) (
 	}, nil
 }
 
+func (f *FakeStorageClient) CreateSnapshot(req *ebsClient.CreateSnapshotReq) (*ebsClient.CreateSnapshotResp, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.snapshotErrVolumes[req.VolumeId] {
+		return nil, fmt.Errorf("snapshot quota of volume %s exceeded", req.VolumeId)
+	}
+	id := randString(36)
+	f.snapshots[id] = &ebsClient.Snapshot{
+		SnapshotID:     id,
+		SnapshotName:   req.SnapshotName,
+		VolumeID:       req.VolumeId,
+		CreateTime:     time.Now().Format("2006-01-02 15:04:05"),
+		SnapshotStatus: ebsClient.SNAPSHOT_AVAILABLE_STATUS,
+	}
+	if vol, ok := f.volumes[req.VolumeId]; ok {
+		f.snapshots[id].Encrypted = vol.Encrypted
+		f.snapshots[id].KmsKeyId = vol.KmsKeyId
+	}
+	return &ebsClient.CreateSnapshotResp{
+		RequestID:  randString(32),
+		SnapshotID: id,
+	}, nil
+}
+
+func (f *FakeStorageClient) GetSnapshot(req *ebsClient.DescribeSnapshotsReq) (*ebsClient.Snapshot, error) {
+	return f.snapshots[req.SnapshotId], nil
+}
+
+func (f *FakeStorageClient) ListSnapshots(req *ebsClient.DescribeSnapshotsReq) (*ebsClient.DescribeSnapshotsResp, error) {
+	snapshots := make([]*ebsClient.Snapshot, 0)
+	for _, snapshot := range f.snapshots {
+		if req.VolumeId == "" || snapshot.VolumeID == req.VolumeId {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	return &ebsClient.DescribeSnapshotsResp{RequestId: randString(32), Snapshots: snapshots}, nil
+}
+
+func (f *FakeStorageClient) GetSnapshotsByName(req *ebsClient.DescribeSnapshotsReq) (*ebsClient.DescribeSnapshotsResp, int, error) {
+	snapshots := make([]*ebsClient.Snapshot, 0)
+	for _, snapshot := range f.snapshots {
+		if snapshot.SnapshotName == req.SnapshotName {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	return &ebsClient.DescribeSnapshotsResp{RequestId: randString(32), Snapshots: snapshots}, len(snapshots), nil
+}
+
+func (f *FakeStorageClient) DeleteSnapshots(req *ebsClient.DeleteSnapshotsReq) (*ebsClient.DeleteSnapshotsResp, error) {
+	delete(f.snapshots, req.SnapshotId)
+	return &ebsClient.DeleteSnapshotsResp{RequestId: randString(32), Return: true}, nil
+}
+
+func (f *FakeStorageClient) DescribeVolumeQuota(req *ebsClient.DescribeVolumeQuotaReq) (*ebsClient.DescribeVolumeQuotaResp, error) {
+	return &ebsClient.DescribeVolumeQuotaResp{RequestId: randString(32)}, nil
+}
+
 func (f *FakeStorageClient) ValidateAttachInstance(req *ebsClient.ValidateAttachInstanceReq) (*ebsClient.ValidateAttachInstanceResp, error) {
 	return &ebsClient.ValidateAttachInstanceResp{
 		RequestId:      randString(36),
@@ -252,34 +445,80 @@ func randString(n int) string {
 	return string(b)
 }
 
-type fakeMounter struct{}
+// fakeMounter records the mounts in memory, the rest of mount.Interface is
+// served by mount.FakeMounter
+type fakeMounter struct {
+	*mountutils.FakeMounter
+	// the mount options of each mounted target
+	mounts map[string][]string
+	// the mkfs arguments of each formatted source
+	formatted map[string][]string
+}
 
 func NewFakeMounter() *fakeMounter {
-	return &fakeMounter{}
+	return &fakeMounter{
+		FakeMounter: mountutils.NewFakeMounter(nil),
+		mounts:      map[string][]string{},
+		formatted:   map[string][]string{},
+	}
 }
 
 func (f *fakeMounter) PathExists(path string) (bool, error) {
 	return false, nil
 }
 
-func (f *fakeMounter) Expand(fsType, source string) (bool, error) {
-	return false, nil
+func (f *fakeMounter) Resize(devicePath, deviceMountPath string) (bool, error) {
+	return true, nil
 }
-func (f *fakeMounter) Format(source string, fsType string) error {
+
+func (f *fakeMounter) FormatAndMount(source, target, fsType string, options, mkfsArgs []string) error {
+	if _, ok := f.formatted[source]; !ok {
+		f.formatted[source] = mkfsArgs
+	}
+	f.mounts[target] = options
 	return nil
 }
 
-func (f *fakeMounter) Mount(source string, target string, fsType string, options ...string) error {
+func (f *fakeMounter) Mount(source string, target string, fsType string, options []string) error {
+	f.mounts[target] = options
 	return nil
 }
 
-func (f *fakeMounter) Unmount(target string) error {
+func (f *fakeMounter) MountBlock(source string, target string, options []string) error {
+	f.mounts[target] = options
 	return nil
 }
 
-func (f *fakeMounter) IsFormatted(source string) (bool, error) {
-	return true, nil
+func (f *fakeMounter) GetBlockSizeBytes(devicePath string) (int64, error) {
+	return 0, nil
 }
+
+func (f *fakeMounter) Unmount(target string) error {
+	delete(f.mounts, target)
+	return nil
+}
+
 func (f *fakeMounter) IsMounted(target string) (bool, error) {
-	return true, nil
+	_, ok := f.mounts[target]
+	return ok, nil
+}
+
+// newBoundTestPVC returns the PVC name in namespace default bound to the PV
+// pv-<name> of volumeID provisioned by driver
+func newBoundTestPVC(name, driver, volumeID string) (*v1.PersistentVolumeClaim, *v1.PersistentVolume) {
+	pvc := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec:       v1.PersistentVolumeClaimSpec{VolumeName: "pv-" + name},
+		Status:     v1.PersistentVolumeClaimStatus{Phase: v1.ClaimBound},
+	}
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: pvc.Spec.VolumeName},
+		Spec: v1.PersistentVolumeSpec{
+			ClaimRef: &v1.ObjectReference{Namespace: pvc.Namespace, Name: pvc.Name},
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: driver, VolumeHandle: volumeID},
+			},
+		},
+	}
+	return pvc, pv
 }
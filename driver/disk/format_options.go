@@ -0,0 +1,161 @@
+package driver
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// keys of the storage class parameters, passed to NodeStageVolume in the
+// volume context, of the options the disks are formatted with
+const (
+	// MkfsOptionsKey is extra mkfs options of the filesystem type, such as
+	// "-O ^metadata_csum -L data" for ext4
+	MkfsOptionsKey = "mkfsOptions"
+	// BlockSizeKey is the block size of the filesystem in bytes
+	BlockSizeKey = "blockSize"
+	// InodeSizeKey is the inode size of the filesystem in bytes
+	InodeSizeKey = "inodeSize"
+	// ReservedBlocksPercentKey is the percentage of the blocks reserved for
+	// root, 5 by default on ext filesystems
+	ReservedBlocksPercentKey = "reservedBlocksPercent"
+)
+
+// mkfsOptionRe matches a token of mkfsOptions, mkfs is not run by a shell
+// but the tokens are kept to the characters of the options
+var mkfsOptionRe = regexp.MustCompile(`^[A-Za-z0-9_=,.:^+/-]+$`)
+
+// formatOptions are the options a disk is formatted with
+type formatOptions struct {
+	blockSize             int64
+	inodeSize             int64
+	reservedBlocksPercent string
+	extra                 []string
+}
+
+// parseFormatOptions parses the format options in the volume context
+// params, they are checked against the filesystem type by mkfsArgs
+func parseFormatOptions(params map[string]string) (*formatOptions, error) {
+	opts := &formatOptions{}
+	parseSize := func(key string) (int64, error) {
+		value := strings.TrimSpace(params[key])
+		if value == "" {
+			return 0, nil
+		}
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || size <= 0 || size&(size-1) != 0 {
+			return 0, fmt.Errorf("invalid %s %q, it must be a power of 2", key, value)
+		}
+		return size, nil
+	}
+	var err error
+	if opts.blockSize, err = parseSize(BlockSizeKey); err != nil {
+		return nil, err
+	}
+	if opts.inodeSize, err = parseSize(InodeSizeKey); err != nil {
+		return nil, err
+	}
+	if value := strings.TrimSpace(params[ReservedBlocksPercentKey]); value != "" {
+		percent, err := strconv.ParseFloat(value, 64)
+		if err != nil || percent < 0 || percent > 50 {
+			return nil, fmt.Errorf("invalid %s %q, it must be between 0 and 50", ReservedBlocksPercentKey, value)
+		}
+		opts.reservedBlocksPercent = value
+	}
+	if value := strings.TrimSpace(params[MkfsOptionsKey]); value != "" {
+		opts.extra = strings.Fields(value)
+		if !strings.HasPrefix(opts.extra[0], "-") {
+			return nil, fmt.Errorf("invalid %s %q, it must start with an option", MkfsOptionsKey, value)
+		}
+		for _, token := range opts.extra {
+			if !mkfsOptionRe.MatchString(token) {
+				return nil, fmt.Errorf("invalid %s %q, unexpected %q", MkfsOptionsKey, value, token)
+			}
+		}
+	}
+	return opts, nil
+}
+
+func (o *formatOptions) empty() bool {
+	return o.blockSize == 0 && o.inodeSize == 0 && o.reservedBlocksPercent == "" && len(o.extra) == 0
+}
+
+// mkfsArgs returns the arguments of mkfs.<fsType> before the device for the
+// options, it fails if an option is not supported by fsType or out of its
+// range
+func (o *formatOptions) mkfsArgs(fsType string) ([]string, error) {
+	var args []string
+	unsupported := func(key string) error {
+		return fmt.Errorf("%s is not supported by filesystem %s", key, fsType)
+	}
+	outOfRange := func(key string, value, min, max int64) error {
+		return fmt.Errorf("%s %d of filesystem %s is out of range %d-%d", key, value, fsType, min, max)
+	}
+
+	switch fsType {
+	case "ext2", "ext3", "ext4":
+		// the device is formatted without asking when it has a partition
+		// table, it is only formatted when blkid finds nothing on it
+		args = append(args, "-F")
+		if o.blockSize != 0 {
+			if o.blockSize < 1024 || o.blockSize > 4096 {
+				return nil, outOfRange(BlockSizeKey, o.blockSize, 1024, 4096)
+			}
+			args = append(args, "-b", strconv.FormatInt(o.blockSize, 10))
+		}
+		if o.inodeSize != 0 {
+			if o.inodeSize < 128 || o.inodeSize > 4096 {
+				return nil, outOfRange(InodeSizeKey, o.inodeSize, 128, 4096)
+			}
+			args = append(args, "-I", strconv.FormatInt(o.inodeSize, 10))
+		}
+		if o.reservedBlocksPercent != "" {
+			args = append(args, "-m", o.reservedBlocksPercent)
+		}
+	case "xfs":
+		if o.blockSize != 0 {
+			if o.blockSize < 512 || o.blockSize > 4096 {
+				return nil, outOfRange(BlockSizeKey, o.blockSize, 512, 4096)
+			}
+			args = append(args, "-b", "size="+strconv.FormatInt(o.blockSize, 10))
+		}
+		if o.inodeSize != 0 {
+			if o.inodeSize < 256 || o.inodeSize > 2048 {
+				return nil, outOfRange(InodeSizeKey, o.inodeSize, 256, 2048)
+			}
+			args = append(args, "-i", "size="+strconv.FormatInt(o.inodeSize, 10))
+		}
+		if o.reservedBlocksPercent != "" {
+			return nil, unsupported(ReservedBlocksPercentKey)
+		}
+	case "btrfs":
+		if o.blockSize != 0 {
+			if o.blockSize < 4096 || o.blockSize > 65536 {
+				return nil, outOfRange(BlockSizeKey, o.blockSize, 4096, 65536)
+			}
+			args = append(args, "--sectorsize", strconv.FormatInt(o.blockSize, 10))
+		}
+		if o.inodeSize != 0 {
+			return nil, unsupported(InodeSizeKey)
+		}
+		if o.reservedBlocksPercent != "" {
+			return nil, unsupported(ReservedBlocksPercentKey)
+		}
+	default:
+		if !o.empty() {
+			return nil, fmt.Errorf("format options are not supported by filesystem %s", fsType)
+		}
+	}
+	return append(args, o.extra...), nil
+}
+
+// getMkfsArgs returns the mkfs arguments of the format options in the
+// volume context params for fsType
+func getMkfsArgs(fsType string, params map[string]string) ([]string, error) {
+	opts, err := parseFormatOptions(params)
+	if err != nil {
+		return nil, err
+	}
+	return opts.mkfsArgs(fsType)
+}
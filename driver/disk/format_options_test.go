@@ -0,0 +1,57 @@
+package driver
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_getMkfsArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		fsType  string
+		params  map[string]string
+		want    []string
+		wantErr bool
+	}{
+		{name: "ext4 default", fsType: "ext4", want: []string{"-F"}},
+		{
+			name:   "ext4 options",
+			fsType: "ext4",
+			params: map[string]string{BlockSizeKey: "4096", InodeSizeKey: "256", ReservedBlocksPercentKey: "0.5", MkfsOptionsKey: "-O ^metadata_csum  -L data"},
+			want:   []string{"-F", "-b", "4096", "-I", "256", "-m", "0.5", "-O", "^metadata_csum", "-L", "data"},
+		},
+		{name: "ext4 block size out of range", fsType: "ext4", params: map[string]string{BlockSizeKey: "65536"}, wantErr: true},
+		{name: "block size not a power of 2", fsType: "ext4", params: map[string]string{BlockSizeKey: "3000"}, wantErr: true},
+		{name: "reserved blocks out of range", fsType: "ext3", params: map[string]string{ReservedBlocksPercentKey: "60"}, wantErr: true},
+		{name: "xfs default", fsType: "xfs"},
+		{
+			name:   "xfs options",
+			fsType: "xfs",
+			params: map[string]string{BlockSizeKey: "4096", InodeSizeKey: "512", MkfsOptionsKey: "-m reflink=1"},
+			want:   []string{"-b", "size=4096", "-i", "size=512", "-m", "reflink=1"},
+		},
+		{name: "xfs reserved blocks", fsType: "xfs", params: map[string]string{ReservedBlocksPercentKey: "1"}, wantErr: true},
+		{
+			name:   "btrfs options",
+			fsType: "btrfs",
+			params: map[string]string{BlockSizeKey: "4096", MkfsOptionsKey: "--csum xxhash"},
+			want:   []string{"--sectorsize", "4096", "--csum", "xxhash"},
+		},
+		{name: "btrfs inode size", fsType: "btrfs", params: map[string]string{InodeSizeKey: "256"}, wantErr: true},
+		{name: "options of unknown filesystem", fsType: "vfat", params: map[string]string{MkfsOptionsKey: "-F 32"}, wantErr: true},
+		{name: "unknown filesystem", fsType: "vfat", params: map[string]string{"type": "SSD3.0"}},
+		{name: "mkfs options without option", fsType: "ext4", params: map[string]string{MkfsOptionsKey: "/dev/vdc"}, wantErr: true},
+		{name: "mkfs options with shell", fsType: "ext4", params: map[string]string{MkfsOptionsKey: "-L $(reboot)"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := getMkfsArgs(tt.fsType, tt.params)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getMkfsArgs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getMkfsArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,328 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	ebsClient "csi-plugin/pkg/ebs-client"
+	"csi-plugin/util"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// A volume group snapshot is a snapshot of each member volume, all created
+// together. EBS has no group of snapshots, so the group snapshot id is the
+// group name, and the snapshot of the i-th volume of the sorted source
+// volumes is named groupSnapshotMemberName(name, i).
+
+// groupControllerServiceCapabilities are advertised with the controller
+// service. The snapshots of a group are requested in parallel without
+// pausing the writes, so a group snapshot is not crash-consistent across its
+// volumes.
+var groupControllerServiceCapabilities = []csi.GroupControllerServiceCapability_RPC_Type{
+	csi.GroupControllerServiceCapability_RPC_CREATE_DELETE_GET_VOLUME_GROUP_SNAPSHOT,
+}
+
+func groupSnapshotMemberName(groupSnapshotID string, index int) string {
+	return fmt.Sprintf("%s-%d", groupSnapshotID, index)
+}
+
+// isGroupSnapshotMember returns whether snapshot is a member of the group
+func isGroupSnapshotMember(groupSnapshotID string, snapshot *ebsClient.Snapshot) bool {
+	index := strings.TrimPrefix(snapshot.SnapshotName, groupSnapshotID+"-")
+	if index == snapshot.SnapshotName || index == "" {
+		return false
+	}
+	for _, c := range index {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func (cs *KscEBSControllerServer) GroupControllerGetCapabilities(ctx context.Context, req *csi.GroupControllerGetCapabilitiesRequest) (*csi.GroupControllerGetCapabilitiesResponse, error) {
+	var caps []*csi.GroupControllerServiceCapability
+	for _, c := range groupControllerServiceCapabilities {
+		caps = append(caps, &csi.GroupControllerServiceCapability{
+			Type: &csi.GroupControllerServiceCapability_Rpc{
+				Rpc: &csi.GroupControllerServiceCapability_RPC{
+					Type: c,
+				},
+			},
+		})
+	}
+	return &csi.GroupControllerGetCapabilitiesResponse{Capabilities: caps}, nil
+}
+
+func (cs *KscEBSControllerServer) CreateVolumeGroupSnapshot(ctx context.Context, req *csi.CreateVolumeGroupSnapshotRequest) (*csi.CreateVolumeGroupSnapshotResponse, error) {
+	groupSnapshotID := req.GetName()
+	if groupSnapshotID == "" {
+		return nil, status.Error(codes.InvalidArgument, "CreateVolumeGroupSnapshot: group snapshot name must be provided")
+	}
+	if len(req.GetSourceVolumeIds()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "CreateVolumeGroupSnapshot: source volume ids must be provided")
+	}
+	sourceVolumeIDs := append([]string(nil), req.GetSourceVolumeIds()...)
+	sort.Strings(sourceVolumeIDs)
+	for i := 1; i < len(sourceVolumeIDs); i++ {
+		if sourceVolumeIDs[i] == sourceVolumeIDs[i-1] {
+			return nil, status.Errorf(codes.InvalidArgument, "CreateVolumeGroupSnapshot: duplicate source volume id %s", sourceVolumeIDs[i])
+		}
+	}
+	if acquired := cs.volumeLocks.TryAcquire(groupSnapshotID); !acquired {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, groupSnapshotID)
+	}
+	defer cs.volumeLocks.Release(groupSnapshotID)
+
+	ref := &v1.ObjectReference{
+		Kind:      "VolumeGroupSnapshot",
+		Name:      req.Parameters[VolumeGroupSnapshotNameKey],
+		Namespace: req.Parameters[VolumeGroupSnapshotNamespaceKey],
+	}
+	var params ebsClient.CreateSnapshotParams
+	if err := parseSnapshotParameters(req.Parameters, &params); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "CreateVolumeGroupSnapshot: %v", err)
+	}
+	klog.Infof("CreateVolumeGroupSnapshot:: Starting to create group snapshot %s of volumes %v", groupSnapshotID, sourceVolumeIDs)
+
+	// find the members created by a previous attempt, and check all the
+	// source volumes exist before creating any snapshot
+	members := make([]*ebsClient.Snapshot, len(sourceVolumeIDs))
+	volumes := make([]*ebsClient.Volume, len(sourceVolumeIDs))
+	for i, volumeID := range sourceVolumeIDs {
+		memberName := groupSnapshotMemberName(groupSnapshotID, i)
+		snapshotResp, snapNum, err := cs.ebsClient.GetSnapshotsByName(&ebsClient.DescribeSnapshotsReq{
+			SnapshotName: memberName,
+		})
+		switch {
+		case err != nil:
+			return nil, status.Errorf(codes.Internal, "CreateVolumeGroupSnapshot: failed to get snapshot %s: %v", memberName, err)
+		case snapNum > 1:
+			return nil, status.Errorf(codes.Internal, "CreateVolumeGroupSnapshot: get snapshot %s more than 1 instance", memberName)
+		case snapNum == 1:
+			if existing := snapshotResp.Snapshots[0]; existing.VolumeID != volumeID {
+				err := status.Errorf(codes.AlreadyExists, "CreateVolumeGroupSnapshot: group snapshot %s already exists with different source volumes", groupSnapshotID)
+				util.CreateEvent(cs.recorder, ref, v1.EventTypeWarning, groupSnapshotAlreadyExist, err.Error())
+				return nil, err
+			}
+			members[i] = snapshotResp.Snapshots[0]
+			continue
+		}
+		vol, err := cs.ebsClient.GetVolume(&ebsClient.ListVolumesReq{VolumeIds: []string{volumeID}})
+		if err != nil || vol == nil {
+			return nil, status.Errorf(codes.NotFound, "CreateVolumeGroupSnapshot: source volume %s not found: %v", volumeID, err)
+		}
+		volumes[i] = vol
+	}
+	// a member past the source volumes means the group has more volumes
+	extraName := groupSnapshotMemberName(groupSnapshotID, len(sourceVolumeIDs))
+	if _, snapNum, err := cs.ebsClient.GetSnapshotsByName(&ebsClient.DescribeSnapshotsReq{SnapshotName: extraName}); err != nil {
+		return nil, status.Errorf(codes.Internal, "CreateVolumeGroupSnapshot: failed to get snapshot %s: %v", extraName, err)
+	} else if snapNum > 0 {
+		err := status.Errorf(codes.AlreadyExists, "CreateVolumeGroupSnapshot: group snapshot %s already exists with different source volumes", groupSnapshotID)
+		util.CreateEvent(cs.recorder, ref, v1.EventTypeWarning, groupSnapshotAlreadyExist, err.Error())
+		return nil, err
+	}
+
+	// the snapshots are requested in parallel to keep them close in time,
+	// they are not crash-consistent, the writes between two snapshots are in
+	// one of them only
+	createAt := timestamppb.Now()
+	snapshotIDs := make([]string, len(sourceVolumeIDs))
+	errs := make([]error, len(sourceVolumeIDs))
+	var wg sync.WaitGroup
+	for i, volumeID := range sourceVolumeIDs {
+		if members[i] != nil {
+			snapshotIDs[i] = members[i].SnapshotID
+			continue
+		}
+		memberParams := params
+		memberParams.VolumeID = volumeID
+		memberParams.SnapshotName = groupSnapshotMemberName(groupSnapshotID, i)
+		wg.Add(1)
+		go func(i int, snapshotReq *ebsClient.CreateSnapshotReq) {
+			defer wg.Done()
+			resp, err := cs.ebsClient.CreateSnapshot(snapshotReq)
+			switch {
+			case err != nil:
+				errs[i] = err
+			case resp.SnapshotID == "":
+				errs[i] = fmt.Errorf("empty snapshot id")
+			default:
+				snapshotIDs[i] = resp.SnapshotID
+			}
+		}(i, requestAndCreateSnapshot(&memberParams))
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		msg := fmt.Sprintf("CreateVolumeGroupSnapshot: failed to create snapshot of volume %s for group snapshot %s: %v", sourceVolumeIDs[i], groupSnapshotID, err)
+		klog.Error(msg)
+		if rollbackErr := cs.deleteGroupSnapshotMembers(snapshotIDs); rollbackErr != nil {
+			klog.Errorf("CreateVolumeGroupSnapshot: failed to roll back group snapshot %s: %v", groupSnapshotID, rollbackErr)
+			msg = fmt.Sprintf("%s, and failed to roll back: %v", msg, rollbackErr)
+		}
+		util.CreateEvent(cs.recorder, ref, v1.EventTypeWarning, groupSnapshotCreateError, msg)
+		return nil, status.Error(codes.Internal, msg)
+	}
+
+	groupSnapshot := &csi.VolumeGroupSnapshot{
+		GroupSnapshotId: groupSnapshotID,
+		CreationTime:    createAt,
+		ReadyToUse:      true,
+	}
+	for i, volumeID := range sourceVolumeIDs {
+		var snapshot *csi.Snapshot
+		if members[i] != nil {
+			var err error
+			if snapshot, err = formatCSISnapshot(members[i]); err != nil {
+				return nil, err
+			}
+			if snapshot.CreationTime.AsTime().Before(groupSnapshot.CreationTime.AsTime()) {
+				groupSnapshot.CreationTime = snapshot.CreationTime
+			}
+		} else {
+			snapshot = &csi.Snapshot{
+				SnapshotId:     snapshotIDs[i],
+				SourceVolumeId: volumeID,
+				CreationTime:   createAt,
+				SizeBytes:      util.Gi2Bytes(volumes[i].Size),
+			}
+		}
+		snapshot.GroupSnapshotId = groupSnapshotID
+		groupSnapshot.ReadyToUse = groupSnapshot.ReadyToUse && snapshot.ReadyToUse
+		groupSnapshot.Snapshots = append(groupSnapshot.Snapshots, snapshot)
+	}
+
+	str := fmt.Sprintf("CreateVolumeGroupSnapshot:: Group snapshot %s of volumes %v created: %v", groupSnapshotID, sourceVolumeIDs, snapshotIDs)
+	klog.Info(str)
+	if groupSnapshot.ReadyToUse {
+		util.CreateEvent(cs.recorder, ref, v1.EventTypeNormal, groupSnapshotCreatedSuccessfully, str)
+	}
+	return &csi.CreateVolumeGroupSnapshotResponse{GroupSnapshot: groupSnapshot}, nil
+}
+
+func (cs *KscEBSControllerServer) DeleteVolumeGroupSnapshot(ctx context.Context, req *csi.DeleteVolumeGroupSnapshotRequest) (*csi.DeleteVolumeGroupSnapshotResponse, error) {
+	groupSnapshotID := req.GetGroupSnapshotId()
+	if groupSnapshotID == "" {
+		return nil, status.Error(codes.InvalidArgument, "DeleteVolumeGroupSnapshot: group snapshot id must be provided")
+	}
+	if len(req.GetSnapshotIds()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "DeleteVolumeGroupSnapshot: snapshot ids must be provided")
+	}
+	if acquired := cs.volumeLocks.TryAcquire(groupSnapshotID); !acquired {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, groupSnapshotID)
+	}
+	defer cs.volumeLocks.Release(groupSnapshotID)
+
+	snapshots, err := cs.getGroupSnapshotMembers(groupSnapshotID, req.GetSnapshotIds())
+	if err != nil {
+		return nil, err
+	}
+	snapshotIDs := make([]string, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		if snapshot != nil {
+			snapshotIDs = append(snapshotIDs, snapshot.SnapshotID)
+		}
+	}
+	ref := &v1.ObjectReference{
+		Kind: "VolumeGroupSnapshotContent",
+		Name: groupSnapshotID,
+	}
+	if err := cs.deleteGroupSnapshotMembers(snapshotIDs); err != nil {
+		msg := fmt.Sprintf("DeleteVolumeGroupSnapshot: failed to delete group snapshot %s: %v", groupSnapshotID, err)
+		util.CreateEvent(cs.recorder, ref, v1.EventTypeWarning, groupSnapshotDeleteError, msg)
+		return nil, status.Error(codes.Internal, msg)
+	}
+	str := fmt.Sprintf("DeleteVolumeGroupSnapshot:: Successfully delete group snapshot %s: %v", groupSnapshotID, snapshotIDs)
+	klog.Info(str)
+	util.CreateEvent(cs.recorder, ref, v1.EventTypeNormal, groupSnapshotDeletedSuccessfully, str)
+	return &csi.DeleteVolumeGroupSnapshotResponse{}, nil
+}
+
+func (cs *KscEBSControllerServer) GetVolumeGroupSnapshot(ctx context.Context, req *csi.GetVolumeGroupSnapshotRequest) (*csi.GetVolumeGroupSnapshotResponse, error) {
+	groupSnapshotID := req.GetGroupSnapshotId()
+	if groupSnapshotID == "" {
+		return nil, status.Error(codes.InvalidArgument, "GetVolumeGroupSnapshot: group snapshot id must be provided")
+	}
+	if len(req.GetSnapshotIds()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "GetVolumeGroupSnapshot: snapshot ids must be provided")
+	}
+	snapshots, err := cs.getGroupSnapshotMembers(groupSnapshotID, req.GetSnapshotIds())
+	if err != nil {
+		return nil, err
+	}
+
+	groupSnapshot := &csi.VolumeGroupSnapshot{
+		GroupSnapshotId: groupSnapshotID,
+		ReadyToUse:      true,
+	}
+	for i, snapshot := range snapshots {
+		if snapshot == nil {
+			return nil, status.Errorf(codes.NotFound, "GetVolumeGroupSnapshot: snapshot %s of group snapshot %s not found", req.GetSnapshotIds()[i], groupSnapshotID)
+		}
+		csiSnapshot, err := formatCSISnapshot(snapshot)
+		if err != nil {
+			return nil, err
+		}
+		csiSnapshot.GroupSnapshotId = groupSnapshotID
+		if groupSnapshot.CreationTime == nil || csiSnapshot.CreationTime.AsTime().Before(groupSnapshot.CreationTime.AsTime()) {
+			groupSnapshot.CreationTime = csiSnapshot.CreationTime
+		}
+		groupSnapshot.ReadyToUse = groupSnapshot.ReadyToUse && csiSnapshot.ReadyToUse
+		groupSnapshot.Snapshots = append(groupSnapshot.Snapshots, csiSnapshot)
+	}
+	return &csi.GetVolumeGroupSnapshotResponse{GroupSnapshot: groupSnapshot}, nil
+}
+
+// getGroupSnapshotMembers returns the snapshots of snapshotIDs, nil for the
+// snapshots not found, and an error if any of them is not in the group
+func (cs *KscEBSControllerServer) getGroupSnapshotMembers(groupSnapshotID string, snapshotIDs []string) ([]*ebsClient.Snapshot, error) {
+	snapshots := make([]*ebsClient.Snapshot, len(snapshotIDs))
+	for i, snapshotID := range snapshotIDs {
+		snapshot, err := cs.ebsClient.GetSnapshot(&ebsClient.DescribeSnapshotsReq{SnapshotId: snapshotID})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to get snapshot %s of group snapshot %s: %v", snapshotID, groupSnapshotID, err)
+		}
+		if snapshot == nil {
+			continue
+		}
+		if !isGroupSnapshotMember(groupSnapshotID, snapshot) {
+			return nil, status.Errorf(codes.InvalidArgument, "snapshot %s(%s) is not a member of group snapshot %s", snapshotID, snapshot.SnapshotName, groupSnapshotID)
+		}
+		snapshots[i] = snapshot
+	}
+	return snapshots, nil
+}
+
+// deleteGroupSnapshotMembers deletes the snapshots of snapshotIDs, empty ids
+// are skipped, it tries all of them and returns the first error
+func (cs *KscEBSControllerServer) deleteGroupSnapshotMembers(snapshotIDs []string) error {
+	var firstErr error
+	for _, snapshotID := range snapshotIDs {
+		if snapshotID == "" {
+			continue
+		}
+		if _, err := cs.ebsClient.DeleteSnapshots(&ebsClient.DeleteSnapshotsReq{SnapshotId: snapshotID}); err != nil {
+			klog.Errorf("deleteGroupSnapshotMembers: failed to delete snapshot %s: %v", snapshotID, err)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to delete snapshot %s: %v", snapshotID, err)
+			}
+			continue
+		}
+		klog.V(2).Infof("deleteGroupSnapshotMembers: snapshot %s deleted", snapshotID)
+	}
+	return firstErr
+}
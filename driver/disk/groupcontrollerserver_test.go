@@ -0,0 +1,175 @@
+package driver
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	ebsClient "csi-plugin/pkg/ebs-client"
+	"csi-plugin/util"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/client-go/tools/record"
+)
+
+func newGroupSnapshotTestServer(t *testing.T, volumes int) (*KscEBSControllerServer, *FakeStorageClient, []string) {
+	fakeClient := NewFakeStorageClient()
+	var volumeIDs []string
+	for i := 0; i < volumes; i++ {
+		resp, err := fakeClient.CreateVolume(&ebsClient.CreateVolumeReq{VolumeType: ESSD_PL1, Size: 20})
+		if err != nil {
+			t.Fatal(err)
+		}
+		volumeIDs = append(volumeIDs, resp.VolumeId)
+	}
+	cs := &KscEBSControllerServer{
+		ebsClient:   fakeClient,
+		recorder:    record.NewFakeRecorder(10),
+		volumeLocks: util.NewVolumeLocks(),
+	}
+	return cs, fakeClient, volumeIDs
+}
+
+func TestCreateVolumeGroupSnapshot(t *testing.T) {
+	cs, fakeClient, volumeIDs := newGroupSnapshotTestServer(t, 3)
+	ctx := context.Background()
+	req := &csi.CreateVolumeGroupSnapshotRequest{Name: "groupsnapshot-a", SourceVolumeIds: volumeIDs}
+
+	resp, err := cs.CreateVolumeGroupSnapshot(ctx, req)
+	if err != nil {
+		t.Fatalf("CreateVolumeGroupSnapshot() error = %v", err)
+	}
+	group := resp.GetGroupSnapshot()
+	if group.GroupSnapshotId != req.Name || len(group.Snapshots) != len(volumeIDs) {
+		t.Fatalf("group snapshot = %+v, want %d snapshots of %s", group, len(volumeIDs), req.Name)
+	}
+	sources := map[string]bool{}
+	var snapshotIDs []string
+	for _, snapshot := range group.Snapshots {
+		sources[snapshot.SourceVolumeId] = true
+		snapshotIDs = append(snapshotIDs, snapshot.SnapshotId)
+		if snapshot.GroupSnapshotId != req.Name {
+			t.Errorf("snapshot %s group = %q, want %q", snapshot.SnapshotId, snapshot.GroupSnapshotId, req.Name)
+		}
+	}
+	if len(sources) != len(volumeIDs) || len(fakeClient.snapshots) != len(volumeIDs) {
+		t.Fatalf("snapshots of %v, %d created, want one of each of %v", sources, len(fakeClient.snapshots), volumeIDs)
+	}
+
+	// retried with the volumes in another order
+	retry := &csi.CreateVolumeGroupSnapshotRequest{Name: req.Name, SourceVolumeIds: []string{volumeIDs[2], volumeIDs[0], volumeIDs[1]}}
+	resp, err = cs.CreateVolumeGroupSnapshot(ctx, retry)
+	if err != nil {
+		t.Fatalf("retried CreateVolumeGroupSnapshot() error = %v", err)
+	}
+	if !resp.GetGroupSnapshot().ReadyToUse || len(fakeClient.snapshots) != len(volumeIDs) {
+		t.Errorf("retried group snapshot ready = %v with %d snapshots, want ready with %d", resp.GetGroupSnapshot().ReadyToUse, len(fakeClient.snapshots), len(volumeIDs))
+	}
+
+	// the same name with a part of the volumes, either end of the sorted ones
+	sorted := append([]string(nil), volumeIDs...)
+	sort.Strings(sorted)
+	for _, volumes := range [][]string{sorted[1:], sorted[:2]} {
+		_, err = cs.CreateVolumeGroupSnapshot(ctx, &csi.CreateVolumeGroupSnapshotRequest{Name: req.Name, SourceVolumeIds: volumes})
+		if status.Code(err) != codes.AlreadyExists {
+			t.Errorf("CreateVolumeGroupSnapshot() with volumes %v error = %v, want AlreadyExists", volumes, err)
+		}
+	}
+
+	getResp, err := cs.GetVolumeGroupSnapshot(ctx, &csi.GetVolumeGroupSnapshotRequest{GroupSnapshotId: req.Name, SnapshotIds: snapshotIDs})
+	if err != nil {
+		t.Fatalf("GetVolumeGroupSnapshot() error = %v", err)
+	}
+	if !getResp.GetGroupSnapshot().ReadyToUse || len(getResp.GetGroupSnapshot().Snapshots) != len(snapshotIDs) {
+		t.Errorf("GetVolumeGroupSnapshot() = %+v, want %d ready snapshots", getResp.GetGroupSnapshot(), len(snapshotIDs))
+	}
+
+	_, err = cs.DeleteVolumeGroupSnapshot(ctx, &csi.DeleteVolumeGroupSnapshotRequest{GroupSnapshotId: req.Name})
+	if status.Code(err) != codes.InvalidArgument || len(fakeClient.snapshots) != len(snapshotIDs) {
+		t.Errorf("DeleteVolumeGroupSnapshot() without snapshot ids error = %v with %d snapshots left, want InvalidArgument", err, len(fakeClient.snapshots))
+	}
+	_, err = cs.DeleteVolumeGroupSnapshot(ctx, &csi.DeleteVolumeGroupSnapshotRequest{GroupSnapshotId: "groupsnapshot-b", SnapshotIds: snapshotIDs})
+	if status.Code(err) != codes.InvalidArgument || len(fakeClient.snapshots) != len(snapshotIDs) {
+		t.Errorf("DeleteVolumeGroupSnapshot() of another group error = %v with %d snapshots left, want InvalidArgument", err, len(fakeClient.snapshots))
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := cs.DeleteVolumeGroupSnapshot(ctx, &csi.DeleteVolumeGroupSnapshotRequest{GroupSnapshotId: req.Name, SnapshotIds: snapshotIDs}); err != nil {
+			t.Fatalf("DeleteVolumeGroupSnapshot() %d error = %v", i, err)
+		}
+	}
+	if len(fakeClient.snapshots) != 0 {
+		t.Errorf("%d snapshots left after DeleteVolumeGroupSnapshot()", len(fakeClient.snapshots))
+	}
+}
+
+func TestCreateVolumeGroupSnapshotRollback(t *testing.T) {
+	cs, fakeClient, volumeIDs := newGroupSnapshotTestServer(t, 3)
+	fakeClient.snapshotErrVolumes = map[string]bool{volumeIDs[1]: true}
+
+	_, err := cs.CreateVolumeGroupSnapshot(context.Background(), &csi.CreateVolumeGroupSnapshotRequest{Name: "groupsnapshot-a", SourceVolumeIds: volumeIDs})
+	if status.Code(err) != codes.Internal {
+		t.Fatalf("CreateVolumeGroupSnapshot() error = %v, want Internal", err)
+	}
+	if len(fakeClient.snapshots) != 0 {
+		t.Errorf("%d snapshots left after the failed group snapshot, want rolled back", len(fakeClient.snapshots))
+	}
+
+	tests := []struct {
+		name     string
+		req      *csi.CreateVolumeGroupSnapshotRequest
+		wantCode codes.Code
+	}{
+		{
+			name:     "no name",
+			req:      &csi.CreateVolumeGroupSnapshotRequest{SourceVolumeIds: volumeIDs},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "no volumes",
+			req:      &csi.CreateVolumeGroupSnapshotRequest{Name: "groupsnapshot-b"},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "duplicate volumes",
+			req:      &csi.CreateVolumeGroupSnapshotRequest{Name: "groupsnapshot-b", SourceVolumeIds: []string{volumeIDs[0], volumeIDs[0]}},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "volume not found",
+			req:      &csi.CreateVolumeGroupSnapshotRequest{Name: "groupsnapshot-b", SourceVolumeIds: []string{volumeIDs[0], "not-exist"}},
+			wantCode: codes.NotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := cs.CreateVolumeGroupSnapshot(context.Background(), tt.req)
+			if status.Code(err) != tt.wantCode {
+				t.Errorf("CreateVolumeGroupSnapshot() error = %v, want %v", err, tt.wantCode)
+			}
+			if len(fakeClient.snapshots) != 0 {
+				t.Errorf("%d snapshots created", len(fakeClient.snapshots))
+			}
+		})
+	}
+}
+
+func Test_isGroupSnapshotMember(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "groupsnapshot-a-0", want: true},
+		{name: "groupsnapshot-a-12", want: true},
+		{name: "groupsnapshot-a-", want: false},
+		{name: "groupsnapshot-a-b-0", want: false},
+		{name: "groupsnapshot-ab-0", want: false},
+		{name: "clone-disk-0", want: false},
+	}
+	for _, tt := range tests {
+		if got := isGroupSnapshotMember("groupsnapshot-a", &ebsClient.Snapshot{SnapshotName: tt.name}); got != tt.want {
+			t.Errorf("isGroupSnapshotMember(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -6,15 +6,20 @@ import (
 )
 
 type IdentityServer struct {
+	csi.UnimplementedIdentityServer
+
 	driverName string
 	version    string
 	ready      bool
+	// groupController is whether the group controller service is served
+	groupController bool
 }
 
 func GetIdentityServer(config *Config) *IdentityServer {
 	return &IdentityServer{
-		driverName: config.DriverName,
-		version:    config.Version,
+		driverName:      config.DriverName,
+		version:         config.Version,
+		groupController: config.EnableControllerServer,
 	}
 }
 
@@ -45,6 +50,17 @@ func (d *IdentityServer) GetPluginCapabilities(ctx context.Context, req *csi.Get
 			},
 		},
 	}
+	// the group snapshots are not crash-consistent, see
+	// groupControllerServiceCapabilities
+	if d.groupController {
+		resp.Capabilities = append(resp.Capabilities, &csi.PluginCapability{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_GROUP_CONTROLLER_SERVICE,
+				},
+			},
+		})
+	}
 	return resp, nil
 }
 
@@ -1,62 +1,58 @@
 package driver
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
 
 	"k8s.io/klog/v2"
 	mountutils "k8s.io/mount-utils"
+	utilexec "k8s.io/utils/exec"
 )
 
-type findmntResponse struct {
-	FileSystems []fileSystem `json:"filesystems"`
-}
-
-type fileSystem struct {
-	Target      string `json:"target"`
-	Propagation string `json:"propagation"`
-	FsType      string `json:"fstype"`
-	Options     string `json:"options"`
-}
-
 // Mounter is responsible for formatting and mounting volumes
 type Mounter interface {
-	// Format formats the source with the given filesystem type
-	Format(source, fsType string) error
-
-	// Mount mounts source to target with the given fstype and options.
-	Mount(source, target, fsType string, options ...string) error
+	mountutils.Interface
 
-	// Unmount unmounts the given target
-	Unmount(target string) error
+	// FormatAndMount formats source with fsType and mkfsArgs when it has no
+	// filesystem, then checks and mounts it to target with options
+	FormatAndMount(source, target, fsType string, options, mkfsArgs []string) error
 
-	// IsFormatted checks whether the source device is formatted or not. It
-	// returns true if the source device is already formatted.
-	IsFormatted(source string) (bool, error)
+	// MountBlock bind mounts the block device source to the file target,
+	// creating the file if it does not exist.
+	MountBlock(source, target string, options []string) error
 
-	// IsMounted checks whether the target path is a correct mount (i.e:
-	// propagated). It returns true if it's mounted. An error is returned in
-	// case of system errors or if it's mounted incorrectly.
+	// IsMounted returns whether target is a mount point, bind mounts
+	// included. A target that does not exist is not mounted.
 	IsMounted(target string) (bool, error)
-	//Expand FileSystem only xfs and ext*(2,3,4) support expand
-	Expand(fsType, source string) (bool, error)
+
+	// Resize grows the filesystem of devicePath mounted at deviceMountPath
+	// to the size of the device, ext3, ext4, xfs and btrfs are grown online
+	Resize(devicePath, deviceMountPath string) (bool, error)
 
 	PathExists(path string) (bool, error)
+
+	// GetBlockSizeBytes returns the size of the block device in bytes
+	GetBlockSizeBytes(devicePath string) (int64, error)
 }
 
-// TODO(arslan): this is Linux only for now. Refactor this into a package with
-// architecture specific code in the future, such as mounter_darwin.go,
-// mounter_linux.go, etc..
+// mounter formats, mounts and resizes with mount-utils, the commands are
+// run by its Exec
 type mounter struct {
+	*mountutils.SafeFormatAndMount
 }
 
 // newMounter returns a new mounter instance
 func newMounter() *mounter {
-	return &mounter{}
+	return &mounter{
+		SafeFormatAndMount: &mountutils.SafeFormatAndMount{
+			Interface: mountutils.New(""),
+			Exec:      utilexec.New(),
+		},
+	}
 }
 
 // This function is mirrored in ./sanity_test.go to make sure sanity test covered this block of code
@@ -65,173 +61,72 @@ func (m *mounter) PathExists(path string) (bool, error) {
 	return mountutils.PathExists(path)
 }
 
-func (m *mounter) Format(source, fsType string) error {
-	mkfsCmd := fmt.Sprintf("mkfs.%s", fsType)
-
-	_, err := exec.LookPath(mkfsCmd)
-	if err != nil {
-		if err == exec.ErrNotFound {
-			return fmt.Errorf("%q executable not found in $PATH", mkfsCmd)
-		}
+// Mount creates the target directory and mounts source to it
+func (m *mounter) Mount(source, target, fsType string, options []string) error {
+	// 0755 保持与kubelet 创建目录文件权限一致
+	if err := os.MkdirAll(target, os.FileMode(0755)); err != nil {
 		return err
 	}
+	return m.Interface.Mount(source, target, fsType, options)
+}
 
-	mkfsArgs := []string{}
-
+func (m *mounter) FormatAndMount(source, target, fsType string, options, mkfsArgs []string) error {
 	if fsType == "" {
 		return errors.New("fs type is not specified for formatting the volume")
 	}
-
 	if source == "" {
 		return errors.New("source is not specified for formatting the volume")
 	}
 
-	mkfsArgs = append(mkfsArgs, source)
-	if fsType == "ext4" || fsType == "ext3" {
-		mkfsArgs = []string{"-F", source}
-	}
-
-	klog.V(2).Infof("executing format command, cmd: %v, args: %v", mkfsCmd, mkfsArgs)
-	out, err := exec.Command(mkfsCmd, mkfsArgs...).CombinedOutput()
-	if err != nil {
-		//  TODO error:
-		/**
-		formatting disk failed:
-		exit status 1
-		cmd: 'mkfs.ext4 -F /dev/disk/by-id/virtio-04eb4eb8-9894-417f-8'
-		output: "mke2fs 1.45.2 (27-May-2019)\nThe file /dev/disk/by-id/virtio-04eb4eb8-9894-417f-8 does not exist and no size was specified.
-		*/
-		// test exec partprobe
-		return fmt.Errorf("formatting disk failed: %v cmd: '%s %s' output: %q",
-			err, mkfsCmd, strings.Join(mkfsArgs, " "), string(out))
-	}
-
-	return nil
-}
-
-func (m *mounter) Mount(source, target, fsType string, opts ...string) error {
-	mountCmd := "mount"
-	mountArgs := []string{}
-
-	if fsType == "" {
-		return errors.New("fs type is not specified for mounting the volume")
-	}
-
-	if source == "" {
-		return errors.New("source is not specified for mounting the volume")
-	}
-
-	if target == "" {
-		return errors.New("target is not specified for mounting the volume")
-	}
-
-	mountArgs = append(mountArgs, "-t", fsType)
-
-	if len(opts) > 0 {
-		mountArgs = append(mountArgs, "-o", strings.Join(opts, ","))
-	}
-
-	mountArgs = append(mountArgs, source)
-	mountArgs = append(mountArgs, target)
-
-	// create target, os.Mkdirall is noop if it exists
-	// 0755 保持与kubelet 创建目录文件权限一致
-	// 0777 暂时兼容非root权限使用csi的fsgroup不生效,导致无法读写的问题
-	err := os.MkdirAll(target, os.FileMode(0755))
+	existingFormat, err := m.GetDiskFormat(source)
 	if err != nil {
 		return err
 	}
-
-	fileinfo, err := os.Stat(source)
-	if err != nil {
-		return err
-	}
-	mode10 := uint32(fileinfo.Mode().Perm())
-	// if mode10 == 493 || mode10 == 488 {
-	// 	out, err := exec.Command("chmod", []string{"777", target}...).CombinedOutput()
-	// 	if err != nil {
-	// 		return fmt.Errorf("chmod failed: %v cmd: '%s %s' output: %q",
-	// 			err, mountCmd, strings.Join(mountArgs, " "), string(out))
-	// 	}
-
-	// 	out, err = exec.Command("chmod", []string{"g+s", target}...).CombinedOutput()
-	// 	if err != nil {
-	// 		return fmt.Errorf("chmod failed: %v cmd: '%s %s' output: %q",
-	// 			err, mountCmd, strings.Join(mountArgs, " "), string(out))
-	// 	}
-
-	// }
-	// fileinfo, _ = os.Stat(target)
-	klog.V(5).Infof("source mode: %d", mode10)
-	klog.V(2).Infof("executing mount command, cmd: %v, args: %v", mountCmd, mountArgs)
-	//err = syscall.Mount(source, target, fsType, 0, "")
-	out, err := exec.Command(mountCmd, mountArgs...).CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("mounting failed: %v cmd: '%s %s' output: %q",
-			err, mountCmd, strings.Join(mountArgs, " "), string(out))
-	}
-
-	// fsGroup 不生效
-	if mode10 < 511 {
-		out, err := exec.Command("chmod", []string{"777", target}...).CombinedOutput()
-		if err != nil {
-			return fmt.Errorf("chmod failed: %v cmd: '%s %s' output: %q",
-				err, mountCmd, strings.Join(mountArgs, " "), string(out))
-		}
-
-		out, err = exec.Command("chmod", []string{"g+s", target}...).CombinedOutput()
+	// a read-only disk is not formatted, SafeFormatAndMount refuses to mount
+	// it unformatted
+	if existingFormat == "" && !hasOption(options, "ro") {
+		mkfsCmd := "mkfs." + fsType
+		args := append(append([]string{}, mkfsArgs...), source)
+		klog.V(2).Infof("executing format command, cmd: %v, args: %v", mkfsCmd, args)
+		out, err := m.Exec.Command(mkfsCmd, args...).CombinedOutput()
 		if err != nil {
-			return fmt.Errorf("chmod failed: %v cmd: '%s %s' output: %q",
-				err, mountCmd, strings.Join(mountArgs, " "), string(out))
+			return fmt.Errorf("formatting disk failed: %v cmd: '%s %s' output: %q",
+				err, mkfsCmd, strings.Join(args, " "), string(out))
 		}
-
+	} else if existingFormat != "" {
+		klog.V(2).Infof("source device %s is already formatted as %s", source, existingFormat)
 	}
 
-	return nil
+	if err := os.MkdirAll(target, os.FileMode(0755)); err != nil {
+		return err
+	}
+	// the filesystem is checked and repaired before it is mounted
+	return m.SafeFormatAndMount.FormatAndMount(source, target, fsType, options)
 }
 
-func (m *mounter) Unmount(target string) error {
-	umountCmd := "umount"
-	if target == "" {
-		return errors.New("target is not specified for unmounting the volume")
+func (m *mounter) MountBlock(source, target string, options []string) error {
+	if source == "" {
+		return errors.New("source is not specified for mounting the block volume")
 	}
 
-	umountArgs := []string{target}
-
-	klog.V(2).Infof("executing umount command, cmd: %v, args: %v", umountCmd, umountArgs)
-	out, err := exec.Command(umountCmd, umountArgs...).CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("unmounting failed: %v cmd: '%s %s' output: %q",
-			err, umountCmd, target, string(out))
+	if target == "" {
+		return errors.New("target is not specified for mounting the block volume")
 	}
-	klog.V(2).Infof("executing umount command result: %s", string(out))
-	return nil
-}
 
-func (m *mounter) IsFormatted(source string) (bool, error) {
-	if source == "" {
-		return false, errors.New("source is not specified")
+	// the target of a raw block volume is a file, the parent directory is
+	// created with the same permission as kubelet does
+	if err := os.MkdirAll(filepath.Dir(target), os.FileMode(0750)); err != nil {
+		return err
 	}
-
-	blkidCmd := "blkid"
-	_, err := exec.LookPath(blkidCmd)
+	file, err := os.OpenFile(target, os.O_CREATE, os.FileMode(0660))
 	if err != nil {
-		if err == exec.ErrNotFound {
-			return false, fmt.Errorf("%q executable not found in $PATH", blkidCmd)
-		}
-		return false, err
+		return fmt.Errorf("failed to create block target file %q: %v", target, err)
 	}
-
-	blkidArgs := []string{source}
-
-	klog.V(5).Infof("checking if source is formatted, cmd: %v, args: %v", blkidCmd, blkidArgs)
-	out, _ := exec.Command(blkidCmd, blkidArgs...).CombinedOutput()
-	klog.V(2).Infof("exec blkid cmd, return %s.", string(out))
-	if strings.TrimSpace(string(out)) == "" {
-		return false, nil
+	if err := file.Close(); err != nil {
+		return err
 	}
 
-	return true, nil
+	return m.Interface.Mount(source, target, "", append([]string{"bind"}, options...))
 }
 
 func (m *mounter) IsMounted(target string) (bool, error) {
@@ -239,83 +134,35 @@ func (m *mounter) IsMounted(target string) (bool, error) {
 		return false, errors.New("target is not specified for checking the mount")
 	}
 
-	findmntCmd := "findmnt"
-	_, err := exec.LookPath(findmntCmd)
+	notMnt, err := mountutils.IsNotMountPoint(m.Interface, target)
 	if err != nil {
-		if err == exec.ErrNotFound {
-			return false, fmt.Errorf("%q executable not found in $PATH", findmntCmd)
-		}
-		return false, err
-	}
-
-	findmntArgs := []string{"-o", "TARGET,PROPAGATION,FSTYPE,OPTIONS", "-M", target, "-J"}
-
-	klog.V(5).Infof("checking if target is mounted, cmd: %v, args: %v", findmntCmd, findmntArgs)
-	out, err := exec.Command(findmntCmd, findmntArgs...).CombinedOutput()
-	if err != nil {
-		// findmnt exits with non zero exit status if it couldn't find anything
-		if strings.TrimSpace(string(out)) == "" {
+		if os.IsNotExist(err) {
 			return false, nil
 		}
-
-		return false, fmt.Errorf("checking mounted failed: %v cmd: %q output: %q",
-			err, findmntCmd, string(out))
+		return false, fmt.Errorf("checking mounted %s failed: %v", target, err)
 	}
+	return !notMnt, nil
+}
 
-	// no response means there is no mount
-	if string(out) == "" {
-		return false, nil
-	}
+func (m *mounter) Resize(devicePath, deviceMountPath string) (bool, error) {
+	return mountutils.NewResizeFs(m.Exec).Resize(devicePath, deviceMountPath)
+}
 
-	var resp *findmntResponse
-	err = json.Unmarshal(out, &resp)
-	if err != nil {
-		return false, fmt.Errorf("couldn't unmarshal data: %q: %s", string(out), err)
+func (m *mounter) GetBlockSizeBytes(devicePath string) (int64, error) {
+	blockdevCmd := "blockdev"
+	if devicePath == "" {
+		return 0, errors.New("device path is not specified")
 	}
 
-	targetFound := false
-	for _, fs := range resp.FileSystems {
-		// check if the mount is propagated correctly. It should be set to shared.
-		if fs.Propagation != "shared" {
-			return true, fmt.Errorf("mount propagation for target %q is not enabled", target)
-		}
-
-		// the mountpoint should match as well
-		if fs.Target == target {
-			targetFound = true
-		}
+	out, err := m.Exec.Command(blockdevCmd, "--getsize64", devicePath).CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("getting block size failed: %v cmd: '%s --getsize64 %s' output: %q",
+			err, blockdevCmd, devicePath, string(out))
 	}
 
-	return targetFound, nil
-}
-
-// Expand 当前扩容文件系统方式是： 扩展裸盘文件系统
-func (m *mounter) Expand(fsType, source string) (bool, error) {
-	expandCmdForEXT := "resize2fs"
-	expandCmdForXFS := "xfs_growfs"
-	if fsType == "xfs" {
-		out, err := exec.Command(expandCmdForXFS, []string{source}...).CombinedOutput()
-		if err != nil {
-			if strings.TrimSpace(string(out)) == "" {
-				return false, nil
-			}
-			return false, fmt.Errorf("xfs filesystem expand failed: %v cmd: %q output: %q",
-				err, expandCmdForXFS, string(out))
-		} else {
-			return true, nil
-		}
-	}
-	if fsType == "ext4" || fsType == "ext3" || fsType == "ext2" {
-		out, err := exec.Command(expandCmdForEXT, []string{source}...).CombinedOutput()
-		if err != nil {
-			if strings.TrimSpace(string(out)) == "" {
-				return false, nil
-			}
-			return false, fmt.Errorf("ext filesystem expand failed: %v cmd: %q output: %q",
-				err, expandCmdForEXT, string(out))
-		} else {
-			return true, nil
-		}
+	size, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse size %q of device %s: %v", string(out), devicePath, err)
 	}
-	return false, errors.New("not supported fs type")
+	return size, nil
 }
@@ -0,0 +1,117 @@
+package driver
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	mountutils "k8s.io/mount-utils"
+	utilexec "k8s.io/utils/exec"
+	testingexec "k8s.io/utils/exec/testing"
+)
+
+// newTestMounter returns a mounter on a fake mount table running the
+// scripted commands, the command lines run are appended to commands
+func newTestMounter(script []testingexec.FakeAction, commands *[]string) *mounter {
+	fakeExec := &testingexec.FakeExec{}
+	for _, action := range script {
+		action := action
+		fakeExec.CommandScript = append(fakeExec.CommandScript, func(cmd string, args ...string) utilexec.Cmd {
+			*commands = append(*commands, fmt.Sprint(append([]string{cmd}, args...)))
+			fakeCmd := &testingexec.FakeCmd{CombinedOutputScript: []testingexec.FakeAction{action}}
+			return testingexec.InitFakeCmd(fakeCmd, cmd, args...)
+		})
+	}
+	return &mounter{
+		SafeFormatAndMount: &mountutils.SafeFormatAndMount{
+			Interface: mountutils.NewFakeMounter(nil),
+			Exec:      fakeExec,
+		},
+	}
+}
+
+func TestMounterFormatAndMount(t *testing.T) {
+	const source = "/dev/vdb"
+	unformatted := func() ([]byte, []byte, error) { return nil, nil, testingexec.FakeExitError{Status: 2} }
+	formatted := func() ([]byte, []byte, error) { return []byte("TYPE=ext4\n"), nil, nil }
+	succeeded := func() ([]byte, []byte, error) { return nil, nil, nil }
+
+	tests := []struct {
+		name         string
+		options      []string
+		script       []testingexec.FakeAction
+		wantCommands []string
+		wantErr      bool
+	}{
+		{
+			name:   "unformatted",
+			script: []testingexec.FakeAction{unformatted, succeeded, formatted, succeeded},
+			wantCommands: []string{
+				"[blkid -p -s TYPE -s PTTYPE -o export /dev/vdb]",
+				"[mkfs.ext4 -F -b 4096 /dev/vdb]",
+				"[blkid -p -s TYPE -s PTTYPE -o export /dev/vdb]",
+				"[fsck -a /dev/vdb]",
+			},
+		},
+		{
+			name:   "formatted",
+			script: []testingexec.FakeAction{formatted, formatted, succeeded},
+			wantCommands: []string{
+				"[blkid -p -s TYPE -s PTTYPE -o export /dev/vdb]",
+				"[blkid -p -s TYPE -s PTTYPE -o export /dev/vdb]",
+				"[fsck -a /dev/vdb]",
+			},
+		},
+		{
+			name:    "unformatted read-only",
+			options: []string{"ro"},
+			script:  []testingexec.FakeAction{unformatted, unformatted},
+			wantCommands: []string{
+				"[blkid -p -s TYPE -s PTTYPE -o export /dev/vdb]",
+				"[blkid -p -s TYPE -s PTTYPE -o export /dev/vdb]",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var commands []string
+			m := newTestMounter(tt.script, &commands)
+			target := filepath.Join(t.TempDir(), "globalmount")
+
+			err := m.FormatAndMount(source, target, "ext4", tt.options, []string{"-F", "-b", "4096"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("FormatAndMount() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(commands, tt.wantCommands) {
+				t.Errorf("FormatAndMount() ran %q, want %q", commands, tt.wantCommands)
+			}
+			if mounted, err := m.IsMounted(target); err != nil || mounted == tt.wantErr {
+				t.Errorf("IsMounted() after FormatAndMount() = %v, %v, want %v", mounted, err, !tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMounterIsMounted(t *testing.T) {
+	var commands []string
+	m := newTestMounter(nil, &commands)
+	target := filepath.Join(t.TempDir(), "mount")
+
+	if mounted, err := m.IsMounted(target); err != nil || mounted {
+		t.Errorf("IsMounted() of a missing target = %v, %v, want false", mounted, err)
+	}
+	if err := m.Mount("/var/lib/kubelet/plugins/globalmount", target, "ext4", []string{"bind", "ro"}); err != nil {
+		t.Fatalf("Mount() error = %v", err)
+	}
+	if mounted, err := m.IsMounted(target); err != nil || !mounted {
+		t.Errorf("IsMounted() of a bind mount = %v, %v, want true", mounted, err)
+	}
+	if err := m.Unmount(target); err != nil {
+		t.Fatalf("Unmount() error = %v", err)
+	}
+	if mounted, err := m.IsMounted(target); err != nil || mounted {
+		t.Errorf("IsMounted() after Unmount() = %v, %v, want false", mounted, err)
+	}
+}
@@ -31,6 +31,8 @@ const (
 )
 
 type NodeServer struct {
+	csi.UnimplementedNodeServer
+
 	config Config
 
 	sync.Mutex
@@ -40,6 +42,7 @@ type NodeServer struct {
 	zone              string
 	maxVolumesPerNode int64
 	mounter           Mounter
+	health            *VolumeHealthChecker
 }
 
 // GetNodeServer create node server
@@ -79,7 +82,9 @@ func GetNodeServer(cfg *Config) *NodeServer {
 		nodeID:            instanceUUID,
 		mounter:           newMounter(),
 		maxVolumesPerNode: maxVolumesNum,
+		health:            NewVolumeHealthChecker(),
 	}
+	go nodeServer.health.WatchKernelLog(context.Background())
 
 	k8sCli := cfg.K8sClient
 	node, err := k8sCli.CoreV1().Nodes().Get(context.Background(), nodeName, meta_v1.GetOptions{})
@@ -132,6 +137,7 @@ func (d *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolu
 
 		//Introduce a delay to allow the file system to update its status
 		time.Sleep(3 * time.Second)
+		source = getDiskSource(req.VolumeId, req.VolumeContext["type"])
 	}
 
 	ok, err = mountutils.PathExists(source)
@@ -139,6 +145,13 @@ func (d *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolu
 		return nil, status.Errorf(codes.NotFound, "failed to check if path %q exists: %v", source, err)
 	}
 
+	// raw block volumes are published straight from the device, there is
+	// nothing to format or mount on the staging path
+	if isBlockCapability(req.VolumeCapability) {
+		klog.V(2).Infof("volume %s is a block volume, skipping format and mount for staging", req.VolumeId)
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
 	//source := devMountPoint
 	target := req.StagingTargetPath
 
@@ -150,38 +163,33 @@ func (d *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolu
 		fsType = mnt.FsType
 	}
 
-	_, ok = req.GetVolumeContext()[annNoFormatVolume]
-	if !ok {
-		d.Lock()
-		defer d.Unlock()
-		formatted, err := d.mounter.IsFormatted(source)
+	_, noFormat := req.GetVolumeContext()[annNoFormatVolume]
+	var mkfsArgs []string
+	if !noFormat {
+		mkfsArgs, err = getMkfsArgs(fsType, req.GetVolumeContext())
 		if err != nil {
-			return nil, err
-		}
-
-		if !formatted {
-			klog.V(5).Info("formatting the volume for staging")
-			if err := d.mounter.Format(source, fsType); err != nil {
-				return nil, status.Error(codes.Internal, err.Error())
-			}
-		} else {
-			klog.V(2).Info("source device is already formatted")
+			return nil, status.Errorf(codes.InvalidArgument, "NodeStageVolume: invalid format options of volume %s: %v", req.VolumeId, err)
 		}
-
-	} else {
-		klog.V(2).Info("skipping formatting the source device")
 	}
+
 	klog.V(5).Info("mounting the volume for staging")
 	mounted, err := d.mounter.IsMounted(target)
 	if err != nil {
 		return nil, err
 	}
-	if !mounted {
-		if err := d.mounter.Mount(source, target, fsType, options...); err != nil {
+	if mounted {
+		klog.V(2).Info("source device is already mounted to the target path")
+	} else if noFormat {
+		klog.V(2).Info("skipping formatting the source device")
+		if err := d.mounter.Mount(source, target, fsType, options); err != nil {
 			return nil, status.Error(codes.Internal, err.Error())
 		}
 	} else {
-		klog.V(2).Info("source device is already mounted to the target path")
+		d.Lock()
+		defer d.Unlock()
+		if err := d.mounter.FormatAndMount(source, target, fsType, options, mkfsArgs); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
 	}
 	klog.V(2).Info("formatting and mounting stage volume is finished")
 	return &csi.NodeStageVolumeResponse{}, nil
@@ -252,6 +260,11 @@ func (d *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublish
 	if req.VolumeCapability == nil {
 		return nil, status.Error(codes.InvalidArgument, "NodePublishVolume Volume Capability must be provided")
 	}
+
+	if isBlockCapability(req.VolumeCapability) {
+		return d.nodePublishBlockVolume(req)
+	}
+
 	source := req.StagingTargetPath
 	target := req.TargetPath
 
@@ -261,10 +274,26 @@ func (d *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublish
 	// TODO(arslan): do we need bind here? check it out
 	// Perform a bind mount to the full path to allow duplicate mounts of the same PD.
 	options = append(options, "bind")
-	if req.Readonly {
+	readOnly := req.Readonly || isReadOnlyCapability(req.VolumeCapability)
+	if readOnly {
 		options = append(options, "ro")
 	}
 
+	// kubelet passes the fsGroup of the pod instead of changing the
+	// ownership itself, the filesystem is given to the group on the staging
+	// path before it is bind mounted to the target
+	if group := mnt.GetVolumeMountGroup(); group != "" {
+		gid, err := parseVolumeMountGroup(group)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if readOnly {
+			klog.V(2).Infof("volume %s is published read-only, skipping the ownership of group %d", req.VolumeId, gid)
+		} else if err := setVolumeOwnership(source, gid); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to set the ownership of volume %s to group %d: %v", req.VolumeId, gid, err)
+		}
+	}
+
 	fsType := "ext4"
 	if mnt.FsType != "" {
 		fsType = mnt.FsType
@@ -277,7 +306,7 @@ func (d *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublish
 
 	if !mounted {
 		klog.V(5).Info("mounting the volume")
-		if err := d.mounter.Mount(source, target, fsType, options...); err != nil {
+		if err := d.mounter.Mount(source, target, fsType, options); err != nil {
 			return nil, status.Error(codes.Internal, err.Error())
 		}
 	} else {
@@ -288,6 +317,39 @@ func (d *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublish
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
+// nodePublishBlockVolume bind mounts the attached device to the target file
+func (d *NodeServer) nodePublishBlockVolume(req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	source := getDiskSource(req.VolumeId, req.VolumeContext["type"])
+	target := req.TargetPath
+
+	ok, err := d.mounter.PathExists(source)
+	if err != nil || !ok {
+		return nil, status.Errorf(codes.NotFound, "failed to check if device %q exists: %v", source, err)
+	}
+
+	var options []string
+	if req.Readonly || isReadOnlyCapability(req.VolumeCapability) {
+		options = append(options, "ro")
+	}
+
+	mounted, err := d.mounter.IsMounted(target)
+	if err != nil {
+		return nil, err
+	}
+
+	if !mounted {
+		klog.V(5).Infof("mounting the block device %s to %s", source, target)
+		if err := d.mounter.MountBlock(source, target, options); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	} else {
+		klog.V(2).Info("block volume is already mounted")
+	}
+
+	klog.V(5).Info("bind mounting the block volume is finished")
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
 // NodeUnpublishVolume unmounts the volume from the target path
 func (d *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
 	if req.VolumeId == "" {
@@ -313,6 +375,13 @@ func (d *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpub
 		klog.V(2).Info("target path is already unmounted")
 	}
 
+	// the target of a block volume is a file created by NodePublishVolume
+	if fi, err := os.Stat(req.TargetPath); err == nil && !fi.IsDir() {
+		if err := os.Remove(req.TargetPath); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to remove block target file %s: %v", req.TargetPath, err)
+		}
+	}
+
 	klog.V(5).Info("unmounting volume is finished")
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
@@ -331,14 +400,40 @@ func (d *NodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVol
 		err = fmt.Errorf("NodeGetVolumeStats targetpath %v is empty", targetPath)
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
+	isBlock, _ := isBlockDevice(targetPath)
+	condition := &csi.VolumeCondition{Abnormal: false, Message: "volume is healthy"}
+	if d.health != nil {
+		condition = d.health.Check(req.VolumeId, targetPath, isBlock)
+	}
+
+	if isBlock {
+		size, err := d.mounter.GetBlockSizeBytes(targetPath)
+		if err != nil {
+			// the condition is reported without the usage of a broken volume
+			if condition.Abnormal {
+				return &csi.NodeGetVolumeStatsResponse{VolumeCondition: condition}, nil
+			}
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		return &csi.NodeGetVolumeStatsResponse{
+			Usage: []*csi.VolumeUsage{
+				{
+					Total: size,
+					Unit:  csi.VolumeUsage_BYTES,
+				},
+			},
+			VolumeCondition: condition,
+		}, nil
+	}
+
 	res, err := util.GetMetrics(targetPath)
 	if err != nil {
+		if condition.Abnormal {
+			return &csi.NodeGetVolumeStatsResponse{VolumeCondition: condition}, nil
+		}
 		return nil, status.Error(codes.Internal, err.Error())
 	}
-	res.VolumeCondition = &csi.VolumeCondition{
-		Abnormal: false,
-		Message:  "TODO",
-	}
+	res.VolumeCondition = condition
 	return res, nil
 }
 
@@ -357,47 +452,39 @@ func (d *NodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVo
 		return nil, status.Error(codes.InvalidArgument, "Capacity range not provided")
 	}
 
+	isBlock := isBlockCapability(req.GetVolumeCapability())
+	if req.GetVolumeCapability() == nil {
+		isBlock, _ = isBlockDevice(req.GetVolumePath())
+	}
+	if isBlock {
+		// a block volume has no filesystem to grow, the device already
+		// reports the new size once the ebs resize is finished
+		klog.V(2).Infof("volume %s is a block volume, skipping filesystem expansion", volID)
+		return &csi.NodeExpandVolumeResponse{
+			CapacityBytes: capRange.GetRequiredBytes(),
+		}, nil
+	}
+
 	volumeInfo, err := d.config.EbsClient.GetVolume(&ebsClient.ListVolumesReq{VolumeIds: []string{volID}})
 	if err != nil {
-		klog.Warning("volume %s not found ,err: %v", volID, err)
+		klog.Warningf("volume %s not found ,err: %v", volID, err)
 		return nil, err
 	}
 
 	devName := getDiskSource(volID, volumeInfo.VolumeType)
 
-	mnt := req.VolumeCapability.GetMount()
-	switch mnt.FsType {
-	case "xfs":
-		ok, err := d.mounter.Expand(mnt.FsType, req.VolumePath)
-		if err != nil {
-			klog.Errorf("expand failed with error: %v, fs type: %s, source: %s", err, "xfs", req.VolumePath)
-			return nil, status.Errorf(codes.Internal, "expand failed with error: %v, fs type: %s, source: %s", err, "xfs", req.VolumePath)
-		}
-		if !ok {
-			klog.Errorf("expand failed, fs type: %s, source: %s", "xfs", devName)
-			return nil, status.Errorf(codes.Internal, "expand failed, fs type: %s, source: %s", "xfs", devName)
-		}
-	case "ext4", "ext3", "ext2":
-		ok, err := d.mounter.Expand(mnt.FsType, devName)
-		if err != nil {
-			klog.Errorf("expand failed with error: %v, fs type: %s, source: %s", err, mnt.FsType, devName)
-			return nil, status.Errorf(codes.Internal, "expand failed with error: %v, fs type: %s, source: %s", err, mnt.FsType, devName)
-		}
-		if !ok {
-			klog.Errorf("expand failed, fs type: %s, source: %s", mnt.FsType, devName)
-			return nil, status.Errorf(codes.Internal, "expand failed, fs type: %s, source: %s", mnt.FsType, devName)
-		}
-	case "":
-		ok, err := d.mounter.Expand("ext4", devName)
-		if err != nil {
-			return nil, status.Errorf(codes.Internal, "expand failed with error: %v, fs type: %s, source: %s", err, "ext4", devName)
-		}
-		if !ok {
-			return nil, status.Errorf(codes.Internal, "expand failed, fs type: %s, source: %s", "ext4", devName)
-		}
+	// ext2 cannot be grown online
+	switch fsType := req.VolumeCapability.GetMount().GetFsType(); fsType {
+	case "", "ext4", "ext3", "xfs", "btrfs":
 	default:
-		klog.Errorf("not supported fsType: %s", mnt.FsType)
-		return nil, status.Errorf(codes.InvalidArgument, "not supported fsType: %s", mnt.FsType)
+		klog.Errorf("not supported fsType: %s", fsType)
+		return nil, status.Errorf(codes.InvalidArgument, "not supported fsType: %s", fsType)
+	}
+	// the format of the device is detected, xfs and btrfs are grown at the
+	// mount point
+	if _, err := d.mounter.Resize(devName, req.VolumePath); err != nil {
+		klog.Errorf("expand failed with error: %v, source: %s, target: %s", err, devName, req.VolumePath)
+		return nil, status.Errorf(codes.Internal, "expand failed with error: %v, source: %s, target: %s", err, devName, req.VolumePath)
 	}
 
 	return &csi.NodeExpandVolumeResponse{
@@ -418,6 +505,8 @@ func (d *NodeServer) getNodeServiceCapabilities() []*csi.NodeServiceCapability {
 	capabilityRpcTypes = []csi.NodeServiceCapability_RPC_Type{
 		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
 		csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+		csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+		csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP,
 	}
 	if d.config.EnableVolumeExpansion {
 		capabilityRpcTypes = append(capabilityRpcTypes, csi.NodeServiceCapability_RPC_EXPAND_VOLUME)
@@ -497,7 +586,7 @@ func (d *NodeServer) GetMaxVolumesPerNode(maxVolumesPerNode int64) (int64, error
 	for _, instance := range instanceInfo.Attachments {
 		volume, err := d.config.EbsClient.GetVolume(&ebsClient.ListVolumesReq{VolumeIds: []string{instance.VolumeId}})
 		if err != nil {
-			klog.Warning("volume %s not found ,err: %v", instance.VolumeId, err)
+			klog.Warningf("volume %s not found ,err: %v", instance.VolumeId, err)
 			// The problem is from ebs
 			return DefaultMaxVolumesPerNode, err
 		}
@@ -562,13 +651,48 @@ func (d *NodeServer) GetMaxVolumesPerNode(maxVolumesPerNode int64) (int64, error
 
 // getDiskSource returns the absolute path of the attached volume for the given
 // DO volume name
+// getDiskSource returns the by-id link of the device of the volume. The type
+// in the volume context is the one created with, the volume may have been
+// modified between an ESSD and the other types since, so the links of both
+// are looked for, the one of volumeType first.
 func getDiskSource(volumeId, volumeType string) string {
+	return findDiskSource(diskIDPath, volumeId, volumeType)
+}
 
-	pattern := "ESSD_PL[0-3]"
-	matched, _ := regexp.MatchString(pattern, volumeType)
-	if matched {
-		return filepath.Join(diskIDPath, EssdPrefix+volumeId[0:13])
+// findDiskSource returns the first of the device links of the volume under
+// idPath which exists, the link of volumeType if none does
+func findDiskSource(idPath, volumeId, volumeType string) string {
+	links := diskSourceLinks(idPath, volumeId, volumeType)
+	if len(links) == 0 {
+		return ""
 	}
+	for _, link := range links {
+		if _, err := os.Stat(link); err == nil {
+			return link
+		}
+	}
+	return links[0]
+}
+
+// diskSourceLinks returns the device links the volume may have under idPath,
+// the one of volumeType first
+func diskSourceLinks(idPath, volumeId, volumeType string) []string {
+	var essdLink, diskLink []string
+	if len(volumeId) >= 13 {
+		essdLink = []string{filepath.Join(idPath, EssdPrefix+volumeId[0:13])}
+	}
+	if len(volumeId) >= 20 {
+		diskLink = []string{filepath.Join(idPath, diskPrefix+volumeId[0:20])}
+	}
+	if isEssdVolumeType(volumeType) {
+		return append(essdLink, diskLink...)
+	}
+	return append(diskLink, essdLink...)
+}
 
-	return filepath.Join(diskIDPath, diskPrefix+volumeId[0:20])
+// isEssdVolumeType returns whether volumeType is an ESSD, the device link of
+// an ESSD has a different prefix from the other volume types
+func isEssdVolumeType(volumeType string) bool {
+	matched, _ := regexp.MatchString("ESSD_PL[0-3]", volumeType)
+	return matched
 }
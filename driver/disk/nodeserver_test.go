@@ -0,0 +1,153 @@
+package driver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestNodeExpandVolumeBlock(t *testing.T) {
+	ns := &NodeServer{
+		config:  Config{EnableVolumeExpansion: true},
+		mounter: NewFakeMounter(),
+	}
+	req := &csi.NodeExpandVolumeRequest{
+		VolumeId:      "c4d5e2f0-1a2b-4c3d-8e9f-0a1b2c3d4e5f",
+		VolumePath:    "/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/pv/pod",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 20 * GB},
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	}
+	resp, err := ns.NodeExpandVolume(context.Background(), req)
+	if err != nil {
+		t.Fatalf("NodeExpandVolume() error = %v", err)
+	}
+	if resp.CapacityBytes != 20*GB {
+		t.Errorf("NodeExpandVolume() CapacityBytes = %d, want %d", resp.CapacityBytes, 20*GB)
+	}
+}
+
+func TestNodePublishVolumeReadOnly(t *testing.T) {
+	tests := []struct {
+		name     string
+		readonly bool
+		mode     csi.VolumeCapability_AccessMode_Mode
+		wantRO   bool
+	}{
+		{name: "read write", mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		{name: "single writer", mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER},
+		{name: "readonly flag", readonly: true, mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, wantRO: true},
+		{name: "reader only mode", mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, wantRO: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mounter := NewFakeMounter()
+			ns := &NodeServer{mounter: mounter}
+			volCap := &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: tt.mode},
+			}
+			target := "/var/lib/kubelet/pods/pod/volumes/kubernetes.io~csi/pv/mount"
+			_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+				VolumeId:          "c4d5e2f0-1a2b-4c3d-8e9f-0a1b2c3d4e5f",
+				StagingTargetPath: "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pv/globalmount",
+				TargetPath:        target,
+				VolumeCapability:  volCap,
+				Readonly:          tt.readonly,
+			})
+			if err != nil {
+				t.Fatalf("NodePublishVolume() error = %v", err)
+			}
+			gotRO := false
+			for _, opt := range mounter.mounts[target] {
+				if opt == "ro" {
+					gotRO = true
+				}
+			}
+			if gotRO != tt.wantRO {
+				t.Errorf("NodePublishVolume() mount options = %v, want ro %v", mounter.mounts[target], tt.wantRO)
+			}
+		})
+	}
+}
+
+func TestNodePublishVolumeMountGroup(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing the group of the files needs root")
+	}
+	staging := t.TempDir()
+	if err := os.WriteFile(filepath.Join(staging, "data"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	publish := func(group string, readonly bool) error {
+		ns := &NodeServer{mounter: NewFakeMounter()}
+		_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:          "c4d5e2f0-1a2b-4c3d-8e9f-0a1b2c3d4e5f",
+			StagingTargetPath: staging,
+			TargetPath:        "/var/lib/kubelet/pods/pod/volumes/kubernetes.io~csi/pv/mount",
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{VolumeMountGroup: group}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			},
+			Readonly: readonly,
+		})
+		return err
+	}
+
+	if err := publish("2000", true); err != nil {
+		t.Fatalf("NodePublishVolume() read-only error = %v", err)
+	}
+	if fi, _ := os.Stat(staging); isOwnedByGroup(fi, 2000) {
+		t.Error("NodePublishVolume() read-only changed the ownership")
+	}
+	if err := publish("2000", false); err != nil {
+		t.Fatalf("NodePublishVolume() error = %v", err)
+	}
+	if fi, _ := os.Stat(staging); !isOwnedByGroup(fi, 2000) {
+		t.Errorf("NodePublishVolume() staging mode = %v, want owned by group 2000", fi.Mode())
+	}
+	if err := publish("fsgroup", false); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("NodePublishVolume() with invalid group error = %v, want InvalidArgument", err)
+	}
+}
+
+func TestFindDiskSource(t *testing.T) {
+	const volumeID = "0d0a8c2f-6a5e-4c84-9f45-3d4b1c2e9a7b"
+	essdLink := EssdPrefix + volumeID[0:13]
+	diskLink := diskPrefix + volumeID[0:20]
+	tests := []struct {
+		name       string
+		volumeType string
+		links      []string
+		want       string
+	}{
+		{name: "essd", volumeType: ESSD_PL1, links: []string{essdLink}, want: essdLink},
+		{name: "other type", volumeType: SSD3_0, links: []string{diskLink}, want: diskLink},
+		{name: "modified to essd", volumeType: SSD3_0, links: []string{essdLink}, want: essdLink},
+		{name: "modified from essd", volumeType: ESSD_PL1, links: []string{diskLink}, want: diskLink},
+		{name: "missing", volumeType: ESSD_PL1, want: essdLink},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "vdb"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			for _, link := range tt.links {
+				if err := os.Symlink(filepath.Join(dir, "vdb"), filepath.Join(dir, link)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := findDiskSource(dir, volumeID, tt.volumeType); got != filepath.Join(dir, tt.want) {
+				t.Errorf("findDiskSource() = %s, want %s", got, filepath.Join(dir, tt.want))
+			}
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	ebsClient "csi-plugin/pkg/ebs-client"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// actions of the volume operations
+const (
+	operationAttach = "attach"
+	operationDetach = "detach"
+	operationResize = "resize"
+)
+
+// OperationTrackerConfig configures the timeouts of the volume operations
+// and how they are polled
+type OperationTrackerConfig struct {
+	// AttachTimeout, DetachTimeout and ResizeTimeout are how long an
+	// operation may take across the retries of the call before it fails with
+	// DeadlineExceeded
+	AttachTimeout time.Duration
+	DetachTimeout time.Duration
+	ResizeTimeout time.Duration
+	// MinBackoff and MaxBackoff bound the interval between the polls of a
+	// volume, which doubles from MinBackoff while the operation is pending
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+func (c *OperationTrackerConfig) Validate() error {
+	if c.AttachTimeout <= 0 || c.DetachTimeout <= 0 || c.ResizeTimeout <= 0 {
+		return fmt.Errorf("invalid volume operation timeouts, attach %v, detach %v, resize %v", c.AttachTimeout, c.DetachTimeout, c.ResizeTimeout)
+	}
+	if c.MinBackoff <= 0 || c.MaxBackoff < c.MinBackoff {
+		return fmt.Errorf("invalid volume operation backoff %v-%v", c.MinBackoff, c.MaxBackoff)
+	}
+	return nil
+}
+
+func (c *OperationTrackerConfig) timeout(action string) time.Duration {
+	switch action {
+	case operationAttach:
+		return c.AttachTimeout
+	case operationDetach:
+		return c.DetachTimeout
+	}
+	return c.ResizeTimeout
+}
+
+// volumeOperation is an EBS action started on a volume, until the volume
+// reaches the state of the action
+type volumeOperation struct {
+	action   string
+	volumeID string
+	// nodeID is the instance attached to or detached from
+	nodeID string
+	// size is the GB resized to
+	size    int64
+	started time.Time
+}
+
+func (op *volumeOperation) String() string {
+	switch op.action {
+	case operationResize:
+		return fmt.Sprintf("resize of volume %s to %dGB", op.volumeID, op.size)
+	case operationAttach:
+		return fmt.Sprintf("attach of volume %s to node %s", op.volumeID, op.nodeID)
+	}
+	return fmt.Sprintf("detach of volume %s from node %s", op.volumeID, op.nodeID)
+}
+
+func (op *volumeOperation) sameAs(other *volumeOperation) bool {
+	return op.action == other.action && op.nodeID == other.nodeID && op.size == other.size
+}
+
+// check returns whether vol reaches the state of the operation, and an
+// error if it never will
+func (op *volumeOperation) check(vol *ebsClient.Volume) (bool, error) {
+	if vol.VolumeStatus == ebsClient.ERROR_STATUS {
+		return false, fmt.Errorf("volume %s is in error status", vol.VolumeId)
+	}
+	switch op.action {
+	case operationAttach:
+		if vol.VolumeStatus != ebsClient.INUSE_STATUS {
+			return false, nil
+		}
+		for _, attachment := range vol.Attachments {
+			if attachment.InstanceId == op.nodeID {
+				return true, nil
+			}
+		}
+		if len(vol.Attachments) > 0 {
+			return false, fmt.Errorf("volume %s is attached to node %s", vol.VolumeId, vol.Attachments[0].InstanceId)
+		}
+		// the attachments may lag behind the status
+		return false, nil
+	case operationDetach:
+		return vol.VolumeStatus == ebsClient.AVAILABLE_STATUS, nil
+	}
+	return vol.Size >= op.size && vol.VolumeStatus != ebsClient.EXTENDING_STATUS, nil
+}
+
+// OperationTracker runs the attach, detach and resize of the volumes
+// without blocking the calls until they are done. An operation is started
+// once and recorded, the volume is polled with backoff while the context of
+// the call allows, and a pending operation fails the call with Aborted. The
+// retry of the call by the sidecar waits for the recorded operation instead
+// of starting it again. An operation fails fast when the volume is in error
+// status, and with DeadlineExceeded after the timeout of its action.
+type OperationTracker struct {
+	config    OperationTrackerConfig
+	ebsClient ebsClient.StorageService
+	now       func() time.Time
+	sleep     func(ctx context.Context, d time.Duration)
+
+	mu         sync.Mutex
+	operations map[string]*volumeOperation
+}
+
+func NewOperationTracker(config OperationTrackerConfig, ebsClient ebsClient.StorageService) *OperationTracker {
+	return &OperationTracker{
+		config:     config,
+		ebsClient:  ebsClient,
+		now:        time.Now,
+		sleep:      sleepContext,
+		operations: make(map[string]*volumeOperation),
+	}
+}
+
+// Pending returns the operation recorded on volumeID, nil if there is none
+func (t *OperationTracker) Pending(volumeID string) *volumeOperation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.operations[volumeID]
+}
+
+func (t *OperationTracker) forget(op *volumeOperation) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.operations[op.volumeID] == op {
+		delete(t.operations, op.volumeID)
+	}
+}
+
+// Run starts op with start unless the same operation is recorded already,
+// then waits for it. start may be nil to wait for an action started
+// elsewhere. The calls on a volume are expected to be serialized by the
+// volume locks.
+func (t *OperationTracker) Run(ctx context.Context, op *volumeOperation, start func() error) error {
+	if pending := t.Pending(op.volumeID); pending != nil {
+		if pending.sameAs(op) {
+			return t.wait(ctx, pending)
+		}
+		// an operation given up by its caller is dropped once it is done or
+		// timed out
+		if done, err := t.poll(pending); !done && err == nil {
+			return status.Errorf(codes.Aborted, "%s is in progress since %s", pending, pending.started.Format(time.RFC3339))
+		}
+		t.forget(pending)
+	}
+
+	if start != nil {
+		if err := start(); err != nil {
+			return err
+		}
+	}
+	op.started = t.now()
+	t.mu.Lock()
+	t.operations[op.volumeID] = op
+	t.mu.Unlock()
+	klog.V(2).Infof("OperationTracker:: %s started", op)
+	return t.wait(ctx, op)
+}
+
+// poll checks op once, it is timed out after the timeout of its action
+func (t *OperationTracker) poll(op *volumeOperation) (bool, error) {
+	vol, err := t.ebsClient.GetVolume(&ebsClient.ListVolumesReq{VolumeIds: []string{op.volumeID}})
+	if err != nil {
+		klog.Errorf("OperationTracker:: failed to get volume of %s: %v", op, err)
+	} else if done, err := op.check(vol); done || err != nil {
+		return done, err
+	}
+	if timeout := t.config.timeout(op.action); t.now().Sub(op.started) >= timeout {
+		return false, status.Errorf(codes.DeadlineExceeded, "%s is not done in %v", op, timeout)
+	}
+	return false, nil
+}
+
+// wait polls op until it is done, failed or timed out. It returns Aborted
+// when the context of the call ends first, with op kept for the retry.
+func (t *OperationTracker) wait(ctx context.Context, op *volumeOperation) error {
+	backoff := t.config.MinBackoff
+	for {
+		done, err := t.poll(op)
+		if done {
+			t.forget(op)
+			klog.V(2).Infof("OperationTracker:: %s is done in %v", op, t.now().Sub(op.started).Round(time.Second))
+			return nil
+		}
+		if err != nil {
+			t.forget(op)
+			if _, ok := status.FromError(err); ok {
+				return err
+			}
+			return status.Errorf(codes.Internal, "%s failed: %v", op, err)
+		}
+
+		// returns before the deadline of the call, so that the sidecar gets
+		// the response
+		if deadline, ok := ctx.Deadline(); ok && t.now().Add(backoff).After(deadline) {
+			return status.Errorf(codes.Aborted, "%s is in progress, retry later", op)
+		}
+		t.sleep(ctx, backoff)
+		if ctx.Err() != nil {
+			return status.Errorf(codes.Aborted, "%s is in progress, retry later", op)
+		}
+		if backoff *= 2; backoff > t.config.MaxBackoff {
+			backoff = t.config.MaxBackoff
+		}
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
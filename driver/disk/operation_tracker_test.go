@@ -0,0 +1,179 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	ebsClient "csi-plugin/pkg/ebs-client"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var testOperationTrackerConfig = OperationTrackerConfig{
+	AttachTimeout: time.Minute,
+	DetachTimeout: time.Minute,
+	ResizeTimeout: time.Minute,
+	MinBackoff:    time.Second,
+	MaxBackoff:    4 * time.Second,
+}
+
+// newTestOperationTracker returns a tracker on a fake clock, poll is called
+// with the elapsed time after each sleep between the polls
+func newTestOperationTracker(storageClient *FakeStorageClient, poll func(elapsed time.Duration)) (*OperationTracker, *[]time.Duration) {
+	t := NewOperationTracker(testOperationTrackerConfig, storageClient)
+	start := time.Now()
+	now := start
+	var sleeps []time.Duration
+	t.now = func() time.Time { return now }
+	t.sleep = func(ctx context.Context, d time.Duration) {
+		sleeps = append(sleeps, d)
+		now = now.Add(d)
+		poll(now.Sub(start))
+	}
+	return t, &sleeps
+}
+
+func TestOperationTracker(t *testing.T) {
+	const volumeID = "vol-op"
+	detach := &volumeOperation{action: operationDetach, volumeID: volumeID, nodeID: "instance-1"}
+
+	t.Run("pending across calls", func(t *testing.T) {
+		storageClient := NewFakeStorageClient()
+		storageClient.volumes[volumeID] = &ebsClient.Volume{VolumeId: volumeID, VolumeStatus: ebsClient.DETACHING_STATUS}
+		tracker, sleeps := newTestOperationTracker(storageClient, func(elapsed time.Duration) {
+			if elapsed >= 20*time.Second {
+				storageClient.volumes[volumeID].VolumeStatus = ebsClient.AVAILABLE_STATUS
+			}
+		})
+		starts := 0
+		start := func() error { starts++; return nil }
+
+		// the call ends before the detach is done
+		ctx, cancel := context.WithDeadline(context.Background(), tracker.now().Add(10*time.Second))
+		defer cancel()
+		err := tracker.Run(ctx, detach, start)
+		if status.Code(err) != codes.Aborted {
+			t.Fatalf("Run() of a pending detach error = %v, want Aborted", err)
+		}
+		if tracker.Pending(volumeID) == nil {
+			t.Fatal("pending detach is not kept for the retry")
+		}
+
+		// the retry waits for it without starting it again
+		retry := &volumeOperation{action: operationDetach, volumeID: volumeID, nodeID: "instance-1"}
+		if err := tracker.Run(context.Background(), retry, start); err != nil {
+			t.Fatalf("Run() of the retry error = %v", err)
+		}
+		if starts != 1 {
+			t.Errorf("detach started %d times, want once", starts)
+		}
+		want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second, 4 * time.Second}
+		if fmt.Sprint(*sleeps) != fmt.Sprint(want) {
+			t.Errorf("backoff = %v, want %v", *sleeps, want)
+		}
+		if tracker.Pending(volumeID) != nil {
+			t.Error("done detach is not forgotten")
+		}
+	})
+
+	t.Run("error status", func(t *testing.T) {
+		storageClient := NewFakeStorageClient()
+		storageClient.volumes[volumeID] = &ebsClient.Volume{VolumeId: volumeID, VolumeStatus: ebsClient.DETACHING_STATUS}
+		tracker, sleeps := newTestOperationTracker(storageClient, func(time.Duration) {
+			storageClient.volumes[volumeID].VolumeStatus = ebsClient.ERROR_STATUS
+		})
+		err := tracker.Run(context.Background(), detach, nil)
+		if status.Code(err) != codes.Internal || len(*sleeps) != 1 {
+			t.Errorf("Run() on error status = %v after %d polls, want Internal at once", err, len(*sleeps))
+		}
+		if tracker.Pending(volumeID) != nil {
+			t.Error("failed detach is not forgotten")
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		storageClient := NewFakeStorageClient()
+		storageClient.volumes[volumeID] = &ebsClient.Volume{VolumeId: volumeID, VolumeStatus: ebsClient.DETACHING_STATUS}
+		tracker, _ := newTestOperationTracker(storageClient, func(time.Duration) {})
+		err := tracker.Run(context.Background(), detach, nil)
+		if status.Code(err) != codes.DeadlineExceeded {
+			t.Errorf("Run() of a stuck detach error = %v, want DeadlineExceeded", err)
+		}
+		if tracker.Pending(volumeID) != nil {
+			t.Error("timed out detach is not forgotten")
+		}
+	})
+
+	t.Run("start error", func(t *testing.T) {
+		storageClient := NewFakeStorageClient()
+		storageClient.volumes[volumeID] = &ebsClient.Volume{VolumeId: volumeID, VolumeStatus: ebsClient.INUSE_STATUS}
+		tracker, _ := newTestOperationTracker(storageClient, func(time.Duration) {})
+		startErr := errors.New("detach failed")
+		if err := tracker.Run(context.Background(), detach, func() error { return startErr }); err != startErr {
+			t.Errorf("Run() error = %v, want the error of start", err)
+		}
+		if tracker.Pending(volumeID) != nil {
+			t.Error("detach failed to start is recorded")
+		}
+	})
+
+	t.Run("another operation pending", func(t *testing.T) {
+		storageClient := NewFakeStorageClient()
+		storageClient.volumes[volumeID] = &ebsClient.Volume{VolumeId: volumeID, Size: 20, VolumeStatus: ebsClient.EXTENDING_STATUS}
+		tracker, _ := newTestOperationTracker(storageClient, func(time.Duration) {})
+		tracker.operations[volumeID] = &volumeOperation{action: operationResize, volumeID: volumeID, size: 30, started: tracker.now()}
+
+		err := tracker.Run(context.Background(), detach, nil)
+		if status.Code(err) != codes.Aborted {
+			t.Fatalf("Run() with a pending resize error = %v, want Aborted", err)
+		}
+		// the resize is dropped once done
+		storageClient.volumes[volumeID].Size = 30
+		storageClient.volumes[volumeID].VolumeStatus = ebsClient.AVAILABLE_STATUS
+		if err := tracker.Run(context.Background(), detach, nil); err != nil {
+			t.Errorf("Run() after the resize error = %v", err)
+		}
+	})
+}
+
+func Test_volumeOperationCheck(t *testing.T) {
+	attach := &volumeOperation{action: operationAttach, volumeID: "vol-1", nodeID: "instance-1"}
+	resize := &volumeOperation{action: operationResize, volumeID: "vol-1", size: 30}
+	tests := []struct {
+		name     string
+		op       *volumeOperation
+		vol      *ebsClient.Volume
+		wantDone bool
+		wantErr  bool
+	}{
+		{name: "attaching", op: attach, vol: &ebsClient.Volume{VolumeStatus: ebsClient.ATTACHING_STATUS}},
+		{name: "in-use without attachments", op: attach, vol: &ebsClient.Volume{VolumeStatus: ebsClient.INUSE_STATUS}},
+		{
+			name:     "attached",
+			op:       attach,
+			vol:      &ebsClient.Volume{VolumeStatus: ebsClient.INUSE_STATUS, Attachments: []*ebsClient.Attachment{{InstanceId: "instance-1"}}},
+			wantDone: true,
+		},
+		{
+			name:    "attached to another node",
+			op:      attach,
+			vol:     &ebsClient.Volume{VolumeStatus: ebsClient.INUSE_STATUS, Attachments: []*ebsClient.Attachment{{InstanceId: "instance-2"}}},
+			wantErr: true,
+		},
+		{name: "extending", op: resize, vol: &ebsClient.Volume{Size: 30, VolumeStatus: ebsClient.EXTENDING_STATUS}},
+		{name: "resized", op: resize, vol: &ebsClient.Volume{Size: 30, VolumeStatus: ebsClient.INUSE_STATUS}, wantDone: true},
+		{name: "error", op: resize, vol: &ebsClient.Volume{Size: 20, VolumeStatus: ebsClient.ERROR_STATUS}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			done, err := tt.op.check(tt.vol)
+			if done != tt.wantDone || (err != nil) != tt.wantErr {
+				t.Errorf("check() = %v, %v, want %v, error %v", done, err, tt.wantDone, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,349 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	ebsClient "csi-plugin/pkg/ebs-client"
+	"csi-plugin/util"
+
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// OrphanCollectorLeaseName is the lease of the controller replica running
+	// the orphan collector
+	OrphanCollectorLeaseName = "com-ksc-csi-diskplugin-orphan-collector"
+
+	// actions taken on the volumes orphaned longer than the grace period
+	OrphanActionReport     = "report"
+	OrphanActionQuarantine = "quarantine"
+	OrphanActionDelete     = "delete"
+
+	// CsiQuarantinedTag is the volume tag of the date an orphaned volume was
+	// quarantined, the volume is kept for the user to check and delete
+	CsiQuarantinedTag = CsiTagPrefix + "quarantined"
+)
+
+var (
+	orphanedVolumes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "csi_disk_orphaned_volumes",
+		Help: "Number of the disk volumes created by the driver without a PersistentVolume.",
+	}, []string{"volume_type"})
+	orphanedVolumesSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "csi_disk_orphaned_volumes_size_gb",
+		Help: "Total size in GB of the disk volumes created by the driver without a PersistentVolume.",
+	}, []string{"volume_type"})
+	orphanedVolumeActions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "csi_disk_orphaned_volume_actions_total",
+		Help: "Number of the actions taken on the orphaned disk volumes.",
+	}, []string{"action", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(orphanedVolumes, orphanedVolumesSize, orphanedVolumeActions)
+}
+
+// OrphanCollectorConfig configures how the orphaned volumes are collected
+type OrphanCollectorConfig struct {
+	// Interval is how often the volumes are compared with the PVs
+	Interval time.Duration
+	// GracePeriod is how long a volume stays orphaned before Action is taken
+	GracePeriod time.Duration
+	// Action is one of OrphanActionReport, OrphanActionQuarantine and
+	// OrphanActionDelete
+	Action string
+	// DryRun only reports the action that would be taken
+	DryRun bool
+}
+
+func (c *OrphanCollectorConfig) Validate() error {
+	switch c.Action {
+	case OrphanActionReport, OrphanActionQuarantine, OrphanActionDelete:
+	default:
+		return fmt.Errorf("invalid orphan action %q, expect one of %s, %s and %s", c.Action, OrphanActionReport, OrphanActionQuarantine, OrphanActionDelete)
+	}
+	if c.Interval <= 0 {
+		return fmt.Errorf("invalid orphan collector interval %v", c.Interval)
+	}
+	if c.GracePeriod < 0 {
+		return fmt.Errorf("invalid orphan collector grace period %v", c.GracePeriod)
+	}
+	return nil
+}
+
+// OrphanCollector finds the volumes created by the driver in this cluster
+// that no PersistentVolume refers to, e.g. left behind by a force deleted PV
+// or a timed out CreateVolume. Orphans are reported with metrics and events,
+// and quarantined or deleted after the grace period.
+//
+// The grace period counts from when a volume is first found orphaned by the
+// current leader, so it starts over when the leader changes.
+type OrphanCollector struct {
+	driverName string
+	clusterID  string
+	config     OrphanCollectorConfig
+	k8sClient  kubernetes.Interface
+	ebsClient  ebsClient.StorageService
+	recorder   record.EventRecorder
+
+	// orphans are the orphaned volumes with the time they were first found
+	orphans map[string]time.Time
+	// handled are the orphans quarantined, or reported in dry run, they are
+	// not handled again while they stay orphaned
+	handled map[string]bool
+	now     func() time.Time
+}
+
+func NewOrphanCollector(driverName, clusterID string, config OrphanCollectorConfig, k8sClient kubernetes.Interface, ebsClient ebsClient.StorageService, recorder record.EventRecorder) *OrphanCollector {
+	return &OrphanCollector{
+		driverName: driverName,
+		clusterID:  clusterID,
+		config:     config,
+		k8sClient:  k8sClient,
+		ebsClient:  ebsClient,
+		recorder:   recorder,
+		orphans:    make(map[string]time.Time),
+		handled:    make(map[string]bool),
+		now:        time.Now,
+	}
+}
+
+// Run collects the orphaned volumes every interval until ctx is done
+func (oc *OrphanCollector) Run(ctx context.Context) {
+	klog.Infof("OrphanCollector:: starting, action: %s, grace period: %v, dry run: %v", oc.config.Action, oc.config.GracePeriod, oc.config.DryRun)
+	// the orphans found by the previous leader are not trusted
+	oc.orphans = make(map[string]time.Time)
+	oc.handled = make(map[string]bool)
+	wait.Until(func() {
+		if err := oc.collect(ctx); err != nil {
+			klog.Errorf("OrphanCollector:: %v", err)
+		}
+	}, oc.config.Interval, ctx.Done())
+	klog.Infof("OrphanCollector:: stopped")
+}
+
+// collect compares the volumes of the cluster with the PVs once
+func (oc *OrphanCollector) collect(ctx context.Context) error {
+	if oc.clusterID == "" {
+		return fmt.Errorf("cluster id is empty, the volumes of this cluster are unknown")
+	}
+	// the PVs are listed before the volumes, so a volume created in between
+	// is at most reported, it has the grace period to get its PV
+	pvs, err := oc.k8sClient.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list persistent volumes: %v", err)
+	}
+	volumeHandles := make(map[string]bool, len(pvs.Items))
+	for _, pv := range pvs.Items {
+		if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == oc.driverName {
+			volumeHandles[pv.Spec.CSI.VolumeHandle] = true
+		}
+	}
+	volumes, err := oc.listVolumes()
+	if err != nil {
+		return err
+	}
+
+	now := oc.now()
+	orphans := make(map[string]time.Time)
+	orphanedVolumes.Reset()
+	orphanedVolumesSize.Reset()
+	for _, vol := range volumes {
+		if vol.VolumeDesc != createdByDO || volumeHandles[vol.VolumeId] {
+			continue
+		}
+		// attached volumes are in use by someone even without a PV
+		if vol.VolumeStatus != ebsClient.AVAILABLE_STATUS && vol.VolumeStatus != ebsClient.ERROR_STATUS {
+			klog.V(4).Infof("OrphanCollector:: volume %s without pv is %s, skipped", vol.VolumeId, vol.VolumeStatus)
+			continue
+		}
+		foundAt, ok := oc.orphans[vol.VolumeId]
+		if !ok {
+			foundAt = now
+			msg := fmt.Sprintf("volume %s of %s is not used by any persistent volume", vol.VolumeId, vol.VolumeName)
+			klog.Warningf("OrphanCollector:: %s", msg)
+			oc.recordEvent(vol, v1.EventTypeWarning, orphanedVolumeFound, msg)
+		}
+		if now.Sub(foundAt) >= oc.config.GracePeriod && oc.handleOrphan(vol, now) {
+			continue
+		}
+		orphans[vol.VolumeId] = foundAt
+		orphanedVolumes.WithLabelValues(vol.VolumeType).Inc()
+		orphanedVolumesSize.WithLabelValues(vol.VolumeType).Add(float64(vol.Size))
+	}
+	for volumeID := range oc.handled {
+		if _, ok := orphans[volumeID]; !ok {
+			delete(oc.handled, volumeID)
+		}
+	}
+	oc.orphans = orphans
+	return oc.collectCloneSnapshots(volumes, now)
+}
+
+// collectCloneSnapshots deletes the temporary clone snapshots of the volumes
+// of the cluster left behind by CreateVolume, when the controller restarted
+// while the clone was creating or the delete failed. A snapshot is deleted
+// once its clone has left the creating state, or when no clone was created
+// within the grace period.
+func (oc *OrphanCollector) collectCloneSnapshots(volumes []*ebsClient.Volume, now time.Time) error {
+	sources := make(map[string]bool, len(volumes))
+	clones := make(map[string]*ebsClient.Volume, len(volumes))
+	for _, vol := range volumes {
+		sources[vol.VolumeId] = true
+		clones[vol.VolumeName] = vol
+	}
+	resp, err := oc.ebsClient.ListSnapshots(&ebsClient.DescribeSnapshotsReq{VolumeCategory: ebsClient.DATA_VOlUME_CATE})
+	if err != nil {
+		return fmt.Errorf("failed to list snapshots: %v", err)
+	}
+	for _, snapshot := range resp.Snapshots {
+		if !strings.HasPrefix(snapshot.SnapshotName, cloneSnapshotPrefix) || !sources[snapshot.VolumeID] {
+			continue
+		}
+		clone, ok := clones[strings.TrimPrefix(snapshot.SnapshotName, cloneSnapshotPrefix)]
+		if ok && clone.VolumeStatus == ebsClient.CREATING_STATUS {
+			continue
+		}
+		if !ok {
+			createdAt, err := time.Parse("2006-01-02 15:04:05", snapshot.CreateTime)
+			if err != nil || now.Sub(createdAt) < oc.config.GracePeriod {
+				continue
+			}
+		}
+		if oc.config.DryRun {
+			klog.Infof("OrphanCollector:: dry run: clone snapshot %s(%s) would be deleted", snapshot.SnapshotName, snapshot.SnapshotID)
+			continue
+		}
+		if _, err := oc.ebsClient.DeleteSnapshots(&ebsClient.DeleteSnapshotsReq{SnapshotId: snapshot.SnapshotID}); err != nil {
+			klog.Errorf("OrphanCollector:: failed to delete clone snapshot %s(%s): %v", snapshot.SnapshotName, snapshot.SnapshotID, err)
+			continue
+		}
+		klog.Infof("OrphanCollector:: clone snapshot %s(%s) left by CreateVolume is deleted", snapshot.SnapshotName, snapshot.SnapshotID)
+	}
+	return nil
+}
+
+// handleOrphan takes the action on vol orphaned longer than the grace
+// period, and returns whether vol is deleted
+func (oc *OrphanCollector) handleOrphan(vol *ebsClient.Volume, now time.Time) bool {
+	action := oc.config.Action
+	if action == OrphanActionReport || oc.handled[vol.VolumeId] {
+		return false
+	}
+	// the list is filtered by the cluster id tag on the server, the volume is
+	// only touched when its own tags say it is of this cluster
+	owned, err := oc.ownedByCluster(vol)
+	if err != nil {
+		klog.Errorf("OrphanCollector:: failed to get the tags of volume %s: %v", vol.VolumeId, err)
+		return false
+	}
+	if !owned {
+		klog.Warningf("OrphanCollector:: volume %s is not tagged with cluster %s, skipped", vol.VolumeId, oc.clusterID)
+		return false
+	}
+	if oc.config.DryRun {
+		msg := fmt.Sprintf("dry run: volume %s of %s would be %s", vol.VolumeId, vol.VolumeName, actionPastTense(action))
+		klog.Infof("OrphanCollector:: %s", msg)
+		orphanedVolumeActions.WithLabelValues(action, "dry_run").Inc()
+		oc.handled[vol.VolumeId] = true
+		oc.recordEvent(vol, v1.EventTypeNormal, orphanedVolumeDryRun, msg)
+		return false
+	}
+
+	switch action {
+	case OrphanActionQuarantine:
+		_, err = oc.ebsClient.TagVolume(&ebsClient.TagVolumeReq{
+			VolumeId: vol.VolumeId,
+			Tags:     map[string]string{CsiQuarantinedTag: now.Format("2006-01-02")},
+		})
+		if err == nil {
+			oc.handled[vol.VolumeId] = true
+		}
+	case OrphanActionDelete:
+		// the volume may have been attached since it was listed
+		var latest *ebsClient.Volume
+		if latest, err = oc.ebsClient.GetVolume(&ebsClient.ListVolumesReq{VolumeIds: []string{vol.VolumeId}}); err == nil {
+			if latest.VolumeStatus != ebsClient.AVAILABLE_STATUS && latest.VolumeStatus != ebsClient.ERROR_STATUS {
+				klog.V(2).Infof("OrphanCollector:: volume %s is %s now, not deleted", vol.VolumeId, latest.VolumeStatus)
+				return false
+			}
+			_, err = oc.ebsClient.DeleteVolume(&ebsClient.DeleteVolumeReq{VolumeId: vol.VolumeId})
+		}
+	}
+	if err != nil {
+		msg := fmt.Sprintf("failed to %s orphaned volume %s of %s: %v", action, vol.VolumeId, vol.VolumeName, err)
+		klog.Errorf("OrphanCollector:: %s", msg)
+		orphanedVolumeActions.WithLabelValues(action, "failed").Inc()
+		oc.recordEvent(vol, v1.EventTypeWarning, orphanedVolumeActionFailed, msg)
+		return false
+	}
+	msg := fmt.Sprintf("orphaned volume %s of %s is %s", vol.VolumeId, vol.VolumeName, actionPastTense(action))
+	klog.Infof("OrphanCollector:: %s", msg)
+	orphanedVolumeActions.WithLabelValues(action, "succeeded").Inc()
+	if action == OrphanActionQuarantine {
+		oc.recordEvent(vol, v1.EventTypeNormal, orphanedVolumeQuarantined, msg)
+		return false
+	}
+	oc.recordEvent(vol, v1.EventTypeNormal, orphanedVolumeDeleted, msg)
+	return true
+}
+
+// ownedByCluster returns whether the csi.clusterId tag of vol is the cluster id
+func (oc *OrphanCollector) ownedByCluster(vol *ebsClient.Volume) (bool, error) {
+	resp, err := oc.ebsClient.DescribeVolumeTags(&ebsClient.DescribeVolumeTagsReq{VolumeId: vol.VolumeId})
+	if err != nil {
+		return false, err
+	}
+	return resp.Tags(vol.VolumeId)[CsiClusterIDTag] == oc.clusterID, nil
+}
+
+// listVolumes returns the data volumes tagged with the cluster id
+func (oc *OrphanCollector) listVolumes() ([]*ebsClient.Volume, error) {
+	var volumes []*ebsClient.Volume
+	req := &ebsClient.ListVolumesReq{
+		VolumeCategory: ebsClient.DATA_VOlUME_CATE,
+		Tags:           map[string]string{CsiClusterIDTag: oc.clusterID},
+		MaxResults:     listVolumesPageSize,
+	}
+	for {
+		resp, err := oc.ebsClient.ListVolumes(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list volumes of cluster %s: %v", oc.clusterID, err)
+		}
+		volumes = append(volumes, resp.Volumes...)
+		next, ok := resp.NextMarker(req)
+		if !ok {
+			return volumes, nil
+		}
+		req.Marker = next
+	}
+}
+
+// recordEvent records an event on the PV named after the volume, the PV is
+// usually gone but the event is still listed with kubectl get events
+func (oc *OrphanCollector) recordEvent(vol *ebsClient.Volume, eventType, reason, message string) {
+	if oc.recorder == nil || vol.VolumeName == "" {
+		return
+	}
+	ref := &v1.ObjectReference{
+		Kind: "PersistentVolume",
+		Name: vol.VolumeName,
+	}
+	util.CreateEvent(oc.recorder, ref, eventType, reason, message)
+}
+
+func actionPastTense(action string) string {
+	if action == OrphanActionQuarantine {
+		return "quarantined"
+	}
+	return "deleted"
+}
@@ -0,0 +1,252 @@
+package driver
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	ebsClient "csi-plugin/pkg/ebs-client"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestOrphanCollectorCollect(t *testing.T) {
+	const (
+		driverName  = "com.ksc.csi.diskplugin"
+		clusterID   = "cluster-a"
+		gracePeriod = time.Hour
+	)
+	tests := []struct {
+		name   string
+		action string
+		dryRun bool
+		// wantOrphan is whether the orphaned volume exists after the grace period
+		wantOrphan      bool
+		wantQuarantined bool
+		wantEvents      []string
+	}{
+		{
+			name:       "report",
+			action:     OrphanActionReport,
+			wantOrphan: true,
+			wantEvents: []string{orphanedVolumeFound},
+		},
+		{
+			name:            "quarantine",
+			action:          OrphanActionQuarantine,
+			wantOrphan:      true,
+			wantQuarantined: true,
+			wantEvents:      []string{orphanedVolumeFound, orphanedVolumeQuarantined},
+		},
+		{
+			name:       "delete",
+			action:     OrphanActionDelete,
+			wantEvents: []string{orphanedVolumeFound, orphanedVolumeDeleted},
+		},
+		{
+			name:       "delete dry run",
+			action:     OrphanActionDelete,
+			dryRun:     true,
+			wantOrphan: true,
+			wantEvents: []string{orphanedVolumeFound, orphanedVolumeDryRun},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storageClient := NewFakeStorageClient()
+			createVolume := func(name, desc, cluster string) string {
+				resp, err := storageClient.CreateVolume(&ebsClient.CreateVolumeReq{
+					VolumeName: name,
+					VolumeDesc: desc,
+					VolumeType: ESSD_PL1,
+					Size:       20,
+					Tags:       map[string]string{CsiClusterIDTag: cluster},
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return resp.VolumeId
+			}
+			bound := createVolume("disk-bound", createdByDO, clusterID)
+			orphan := createVolume("disk-orphan", createdByDO, clusterID)
+			attached := createVolume("disk-attached", createdByDO, clusterID)
+			storageClient.volumes[attached].VolumeStatus = ebsClient.INUSE_STATUS
+			others := []string{
+				createVolume("disk-other-cluster", createdByDO, "cluster-b"),
+				createVolume("disk-user", "created by user", clusterID),
+			}
+
+			pv := &v1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{Name: "disk-bound"},
+				Spec: v1.PersistentVolumeSpec{
+					PersistentVolumeSource: v1.PersistentVolumeSource{
+						CSI: &v1.CSIPersistentVolumeSource{Driver: driverName, VolumeHandle: bound},
+					},
+				},
+			}
+			recorder := record.NewFakeRecorder(10)
+			config := OrphanCollectorConfig{Interval: time.Minute, GracePeriod: gracePeriod, Action: tt.action, DryRun: tt.dryRun}
+			oc := NewOrphanCollector(driverName, clusterID, config, fake.NewSimpleClientset(pv), storageClient, recorder)
+			now := time.Now()
+			oc.now = func() time.Time { return now }
+
+			ctx := context.Background()
+			for _, step := range []time.Duration{0, gracePeriod / 2, gracePeriod / 2, time.Minute} {
+				now = now.Add(step)
+				if err := oc.collect(ctx); err != nil {
+					t.Fatalf("collect() error = %v", err)
+				}
+			}
+
+			if _, ok := storageClient.volumes[orphan]; ok != tt.wantOrphan {
+				t.Errorf("orphaned volume exists = %v, want %v", ok, tt.wantOrphan)
+			}
+			if _, ok := storageClient.volumeTags[orphan][CsiQuarantinedTag]; ok != tt.wantQuarantined {
+				t.Errorf("orphaned volume quarantined = %v, want %v", ok, tt.wantQuarantined)
+			}
+			for _, volumeID := range append(others, bound, attached) {
+				if _, ok := storageClient.volumes[volumeID]; !ok {
+					t.Errorf("volume %s is deleted", volumeID)
+				}
+				if _, ok := storageClient.volumeTags[volumeID][CsiQuarantinedTag]; ok {
+					t.Errorf("volume %s is quarantined", volumeID)
+				}
+			}
+
+			close(recorder.Events)
+			var events []string
+			for event := range recorder.Events {
+				events = append(events, event)
+			}
+			if len(events) != len(tt.wantEvents) {
+				t.Fatalf("events = %v, want reasons %v", events, tt.wantEvents)
+			}
+			for i, reason := range tt.wantEvents {
+				if !strings.Contains(events[i], reason) {
+					t.Errorf("event %d = %q, want reason %s", i, events[i], reason)
+				}
+			}
+		})
+	}
+}
+
+func TestOrphanCollectorOtherCluster(t *testing.T) {
+	const (
+		driverName = "com.ksc.csi.diskplugin"
+		clusterID  = "cluster-a"
+	)
+	for _, action := range []string{OrphanActionQuarantine, OrphanActionDelete} {
+		t.Run(action, func(t *testing.T) {
+			// the tag filter is not honored, the volume of the other cluster is listed
+			storageClient := NewFakeStorageClient()
+			storageClient.ignoreTagFilter = true
+			resp, err := storageClient.CreateVolume(&ebsClient.CreateVolumeReq{
+				VolumeName: "disk-other-cluster",
+				VolumeDesc: createdByDO,
+				VolumeType: ESSD_PL1,
+				Size:       20,
+				Tags:       map[string]string{CsiClusterIDTag: "cluster-b"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			config := OrphanCollectorConfig{Interval: time.Minute, Action: action}
+			oc := NewOrphanCollector(driverName, clusterID, config, fake.NewSimpleClientset(), storageClient, nil)
+			for i := 0; i < 2; i++ {
+				if err := oc.collect(context.Background()); err != nil {
+					t.Fatalf("collect() error = %v", err)
+				}
+			}
+
+			if _, ok := storageClient.volumes[resp.VolumeId]; !ok {
+				t.Errorf("volume of the other cluster is deleted")
+			}
+			if _, ok := storageClient.volumeTags[resp.VolumeId][CsiQuarantinedTag]; ok {
+				t.Errorf("volume of the other cluster is quarantined")
+			}
+		})
+	}
+}
+
+func TestOrphanCollectorConfigValidate(t *testing.T) {
+	tests := []struct {
+		config  OrphanCollectorConfig
+		wantErr bool
+	}{
+		{config: OrphanCollectorConfig{Interval: time.Hour, GracePeriod: time.Hour, Action: OrphanActionDelete}},
+		{config: OrphanCollectorConfig{Interval: time.Hour, Action: OrphanActionReport}},
+		{config: OrphanCollectorConfig{Interval: time.Hour, Action: "archive"}, wantErr: true},
+		{config: OrphanCollectorConfig{Action: OrphanActionQuarantine}, wantErr: true},
+		{config: OrphanCollectorConfig{Interval: time.Hour, GracePeriod: -time.Hour, Action: OrphanActionQuarantine}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := tt.config.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("Validate(%+v) error = %v, wantErr %v", tt.config, err, tt.wantErr)
+		}
+	}
+}
+
+func TestOrphanCollectorCloneSnapshots(t *testing.T) {
+	const (
+		clusterID   = "cluster-a"
+		gracePeriod = time.Hour
+	)
+	storageClient := NewFakeStorageClient()
+	createVolume := func(name, cluster string, status ebsClient.VolumeStatusType) string {
+		resp, err := storageClient.CreateVolume(&ebsClient.CreateVolumeReq{
+			VolumeName: name,
+			VolumeDesc: createdByDO,
+			VolumeType: ESSD_PL1,
+			Size:       20,
+			Tags:       map[string]string{CsiClusterIDTag: cluster},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		storageClient.volumes[resp.VolumeId].VolumeStatus = status
+		return resp.VolumeId
+	}
+	source := createVolume("pvc-source", clusterID, ebsClient.INUSE_STATUS)
+	otherSource := createVolume("pvc-other-source", "cluster-b", ebsClient.INUSE_STATUS)
+	createVolume("pvc-attached", clusterID, ebsClient.INUSE_STATUS)
+	createVolume("pvc-creating", clusterID, ebsClient.CREATING_STATUS)
+	createSnapshot := func(name, volumeID string, age time.Duration) string {
+		resp, err := storageClient.CreateSnapshot(&ebsClient.CreateSnapshotReq{VolumeId: volumeID, SnapshotName: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		storageClient.snapshots[resp.SnapshotID].CreateTime = time.Now().Add(-age).Format("2006-01-02 15:04:05")
+		return resp.SnapshotID
+	}
+	deleted := []string{
+		createSnapshot(cloneSnapshotPrefix+"pvc-attached", source, time.Minute),
+		createSnapshot(cloneSnapshotPrefix+"pvc-abandoned", source, 2*gracePeriod),
+	}
+	kept := []string{
+		createSnapshot(cloneSnapshotPrefix+"pvc-creating", source, 2*gracePeriod),
+		createSnapshot(cloneSnapshotPrefix+"pvc-pending", source, time.Minute),
+		createSnapshot(cloneSnapshotPrefix+"pvc-other", otherSource, 2*gracePeriod),
+		createSnapshot("snapshot-user", source, 2*gracePeriod),
+	}
+
+	config := OrphanCollectorConfig{Interval: time.Minute, GracePeriod: gracePeriod, Action: OrphanActionReport}
+	oc := NewOrphanCollector(driverName, clusterID, config, fake.NewSimpleClientset(), storageClient, nil)
+	if err := oc.collect(context.Background()); err != nil {
+		t.Fatalf("collect() error = %v", err)
+	}
+	for _, snapshotID := range deleted {
+		if _, ok := storageClient.snapshots[snapshotID]; ok {
+			t.Errorf("clone snapshot %s is kept", storageClient.snapshots[snapshotID].SnapshotName)
+		}
+	}
+	for _, snapshotID := range kept {
+		if _, ok := storageClient.snapshots[snapshotID]; !ok {
+			t.Errorf("snapshot %s is deleted", snapshotID)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"csi-plugin/util"
+
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	snapClientset "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned"
+	"github.com/robfig/cron/v3"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// SnapshotPolicyLeaseName is the lease of the controller replica running
+	// the snapshot policies
+	SnapshotPolicyLeaseName = "com-ksc-csi-diskplugin-snapshot-policy"
+
+	// LabelSnapshotPolicy is the label of the VolumeSnapshots created by a
+	// SnapshotPolicy, the name of the policy
+	LabelSnapshotPolicy = "storage.ksyun.com/snapshot-policy"
+
+	// snapshotPolicySyncInterval is how often the policies are checked, the
+	// finest granularity of a cron schedule
+	snapshotPolicySyncInterval = time.Minute
+)
+
+// SnapshotPolicyController runs the SnapshotPolicies of all namespaces.
+// The VolumeSnapshots of a schedule are named after the policy, the PVC and
+// the schedule time, so a schedule retried after a failure or by another
+// leader does not create them twice. Only the latest of the schedules
+// missed while the controller is down is run.
+type SnapshotPolicyController struct {
+	driverName    string
+	k8sClient     kubernetes.Interface
+	snapClient    snapClientset.Interface
+	dynamicClient dynamic.Interface
+	recorder      record.EventRecorder
+	now           func() time.Time
+
+	mu sync.Mutex
+	// invalid is the generations of the policies warned to be invalid
+	invalid map[types.UID]int64
+}
+
+func NewSnapshotPolicyController(driverName string, k8sClient kubernetes.Interface, snapClient snapClientset.Interface, dynamicClient dynamic.Interface, recorder record.EventRecorder) *SnapshotPolicyController {
+	return &SnapshotPolicyController{
+		driverName:    driverName,
+		k8sClient:     k8sClient,
+		snapClient:    snapClient,
+		dynamicClient: dynamicClient,
+		recorder:      recorder,
+		now:           time.Now,
+		invalid:       make(map[types.UID]int64),
+	}
+}
+
+// Run runs the policies until ctx is done
+func (c *SnapshotPolicyController) Run(ctx context.Context) {
+	klog.Infof("SnapshotPolicyController:: starting")
+	wait.Until(func() {
+		if err := c.sync(ctx); err != nil {
+			klog.Errorf("SnapshotPolicyController:: %v", err)
+		}
+	}, snapshotPolicySyncInterval, ctx.Done())
+	klog.Infof("SnapshotPolicyController:: stopped")
+}
+
+func (c *SnapshotPolicyController) sync(ctx context.Context) error {
+	list, err := c.dynamicClient.Resource(SnapshotPolicyResource).Namespace(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list snapshot policies: %v", err)
+	}
+	for i := range list.Items {
+		obj := &list.Items[i]
+		if err := c.syncPolicy(ctx, obj); err != nil {
+			klog.Errorf("SnapshotPolicyController:: failed to sync snapshot policy %s/%s: %v", obj.GetNamespace(), obj.GetName(), err)
+		}
+	}
+	return nil
+}
+
+// syncPolicy creates the VolumeSnapshots of the latest schedule due, then
+// prunes the VolumeSnapshots of the policy
+func (c *SnapshotPolicyController) syncPolicy(ctx context.Context, obj *unstructured.Unstructured) error {
+	policy, err := decodeSnapshotPolicy(obj)
+	if err != nil {
+		return err
+	}
+	schedule, loc, err := parseSnapshotPolicySchedule(&policy.Spec)
+	if err == nil && policy.Spec.Retention.KeepLast < 0 {
+		err = fmt.Errorf("invalid keepLast %d", policy.Spec.Retention.KeepLast)
+	}
+	if err != nil {
+		c.mu.Lock()
+		generation, warned := c.invalid[policy.UID]
+		warned = warned && generation == policy.Generation
+		c.invalid[policy.UID] = policy.Generation
+		c.mu.Unlock()
+		if !warned {
+			c.createEvent(policy, v1.EventTypeWarning, snapshotPolicyInvalid, err.Error())
+		}
+		return err
+	}
+
+	now := c.now().In(loc)
+	last := policy.CreationTimestamp.Time
+	if policy.Status.LastScheduleTime != nil {
+		last = policy.Status.LastScheduleTime.Time
+	}
+	var scheduled time.Time
+	for next := schedule.Next(last.In(loc)); !next.IsZero() && !next.After(now); next = schedule.Next(next) {
+		scheduled = next
+	}
+	if !scheduled.IsZero() {
+		if !policy.Spec.Suspend {
+			if err := c.createSnapshots(ctx, policy, scheduled); err != nil {
+				// retried on the next sync
+				c.createEvent(policy, v1.EventTypeWarning, scheduledSnapshotFailed, err.Error())
+				return err
+			}
+		}
+		// a suspended policy skips the schedule
+		if err := unstructured.SetNestedField(obj.Object, scheduled.UTC().Format(time.RFC3339), "status", "lastScheduleTime"); err != nil {
+			return err
+		}
+		if _, err := c.dynamicClient.Resource(SnapshotPolicyResource).Namespace(policy.Namespace).UpdateStatus(ctx, obj, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("failed to update status: %v", err)
+		}
+	}
+	return c.pruneSnapshots(ctx, policy)
+}
+
+// createSnapshots creates a VolumeSnapshot of scheduled for each of the
+// bound PVCs of the driver selected by policy
+func (c *SnapshotPolicyController) createSnapshots(ctx context.Context, policy *SnapshotPolicy, scheduled time.Time) error {
+	selector, err := metav1.LabelSelectorAsSelector(&policy.Spec.Selector)
+	if err != nil {
+		return fmt.Errorf("invalid selector: %v", err)
+	}
+	pvcs, err := c.k8sClient.CoreV1().PersistentVolumeClaims(policy.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return fmt.Errorf("failed to list pvcs: %v", err)
+	}
+	var created, errs []string
+	for _, pvc := range pvcs.Items {
+		if pvc.Status.Phase != v1.ClaimBound || pvc.Spec.VolumeName == "" || pvc.DeletionTimestamp != nil {
+			continue
+		}
+		pv, err := c.k8sClient.CoreV1().PersistentVolumes().Get(ctx, pvc.Spec.VolumeName, metav1.GetOptions{})
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("failed to get pv of pvc %s: %v", pvc.Name, err))
+			continue
+		}
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != c.driverName {
+			continue
+		}
+
+		pvcName := pvc.Name
+		vs := &snapshotv1.VolumeSnapshot{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      scheduledSnapshotName(policy.Name, pvc.Name, scheduled),
+				Namespace: policy.Namespace,
+				Labels:    map[string]string{LabelSnapshotPolicy: policy.Name},
+			},
+			Spec: snapshotv1.VolumeSnapshotSpec{
+				Source: snapshotv1.VolumeSnapshotSource{PersistentVolumeClaimName: &pvcName},
+			},
+		}
+		if policy.Spec.VolumeSnapshotClassName != "" {
+			className := policy.Spec.VolumeSnapshotClassName
+			vs.Spec.VolumeSnapshotClassName = &className
+		}
+		_, err = c.snapClient.SnapshotV1().VolumeSnapshots(policy.Namespace).Create(ctx, vs, metav1.CreateOptions{})
+		switch {
+		case apierrors.IsAlreadyExists(err):
+		case err != nil:
+			errs = append(errs, fmt.Sprintf("failed to create volume snapshot %s: %v", vs.Name, err))
+		default:
+			created = append(created, vs.Name)
+		}
+	}
+	if len(created) > 0 {
+		msg := fmt.Sprintf("created volume snapshots %s of schedule %s", strings.Join(created, ", "), scheduled.Format(time.RFC3339))
+		klog.Infof("SnapshotPolicyController:: snapshot policy %s/%s %s", policy.Namespace, policy.Name, msg)
+		c.createEvent(policy, v1.EventTypeNormal, scheduledSnapshotCreated, msg)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// pruneSnapshots deletes the VolumeSnapshots of each PVC out of the
+// retention of policy
+func (c *SnapshotPolicyController) pruneSnapshots(ctx context.Context, policy *SnapshotPolicy) error {
+	retention := policy.Spec.Retention
+	if retention.KeepLast <= 0 && retention.MaxAge.Duration <= 0 {
+		return nil
+	}
+	list, err := c.snapClient.SnapshotV1().VolumeSnapshots(policy.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: LabelSnapshotPolicy + "=" + policy.Name,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list volume snapshots: %v", err)
+	}
+	byPVC := make(map[string][]*snapshotv1.VolumeSnapshot)
+	for i := range list.Items {
+		vs := &list.Items[i]
+		if vs.DeletionTimestamp != nil || vs.Spec.Source.PersistentVolumeClaimName == nil {
+			continue
+		}
+		pvcName := *vs.Spec.Source.PersistentVolumeClaimName
+		byPVC[pvcName] = append(byPVC[pvcName], vs)
+	}
+
+	now := c.now()
+	var pruned, errs []string
+	for _, snapshots := range byPVC {
+		// the latest first, the names of the same second end with the schedule
+		sort.Slice(snapshots, func(i, j int) bool {
+			ti, tj := snapshots[i].CreationTimestamp, snapshots[j].CreationTimestamp
+			if !ti.Equal(&tj) {
+				return tj.Before(&ti)
+			}
+			return snapshots[i].Name > snapshots[j].Name
+		})
+		for i, vs := range snapshots {
+			overCount := retention.KeepLast > 0 && i >= retention.KeepLast
+			overAge := retention.MaxAge.Duration > 0 && now.Sub(vs.CreationTimestamp.Time) > retention.MaxAge.Duration
+			if !overCount && !overAge {
+				continue
+			}
+			err := c.snapClient.SnapshotV1().VolumeSnapshots(vs.Namespace).Delete(ctx, vs.Name, metav1.DeleteOptions{})
+			if err != nil && !apierrors.IsNotFound(err) {
+				errs = append(errs, fmt.Sprintf("failed to delete volume snapshot %s: %v", vs.Name, err))
+				continue
+			}
+			pruned = append(pruned, vs.Name)
+		}
+	}
+	if len(pruned) > 0 {
+		sort.Strings(pruned)
+		msg := fmt.Sprintf("pruned volume snapshots %s", strings.Join(pruned, ", "))
+		klog.Infof("SnapshotPolicyController:: snapshot policy %s/%s %s", policy.Namespace, policy.Name, msg)
+		c.createEvent(policy, v1.EventTypeNormal, scheduledSnapshotPruned, msg)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (c *SnapshotPolicyController) createEvent(policy *SnapshotPolicy, eventType, reason, message string) {
+	if c.recorder == nil {
+		return
+	}
+	ref := &v1.ObjectReference{
+		APIVersion: SnapshotPolicyResource.GroupVersion().String(),
+		Kind:       "SnapshotPolicy",
+		Name:       policy.Name,
+		Namespace:  policy.Namespace,
+		UID:        policy.UID,
+	}
+	util.CreateEvent(c.recorder, ref, eventType, reason, message)
+}
+
+func decodeSnapshotPolicy(obj *unstructured.Unstructured) (*SnapshotPolicy, error) {
+	data, err := json.Marshal(obj.Object)
+	if err != nil {
+		return nil, err
+	}
+	policy := &SnapshotPolicy{}
+	if err := json.Unmarshal(data, policy); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot policy %s/%s: %v", obj.GetNamespace(), obj.GetName(), err)
+	}
+	return policy, nil
+}
+
+func parseSnapshotPolicySchedule(spec *SnapshotPolicySpec) (cron.Schedule, *time.Location, error) {
+	schedule, err := cron.ParseStandard(spec.Schedule)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid cron schedule %q: %v", spec.Schedule, err)
+	}
+	loc := time.UTC
+	if spec.TimeZone != "" {
+		if loc, err = time.LoadLocation(spec.TimeZone); err != nil {
+			return nil, nil, fmt.Errorf("invalid time zone %q: %v", spec.TimeZone, err)
+		}
+	}
+	return schedule, loc, nil
+}
+
+// scheduledSnapshotName returns the name of the VolumeSnapshot of pvcName
+// for the schedule time, the pvc name is hashed if the name is too long
+func scheduledSnapshotName(policyName, pvcName string, scheduled time.Time) string {
+	suffix := scheduled.UTC().Format("200601021504")
+	name := fmt.Sprintf("%s-%s-%s", policyName, pvcName, suffix)
+	if len(name) <= validation.DNS1123SubdomainMaxLength {
+		return name
+	}
+	h := fnv.New32a()
+	h.Write([]byte(pvcName))
+	return fmt.Sprintf("%s-%x-%s", policyName, h.Sum32(), suffix)
+}
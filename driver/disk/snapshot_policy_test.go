@@ -0,0 +1,235 @@
+package driver
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	snapfake "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned/fake"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func newSnapshotPolicy(name string, created time.Time, spec map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": SnapshotPolicyResource.GroupVersion().String(),
+		"kind":       "SnapshotPolicy",
+		"metadata": map[string]interface{}{
+			"name":              name,
+			"namespace":         "default",
+			"uid":               name + "-uid",
+			"creationTimestamp": created.UTC().Format(time.RFC3339),
+		},
+		"spec": spec,
+	}}
+}
+
+func TestSnapshotPolicyController(t *testing.T) {
+	created := time.Date(2024, 5, 15, 1, 30, 0, 0, time.UTC)
+	daily := newSnapshotPolicy("daily", created, map[string]interface{}{
+		"schedule":                "0 2 * * *",
+		"selector":                map[string]interface{}{"matchLabels": map[string]interface{}{"app": "db"}},
+		"volumeSnapshotClassName": "ksc-snapshot",
+		"retention":               map[string]interface{}{"keepLast": int64(2)},
+	})
+	invalid := newSnapshotPolicy("invalid", created, map[string]interface{}{
+		"schedule": "0 25 * * *",
+		"selector": map[string]interface{}{"matchLabels": map[string]interface{}{"app": "db"}},
+	})
+	var objects []runtime.Object
+	for _, c := range []struct {
+		name, driver string
+		labels       map[string]string
+		bound        bool
+	}{
+		{name: "db-0", driver: driverName, labels: map[string]string{"app": "db"}, bound: true},
+		{name: "db-1", driver: "other.csi.driver", labels: map[string]string{"app": "db"}, bound: true},
+		{name: "db-2", driver: driverName, labels: map[string]string{"app": "db"}},
+		{name: "web", driver: driverName, labels: map[string]string{"app": "web"}, bound: true},
+	} {
+		pvc, pv := newBoundTestPVC(c.name, c.driver, "vol-"+c.name)
+		pvc.Labels = c.labels
+		if !c.bound {
+			pvc.Spec.VolumeName = ""
+			pvc.Status.Phase = v1.ClaimPending
+			objects = append(objects, pvc)
+			continue
+		}
+		objects = append(objects, pvc, pv)
+	}
+	snapClient := snapfake.NewSimpleClientset()
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), daily, invalid)
+	recorder := record.NewFakeRecorder(100)
+	c := NewSnapshotPolicyController(driverName, fake.NewSimpleClientset(objects...), snapClient, dynamicClient, recorder)
+	now := created
+	c.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	snapshotNames := func() []string {
+		t.Helper()
+		list, err := snapClient.SnapshotV1().VolumeSnapshots("default").List(ctx, metav1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, vs := range list.Items {
+			names = append(names, vs.Name)
+			if vs.Labels[LabelSnapshotPolicy] != "daily" || *vs.Spec.Source.PersistentVolumeClaimName != "db-0" || *vs.Spec.VolumeSnapshotClassName != "ksc-snapshot" {
+				t.Errorf("volume snapshot %s = %+v, want of db-0 by daily", vs.Name, vs)
+			}
+		}
+		sort.Strings(names)
+		return names
+	}
+	sync := func(at time.Time, want ...string) {
+		t.Helper()
+		now = at
+		if err := c.sync(ctx); err != nil {
+			t.Fatalf("sync() error = %v", err)
+		}
+		if got := snapshotNames(); strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("volume snapshots at %v = %v, want %v", at, got, want)
+		}
+	}
+
+	sync(created.Add(20 * time.Minute))
+	sync(created.Add(31*time.Minute), "daily-db-0-202405150200")
+	sync(created.Add(40*time.Minute), "daily-db-0-202405150200")
+	sync(created.Add(24*time.Hour+31*time.Minute), "daily-db-0-202405150200", "daily-db-0-202405160200")
+	// the oldest is pruned by keepLast
+	sync(created.Add(48*time.Hour+31*time.Minute), "daily-db-0-202405160200", "daily-db-0-202405170200")
+	// only the latest of the missed schedules
+	sync(created.Add(5*24*time.Hour+31*time.Minute), "daily-db-0-202405170200", "daily-db-0-202405200200")
+
+	obj, err := dynamicClient.Resource(SnapshotPolicyResource).Namespace("default").Get(ctx, "daily", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last, _, _ := unstructured.NestedString(obj.Object, "status", "lastScheduleTime"); last != "2024-05-20T02:00:00Z" {
+		t.Errorf("lastScheduleTime = %q, want 2024-05-20T02:00:00Z", last)
+	}
+
+	// the events of the daily policy, and one of the invalid policy
+	close(recorder.Events)
+	reasons := map[string]int{}
+	for event := range recorder.Events {
+		reasons[strings.Fields(event)[1]]++
+	}
+	want := map[string]int{scheduledSnapshotCreated: 4, scheduledSnapshotPruned: 2, snapshotPolicyInvalid: 1}
+	for reason, count := range want {
+		if reasons[reason] != count {
+			t.Errorf("%d events of %s, want %d, all %v", reasons[reason], reason, count, reasons)
+		}
+	}
+}
+
+func TestSnapshotPolicySuspendAndMaxAge(t *testing.T) {
+	created := time.Date(2024, 5, 15, 1, 30, 0, 0, time.UTC)
+	policy := newSnapshotPolicy("hourly", created, map[string]interface{}{
+		"schedule":  "@hourly",
+		"timeZone":  "Asia/Shanghai",
+		"selector":  map[string]interface{}{},
+		"retention": map[string]interface{}{"maxAge": "1h"},
+		"suspend":   true,
+	})
+	pvc, pv := newBoundTestPVC("db-0", driverName, "vol-db-0")
+	snapClient := snapfake.NewSimpleClientset()
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), policy)
+	c := NewSnapshotPolicyController(driverName, fake.NewSimpleClientset(pvc, pv), snapClient, dynamicClient, record.NewFakeRecorder(10))
+	now := created.Add(40 * time.Minute)
+	c.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	if err := c.sync(ctx); err != nil {
+		t.Fatalf("sync() error = %v", err)
+	}
+	list, _ := snapClient.SnapshotV1().VolumeSnapshots("default").List(ctx, metav1.ListOptions{})
+	if len(list.Items) != 0 {
+		t.Errorf("suspended policy created %d volume snapshots", len(list.Items))
+	}
+	obj, _ := dynamicClient.Resource(SnapshotPolicyResource).Namespace("default").Get(ctx, "hourly", metav1.GetOptions{})
+	if last, _, _ := unstructured.NestedString(obj.Object, "status", "lastScheduleTime"); last != "2024-05-15T02:00:00Z" {
+		t.Errorf("lastScheduleTime = %q, want the skipped schedule 2024-05-15T02:00:00Z", last)
+	}
+
+	// a snapshot of the policy older than maxAge is pruned while suspended
+	pvcName := "db-0"
+	old := created.Add(-2 * time.Hour)
+	for name, createdAt := range map[string]time.Time{"hourly-db-0-old": old, "hourly-db-0-new": now} {
+		vs := newPolicyTestSnapshot(name, pvcName, createdAt)
+		if _, err := snapClient.SnapshotV1().VolumeSnapshots("default").Create(ctx, vs, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.sync(ctx); err != nil {
+		t.Fatalf("sync() error = %v", err)
+	}
+	list, _ = snapClient.SnapshotV1().VolumeSnapshots("default").List(ctx, metav1.ListOptions{})
+	if len(list.Items) != 1 || list.Items[0].Name != "hourly-db-0-new" {
+		t.Errorf("volume snapshots = %v, want hourly-db-0-new only", list.Items)
+	}
+}
+
+func Test_parseSnapshotPolicySchedule(t *testing.T) {
+	// a Wednesday
+	from := time.Date(2024, 5, 15, 10, 20, 30, 0, time.UTC)
+	tests := []struct {
+		spec    SnapshotPolicySpec
+		want    time.Time
+		wantErr bool
+	}{
+		{spec: SnapshotPolicySpec{Schedule: "*/15 * * * *"}, want: time.Date(2024, 5, 15, 10, 30, 0, 0, time.UTC)},
+		{spec: SnapshotPolicySpec{Schedule: "0 9 * * 1-5"}, want: time.Date(2024, 5, 16, 9, 0, 0, 0, time.UTC)},
+		{spec: SnapshotPolicySpec{Schedule: "@daily"}, want: time.Date(2024, 5, 16, 0, 0, 0, 0, time.UTC)},
+		{spec: SnapshotPolicySpec{Schedule: "0 2 * * *", TimeZone: "Asia/Shanghai"}, want: time.Date(2024, 5, 15, 18, 0, 0, 0, time.UTC)},
+		{spec: SnapshotPolicySpec{Schedule: "0 25 * * *"}, wantErr: true},
+		{spec: SnapshotPolicySpec{Schedule: "* * * *"}, wantErr: true},
+		{spec: SnapshotPolicySpec{Schedule: "0 2 * * *", TimeZone: "Mars/Olympus"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		schedule, loc, err := parseSnapshotPolicySchedule(&tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseSnapshotPolicySchedule(%+v) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got := schedule.Next(from.In(loc)); !got.Equal(tt.want) {
+			t.Errorf("parseSnapshotPolicySchedule(%+v).Next() = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func Test_scheduledSnapshotName(t *testing.T) {
+	scheduled := time.Date(2024, 5, 15, 2, 0, 0, 0, time.FixedZone("CST", 8*3600))
+	if got := scheduledSnapshotName("daily", "db-0", scheduled); got != "daily-db-0-202405141800" {
+		t.Errorf("scheduledSnapshotName() = %q, want daily-db-0-202405141800", got)
+	}
+	long := scheduledSnapshotName("daily", strings.Repeat("a", 250), scheduled)
+	if len(long) > 253 || !strings.HasPrefix(long, "daily-") || !strings.HasSuffix(long, "-202405141800") {
+		t.Errorf("scheduledSnapshotName() of a long pvc name = %q", long)
+	}
+}
+
+func newPolicyTestSnapshot(name, pvcName string, created time.Time) *snapshotv1.VolumeSnapshot {
+	return &snapshotv1.VolumeSnapshot{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         "default",
+			Labels:            map[string]string{LabelSnapshotPolicy: strings.SplitN(name, "-", 2)[0]},
+			CreationTimestamp: metav1.NewTime(created),
+		},
+		Spec: snapshotv1.VolumeSnapshotSpec{
+			Source: snapshotv1.VolumeSnapshotSource{PersistentVolumeClaimName: &pvcName},
+		},
+	}
+}
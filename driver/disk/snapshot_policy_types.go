@@ -0,0 +1,53 @@
+package driver
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// SnapshotPolicyResource is the SnapshotPolicy custom resource, defined by
+// deploy/chart/crds/storage.ksyun.com_snapshotpolicies.yaml
+var SnapshotPolicyResource = schema.GroupVersionResource{
+	Group:    "storage.ksyun.com",
+	Version:  "v1alpha1",
+	Resource: "snapshotpolicies",
+}
+
+// SnapshotPolicy creates VolumeSnapshots of the PVCs selected in its
+// namespace on a cron schedule, and prunes them by the retention rules.
+type SnapshotPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   SnapshotPolicySpec   `json:"spec"`
+	Status SnapshotPolicyStatus `json:"status,omitempty"`
+}
+
+type SnapshotPolicySpec struct {
+	// Schedule is a cron schedule of five fields, such as "0 2 * * *"
+	Schedule string `json:"schedule"`
+	// TimeZone is the IANA time zone of Schedule, UTC when empty
+	TimeZone string `json:"timeZone,omitempty"`
+	// Selector selects the PVCs to snapshot in the namespace of the policy
+	Selector metav1.LabelSelector `json:"selector"`
+	// VolumeSnapshotClassName of the created VolumeSnapshots, the default
+	// class when empty
+	VolumeSnapshotClassName string `json:"volumeSnapshotClassName,omitempty"`
+	// Retention prunes the VolumeSnapshots created by the policy
+	Retention SnapshotRetention `json:"retention,omitempty"`
+	// Suspend stops creating VolumeSnapshots, the pruning goes on
+	Suspend bool `json:"suspend,omitempty"`
+}
+
+// SnapshotRetention keeps a VolumeSnapshot of a PVC while it is one of the
+// KeepLast latest and younger than MaxAge, a rule is disabled when unset
+type SnapshotRetention struct {
+	KeepLast int             `json:"keepLast,omitempty"`
+	MaxAge   metav1.Duration `json:"maxAge,omitempty"`
+}
+
+type SnapshotPolicyStatus struct {
+	// LastScheduleTime is the last schedule the VolumeSnapshots were created
+	// for
+	LastScheduleTime *metav1.Time `json:"lastScheduleTime,omitempty"`
+}
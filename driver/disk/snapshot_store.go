@@ -0,0 +1,305 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// defaultSnapshotStoreTTL is how long a created snapshot is remembered
+	defaultSnapshotStoreTTL = 24 * time.Hour
+	// maxSnapshotStoreEntries bounds the requests and the snapshots kept, the
+	// oldest are dropped first
+	maxSnapshotStoreEntries = 1000
+
+	// snapshotStoreConfigMapKey is the key of the state in the ConfigMap
+	snapshotStoreConfigMapKey = "state"
+)
+
+// snapshotRecord is a created snapshot, the last time it was seen
+type snapshotRecord struct {
+	SnapshotID     string    `json:"snapshotId"`
+	SourceVolumeID string    `json:"sourceVolumeId"`
+	SizeBytes      int64     `json:"sizeBytes"`
+	CreationTime   time.Time `json:"creationTime"`
+	ReadyToUse     bool      `json:"readyToUse"`
+	UpdateTime     time.Time `json:"updateTime"`
+}
+
+// snapshotStoreState maps the names of CreateSnapshot requests to the time
+// of the last request and the created snapshot
+type snapshotStoreState struct {
+	Requests  map[string]time.Time       `json:"requests"`
+	Snapshots map[string]*snapshotRecord `json:"snapshots"`
+}
+
+func newSnapshotStoreState() *snapshotStoreState {
+	return &snapshotStoreState{
+		Requests:  make(map[string]time.Time),
+		Snapshots: make(map[string]*snapshotRecord),
+	}
+}
+
+// snapshotStatePersister saves the state of a SnapshotStore out of the
+// process, so it is shared by the controller replicas
+type snapshotStatePersister interface {
+	Load() (*snapshotStoreState, error)
+	// Update applies apply to the latest saved state and saves it
+	Update(apply func(*snapshotStoreState)) (*snapshotStoreState, error)
+}
+
+// SnapshotStore limits the rate of the CreateSnapshot requests of the same
+// name, and remembers the snapshots created for them. It is safe for
+// concurrent use, the entries expire, and with a persister they survive
+// restarts and leader changes of the controller.
+type SnapshotStore struct {
+	mu sync.Mutex
+	// requestInterval is the minimum time between the requests of a name
+	requestInterval time.Duration
+	// ttl is how long a snapshot is remembered since it was last updated
+	ttl       time.Duration
+	state     *snapshotStoreState
+	persister snapshotStatePersister
+	now       func() time.Time
+}
+
+// NewSnapshotStore returns a SnapshotStore kept in memory, or also saved by
+// persister if it is not nil
+func NewSnapshotStore(requestInterval, ttl time.Duration, persister snapshotStatePersister) *SnapshotStore {
+	s := &SnapshotStore{
+		requestInterval: requestInterval,
+		ttl:             ttl,
+		state:           newSnapshotStoreState(),
+		persister:       persister,
+		now:             time.Now,
+	}
+	if persister != nil {
+		if state, err := persister.Load(); err != nil {
+			klog.Errorf("SnapshotStore:: failed to load the snapshot store: %v", err)
+		} else {
+			s.state = state
+		}
+	}
+	return s
+}
+
+// AllowRequest records a request of name and returns true, or returns false
+// if the last request of name was within the request interval
+func (s *SnapshotStore) AllowRequest(name string) bool {
+	allowed := false
+	s.update(func(state *snapshotStoreState, now time.Time) {
+		if last, ok := state.Requests[name]; ok && now.Sub(last) < s.requestInterval {
+			return
+		}
+		state.Requests[name] = now
+		allowed = true
+	})
+	return allowed
+}
+
+// ForgetRequest allows the next request of name right away
+func (s *SnapshotStore) ForgetRequest(name string) {
+	s.update(func(state *snapshotStoreState, now time.Time) {
+		delete(state.Requests, name)
+	})
+}
+
+// SetSnapshot remembers snapshot as created for the request name
+func (s *SnapshotStore) SetSnapshot(name string, snapshot *csi.Snapshot) {
+	s.update(func(state *snapshotStoreState, now time.Time) {
+		state.Snapshots[name] = &snapshotRecord{
+			SnapshotID:     snapshot.SnapshotId,
+			SourceVolumeID: snapshot.SourceVolumeId,
+			SizeBytes:      snapshot.SizeBytes,
+			CreationTime:   snapshot.CreationTime.AsTime(),
+			ReadyToUse:     snapshot.ReadyToUse,
+			UpdateTime:     now,
+		}
+	})
+}
+
+// GetSnapshot returns the snapshot created for the request name, or nil. It
+// reads the state in memory, which is loaded at startup and replaced by the
+// saved one on every update, so the snapshots of a previous leader are seen
+// after the AllowRequest of the request.
+func (s *SnapshotStore) GetSnapshot(name string) *csi.Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.state.Snapshots[name]
+	if !ok || s.now().Sub(record.UpdateTime) >= s.ttl {
+		return nil
+	}
+	return &csi.Snapshot{
+		SnapshotId:     record.SnapshotID,
+		SourceVolumeId: record.SourceVolumeID,
+		SizeBytes:      record.SizeBytes,
+		CreationTime:   timestamppb.New(record.CreationTime),
+		ReadyToUse:     record.ReadyToUse,
+	}
+}
+
+// DeleteSnapshot forgets the snapshot created for the request name
+func (s *SnapshotStore) DeleteSnapshot(name string) {
+	s.update(func(state *snapshotStoreState, now time.Time) {
+		delete(state.Snapshots, name)
+	})
+}
+
+// update applies apply to the latest state, together with the expiration.
+// A failure to persist is logged and the state is still updated in memory.
+func (s *SnapshotStore) update(apply func(state *snapshotStoreState, now time.Time)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	applyAndExpire := func(state *snapshotStoreState) {
+		apply(state, now)
+		s.expire(state, now)
+	}
+	if s.persister != nil {
+		state, err := s.persister.Update(applyAndExpire)
+		if err == nil {
+			s.state = state
+			return
+		}
+		klog.Errorf("SnapshotStore:: failed to save the snapshot store: %v", err)
+	}
+	applyAndExpire(s.state)
+}
+
+// expire drops the requests out of the request interval and the snapshots
+// out of ttl, then the oldest entries over maxSnapshotStoreEntries
+func (s *SnapshotStore) expire(state *snapshotStoreState, now time.Time) {
+	for name, last := range state.Requests {
+		if now.Sub(last) >= s.requestInterval {
+			delete(state.Requests, name)
+		}
+	}
+	for name, record := range state.Snapshots {
+		if now.Sub(record.UpdateTime) >= s.ttl {
+			delete(state.Snapshots, name)
+		}
+	}
+	if len(state.Requests) > maxSnapshotStoreEntries {
+		names := make([]string, 0, len(state.Requests))
+		for name := range state.Requests {
+			names = append(names, name)
+		}
+		sort.Slice(names, func(i, j int) bool { return state.Requests[names[i]].Before(state.Requests[names[j]]) })
+		for _, name := range names[:len(names)-maxSnapshotStoreEntries] {
+			delete(state.Requests, name)
+		}
+	}
+	if len(state.Snapshots) > maxSnapshotStoreEntries {
+		names := make([]string, 0, len(state.Snapshots))
+		for name := range state.Snapshots {
+			names = append(names, name)
+		}
+		sort.Slice(names, func(i, j int) bool {
+			return state.Snapshots[names[i]].UpdateTime.Before(state.Snapshots[names[j]].UpdateTime)
+		})
+		for _, name := range names[:len(names)-maxSnapshotStoreEntries] {
+			delete(state.Snapshots, name)
+		}
+	}
+}
+
+// configMapSnapshotPersister saves the state of a SnapshotStore in a
+// ConfigMap, which is created when it does not exist
+type configMapSnapshotPersister struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+}
+
+func NewConfigMapSnapshotPersister(client kubernetes.Interface, namespace, name string) *configMapSnapshotPersister {
+	return &configMapSnapshotPersister{
+		client:    client,
+		namespace: namespace,
+		name:      name,
+	}
+}
+
+func (p *configMapSnapshotPersister) Load() (*snapshotStoreState, error) {
+	cm, err := p.client.CoreV1().ConfigMaps(p.namespace).Get(context.Background(), p.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return newSnapshotStoreState(), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get configmap %s/%s: %v", p.namespace, p.name, err)
+	}
+	return p.decode(cm)
+}
+
+func (p *configMapSnapshotPersister) Update(apply func(*snapshotStoreState)) (*snapshotStoreState, error) {
+	var state *snapshotStoreState
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		ctx := context.Background()
+		cm, err := p.client.CoreV1().ConfigMaps(p.namespace).Get(ctx, p.name, metav1.GetOptions{})
+		notFound := apierrors.IsNotFound(err)
+		switch {
+		case notFound:
+			cm = &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: p.name, Namespace: p.namespace}}
+			state = newSnapshotStoreState()
+		case err != nil:
+			return err
+		default:
+			if state, err = p.decode(cm); err != nil {
+				// a broken state only loses the bookkeeping, start over
+				klog.Warningf("SnapshotStore:: %v, reset", err)
+				state = newSnapshotStoreState()
+			}
+		}
+		apply(state)
+		data, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		cm = cm.DeepCopy()
+		cm.Data = map[string]string{snapshotStoreConfigMapKey: string(data)}
+		if notFound {
+			_, err = p.client.CoreV1().ConfigMaps(p.namespace).Create(ctx, cm, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				// created by another replica, retried as a conflict
+				return apierrors.NewConflict(v1.Resource("configmaps"), p.name, err)
+			}
+			return err
+		}
+		_, err = p.client.CoreV1().ConfigMaps(p.namespace).Update(ctx, cm, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to update configmap %s/%s: %v", p.namespace, p.name, err)
+	}
+	return state, nil
+}
+
+func (p *configMapSnapshotPersister) decode(cm *v1.ConfigMap) (*snapshotStoreState, error) {
+	state := newSnapshotStoreState()
+	data, ok := cm.Data[snapshotStoreConfigMapKey]
+	if !ok {
+		return state, nil
+	}
+	if err := json.Unmarshal([]byte(data), state); err != nil {
+		return nil, fmt.Errorf("failed to decode configmap %s/%s: %v", p.namespace, p.name, err)
+	}
+	if state.Requests == nil {
+		state.Requests = make(map[string]time.Time)
+	}
+	if state.Snapshots == nil {
+		state.Snapshots = make(map[string]*snapshotRecord)
+	}
+	return state, nil
+}
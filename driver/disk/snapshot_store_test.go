@@ -0,0 +1,173 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	ebsClient "csi-plugin/pkg/ebs-client"
+	"csi-plugin/util"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestSnapshotStore(t *testing.T) {
+	now := time.Now()
+	s := NewSnapshotStore(10*time.Second, time.Hour, nil)
+	s.now = func() time.Time { return now }
+
+	if !s.AllowRequest("snap-a") {
+		t.Fatal("first request is not allowed")
+	}
+	if s.AllowRequest("snap-a") {
+		t.Error("repeated request within the interval is allowed")
+	}
+	if !s.AllowRequest("snap-b") {
+		t.Error("request of another name is not allowed")
+	}
+	now = now.Add(10 * time.Second)
+	if !s.AllowRequest("snap-a") {
+		t.Error("request after the interval is not allowed")
+	}
+	s.ForgetRequest("snap-a")
+	if !s.AllowRequest("snap-a") {
+		t.Error("request after ForgetRequest is not allowed")
+	}
+
+	s.SetSnapshot("snap-a", &csi.Snapshot{SnapshotId: "id-a", SourceVolumeId: "vol-a", CreationTime: timestamppb.New(now)})
+	if got := s.GetSnapshot("snap-a"); got == nil || got.SnapshotId != "id-a" || got.SourceVolumeId != "vol-a" {
+		t.Errorf("GetSnapshot() = %v, want id-a of vol-a", got)
+	}
+	s.DeleteSnapshot("snap-a")
+	if got := s.GetSnapshot("snap-a"); got != nil {
+		t.Errorf("GetSnapshot() after DeleteSnapshot = %v, want nil", got)
+	}
+
+	s.SetSnapshot("snap-b", &csi.Snapshot{SnapshotId: "id-b", CreationTime: timestamppb.New(now)})
+	now = now.Add(time.Hour)
+	if got := s.GetSnapshot("snap-b"); got != nil {
+		t.Errorf("GetSnapshot() after ttl = %v, want nil", got)
+	}
+	s.ForgetRequest("snap-c")
+	if len(s.state.Requests) != 0 || len(s.state.Snapshots) != 0 {
+		t.Errorf("state = %+v, want the expired entries dropped", s.state)
+	}
+}
+
+func TestSnapshotStoreBounded(t *testing.T) {
+	now := time.Now()
+	s := NewSnapshotStore(time.Hour, time.Hour, nil)
+	s.now = func() time.Time { return now }
+	for i := 0; i < maxSnapshotStoreEntries+10; i++ {
+		now = now.Add(time.Millisecond)
+		name := fmt.Sprintf("snap-%d", i)
+		s.AllowRequest(name)
+		s.SetSnapshot(name, &csi.Snapshot{SnapshotId: name, CreationTime: timestamppb.New(now)})
+	}
+	if len(s.state.Requests) != maxSnapshotStoreEntries || len(s.state.Snapshots) != maxSnapshotStoreEntries {
+		t.Fatalf("%d requests and %d snapshots kept, want %d", len(s.state.Requests), len(s.state.Snapshots), maxSnapshotStoreEntries)
+	}
+	if s.GetSnapshot("snap-0") != nil || s.GetSnapshot(fmt.Sprintf("snap-%d", maxSnapshotStoreEntries+9)) == nil {
+		t.Error("the oldest snapshots are not dropped first")
+	}
+}
+
+func TestSnapshotStoreConcurrent(t *testing.T) {
+	s := NewSnapshotStore(time.Hour, time.Hour, nil)
+	var wg sync.WaitGroup
+	allowed := make([]bool, 20)
+	for i := range allowed {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			allowed[i] = s.AllowRequest("snap-a")
+			s.SetSnapshot(fmt.Sprintf("snap-%d", i), &csi.Snapshot{CreationTime: timestamppb.Now()})
+		}(i)
+	}
+	wg.Wait()
+	count := 0
+	for _, ok := range allowed {
+		if ok {
+			count++
+		}
+	}
+	if count != 1 || len(s.state.Snapshots) != len(allowed) {
+		t.Errorf("%d requests allowed and %d snapshots kept, want 1 and %d", count, len(s.state.Snapshots), len(allowed))
+	}
+}
+
+func TestSnapshotStoreConfigMap(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	leader := NewSnapshotStore(time.Hour, time.Hour, NewConfigMapSnapshotPersister(client, "kube-system", "csi-disk-snapshots"))
+	// started before the first leader saved anything
+	next := NewSnapshotStore(time.Hour, time.Hour, NewConfigMapSnapshotPersister(client, "kube-system", "csi-disk-snapshots"))
+
+	if !leader.AllowRequest("snap-a") {
+		t.Fatal("first request is not allowed")
+	}
+	leader.SetSnapshot("snap-a", &csi.Snapshot{SnapshotId: "id-a", SourceVolumeId: "vol-a", CreationTime: timestamppb.Now()})
+	leader.SetSnapshot("snap-b", &csi.Snapshot{SnapshotId: "id-b", SourceVolumeId: "vol-b", CreationTime: timestamppb.Now()})
+	leader.DeleteSnapshot("snap-b")
+
+	if next.AllowRequest("snap-a") {
+		t.Error("request limited by the previous leader is allowed")
+	}
+	if got := next.GetSnapshot("snap-a"); got == nil || got.SnapshotId != "id-a" {
+		t.Errorf("GetSnapshot() = %v, want id-a saved by the previous leader", got)
+	}
+	if got := next.GetSnapshot("snap-b"); got != nil {
+		t.Errorf("GetSnapshot() = %v, want the snapshot deleted by the previous leader", got)
+	}
+	// a miss is answered from memory
+	actions := len(client.Actions())
+	if got := next.GetSnapshot("snap-c"); got != nil || len(client.Actions()) != actions {
+		t.Errorf("GetSnapshot() of a missing snapshot = %v with %d api calls, want nil without any", got, len(client.Actions())-actions)
+	}
+
+	restarted := NewSnapshotStore(time.Hour, time.Hour, NewConfigMapSnapshotPersister(client, "kube-system", "csi-disk-snapshots"))
+	if len(restarted.state.Snapshots) != 1 || len(restarted.state.Requests) != 1 {
+		t.Errorf("restarted state = %+v, want 1 request and 1 snapshot", restarted.state)
+	}
+}
+
+func TestCreateSnapshotRequestLimit(t *testing.T) {
+	fakeClient := NewFakeStorageClient()
+	vol, err := fakeClient.CreateVolume(&ebsClient.CreateVolumeReq{VolumeType: ESSD_PL1, Size: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := &KscEBSControllerServer{
+		ebsClient:     fakeClient,
+		recorder:      record.NewFakeRecorder(10),
+		volumeLocks:   util.NewVolumeLocks(),
+		snapshotStore: NewSnapshotStore(time.Hour, time.Hour, nil),
+	}
+	req := &csi.CreateSnapshotRequest{Name: "snapshot-a", SourceVolumeId: vol.VolumeId}
+	first, err := cs.CreateSnapshot(context.Background(), req)
+	if err != nil {
+		t.Fatalf("CreateSnapshot() error = %v", err)
+	}
+	// repeated within the interval, answered with the snapshot being created
+	second, err := cs.CreateSnapshot(context.Background(), req)
+	if err != nil {
+		t.Fatalf("repeated CreateSnapshot() error = %v", err)
+	}
+	if second.Snapshot.SnapshotId != first.Snapshot.SnapshotId || len(fakeClient.snapshots) != 1 {
+		t.Errorf("repeated CreateSnapshot() = %v with %d snapshots, want %s only", second.Snapshot, len(fakeClient.snapshots), first.Snapshot.SnapshotId)
+	}
+	if _, err := cs.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: req.Name, SourceVolumeId: "other"}); err == nil {
+		t.Error("repeated CreateSnapshot() of another volume succeeded")
+	}
+
+	if _, err := cs.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: first.Snapshot.SnapshotId}); err != nil {
+		t.Fatalf("DeleteSnapshot() error = %v", err)
+	}
+	if got := cs.snapshotStore.GetSnapshot(req.Name); got != nil {
+		t.Errorf("snapshot %v is remembered after DeleteSnapshot()", got)
+	}
+}
@@ -0,0 +1,322 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	ebsClient "csi-plugin/pkg/ebs-client"
+	"csi-plugin/util"
+
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	snapClientset "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned"
+	snapInformers "github.com/kubernetes-csi/external-snapshotter/client/v4/informers/externalversions"
+	snapListers "github.com/kubernetes-csi/external-snapshotter/client/v4/listers/volumesnapshot/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// SnapshotTrackerLeaseName is the lease of the controller replica running
+	// the snapshot tracker
+	SnapshotTrackerLeaseName = "com-ksc-csi-diskplugin-snapshot-tracker"
+
+	snapshotTrackerResync = 10 * time.Minute
+)
+
+// SnapshotTrackerConfig configures how the pending snapshots are polled
+type SnapshotTrackerConfig struct {
+	// MinBackoff and MaxBackoff bound the interval between the polls of a
+	// snapshot, which doubles from MinBackoff while it is not ready
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// SLA is how long a snapshot may take to be ready before a warning
+	// event, disabled when 0
+	SLA time.Duration
+}
+
+func (c *SnapshotTrackerConfig) Validate() error {
+	if c.MinBackoff <= 0 || c.MaxBackoff < c.MinBackoff {
+		return fmt.Errorf("invalid snapshot tracker backoff %v-%v", c.MinBackoff, c.MaxBackoff)
+	}
+	if c.SLA < 0 {
+		return fmt.Errorf("invalid snapshot tracker sla %v", c.SLA)
+	}
+	return nil
+}
+
+// SnapshotTracker polls the disk snapshots of the VolumeSnapshotContents
+// until they are ready, and reports the status and progress with the
+// AnnSnapshotStatus and AnnSnapshotProgress annotations of the
+// VolumeSnapshotContent and its VolumeSnapshot. A snapshot in error status
+// or not ready within the SLA gets a warning event on the VolumeSnapshot.
+type SnapshotTracker struct {
+	driverName string
+	config     SnapshotTrackerConfig
+	k8sClient  kubernetes.Interface
+	snapClient snapClientset.Interface
+	ebsClient  ebsClient.StorageService
+	recorder   record.EventRecorder
+	now        func() time.Time
+
+	mu sync.Mutex
+	// slaExceeded is the VolumeSnapshotContents warned about the SLA
+	slaExceeded map[string]bool
+}
+
+func NewSnapshotTracker(driverName string, config SnapshotTrackerConfig, k8sClient kubernetes.Interface, snapClient snapClientset.Interface, ebsClient ebsClient.StorageService, recorder record.EventRecorder) *SnapshotTracker {
+	return &SnapshotTracker{
+		driverName:  driverName,
+		config:      config,
+		k8sClient:   k8sClient,
+		snapClient:  snapClient,
+		ebsClient:   ebsClient,
+		recorder:    recorder,
+		now:         time.Now,
+		slaExceeded: make(map[string]bool),
+	}
+}
+
+// Run watches the VolumeSnapshotContents until ctx is done
+func (st *SnapshotTracker) Run(ctx context.Context) {
+	factory := snapInformers.NewSharedInformerFactory(st.snapClient, snapshotTrackerResync)
+	contentInformer := factory.Snapshot().V1().VolumeSnapshotContents()
+	queue := workqueue.NewNamedRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(st.config.MinBackoff, st.config.MaxBackoff), "snapshot-tracker")
+	defer queue.ShutDown()
+
+	enqueue := func(obj interface{}) {
+		content, ok := obj.(*snapshotv1.VolumeSnapshotContent)
+		if !ok || !st.needsTracking(content) {
+			return
+		}
+		if key, err := cache.MetaNamespaceKeyFunc(content); err == nil {
+			queue.Add(key)
+		}
+	}
+	contentInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: enqueue,
+		UpdateFunc: func(oldObj, obj interface{}) {
+			// the annotations set by the tracker would requeue the content
+			// at once, instead of after the backoff of the rate limiter
+			oldContent, ok := oldObj.(*snapshotv1.VolumeSnapshotContent)
+			content, ok2 := obj.(*snapshotv1.VolumeSnapshotContent)
+			if ok && ok2 && onlyTrackerAnnotationsChanged(oldContent, content) {
+				return
+			}
+			enqueue(obj)
+		},
+	})
+
+	klog.Infof("SnapshotTracker:: starting")
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), contentInformer.Informer().HasSynced) {
+		klog.Errorf("SnapshotTracker:: failed to sync the volume snapshot content cache")
+		return
+	}
+
+	lister := contentInformer.Lister()
+	go wait.Until(func() {
+		for st.processNextItem(ctx, queue, lister) {
+		}
+	}, time.Second, ctx.Done())
+
+	<-ctx.Done()
+	klog.Infof("SnapshotTracker:: stopped")
+}
+
+// onlyTrackerAnnotationsChanged returns whether newContent differs from
+// oldContent only by the annotations the tracker sets. A resync, with the
+// same resource version, is not such an update.
+func onlyTrackerAnnotationsChanged(oldContent, newContent *snapshotv1.VolumeSnapshotContent) bool {
+	if oldContent.ResourceVersion == newContent.ResourceVersion {
+		return false
+	}
+	oldCopy, newCopy := oldContent.DeepCopy(), newContent.DeepCopy()
+	for _, content := range []*snapshotv1.VolumeSnapshotContent{oldCopy, newCopy} {
+		delete(content.Annotations, AnnSnapshotStatus)
+		delete(content.Annotations, AnnSnapshotProgress)
+		content.ResourceVersion = ""
+		content.ManagedFields = nil
+	}
+	return equality.Semantic.DeepEqual(oldCopy, newCopy)
+}
+
+// needsTracking returns whether the snapshot of content is created by the
+// driver and not yet reported as ready or failed
+func (st *SnapshotTracker) needsTracking(content *snapshotv1.VolumeSnapshotContent) bool {
+	if content.Spec.Driver != st.driverName || content.DeletionTimestamp != nil || contentSnapshotID(content) == "" {
+		return false
+	}
+	switch content.Annotations[AnnSnapshotStatus] {
+	case ebsClient.SNAPSHOT_AVAILABLE_STATUS, ebsClient.SNAPSHOT_ERROR_STATUS:
+		return false
+	}
+	return true
+}
+
+func (st *SnapshotTracker) processNextItem(ctx context.Context, queue workqueue.RateLimitingInterface, lister snapListers.VolumeSnapshotContentLister) bool {
+	key, quit := queue.Get()
+	if quit {
+		return false
+	}
+	defer queue.Done(key)
+
+	content, err := lister.Get(key.(string))
+	if apierrors.IsNotFound(err) {
+		st.forget(key.(string))
+		queue.Forget(key)
+		return true
+	}
+	if err == nil {
+		var done bool
+		if done, err = st.syncContent(ctx, content); err == nil {
+			if done {
+				st.forget(key.(string))
+				queue.Forget(key)
+			} else {
+				// polled again with backoff until it is ready
+				queue.AddRateLimited(key)
+			}
+			return true
+		}
+	}
+	klog.Errorf("SnapshotTracker:: failed to sync volume snapshot content %s: %v", key, err)
+	queue.AddRateLimited(key)
+	return true
+}
+
+// syncContent reports the status of the snapshot of content, it returns
+// true when the snapshot no longer needs to be polled
+func (st *SnapshotTracker) syncContent(ctx context.Context, content *snapshotv1.VolumeSnapshotContent) (bool, error) {
+	if !st.needsTracking(content) {
+		return true, nil
+	}
+	snapshotID := contentSnapshotID(content)
+	snapshot, err := st.ebsClient.GetSnapshot(&ebsClient.DescribeSnapshotsReq{SnapshotId: snapshotID})
+	if err != nil {
+		return false, err
+	}
+	if snapshot == nil {
+		klog.Warningf("SnapshotTracker:: snapshot %s of volume snapshot content %s not found", snapshotID, content.Name)
+		return true, nil
+	}
+
+	progress := formatSnapshotProgress(snapshot)
+	klog.V(4).Infof("SnapshotTracker:: snapshot %s of volume snapshot content %s is %s, progress %s", snapshotID, content.Name, snapshot.SnapshotStatus, progress)
+	annotations := map[string]string{
+		AnnSnapshotStatus:   snapshot.SnapshotStatus,
+		AnnSnapshotProgress: progress,
+	}
+	if err := st.setAnnotations(ctx, content, annotations); err != nil {
+		return false, err
+	}
+
+	switch snapshot.SnapshotStatus {
+	case ebsClient.SNAPSHOT_AVAILABLE_STATUS:
+		return true, nil
+	case ebsClient.SNAPSHOT_ERROR_STATUS:
+		msg := fmt.Sprintf("snapshot %s of volume %s is in error status", snapshotID, snapshot.VolumeID)
+		st.createEvent(content, v1.EventTypeWarning, snapshotFailed, msg)
+		return true, nil
+	}
+	if elapsed := st.now().Sub(content.CreationTimestamp.Time); st.config.SLA > 0 && elapsed > st.config.SLA {
+		st.mu.Lock()
+		warned := st.slaExceeded[content.Name]
+		st.slaExceeded[content.Name] = true
+		st.mu.Unlock()
+		if !warned {
+			msg := fmt.Sprintf("snapshot %s of volume %s is not ready in %v, status %s, progress %s", snapshotID, snapshot.VolumeID, st.config.SLA, snapshot.SnapshotStatus, progress)
+			st.createEvent(content, v1.EventTypeWarning, snapshotSLAExceeded, msg)
+		}
+	}
+	return false, nil
+}
+
+// setAnnotations merges annotations into the VolumeSnapshotContent and its
+// VolumeSnapshot if they are changed
+func (st *SnapshotTracker) setAnnotations(ctx context.Context, content *snapshotv1.VolumeSnapshotContent, annotations map[string]string) error {
+	changed := false
+	for k, v := range annotations {
+		if content.Annotations[k] != v {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": annotations},
+	})
+	if err != nil {
+		return err
+	}
+	// the VolumeSnapshot is patched first, the status of the content stops
+	// the tracking when it is final
+	ref := content.Spec.VolumeSnapshotRef
+	if ref.Name != "" && ref.Namespace != "" {
+		_, err := st.snapClient.SnapshotV1().VolumeSnapshots(ref.Namespace).Patch(ctx, ref.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("failed to annotate volume snapshot %s/%s: %v", ref.Namespace, ref.Name, err)
+		}
+	}
+	if _, err := st.snapClient.SnapshotV1().VolumeSnapshotContents().Patch(ctx, content.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("failed to annotate volume snapshot content %s: %v", content.Name, err)
+	}
+	return nil
+}
+
+func (st *SnapshotTracker) createEvent(content *snapshotv1.VolumeSnapshotContent, eventType, reason, message string) {
+	if st.recorder == nil {
+		return
+	}
+	ref := &v1.ObjectReference{
+		Kind:      "VolumeSnapshot",
+		Name:      content.Spec.VolumeSnapshotRef.Name,
+		Namespace: content.Spec.VolumeSnapshotRef.Namespace,
+		UID:       content.Spec.VolumeSnapshotRef.UID,
+	}
+	util.CreateEvent(st.recorder, ref, eventType, reason, message)
+}
+
+func (st *SnapshotTracker) forget(name string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.slaExceeded, name)
+}
+
+// contentSnapshotID returns the disk snapshot id of content, or "" if it is
+// not created yet
+func contentSnapshotID(content *snapshotv1.VolumeSnapshotContent) string {
+	if content.Status != nil && content.Status.SnapshotHandle != nil {
+		return *content.Status.SnapshotHandle
+	}
+	if content.Spec.Source.SnapshotHandle != nil {
+		return *content.Spec.Source.SnapshotHandle
+	}
+	return ""
+}
+
+// formatSnapshotProgress returns the progress of snapshot as a percentage,
+// such as "45%"
+func formatSnapshotProgress(snapshot *ebsClient.Snapshot) string {
+	if snapshot.SnapshotStatus == ebsClient.SNAPSHOT_AVAILABLE_STATUS {
+		return "100%"
+	}
+	progress := strings.TrimSuffix(strings.TrimSpace(snapshot.Progress), "%")
+	if progress == "" {
+		return "0%"
+	}
+	return progress + "%"
+}
@@ -0,0 +1,201 @@
+package driver
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	ebsClient "csi-plugin/pkg/ebs-client"
+
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	snapfake "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned/fake"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestSnapshotTrackerSyncContent(t *testing.T) {
+	storageClient := NewFakeStorageClient()
+	vol, err := storageClient.CreateVolume(&ebsClient.CreateVolumeReq{VolumeType: ESSD_PL1, Size: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := storageClient.CreateSnapshot(&ebsClient.CreateSnapshotReq{VolumeId: vol.VolumeId, SnapshotName: "snapshot-a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := storageClient.snapshots[resp.SnapshotID]
+	snapshot.SnapshotStatus = ebsClient.SNAPSHOT_CREATING_STATUS
+	snapshot.Progress = "40"
+
+	created := time.Now()
+	vs := &snapshotv1.VolumeSnapshot{ObjectMeta: metav1.ObjectMeta{Name: "vs-a", Namespace: "default"}}
+	content := &snapshotv1.VolumeSnapshotContent{
+		ObjectMeta: metav1.ObjectMeta{Name: "snapcontent-a", CreationTimestamp: metav1.NewTime(created)},
+		Spec: snapshotv1.VolumeSnapshotContentSpec{
+			Driver:            driverName,
+			VolumeSnapshotRef: v1.ObjectReference{Name: vs.Name, Namespace: vs.Namespace},
+		},
+		Status: &snapshotv1.VolumeSnapshotContentStatus{SnapshotHandle: &resp.SnapshotID},
+	}
+	otherContent := content.DeepCopy()
+	otherContent.Name = "snapcontent-other"
+	otherContent.Spec.Driver = "other.csi.driver"
+	snapClient := snapfake.NewSimpleClientset(vs, content, otherContent)
+	recorder := record.NewFakeRecorder(10)
+	config := SnapshotTrackerConfig{MinBackoff: time.Second, MaxBackoff: time.Minute, SLA: time.Hour}
+	st := NewSnapshotTracker(driverName, config, fake.NewSimpleClientset(), snapClient, storageClient, recorder)
+	now := created
+	st.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	sync := func(name string) bool {
+		t.Helper()
+		content, err := snapClient.SnapshotV1().VolumeSnapshotContents().Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		done, err := st.syncContent(ctx, content)
+		if err != nil {
+			t.Fatalf("syncContent() error = %v", err)
+		}
+		return done
+	}
+	checkAnnotations := func(status, progress string) {
+		t.Helper()
+		gotContent, _ := snapClient.SnapshotV1().VolumeSnapshotContents().Get(ctx, content.Name, metav1.GetOptions{})
+		gotVS, _ := snapClient.SnapshotV1().VolumeSnapshots(vs.Namespace).Get(ctx, vs.Name, metav1.GetOptions{})
+		for _, annotations := range []map[string]string{gotContent.Annotations, gotVS.Annotations} {
+			if annotations[AnnSnapshotStatus] != status || annotations[AnnSnapshotProgress] != progress {
+				t.Errorf("annotations = %v, want status %s and progress %s", annotations, status, progress)
+			}
+		}
+	}
+	checkEvents := func(want ...string) {
+		t.Helper()
+		for _, reason := range want {
+			select {
+			case event := <-recorder.Events:
+				if !strings.Contains(event, reason) {
+					t.Errorf("event = %q, want reason %s", event, reason)
+				}
+			default:
+				t.Errorf("no event, want reason %s", reason)
+			}
+		}
+		select {
+		case event := <-recorder.Events:
+			t.Errorf("unexpected event %q", event)
+		default:
+		}
+	}
+
+	if !sync(otherContent.Name) {
+		t.Error("content of another driver is tracked")
+	}
+	if sync(content.Name) {
+		t.Error("creating snapshot is not tracked")
+	}
+	checkAnnotations(ebsClient.SNAPSHOT_CREATING_STATUS, "40%")
+	checkEvents()
+
+	snapshot.Progress = "80%"
+	now = created.Add(2 * time.Hour)
+	for i := 0; i < 2; i++ {
+		if sync(content.Name) {
+			t.Error("creating snapshot is not tracked")
+		}
+	}
+	checkAnnotations(ebsClient.SNAPSHOT_CREATING_STATUS, "80%")
+	checkEvents(snapshotSLAExceeded)
+
+	snapshot.SnapshotStatus = ebsClient.SNAPSHOT_AVAILABLE_STATUS
+	if !sync(content.Name) {
+		t.Error("available snapshot is still tracked")
+	}
+	checkAnnotations(ebsClient.SNAPSHOT_AVAILABLE_STATUS, "100%")
+	checkEvents()
+	if !sync(content.Name) {
+		t.Error("reported snapshot is tracked again")
+	}
+}
+
+func TestSnapshotTrackerErrorStatus(t *testing.T) {
+	storageClient := NewFakeStorageClient()
+	resp, err := storageClient.CreateSnapshot(&ebsClient.CreateSnapshotReq{VolumeId: "vol-a", SnapshotName: "snapshot-a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storageClient.snapshots[resp.SnapshotID].SnapshotStatus = ebsClient.SNAPSHOT_ERROR_STATUS
+	content := &snapshotv1.VolumeSnapshotContent{
+		ObjectMeta: metav1.ObjectMeta{Name: "snapcontent-a"},
+		Spec: snapshotv1.VolumeSnapshotContentSpec{
+			Driver:            driverName,
+			VolumeSnapshotRef: v1.ObjectReference{Name: "vs-a", Namespace: "default"},
+		},
+		Status: &snapshotv1.VolumeSnapshotContentStatus{SnapshotHandle: &resp.SnapshotID},
+	}
+	recorder := record.NewFakeRecorder(10)
+	config := SnapshotTrackerConfig{MinBackoff: time.Second, MaxBackoff: time.Minute}
+	// the VolumeSnapshot is already deleted
+	st := NewSnapshotTracker(driverName, config, fake.NewSimpleClientset(), snapfake.NewSimpleClientset(content), storageClient, recorder)
+
+	done, err := st.syncContent(context.Background(), content)
+	if err != nil || !done {
+		t.Fatalf("syncContent() = %v, %v, want done", done, err)
+	}
+	if len(recorder.Events) != 1 || !strings.Contains(<-recorder.Events, snapshotFailed) {
+		t.Errorf("want one %s event", snapshotFailed)
+	}
+}
+
+func TestSnapshotTrackerOnlyTrackerAnnotationsChanged(t *testing.T) {
+	snapshotID := "snapshot-a"
+	oldContent := &snapshotv1.VolumeSnapshotContent{
+		ObjectMeta: metav1.ObjectMeta{Name: "snapcontent-a", ResourceVersion: "1"},
+		Spec:       snapshotv1.VolumeSnapshotContentSpec{Driver: driverName},
+		Status:     &snapshotv1.VolumeSnapshotContentStatus{SnapshotHandle: &snapshotID},
+	}
+	annotated := oldContent.DeepCopy()
+	annotated.ResourceVersion = "2"
+	annotated.Annotations = map[string]string{AnnSnapshotStatus: "creating", AnnSnapshotProgress: "45%"}
+	ready := annotated.DeepCopy()
+	ready.ResourceVersion = "3"
+	readyToUse := true
+	ready.Status.ReadyToUse = &readyToUse
+
+	tests := []struct {
+		name     string
+		old, new *snapshotv1.VolumeSnapshotContent
+		want     bool
+	}{
+		{name: "tracker annotations", old: oldContent, new: annotated, want: true},
+		{name: "resync", old: annotated, new: annotated},
+		{name: "status", old: annotated, new: ready},
+	}
+	for _, tt := range tests {
+		if got := onlyTrackerAnnotationsChanged(tt.old, tt.new); got != tt.want {
+			t.Errorf("onlyTrackerAnnotationsChanged() of %s = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSnapshotTrackerConfigValidate(t *testing.T) {
+	tests := []struct {
+		config  SnapshotTrackerConfig
+		wantErr bool
+	}{
+		{config: SnapshotTrackerConfig{MinBackoff: time.Second, MaxBackoff: time.Minute, SLA: time.Hour}},
+		{config: SnapshotTrackerConfig{MinBackoff: time.Second, MaxBackoff: time.Second}},
+		{config: SnapshotTrackerConfig{MaxBackoff: time.Minute}, wantErr: true},
+		{config: SnapshotTrackerConfig{MinBackoff: time.Minute, MaxBackoff: time.Second}, wantErr: true},
+		{config: SnapshotTrackerConfig{MinBackoff: time.Second, MaxBackoff: time.Minute, SLA: -time.Hour}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := tt.config.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("Validate(%+v) error = %v, wantErr %v", tt.config, err, tt.wantErr)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package driver
 
 import (
+	"crypto/sha256"
 	OpenApi "csi-plugin/pkg/open-api"
 	"csi-plugin/util"
 	"encoding/json"
@@ -9,10 +10,10 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog/v2"
-	"math/rand"
 	"os"
 	"regexp"
 	"strconv"
@@ -23,15 +24,28 @@ import (
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"golang.org/x/net/context"
 
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
 	k8sclient "k8s.io/client-go/kubernetes"
 	core_v1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
 )
 
 var (
-	supportedAccessMode = &csi.VolumeCapability_AccessMode{
-		Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+	// the single node access modes and ReadOnlyMany are accepted, an EBS disk
+	// is attached to a single instance at a time, so ControllerPublishVolume
+	// keeps a ReadOnlyMany volume on a single node. SINGLE_NODE_MULTI_WRITER is
+	// supported to let the provisioner pass ReadWriteOncePod as
+	// SINGLE_NODE_SINGLE_WRITER.
+	supportedAccessModes = []csi.VolumeCapability_AccessMode_Mode{
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
 	}
 )
 
@@ -51,15 +65,14 @@ const (
 	// defaultVolumeSizeInBytes is used when the user did not provide a size or
 	// the size they provided did not satisfy our requirements
 	defaultVolumeSizeInBytes int64 = 16 * GB
+
+	volumeOperationAlreadyExistsFmt = "An operation with the given Volume ID %s already exists"
 )
 
 var (
 	AvailableVolumeTypes  = []string{SSD2_0, SSD3_0, SATA3_0, EHDD, ESSD, ESSD_PL1, ESSD_PL2, ESSD_PL3, ESSD_PL0}
 	CustomDiskTypes       = map[string]int{ESSD: 0, SSD3_0: 1, SSD2_0: 2, SATA3_0: 3, EHDD: 4}
 	CustomDiskPerfermance = map[string]string{DISK_PERFORMANCE_LEVEL0: "", DISK_PERFORMANCE_LEVEL1: "", DISK_PERFORMANCE_LEVEL2: "", DISK_PERFORMANCE_LEVEL3: ""}
-
-	// the map of multizone and index
-	storageClassZonePos = map[string]int{}
 )
 
 type AccountAllProjectListResp struct {
@@ -124,11 +137,9 @@ type Volumes struct {
 }
 
 func validateCapabilities(caps []*csi.VolumeCapability) bool {
-	vcaps := []*csi.VolumeCapability_AccessMode{supportedAccessMode}
-
 	hasSupport := func(mode csi.VolumeCapability_AccessMode_Mode) bool {
-		for _, m := range vcaps {
-			if mode == m.Mode {
+		for _, m := range supportedAccessModes {
+			if mode == m {
 				return true
 			}
 		}
@@ -137,7 +148,11 @@ func validateCapabilities(caps []*csi.VolumeCapability) bool {
 
 	supported := false
 	for _, cap := range caps {
-		if hasSupport(cap.AccessMode.Mode) {
+		// both filesystem and raw block volumes are supported
+		if cap.GetMount() == nil && cap.GetBlock() == nil {
+			return false
+		}
+		if hasSupport(cap.GetAccessMode().GetMode()) {
 			supported = true
 		} else {
 			// we need to make sure all capabilities are supported. Revert back
@@ -149,6 +164,33 @@ func validateCapabilities(caps []*csi.VolumeCapability) bool {
 	return supported
 }
 
+// isBlockCapability reports whether the volume capability requests raw block access
+func isBlockCapability(cap *csi.VolumeCapability) bool {
+	return cap != nil && cap.GetBlock() != nil
+}
+
+// isReadOnlyCapability reports whether the access mode only allows reading
+func isReadOnlyCapability(cap *csi.VolumeCapability) bool {
+	mode := cap.GetAccessMode().GetMode()
+	return mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY ||
+		mode == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+}
+
+// isBlockDevice reports whether the given path is a block device node
+func isBlockDevice(path string) (bool, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	return fi.Mode()&os.ModeDevice != 0 && fi.Mode()&os.ModeCharDevice == 0, nil
+}
+
+// isVolumeNotFound reports whether err of GetVolume is for a volume which
+// does not exist
+func isVolumeNotFound(err error) bool {
+	return err != nil && err.Error() == "not found volume"
+}
+
 // extractStorage extracts the storage size in bytes from the given capacity
 // range. If the capacity range is not satisfied it returns the default volume
 // size. If the capacity range is below or above supported sizes, it returns an
@@ -272,43 +314,59 @@ func ShoudLog(method string) bool {
 
 type K8sClientWrap struct {
 	k8sclient *k8sclient.Clientset
+	// the nodes are looked up by every attach to another node and every
+	// volume condition, they are watched instead of listed each time
+	nodeLister  corelisters.NodeLister
+	nodesSynced cache.InformerSynced
 }
 
 func GetK8sClientWrapper(k8sclient *k8sclient.Clientset) K8sClientWrapper {
-	return &K8sClientWrap{
-		k8sclient: k8sclient,
-	}
+	factory := informers.NewSharedInformerFactory(k8sclient, 0)
+	nodeInformer := factory.Core().V1().Nodes()
+	kc := &K8sClientWrap{
+		k8sclient:   k8sclient,
+		nodeLister:  nodeInformer.Lister(),
+		nodesSynced: nodeInformer.Informer().HasSynced,
+	}
+	factory.Start(wait.NeverStop)
+	return kc
 }
 
-func (kc *K8sClientWrap) GetNodeRegionZone() (string, string, error) {
-	//var randNodes []k8s_v1.Node
-	//TODO meta_v1.ListOptions 选择node
+// GetPersistentVolumeClaim returns the PVC namespace/name
+func (kc *K8sClientWrap) GetPersistentVolumeClaim(namespace, name string) (*v1.PersistentVolumeClaim, error) {
+	return kc.k8sclient.CoreV1().PersistentVolumeClaims(namespace).Get(context.Background(), name, meta_v1.GetOptions{})
+}
+
+// GetZoneNodeCounts counts the ready nodes with role node in each zone
+func (kc *K8sClientWrap) GetZoneNodeCounts() (map[string]int, error) {
 	labeSelector := meta_v1.LabelSelector{
 		MatchLabels: map[string]string{"kubernetes.io/role": "node"},
 	}
 	mapLabel, err := meta_v1.LabelSelectorAsMap(&labeSelector)
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
 	nodes, err := kc.k8sclient.CoreV1().Nodes().List(context.Background(), meta_v1.ListOptions{
 		LabelSelector: labels.SelectorFromSet(mapLabel).String(),
 	})
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
 
-	rand.Seed(time.Now().UnixNano())
-	// sc 没有声明region和AZ, 这里只随机选择role为node的可用区
-	// for _, v := range nodes.Items {
-	// 	if role, ok := v.Labels[util.NodeRoleKey]; ok {
-	// 		if role == "node" {
-	// 			randNodes = append(randNodes, v)
-	// 		}
-	// 	}
-	// }
-	randNode := nodes.Items[rand.Intn(len(nodes.Items))]
-
-	return randNode.Labels[util.NodeRegionKey], randNode.Labels[util.NodeZoneKey], nil
+	nodeCounts := make(map[string]int)
+	for _, node := range nodes.Items {
+		zone := node.Labels[util.NodeZoneKey]
+		if zone == "" {
+			continue
+		}
+		for _, v := range node.Status.Conditions {
+			if v.Type == "Ready" && v.Status == "True" {
+				nodeCounts[zone]++
+				break
+			}
+		}
+	}
+	return nodeCounts, nil
 }
 
 func (kc *K8sClientWrap) IsNodeStatusReadyByNodename(nodename string) (bool, error) {
@@ -324,35 +382,123 @@ func (kc *K8sClientWrap) IsNodeStatusReadyByNodename(nodename string) (bool, err
 	return false, nil
 }
 
+// IsNodeStatusReady returns whether the node of instance nodeID is ready,
+// false if there is no such node
 func (kc *K8sClientWrap) IsNodeStatusReady(nodeID string) (bool, error) {
-	labeSelector := meta_v1.LabelSelector{
-		MatchLabels: map[string]string{"kubernetes.io/role": "node"},
+	node, err := kc.GetNodeByInstanceID(nodeID)
+	if apierrors.IsNotFound(err) {
+		return false, nil
 	}
-	mapLabel, err := meta_v1.LabelSelectorAsMap(&labeSelector)
 	if err != nil {
 		return false, err
 	}
-	nodes, err := kc.k8sclient.CoreV1().Nodes().List(context.Background(), meta_v1.ListOptions{
-		LabelSelector: labels.SelectorFromSet(mapLabel).String(),
-	})
+	cond := getNodeReadyCondition(node)
+	return cond != nil && cond.Status == v1.ConditionTrue, nil
+}
+
+// GetNodeByInstanceID returns the node of instance instanceID, see
+// nodeByInstanceID
+func (kc *K8sClientWrap) GetNodeByInstanceID(instanceID string) (*v1.Node, error) {
+	if !kc.nodesSynced() {
+		return nil, fmt.Errorf("the node cache is not synced yet")
+	}
+	nodes, err := kc.nodeLister.List(labels.Everything())
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-	for _, node := range nodes.Items {
-		if a, ok := node.Annotations["appengine.sdns.ksyun.com/instance-uuid"]; ok {
-			if a != nodeID {
-				continue
+	return nodeByInstanceID(nodes, instanceID)
+}
+
+// errNodeUnknown means no node is found for an instance while some nodes
+// are not annotated with their instance, one of them may be the node
+var errNodeUnknown = fmt.Errorf("node annotation missing: %s", InstanceUuid)
+
+// nodeByInstanceID returns the node annotated with instance instanceID, or
+// the node not annotated named by it or with it in the provider id. A
+// NotFound error is returned only when every node is annotated, otherwise
+// the node of the instance cannot be told and errNodeUnknown is returned.
+func nodeByInstanceID(nodes []*v1.Node, instanceID string) (*v1.Node, error) {
+	unannotated := false
+	for _, node := range nodes {
+		if id, ok := node.Annotations[InstanceUuid]; ok {
+			if id == instanceID {
+				return node, nil
 			}
-		} else {
-			return false, fmt.Errorf("node annotation missing: appengine.sdns.ksyun.com/instance-uuid")
+			continue
 		}
-		for _, v := range node.Status.Conditions {
-			if v.Type == "Ready" && v.Status == "True" {
-				return true, nil
-			}
+		providerID := node.Spec.ProviderID
+		if node.Name == instanceID || providerID == instanceID || strings.HasSuffix(providerID, "/"+instanceID) {
+			return node, nil
 		}
+		unannotated = true
 	}
-	return false, nil
+	if unannotated {
+		return nil, errNodeUnknown
+	}
+	return nil, apierrors.NewNotFound(v1.Resource("nodes"), instanceID)
+}
+
+// GetVolumeAttachment returns the VolumeAttachment of volumeID by
+// driverName on node nodeName, of any node when nodeName is empty, nil if
+// there is none
+func (kc *K8sClientWrap) GetVolumeAttachment(driverName, volumeID, nodeName string) (*storagev1.VolumeAttachment, error) {
+	if nodeName != "" {
+		va, err := kc.k8sclient.StorageV1().VolumeAttachments().Get(context.Background(), volumeAttachmentName(driverName, volumeID, nodeName), meta_v1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return va, err
+	}
+
+	// the node is not known, such as a deleted node, the attachment is
+	// found by the PV of the volume
+	pvs, err := kc.k8sclient.CoreV1().PersistentVolumes().List(context.Background(), meta_v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	pvName := ""
+	for _, pv := range pvs.Items {
+		if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == driverName && pv.Spec.CSI.VolumeHandle == volumeID {
+			pvName = pv.Name
+			break
+		}
+	}
+	vas, err := kc.k8sclient.StorageV1().VolumeAttachments().List(context.Background(), meta_v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for i := range vas.Items {
+		va := &vas.Items[i]
+		if va.Spec.Attacher != driverName {
+			continue
+		}
+		source := va.Spec.Source
+		if source.InlineVolumeSpec != nil && source.InlineVolumeSpec.CSI != nil && source.InlineVolumeSpec.CSI.VolumeHandle == volumeID {
+			return va, nil
+		}
+		if pvName != "" && source.PersistentVolumeName != nil && *source.PersistentVolumeName == pvName {
+			return va, nil
+		}
+	}
+	return nil, nil
+}
+
+// volumeAttachmentName returns the name kubelet and the external attacher
+// give to the VolumeAttachment of volumeID on node nodeName
+func volumeAttachmentName(driverName, volumeID, nodeName string) string {
+	result := sha256.Sum256([]byte(volumeID + driverName + nodeName))
+	return fmt.Sprintf("csi-%x", result)
+}
+
+// getNodeReadyCondition returns the Ready condition of node, nil if it is
+// not reported yet
+func getNodeReadyCondition(node *v1.Node) *v1.NodeCondition {
+	for i := range node.Status.Conditions {
+		if node.Status.Conditions[i].Type == v1.NodeReady {
+			return &node.Status.Conditions[i]
+		}
+	}
+	return nil
 }
 
 // getVolumeOptions
@@ -376,18 +522,6 @@ func getVolumeOptions(req *csi.CreateVolumeRequest) (*volumeArgs, error) {
 	//	}
 	//}
 
-	//TODO: Support Multi zones if set
-	//zoneStr := volArgArgs.Zone
-	//zones := strings.Split(zoneStr, ",")
-	//zoneNum := len(zones)
-	//if zoneNum > 1 {
-	//	if _, ok := storageClassZonePos[zoneStr]; !ok {
-	//		storageClassZonePos[zoneStr] = 0
-	//	}
-	//	zoneIndex := storageClassZonePos[zoneStr] % zoneNum
-	//	volArgArgs.Zone = zones[zoneIndex]
-	//	storageClassZonePos[zoneStr]++
-	//}
 	//volArgArgs.Region, ok = volOptions["region"]
 	//if !ok {
 	//	volArgArgs.Region = GlobalConfigVar.Region
@@ -407,37 +541,59 @@ func getVolumeOptions(req *csi.CreateVolumeRequest) (*volumeArgs, error) {
 	}
 	volArgArgs.PerformanceLevel = pls
 
-	// diskTags
-	diskTags, ok := volOptions["tags"]
-	if ok {
-		keyRegex := regexp.MustCompile("[^a-zA-Z0-9\u4e00-\u9fa5=._/@]")
-		valueRegex := regexp.MustCompile("[^a-zA-Z0-9\u4e00-\u9fa5=._/@(){}]")
-
-		for _, tag := range strings.Split(diskTags, ",") {
-			k, v, found := strings.Cut(tag, ":")
-			if !found {
-				return nil, status.Errorf(codes.InvalidArgument, "Invalid diskTags format name: %s tags: %s", req.GetName(), diskTags)
-			}
-			if len(k) > 128 || len(v) > 256 {
-				return nil, status.Errorf(codes.InvalidArgument, "key or value length exceeds the limit，key: %s value: %s", k, v)
-			}
-			if k == "" || v == "" {
-				return nil, status.Errorf(codes.InvalidArgument, "key or value is nil，key: %s value: %s", k, v)
-			}
-			if keyRegex.MatchString(k) || valueRegex.MatchString(v) {
-				return nil, status.Errorf(codes.InvalidArgument, "key or value contains unsupported characters, key: %s value: %s", k, v)
-			}
-			volArgArgs.DiskTags[k] = v
+	// encryption
+	if value, ok := volOptions[EncryptedKey]; ok && value != "" {
+		encrypted, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid %s: %s", EncryptedKey, value)
 		}
+		volArgArgs.Encrypted = encrypted
 	}
-	if len(volArgArgs.DiskTags) > 5 {
-		return nil, errors.New("the number of labels cannot exceed 5")
+	volArgArgs.KmsKeyID = strings.TrimSpace(volOptions[KmsKeyIDKey])
+	if volArgArgs.KmsKeyID != "" && !volArgArgs.Encrypted {
+		return nil, status.Errorf(codes.InvalidArgument, "%s is only allowed when %s is true", KmsKeyIDKey, EncryptedKey)
+	}
+
+	// diskTags, the tags of the PVC and the CSI tags are added by CreateVolume
+	if diskTags, ok := volOptions["tags"]; ok {
+		tags, err := parseDiskTags(diskTags)
+		if err != nil {
+			return nil, err
+		}
+		volArgArgs.DiskTags = tags
 	}
-	//TODO: 将PV信息作为diskTags
 
 	return volArgArgs, nil
 }
 
+// parseDiskTags parses tags in the format of "key1:value1,key2:value2"
+func parseDiskTags(diskTags string) (map[string]string, error) {
+	keyRegex := regexp.MustCompile("[^a-zA-Z0-9\u4e00-\u9fa5=._/@]")
+	valueRegex := regexp.MustCompile("[^a-zA-Z0-9\u4e00-\u9fa5=._/@(){}]")
+
+	tags := map[string]string{}
+	for _, tag := range strings.Split(diskTags, ",") {
+		k, v, found := strings.Cut(tag, ":")
+		if !found {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid diskTags format tags: %s", diskTags)
+		}
+		if len(k) > 128 || len(v) > 256 {
+			return nil, status.Errorf(codes.InvalidArgument, "key or value length exceeds the limit，key: %s value: %s", k, v)
+		}
+		if k == "" || v == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "key or value is nil，key: %s value: %s", k, v)
+		}
+		if keyRegex.MatchString(k) || valueRegex.MatchString(v) {
+			return nil, status.Errorf(codes.InvalidArgument, "key or value contains unsupported characters, key: %s value: %s", k, v)
+		}
+		tags[k] = v
+	}
+	if len(tags) > maxDiskTags {
+		return nil, status.Errorf(codes.InvalidArgument, "the number of tags cannot exceed %d", maxDiskTags)
+	}
+	return tags, nil
+}
+
 func validateDiskType(opts map[string]string) (diskType string, err error) {
 
 	if strings.Contains(opts["type"], ",") {
@@ -599,7 +755,7 @@ func UpdateNode(nodes core_v1.NodeInterface, instanceID string) {
 			}
 		}
 	} else {
-		klog.Warningf("UpdateNode:: instaceType or zone is empty, skipping disk label update, instanceType: %s, zone: %s")
+		klog.Warningf("UpdateNode:: instaceType or zone is empty, skipping disk label update, instanceType: %s, zone: %s", instanceType, instanceZone)
 	}
 
 	needUpdate := false
@@ -795,3 +951,76 @@ Loop:
 	}
 	return int64(availableVolumeCount), nil
 }
+
+// GetDiskQuotaByZone aggregates the DataDiskQuotaSet of all instance types by
+// zone and disk type, keeping the widest size range offered in each zone
+func GetDiskQuotaByZone() (map[string]map[string]DataDiskQuotaSet, error) {
+	cli := OpenApi.New(GlobalConfigVar.OpenApiConfig)
+	DescribeInstanceTypeConfigsResp := &DescribeInstanceTypeConfigsResp{}
+
+	resp, err := cli.DoRequest("kec", "Action=DescribeInstanceTypeConfigs", "")
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(resp, &DescribeInstanceTypeConfigsResp)
+	if err != nil {
+		klog.Error("Error decoding json: ", err)
+		return nil, err
+	}
+	return aggregateDiskQuota(DescribeInstanceTypeConfigsResp.InstanceTypeConfigSet), nil
+}
+
+func aggregateDiskQuota(configSet []InstanceTypeConfigSet) map[string]map[string]DataDiskQuotaSet {
+	quotas := make(map[string]map[string]DataDiskQuotaSet)
+	for _, config := range configSet {
+		for _, quota := range config.DataDiskQuotaSet {
+			for _, az := range quota.AvailabilityZoneSet {
+				if _, ok := quotas[az.AzCode]; !ok {
+					quotas[az.AzCode] = make(map[string]DataDiskQuotaSet)
+				}
+				existing, ok := quotas[az.AzCode][quota.DataDiskType]
+				if !ok {
+					quotas[az.AzCode][quota.DataDiskType] = DataDiskQuotaSet{
+						DataDiskType:    quota.DataDiskType,
+						DataDiskMinSize: quota.DataDiskMinSize,
+						DataDiskMaxsize: quota.DataDiskMaxsize,
+						DataDiskCount:   quota.DataDiskCount,
+					}
+					continue
+				}
+				if quota.DataDiskMinSize < existing.DataDiskMinSize {
+					existing.DataDiskMinSize = quota.DataDiskMinSize
+				}
+				if quota.DataDiskMaxsize > existing.DataDiskMaxsize {
+					existing.DataDiskMaxsize = quota.DataDiskMaxsize
+				}
+				if quota.DataDiskCount > existing.DataDiskCount {
+					existing.DataDiskCount = quota.DataDiskCount
+				}
+				quotas[az.AzCode][quota.DataDiskType] = existing
+			}
+		}
+	}
+	return quotas
+}
+
+// getCapacityDiskTypes returns the disk type names used by DescribeInstanceTypeConfigs
+// for the ordered disk types of the storage class parameters
+func getCapacityDiskTypes(opts map[string]string) ([]string, error) {
+	validTypes, err := validateDiskType(opts)
+	if err != nil {
+		return nil, err
+	}
+	diskTypes := strings.Split(validTypes, ",")
+	for i, diskType := range diskTypes {
+		if diskType == ESSD {
+			pl := DISK_PERFORMANCE_LEVEL1
+			if opts[ESSD_PERFORMANCE_LEVEL] != "" {
+				pl = strings.Split(opts[ESSD_PERFORMANCE_LEVEL], ",")[0]
+			}
+			diskTypes[i] = diskType + "_" + pl
+		}
+	}
+	return diskTypes, nil
+}
@@ -0,0 +1,346 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/klog/v2"
+	mountutils "k8s.io/mount-utils"
+)
+
+const (
+	procMountInfoPath = "/proc/self/mountinfo"
+	kmsgPath          = "/dev/kmsg"
+
+	// volumeHealthErrorTTL is how long an error is reported after it is last
+	// seen, so that it outlives the polls of kubelet and the health monitor
+	volumeHealthErrorTTL = 10 * time.Minute
+	// mountPointCheckTimeout bounds the read of a mount point
+	mountPointCheckTimeout = 5 * time.Second
+)
+
+// kernelIOErrorRe matches the kernel messages of the I/O errors of a block
+// device and of the filesystem errors, the device name is in one of the
+// groups
+var kernelIOErrorRe = regexp.MustCompile(`I/O error,? (?:on )?dev(?:ice)? ([a-z0-9]+)|EXT4-fs error \(device ([a-z0-9]+)\)|XFS \(([a-z0-9]+)\): .*(?:error|shut(?:ting)? down|[Cc]orruption)`)
+
+// partitionSuffixRe is what follows the disk in the name of a partition,
+// vdb1, or nvme0n1p1 of a disk whose name ends with a digit
+var partitionSuffixRe = regexp.MustCompile(`^[0-9]+$`)
+
+type volumeHealthError struct {
+	message string
+	seen    time.Time
+}
+
+// mountPointRead is a read of a mount point in flight, err is set before
+// done is closed
+type mountPointRead struct {
+	started time.Time
+	done    chan struct{}
+	err     error
+}
+
+// VolumeHealthChecker finds the problems of the volumes on the node: the
+// filesystems remounted read-only, the devices missing from
+// /dev/disk/by-id, the mount points that cannot be read and the I/O errors
+// of the devices in the kernel log. An error is cached per volume and
+// reported for volumeHealthErrorTTL after it is last seen.
+type VolumeHealthChecker struct {
+	mountInfoPath string
+	kmsgPath      string
+	diskIDPath    string
+	now           func() time.Time
+	// readMountPoint reads the directory of a mount point
+	readMountPoint func(path string) error
+
+	mu sync.Mutex
+	// deviceErrors are the last kernel error of each block device
+	deviceErrors map[string]*volumeHealthError
+	// volumeErrors are the last abnormal condition of each volume
+	volumeErrors map[string]*volumeHealthError
+	// mountPointReads are the reads in flight by mount point, a hung read
+	// is not started again until it returns
+	mountPointReads map[string]*mountPointRead
+}
+
+func NewVolumeHealthChecker() *VolumeHealthChecker {
+	return &VolumeHealthChecker{
+		mountInfoPath:   procMountInfoPath,
+		kmsgPath:        kmsgPath,
+		diskIDPath:      diskIDPath,
+		now:             time.Now,
+		readMountPoint:  readMountPoint,
+		deviceErrors:    make(map[string]*volumeHealthError),
+		volumeErrors:    make(map[string]*volumeHealthError),
+		mountPointReads: make(map[string]*mountPointRead),
+	}
+}
+
+// Check returns the condition of the volume published at volumePath
+func (c *VolumeHealthChecker) Check(volumeID, volumePath string, isBlock bool) *csi.VolumeCondition {
+	problems := c.check(volumeID, volumePath, isBlock)
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(problems) > 0 {
+		message := strings.Join(problems, "; ")
+		if last := c.volumeErrors[volumeID]; last == nil || last.message != message {
+			klog.Warningf("VolumeHealthChecker:: volume %s is abnormal: %s", volumeID, message)
+		}
+		c.volumeErrors[volumeID] = &volumeHealthError{message: message, seen: now}
+		return &csi.VolumeCondition{Abnormal: true, Message: message}
+	}
+	if last := c.volumeErrors[volumeID]; last != nil {
+		if now.Sub(last.seen) < volumeHealthErrorTTL {
+			return &csi.VolumeCondition{
+				Abnormal: true,
+				Message:  fmt.Sprintf("%s, last seen at %s", last.message, last.seen.Format(time.RFC3339)),
+			}
+		}
+		klog.Infof("VolumeHealthChecker:: volume %s is healthy again", volumeID)
+		delete(c.volumeErrors, volumeID)
+	}
+	return &csi.VolumeCondition{Abnormal: false, Message: "volume is healthy"}
+}
+
+func (c *VolumeHealthChecker) check(volumeID, volumePath string, isBlock bool) []string {
+	var problems []string
+
+	device, err := c.findDevice(volumeID)
+	if err != nil {
+		problems = append(problems, err.Error())
+	} else if kernelErr := c.deviceError(device); kernelErr != nil {
+		problems = append(problems, fmt.Sprintf("kernel reported errors of device %s at %s: %s", device, kernelErr.seen.Format(time.RFC3339), kernelErr.message))
+	}
+
+	if isBlock {
+		return problems
+	}
+	if mnt, err := c.findMount(volumePath); err != nil {
+		klog.Errorf("VolumeHealthChecker:: failed to read the mounts of %s: %v", volumePath, err)
+	} else if mnt != nil && isRemountedReadOnly(mnt) {
+		problems = append(problems, fmt.Sprintf("filesystem %s of %s is remounted read-only", mnt.FsType, mnt.Source))
+	}
+	if err := c.checkMountPoint(volumePath, mountPointCheckTimeout); err != nil {
+		problems = append(problems, err.Error())
+	}
+	return problems
+}
+
+// findDevice returns the name of the block device of the volume in /dev,
+// from its link in /dev/disk/by-id
+func (c *VolumeHealthChecker) findDevice(volumeID string) (string, error) {
+	// the links of the ESSD volumes and of the others, see getDiskSource
+	for _, link := range diskSourceLinks(c.diskIDPath, volumeID, "") {
+		device, err := filepath.EvalSymlinks(link)
+		if err == nil {
+			return filepath.Base(device), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", fmt.Errorf("failed to resolve device %s: %v", link, err)
+		}
+	}
+	return "", fmt.Errorf("device of the volume is missing from %s", c.diskIDPath)
+}
+
+// findMount returns the mount at path, nil if it is not mounted
+func (c *VolumeHealthChecker) findMount(path string) (*mountutils.MountInfo, error) {
+	mounts, err := mountutils.ParseMountInfo(c.mountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	// the last mount at a path hides the others
+	for i := len(mounts) - 1; i >= 0; i-- {
+		if mounts[i].MountPoint == path {
+			return &mounts[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// isRemountedReadOnly returns whether the filesystem of mnt is read-only
+// while the mount is not, the filesystems remount themselves read-only on
+// errors. A read-only mount is what was asked for.
+func isRemountedReadOnly(mnt *mountutils.MountInfo) bool {
+	return hasOption(mnt.SuperOptions, "ro") && !hasOption(mnt.MountOptions, "ro")
+}
+
+func hasOption(options []string, option string) bool {
+	for _, o := range options {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+// checkMountPoint reads the directory at path, a hung read is given up
+// after timeout. The read of an earlier check still in flight is waited for
+// instead of starting another, and once it is past timeout it is reported
+// at once.
+func (c *VolumeHealthChecker) checkMountPoint(path string, timeout time.Duration) error {
+	c.mu.Lock()
+	read := c.mountPointReads[path]
+	if read == nil {
+		read = &mountPointRead{started: c.now(), done: make(chan struct{})}
+		c.mountPointReads[path] = read
+		go func() {
+			read.err = c.readMountPoint(path)
+			c.mu.Lock()
+			delete(c.mountPointReads, path)
+			c.mu.Unlock()
+			close(read.done)
+		}()
+	}
+	c.mu.Unlock()
+
+	result := func() error {
+		if read.err != nil {
+			return fmt.Errorf("mount point %s is not readable: %v", path, read.err)
+		}
+		return nil
+	}
+	wait := timeout - c.now().Sub(read.started)
+	if wait <= 0 {
+		select {
+		case <-read.done:
+			return result()
+		default:
+			return fmt.Errorf("mount point %s is not responding since %s", path, read.started.Format(time.RFC3339))
+		}
+	}
+	select {
+	case <-read.done:
+		return result()
+	case <-time.After(wait):
+		return fmt.Errorf("mount point %s is not responding in %v", path, timeout)
+	}
+}
+
+// readMountPoint reads an entry of the directory at path
+func readMountPoint(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Readdirnames(1); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// deviceError returns the last kernel error of device or of its partitions
+// in volumeHealthErrorTTL, nil if there is none
+func (c *VolumeHealthChecker) deviceError(device string) *volumeHealthError {
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var last *volumeHealthError
+	for name, e := range c.deviceErrors {
+		if now.Sub(e.seen) >= volumeHealthErrorTTL {
+			delete(c.deviceErrors, name)
+			continue
+		}
+		if name != device && !isPartitionOf(name, device) {
+			continue
+		}
+		if last == nil || e.seen.After(last.seen) {
+			last = e
+		}
+	}
+	return last
+}
+
+// isPartitionOf returns whether name is a partition of device, the number
+// follows a "p" when the name of device ends with a digit, so nvme0n10 is a
+// disk of its own rather than a partition of nvme0n1
+func isPartitionOf(name, device string) bool {
+	if device == "" || !strings.HasPrefix(name, device) {
+		return false
+	}
+	suffix := name[len(device):]
+	if last := device[len(device)-1]; last >= '0' && last <= '9' {
+		if !strings.HasPrefix(suffix, "p") {
+			return false
+		}
+		suffix = suffix[1:]
+	}
+	return partitionSuffixRe.MatchString(suffix)
+}
+
+// recordKernelMessage records message of the kernel log if it is an error
+// of a block device
+func (c *VolumeHealthChecker) recordKernelMessage(message string) {
+	match := kernelIOErrorRe.FindStringSubmatch(message)
+	if match == nil {
+		return
+	}
+	var device string
+	for _, group := range match[1:] {
+		if group != "" {
+			device = group
+			break
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deviceErrors[device] = &volumeHealthError{message: message, seen: c.now()}
+}
+
+// WatchKernelLog records the errors of the block devices logged by the
+// kernel until ctx is done. Only the messages logged after it starts are
+// read.
+func (c *VolumeHealthChecker) WatchKernelLog(ctx context.Context) {
+	f, err := os.Open(c.kmsgPath)
+	if err != nil {
+		klog.Warningf("VolumeHealthChecker:: I/O errors of the devices are not checked, failed to open %s: %v", c.kmsgPath, err)
+		return
+	}
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		klog.Warningf("VolumeHealthChecker:: failed to skip the kernel log before now: %v", err)
+	}
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+
+	// a read of /dev/kmsg returns one record, "priority,sequence,timestamp,flags;message"
+	buf := make([]byte, 8192)
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			if errors.Is(err, syscall.EPIPE) {
+				// the records overwritten before they are read are skipped
+				continue
+			}
+			if ctx.Err() == nil {
+				klog.Errorf("VolumeHealthChecker:: failed to read %s: %v", c.kmsgPath, err)
+			}
+			return
+		}
+		record := string(buf[:n])
+		if i := strings.IndexByte(record, ';'); i >= 0 {
+			record = record[i+1:]
+		}
+		// the lines after the message are its key/value dictionary
+		if i := strings.IndexByte(record, '\n'); i >= 0 {
+			record = record[:i]
+		}
+		c.recordKernelMessage(record)
+	}
+}
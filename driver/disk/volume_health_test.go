@@ -0,0 +1,210 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const healthTestVolumeID = "c4d5e2f0-1a2b-4c3d-8e9f-0a1b2c3d4e5f"
+
+// newTestVolumeHealthChecker returns a checker on a fake clock of a volume
+// attached as vdb and published at a directory with the super options
+func newTestVolumeHealthChecker(t *testing.T, mountOptions, superOptions string) (*VolumeHealthChecker, string, *time.Time) {
+	dir := t.TempDir()
+	byID := filepath.Join(dir, "by-id")
+	volumePath := filepath.Join(dir, "mount")
+	for _, d := range []string{byID, volumePath} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "vdb"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "vdb"), filepath.Join(byID, diskPrefix+healthTestVolumeID[0:20])); err != nil {
+		t.Fatal(err)
+	}
+	mountInfo := fmt.Sprintf("36 25 253:16 / %s %s shared:1 - ext4 /dev/vdb %s\n", volumePath, mountOptions, superOptions)
+	if err := os.WriteFile(filepath.Join(dir, "mountinfo"), []byte(mountInfo), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewVolumeHealthChecker()
+	c.diskIDPath = byID
+	c.mountInfoPath = filepath.Join(dir, "mountinfo")
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	return c, volumePath, &now
+}
+
+func TestVolumeHealthChecker(t *testing.T) {
+	tests := []struct {
+		name         string
+		mountOptions string
+		superOptions string
+		prepare      func(c *VolumeHealthChecker, volumePath string)
+		wantMessage  string
+	}{
+		{name: "healthy", mountOptions: "rw,relatime", superOptions: "rw"},
+		{name: "read-only mount", mountOptions: "ro,relatime", superOptions: "ro"},
+		{
+			name:         "remounted read-only",
+			mountOptions: "rw,relatime",
+			superOptions: "ro,errors=remount-ro",
+			wantMessage:  "filesystem ext4 of /dev/vdb is remounted read-only",
+		},
+		{
+			name:         "missing device",
+			mountOptions: "rw",
+			superOptions: "rw",
+			prepare: func(c *VolumeHealthChecker, _ string) {
+				os.Remove(filepath.Join(filepath.Dir(c.diskIDPath), "vdb"))
+			},
+			wantMessage: "device of the volume is missing",
+		},
+		{
+			name:         "unreadable mount point",
+			mountOptions: "rw",
+			superOptions: "rw",
+			prepare: func(_ *VolumeHealthChecker, volumePath string) {
+				os.Remove(volumePath)
+			},
+			wantMessage: "is not readable",
+		},
+		{
+			name:         "I/O error of a partition",
+			mountOptions: "rw",
+			superOptions: "rw",
+			prepare: func(c *VolumeHealthChecker, _ string) {
+				c.recordKernelMessage("Buffer I/O error on dev vdb1, logical block 0, lost async page write")
+			},
+			wantMessage: "kernel reported errors of device vdb",
+		},
+		{
+			name:         "I/O error of another device",
+			mountOptions: "rw",
+			superOptions: "rw",
+			prepare: func(c *VolumeHealthChecker, _ string) {
+				c.recordKernelMessage("blk_update_request: I/O error, dev vdbb, sector 2048")
+				c.recordKernelMessage("blk_update_request: I/O error, dev vdc, sector 2048")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, volumePath, _ := newTestVolumeHealthChecker(t, tt.mountOptions, tt.superOptions)
+			if tt.prepare != nil {
+				tt.prepare(c, volumePath)
+			}
+			condition := c.Check(healthTestVolumeID, volumePath, false)
+			if condition.Abnormal != (tt.wantMessage != "") || !strings.Contains(condition.Message, tt.wantMessage) {
+				t.Errorf("Check() = %+v, want abnormal with %q", condition, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestVolumeHealthCheckerCache(t *testing.T) {
+	c, volumePath, now := newTestVolumeHealthChecker(t, "rw", "rw")
+	c.recordKernelMessage("EXT4-fs error (device vdb): ext4_find_entry:1455: inode #2: comm ls: reading directory lblock 0")
+	if condition := c.Check(healthTestVolumeID, volumePath, false); !condition.Abnormal {
+		t.Fatalf("Check() after an ext4 error = %+v, want abnormal", condition)
+	}
+
+	// the error is still reported once it is gone from the kernel log
+	c.deviceErrors = make(map[string]*volumeHealthError)
+	*now = now.Add(volumeHealthErrorTTL / 2)
+	if condition := c.Check(healthTestVolumeID, volumePath, false); !condition.Abnormal || !strings.Contains(condition.Message, "last seen at") {
+		t.Errorf("Check() of a recent error = %+v, want abnormal", condition)
+	}
+
+	*now = now.Add(volumeHealthErrorTTL)
+	if condition := c.Check(healthTestVolumeID, volumePath, false); condition.Abnormal {
+		t.Errorf("Check() of an expired error = %+v, want healthy", condition)
+	}
+	if _, ok := c.volumeErrors[healthTestVolumeID]; ok {
+		t.Error("expired error of the volume is kept")
+	}
+}
+
+func TestVolumeHealthCheckerHungMountPoint(t *testing.T) {
+	c, volumePath, now := newTestVolumeHealthChecker(t, "rw", "rw")
+	var reads int32
+	unblock := make(chan struct{})
+	c.readMountPoint = func(path string) error {
+		atomic.AddInt32(&reads, 1)
+		<-unblock
+		return nil
+	}
+
+	if err := c.checkMountPoint(volumePath, 10*time.Millisecond); err == nil || !strings.Contains(err.Error(), "not responding in") {
+		t.Fatalf("checkMountPoint() of a hung mount point error = %v", err)
+	}
+	// the hung read is reported at once without another read
+	*now = now.Add(time.Minute)
+	if err := c.checkMountPoint(volumePath, 30*time.Second); err == nil || !strings.Contains(err.Error(), "not responding since") {
+		t.Errorf("checkMountPoint() of a read in flight error = %v", err)
+	}
+	if got := atomic.LoadInt32(&reads); got != 1 {
+		t.Errorf("reads of a hung mount point = %d, want 1", got)
+	}
+
+	close(unblock)
+	if err := c.checkMountPoint(volumePath, time.Hour); err != nil {
+		t.Errorf("checkMountPoint() after the read returned error = %v", err)
+	}
+}
+
+func Test_kernelIOErrorRe(t *testing.T) {
+	tests := []struct {
+		message    string
+		wantDevice string
+	}{
+		{message: "blk_update_request: I/O error, dev vdb, sector 2048 op 0x1:(WRITE) flags 0x800 phys_seg 1 prio class 0", wantDevice: "vdb"},
+		{message: "I/O error, dev nvme0n1, sector 0 op 0x0:(READ)", wantDevice: "nvme0n1"},
+		{message: "Buffer I/O error on device vdc1, logical block 1024", wantDevice: "vdc1"},
+		{message: "EXT4-fs error (device vdd): ext4_journal_check_start:83: Detected aborted journal", wantDevice: "vdd"},
+		{message: "XFS (vde): metadata I/O error in \"xfs_trans_read_buf_map\" at daddr 0x2 len 1 error 5", wantDevice: "vde"},
+		{message: "XFS (vde): Filesystem has been shut down due to log error (0x2).", wantDevice: "vde"},
+		{message: "XFS (vde): Mounting V5 Filesystem"},
+		{message: "EXT4-fs (vdd): mounted filesystem with ordered data mode"},
+	}
+	for _, tt := range tests {
+		c := NewVolumeHealthChecker()
+		c.recordKernelMessage(tt.message)
+		var devices []string
+		for device := range c.deviceErrors {
+			devices = append(devices, device)
+		}
+		if want := []string{tt.wantDevice}; tt.wantDevice == "" && len(devices) > 0 || tt.wantDevice != "" && fmt.Sprint(devices) != fmt.Sprint(want) {
+			t.Errorf("recordKernelMessage(%q) recorded %v, want %q", tt.message, devices, tt.wantDevice)
+		}
+	}
+}
+
+func Test_isPartitionOf(t *testing.T) {
+	tests := []struct {
+		name   string
+		device string
+		want   bool
+	}{
+		{name: "vdb1", device: "vdb", want: true},
+		{name: "vdb12", device: "vdb", want: true},
+		{name: "vdbp1", device: "vdb"},
+		{name: "vdbc", device: "vdb"},
+		{name: "nvme0n1p1", device: "nvme0n1", want: true},
+		{name: "nvme0n10", device: "nvme0n1"},
+		{name: "nvme0n1", device: "nvme0n1"},
+		{name: "vdb1", device: ""},
+	}
+	for _, tt := range tests {
+		if got := isPartitionOf(tt.name, tt.device); got != tt.want {
+			t.Errorf("isPartitionOf(%q, %q) = %v, want %v", tt.name, tt.device, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,614 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	ebsClient "csi-plugin/pkg/ebs-client"
+	"csi-plugin/util"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// VolumeMigrationLeaseName is the lease of the controller replica running
+	// the volume migrations
+	VolumeMigrationLeaseName = "com-ksc-csi-diskplugin-volume-migration"
+
+	// AnnMigratedFrom on the PV of a migrated disk is the PV of the source
+	// disk
+	AnnMigratedFrom = "storage.ksyun.com/migrated-from"
+
+	volumeMigrationSyncInterval = 10 * time.Second
+)
+
+// annotations of the source PVC not copied to the recreated one, they are
+// set again when it is bound
+var migrationDroppedClaimAnnotations = []string{
+	"pv.kubernetes.io/bind-completed",
+	"pv.kubernetes.io/bound-by-controller",
+}
+
+// VolumeMigrationController runs the VolumeMigrations of all namespaces.
+// A migration waits for the disk to be detached, snapshots it, restores the
+// snapshot in the target zone, then recreates the PVC bound to a new PV of
+// the restored disk. The source PV is retained while the PVC is recreated,
+// and the source disk is deleted only after the PVC is bound to the new PV.
+// The snapshot and the restored disk are named after the migration, so
+// every step can be retried by another leader.
+type VolumeMigrationController struct {
+	driverName    string
+	clusterID     string
+	k8sClient     kubernetes.Interface
+	dynamicClient dynamic.Interface
+	ebsClient     ebsClient.StorageService
+	recorder      record.EventRecorder
+}
+
+func NewVolumeMigrationController(driverName, clusterID string, k8sClient kubernetes.Interface, dynamicClient dynamic.Interface, ebsClient ebsClient.StorageService, recorder record.EventRecorder) *VolumeMigrationController {
+	return &VolumeMigrationController{
+		driverName:    driverName,
+		clusterID:     clusterID,
+		k8sClient:     k8sClient,
+		dynamicClient: dynamicClient,
+		ebsClient:     ebsClient,
+		recorder:      recorder,
+	}
+}
+
+// Run runs the migrations until ctx is done
+func (c *VolumeMigrationController) Run(ctx context.Context) {
+	klog.Infof("VolumeMigrationController:: starting")
+	wait.Until(func() {
+		if err := c.sync(ctx); err != nil {
+			klog.Errorf("VolumeMigrationController:: %v", err)
+		}
+	}, volumeMigrationSyncInterval, ctx.Done())
+	klog.Infof("VolumeMigrationController:: stopped")
+}
+
+func (c *VolumeMigrationController) sync(ctx context.Context) error {
+	list, err := c.dynamicClient.Resource(VolumeMigrationResource).Namespace(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list volume migrations: %v", err)
+	}
+	for i := range list.Items {
+		obj := &list.Items[i]
+		if err := c.syncMigration(ctx, obj); err != nil {
+			klog.Errorf("VolumeMigrationController:: failed to sync volume migration %s/%s: %v", obj.GetNamespace(), obj.GetName(), err)
+		}
+	}
+	return nil
+}
+
+// syncMigration runs a step of the migration, and saves the status if it
+// is changed
+func (c *VolumeMigrationController) syncMigration(ctx context.Context, obj *unstructured.Unstructured) error {
+	m, err := decodeVolumeMigration(obj)
+	if err != nil {
+		return err
+	}
+	if m.Status.Phase == MigrationPhaseSucceeded || m.Status.Phase == MigrationPhaseFailed {
+		return nil
+	}
+	oldStatus := m.Status
+	if m.Status.Phase == "" {
+		m.Status.Phase = MigrationPhasePending
+	}
+	// a failed step without a status change is retried on the next sync
+	stepErr := c.migrate(ctx, m)
+	if reflect.DeepEqual(oldStatus, m.Status) {
+		return stepErr
+	}
+
+	data, err := json.Marshal(m.Status)
+	if err != nil {
+		return err
+	}
+	status := map[string]interface{}{}
+	if err := json.Unmarshal(data, &status); err != nil {
+		return err
+	}
+	obj.Object["status"] = status
+	if _, err := c.dynamicClient.Resource(VolumeMigrationResource).Namespace(m.Namespace).UpdateStatus(ctx, obj, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update status: %v", err)
+	}
+
+	msg := fmt.Sprintf("%s: %s", m.Status.Phase, m.Status.Message)
+	switch m.Status.Phase {
+	case MigrationPhaseFailed:
+		c.createEvent(m, v1.EventTypeWarning, volumeMigrationFailed, msg)
+	case MigrationPhaseSucceeded:
+		c.createEvent(m, v1.EventTypeNormal, volumeMigrated, msg)
+	default:
+		c.createEvent(m, v1.EventTypeNormal, volumeMigrating, msg)
+	}
+	klog.Infof("VolumeMigrationController:: volume migration %s/%s %s", m.Namespace, m.Name, msg)
+	return stepErr
+}
+
+// migrate runs the step of the phase of m, and moves m to the next phase
+// when the step is done
+func (c *VolumeMigrationController) migrate(ctx context.Context, m *VolumeMigration) error {
+	switch m.Status.Phase {
+	case MigrationPhasePending:
+		return c.prepare(ctx, m)
+	case MigrationPhaseSnapshotting:
+		return c.snapshot(m)
+	case MigrationPhaseRestoring:
+		return c.restore(m)
+	case MigrationPhaseRebinding:
+		return c.rebind(ctx, m)
+	case MigrationPhaseVerifying:
+		return c.verify(ctx, m)
+	}
+	c.fail(m, fmt.Sprintf("unknown phase %q", m.Status.Phase))
+	return nil
+}
+
+// prepare checks the migration and records the source, once the disk is
+// detached
+func (c *VolumeMigrationController) prepare(ctx context.Context, m *VolumeMigration) error {
+	if m.Spec.PersistentVolumeClaimName == "" || m.Spec.TargetZone == "" {
+		c.fail(m, "persistentVolumeClaimName and targetZone must be provided")
+		return nil
+	}
+	if m.Spec.VolumeType != "" && !containsString(AvailableVolumeTypes, m.Spec.VolumeType) {
+		c.fail(m, fmt.Sprintf("invalid volume type %q, expect one of %v", m.Spec.VolumeType, AvailableVolumeTypes))
+		return nil
+	}
+	pvc, err := c.k8sClient.CoreV1().PersistentVolumeClaims(m.Namespace).Get(ctx, m.Spec.PersistentVolumeClaimName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		c.fail(m, fmt.Sprintf("pvc %s not found", m.Spec.PersistentVolumeClaimName))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if pvc.Status.Phase != v1.ClaimBound || pvc.Spec.VolumeName == "" {
+		c.fail(m, fmt.Sprintf("pvc %s is not bound", pvc.Name))
+		return nil
+	}
+	pv, err := c.k8sClient.CoreV1().PersistentVolumes().Get(ctx, pvc.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != c.driverName {
+		c.fail(m, fmt.Sprintf("pv %s of pvc %s is not a disk of %s", pv.Name, pvc.Name, c.driverName))
+		return nil
+	}
+	vol, err := c.ebsClient.GetVolume(&ebsClient.ListVolumesReq{VolumeIds: []string{pv.Spec.CSI.VolumeHandle}})
+	if err != nil {
+		return err
+	}
+	if vol.AvailabilityZone == m.Spec.TargetZone {
+		c.fail(m, fmt.Sprintf("volume %s is already in zone %s", vol.VolumeId, vol.AvailabilityZone))
+		return nil
+	}
+	if vol.VolumeStatus != ebsClient.AVAILABLE_STATUS {
+		// the data written after the snapshot would be lost
+		m.Status.Message = fmt.Sprintf("waiting for volume %s to be detached, stop the pods using pvc %s", vol.VolumeId, pvc.Name)
+		return nil
+	}
+
+	m.Status.SourcePersistentVolumeName = pv.Name
+	m.Status.SourceVolumeID = vol.VolumeId
+	m.Status.SourceZone = vol.AvailabilityZone
+	m.Status.Claim = &MigrationClaim{
+		UID:         string(pvc.UID),
+		Labels:      pvc.Labels,
+		Annotations: pvc.Annotations,
+		Spec:        pvc.Spec,
+	}
+	m.Status.Phase = MigrationPhaseSnapshotting
+	m.Status.Message = fmt.Sprintf("creating snapshot of volume %s", vol.VolumeId)
+	return nil
+}
+
+// snapshot creates the snapshot of the source disk and waits for it
+func (c *VolumeMigrationController) snapshot(m *VolumeMigration) error {
+	name := migrationResourceName(m)
+	if m.Status.SnapshotID == "" {
+		resp, snapNum, err := c.ebsClient.GetSnapshotsByName(&ebsClient.DescribeSnapshotsReq{SnapshotName: name})
+		if err != nil {
+			return err
+		}
+		if snapNum > 0 {
+			m.Status.SnapshotID = resp.Snapshots[0].SnapshotID
+		} else {
+			createResp, err := c.ebsClient.CreateSnapshot(&ebsClient.CreateSnapshotReq{
+				VolumeId:     m.Status.SourceVolumeID,
+				SnapshotName: name,
+				SnapshotDesc: "Created by KCE CSI for volume migration",
+			})
+			if err != nil {
+				return err
+			}
+			m.Status.SnapshotID = createResp.SnapshotID
+		}
+		m.Status.Message = fmt.Sprintf("waiting for snapshot %s of volume %s", m.Status.SnapshotID, m.Status.SourceVolumeID)
+		return nil
+	}
+
+	snapshot, err := c.ebsClient.GetSnapshot(&ebsClient.DescribeSnapshotsReq{SnapshotId: m.Status.SnapshotID})
+	if err != nil {
+		return err
+	}
+	switch {
+	case snapshot == nil:
+		c.fail(m, fmt.Sprintf("snapshot %s not found", m.Status.SnapshotID))
+	case snapshot.SnapshotStatus == ebsClient.SNAPSHOT_ERROR_STATUS:
+		c.fail(m, fmt.Sprintf("snapshot %s is in error status", m.Status.SnapshotID))
+	case snapshot.SnapshotStatus == ebsClient.SNAPSHOT_AVAILABLE_STATUS:
+		m.Status.Phase = MigrationPhaseRestoring
+		m.Status.Message = fmt.Sprintf("restoring snapshot %s in zone %s", m.Status.SnapshotID, m.Spec.TargetZone)
+	default:
+		m.Status.Message = fmt.Sprintf("waiting for snapshot %s of volume %s, progress %s", m.Status.SnapshotID, m.Status.SourceVolumeID, formatSnapshotProgress(snapshot))
+	}
+	return nil
+}
+
+// restore creates the disk of the snapshot in the target zone and waits
+// for it
+func (c *VolumeMigrationController) restore(m *VolumeMigration) error {
+	name := migrationResourceName(m)
+	if m.Status.VolumeID == "" {
+		listResp, err := c.ebsClient.ListVolumes(&ebsClient.ListVolumesReq{Tags: map[string]string{CsiRequestNameTag: name}})
+		if err != nil {
+			return err
+		}
+		if len(listResp.Volumes) > 0 {
+			m.Status.VolumeID = listResp.Volumes[0].VolumeId
+			m.Status.Message = fmt.Sprintf("waiting for volume %s in zone %s", m.Status.VolumeID, m.Spec.TargetZone)
+			return nil
+		}
+
+		source, err := c.ebsClient.GetVolume(&ebsClient.ListVolumesReq{VolumeIds: []string{m.Status.SourceVolumeID}})
+		if err != nil {
+			return err
+		}
+		req := &ebsClient.CreateVolumeReq{
+			VolumeName:       source.VolumeName,
+			VolumeType:       migrationVolumeType(m, source),
+			VolumeDesc:       createdByDO,
+			SnapshotId:       m.Status.SnapshotID,
+			Size:             source.Size,
+			AvailabilityZone: m.Spec.TargetZone,
+			ChargeType:       defaultChargeType,
+			Encrypted:        source.Encrypted,
+			KmsKeyId:         source.KmsKeyId,
+			Tags: map[string]string{
+				CsiRequestNameTag:  name,
+				CsiPVNameTag:       migrationPVName(m),
+				CsiPVCNameTag:      m.Spec.PersistentVolumeClaimName,
+				CsiPVCNamespaceTag: m.Namespace,
+			},
+		}
+		if source.ProjectId != 0 {
+			req.ProjectId = strconv.Itoa(source.ProjectId)
+		}
+		if c.clusterID != "" {
+			req.Tags[CsiClusterIDTag] = c.clusterID
+		}
+		createResp, err := c.ebsClient.CreateVolume(req)
+		if ebsClient.IsVolumeTypeUnavailable(err) {
+			c.fail(m, fmt.Sprintf("failed to restore snapshot %s in zone %s: %v", m.Status.SnapshotID, m.Spec.TargetZone, err))
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		m.Status.VolumeID = createResp.VolumeId
+		m.Status.Message = fmt.Sprintf("waiting for volume %s in zone %s", m.Status.VolumeID, m.Spec.TargetZone)
+		return nil
+	}
+
+	vol, err := c.ebsClient.GetVolume(&ebsClient.ListVolumesReq{VolumeIds: []string{m.Status.VolumeID}})
+	if err != nil {
+		return err
+	}
+	switch vol.VolumeStatus {
+	case ebsClient.AVAILABLE_STATUS:
+		m.Status.Phase = MigrationPhaseRebinding
+		m.Status.Message = fmt.Sprintf("binding pvc %s to volume %s", m.Spec.PersistentVolumeClaimName, vol.VolumeId)
+	case ebsClient.ERROR_STATUS:
+		c.fail(m, fmt.Sprintf("volume %s restored from snapshot %s is in error status", vol.VolumeId, m.Status.SnapshotID))
+	}
+	return nil
+}
+
+// rebind creates the PV of the restored disk, retains the source PV, and
+// recreates the PVC bound to the new PV
+func (c *VolumeMigrationController) rebind(ctx context.Context, m *VolumeMigration) error {
+	if m.Status.PersistentVolumeName == "" {
+		source, err := c.ebsClient.GetVolume(&ebsClient.ListVolumesReq{VolumeIds: []string{m.Status.SourceVolumeID}})
+		if err != nil {
+			return err
+		}
+		if source.VolumeStatus != ebsClient.AVAILABLE_STATUS {
+			c.fail(m, fmt.Sprintf("volume %s is attached during the migration, the data written since snapshot %s would be lost", source.VolumeId, m.Status.SnapshotID))
+			return nil
+		}
+	}
+
+	oldPV, err := c.k8sClient.CoreV1().PersistentVolumes().Get(ctx, m.Status.SourcePersistentVolumeName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if m.Status.PersistentVolumeName == "" {
+		pv := newMigratedPV(m, oldPV)
+		if _, err := c.k8sClient.CoreV1().PersistentVolumes().Create(ctx, pv, metav1.CreateOptions{}); err != nil && !apierrors.IsAlreadyExists(err) {
+			return err
+		}
+		m.Status.PersistentVolumeName = pv.Name
+		m.Status.Message = fmt.Sprintf("pv %s of volume %s is created", pv.Name, m.Status.VolumeID)
+		return nil
+	}
+	// the source disk is kept when the pvc is deleted
+	if oldPV.Spec.PersistentVolumeReclaimPolicy != v1.PersistentVolumeReclaimRetain {
+		patch := []byte(`{"spec":{"persistentVolumeReclaimPolicy":"Retain"}}`)
+		if _, err := c.k8sClient.CoreV1().PersistentVolumes().Patch(ctx, oldPV.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+			return err
+		}
+	}
+
+	claim := m.Status.Claim
+	pvc, err := c.k8sClient.CoreV1().PersistentVolumeClaims(m.Namespace).Get(ctx, m.Spec.PersistentVolumeClaimName, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		newPVC := &v1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        m.Spec.PersistentVolumeClaimName,
+				Namespace:   m.Namespace,
+				Labels:      claim.Labels,
+				Annotations: map[string]string{},
+			},
+			Spec: claim.Spec,
+		}
+		for k, v := range claim.Annotations {
+			if !containsString(migrationDroppedClaimAnnotations, k) {
+				newPVC.Annotations[k] = v
+			}
+		}
+		newPVC.Spec.VolumeName = m.Status.PersistentVolumeName
+		if _, err := c.k8sClient.CoreV1().PersistentVolumeClaims(m.Namespace).Create(ctx, newPVC, metav1.CreateOptions{}); err != nil && !apierrors.IsAlreadyExists(err) {
+			return err
+		}
+		m.Status.Message = fmt.Sprintf("pvc %s is recreated with pv %s", newPVC.Name, m.Status.PersistentVolumeName)
+	case err != nil:
+		return err
+	case string(pvc.UID) == claim.UID:
+		if pvc.DeletionTimestamp == nil {
+			// the pvc may be used again since the pv is created
+			source, err := c.ebsClient.GetVolume(&ebsClient.ListVolumesReq{VolumeIds: []string{m.Status.SourceVolumeID}})
+			if err != nil {
+				return err
+			}
+			if source.VolumeStatus != ebsClient.AVAILABLE_STATUS {
+				c.fail(m, fmt.Sprintf("volume %s is attached during the migration, the data written since snapshot %s would be lost, pv %s of volume %s is left to delete", source.VolumeId, m.Status.SnapshotID, m.Status.PersistentVolumeName, m.Status.VolumeID))
+				return nil
+			}
+			if err := c.k8sClient.CoreV1().PersistentVolumeClaims(m.Namespace).Delete(ctx, pvc.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+				return err
+			}
+		}
+		m.Status.Message = fmt.Sprintf("waiting for pvc %s to be deleted, delete the pods using it", pvc.Name)
+	case pvc.Spec.VolumeName != m.Status.PersistentVolumeName:
+		c.fail(m, fmt.Sprintf("pvc %s is recreated with pv %q by others, pv %s of volume %s is left to bind", pvc.Name, pvc.Spec.VolumeName, m.Status.PersistentVolumeName, m.Status.VolumeID))
+	default:
+		m.Status.Phase = MigrationPhaseVerifying
+		m.Status.Message = fmt.Sprintf("waiting for pvc %s to be bound to pv %s", pvc.Name, m.Status.PersistentVolumeName)
+	}
+	return nil
+}
+
+// verify checks the PVC is bound to the restored disk, then deletes the
+// source unless it is retained. Each deletion is recorded in the status, a
+// source volume which is gone was deleted by a sync whose status was lost.
+func (c *VolumeMigrationController) verify(ctx context.Context, m *VolumeMigration) error {
+	pvc, err := c.k8sClient.CoreV1().PersistentVolumeClaims(m.Namespace).Get(ctx, m.Spec.PersistentVolumeClaimName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if pvc.Status.Phase != v1.ClaimBound || pvc.Spec.VolumeName != m.Status.PersistentVolumeName {
+		return nil
+	}
+	vol, err := c.ebsClient.GetVolume(&ebsClient.ListVolumesReq{VolumeIds: []string{m.Status.VolumeID}})
+	if err != nil {
+		return err
+	}
+	if vol.AvailabilityZone != m.Spec.TargetZone {
+		c.fail(m, fmt.Sprintf("volume %s is in zone %s, expect zone %s, source volume %s is kept", vol.VolumeId, vol.AvailabilityZone, m.Spec.TargetZone, m.Status.SourceVolumeID))
+		return nil
+	}
+
+	if !m.Status.SourceVolumeDeleted {
+		source, err := c.ebsClient.GetVolume(&ebsClient.ListVolumesReq{VolumeIds: []string{m.Status.SourceVolumeID}})
+		switch {
+		case isVolumeNotFound(err):
+			klog.Warningf("VolumeMigrationController:: source volume %s of volume migration %s/%s is already deleted", m.Status.SourceVolumeID, m.Namespace, m.Name)
+			m.Status.SourceVolumeDeleted = true
+		case err != nil:
+			return err
+		case vol.Size < source.Size:
+			c.fail(m, fmt.Sprintf("volume %s is %dGB, expect at least %dGB, source volume %s is kept", vol.VolumeId, vol.Size, source.Size, source.VolumeId))
+			return nil
+		case !m.Spec.RetainSource:
+			if _, err := c.ebsClient.DeleteVolume(&ebsClient.DeleteVolumeReq{VolumeId: source.VolumeId}); err != nil {
+				return fmt.Errorf("failed to delete source volume %s: %v", source.VolumeId, err)
+			}
+			m.Status.SourceVolumeDeleted = true
+			m.Status.Message = fmt.Sprintf("source volume %s is deleted", source.VolumeId)
+		}
+	}
+	if !m.Spec.RetainSource {
+		if !m.Status.SourcePersistentVolumeDeleted {
+			if err := c.k8sClient.CoreV1().PersistentVolumes().Delete(ctx, m.Status.SourcePersistentVolumeName, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+				return err
+			}
+			m.Status.SourcePersistentVolumeDeleted = true
+		}
+		if !m.Status.SnapshotDeleted {
+			if _, err := c.ebsClient.DeleteSnapshots(&ebsClient.DeleteSnapshotsReq{SnapshotId: m.Status.SnapshotID}); err != nil {
+				klog.Errorf("VolumeMigrationController:: failed to delete snapshot %s: %v", m.Status.SnapshotID, err)
+			} else {
+				m.Status.SnapshotDeleted = true
+			}
+		}
+	}
+	m.Status.Phase = MigrationPhaseSucceeded
+	m.Status.Message = fmt.Sprintf("volume %s of pvc %s is moved from zone %s to zone %s as volume %s", m.Status.SourceVolumeID, pvc.Name, m.Status.SourceZone, vol.AvailabilityZone, vol.VolumeId)
+	return nil
+}
+
+// fail stops the migration with msg. The snapshot and the restored disk
+// are deleted if the PVC is not touched yet.
+func (c *VolumeMigrationController) fail(m *VolumeMigration, msg string) {
+	rollback := m.Status.Phase == MigrationPhaseSnapshotting || m.Status.Phase == MigrationPhaseRestoring ||
+		(m.Status.Phase == MigrationPhaseRebinding && m.Status.PersistentVolumeName == "")
+	if rollback {
+		var errs []string
+		if m.Status.VolumeID != "" {
+			if _, err := c.ebsClient.DeleteVolume(&ebsClient.DeleteVolumeReq{VolumeId: m.Status.VolumeID}); err != nil {
+				errs = append(errs, fmt.Sprintf("failed to delete volume %s: %v", m.Status.VolumeID, err))
+			}
+		}
+		if m.Status.SnapshotID != "" {
+			if _, err := c.ebsClient.DeleteSnapshots(&ebsClient.DeleteSnapshotsReq{SnapshotId: m.Status.SnapshotID}); err != nil {
+				errs = append(errs, fmt.Sprintf("failed to delete snapshot %s: %v", m.Status.SnapshotID, err))
+			}
+		}
+		if len(errs) > 0 {
+			msg = fmt.Sprintf("%s, and %s", msg, strings.Join(errs, ", "))
+		}
+	}
+	m.Status.Phase = MigrationPhaseFailed
+	m.Status.Message = msg
+}
+
+func (c *VolumeMigrationController) createEvent(m *VolumeMigration, eventType, reason, message string) {
+	if c.recorder == nil {
+		return
+	}
+	ref := &v1.ObjectReference{
+		APIVersion: VolumeMigrationResource.GroupVersion().String(),
+		Kind:       "VolumeMigration",
+		Name:       m.Name,
+		Namespace:  m.Namespace,
+		UID:        m.UID,
+	}
+	util.CreateEvent(c.recorder, ref, eventType, reason, message)
+}
+
+func decodeVolumeMigration(obj *unstructured.Unstructured) (*VolumeMigration, error) {
+	data, err := json.Marshal(obj.Object)
+	if err != nil {
+		return nil, err
+	}
+	m := &VolumeMigration{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("failed to decode volume migration %s/%s: %v", obj.GetNamespace(), obj.GetName(), err)
+	}
+	return m, nil
+}
+
+// migrationResourceName is the name of the snapshot and the request name
+// tag of the restored disk of m
+func migrationResourceName(m *VolumeMigration) string {
+	return "migrate-" + string(m.UID)
+}
+
+// migrationPVName is the name of the PV of the restored disk
+func migrationPVName(m *VolumeMigration) string {
+	uid := strings.ReplaceAll(string(m.UID), "-", "")
+	if len(uid) > 8 {
+		uid = uid[:8]
+	}
+	return fmt.Sprintf("%s-%s", m.Status.SourcePersistentVolumeName, strings.ToLower(uid))
+}
+
+func migrationVolumeType(m *VolumeMigration, source *ebsClient.Volume) string {
+	if m.Spec.VolumeType != "" {
+		return m.Spec.VolumeType
+	}
+	return source.VolumeType
+}
+
+// newMigratedPV returns a copy of the source PV bound to the claim of m,
+// with the restored disk and the node affinity of the target zone
+func newMigratedPV(m *VolumeMigration, source *v1.PersistentVolume) *v1.PersistentVolume {
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        migrationPVName(m),
+			Labels:      map[string]string{},
+			Annotations: map[string]string{AnnMigratedFrom: source.Name},
+		},
+		Spec: *source.Spec.DeepCopy(),
+	}
+	for k, v := range source.Labels {
+		if k == util.NodeZoneKey || k == v1.LabelZoneFailureDomainStable {
+			v = m.Spec.TargetZone
+		}
+		pv.Labels[k] = v
+	}
+	if provisioner, ok := source.Annotations["pv.kubernetes.io/provisioned-by"]; ok {
+		pv.Annotations["pv.kubernetes.io/provisioned-by"] = provisioner
+	}
+	pv.Spec.ClaimRef = &v1.ObjectReference{
+		Kind:       "PersistentVolumeClaim",
+		APIVersion: "v1",
+		Namespace:  m.Namespace,
+		Name:       m.Spec.PersistentVolumeClaimName,
+	}
+	pv.Spec.CSI.VolumeHandle = m.Status.VolumeID
+	oldType := pv.Spec.CSI.VolumeAttributes["type"]
+	if m.Spec.VolumeType != "" && pv.Spec.CSI.VolumeAttributes != nil {
+		pv.Spec.CSI.VolumeAttributes["type"] = m.Spec.VolumeType
+		if _, ok := pv.Spec.CSI.VolumeAttributes[labelAppendPrefix+labelVolumeType]; ok {
+			pv.Spec.CSI.VolumeAttributes[labelAppendPrefix+labelVolumeType] = m.Spec.VolumeType
+		}
+	}
+
+	if pv.Spec.NodeAffinity == nil || pv.Spec.NodeAffinity.Required == nil || len(pv.Spec.NodeAffinity.Required.NodeSelectorTerms) == 0 {
+		pv.Spec.NodeAffinity = &v1.VolumeNodeAffinity{Required: &v1.NodeSelector{
+			NodeSelectorTerms: []v1.NodeSelectorTerm{{}},
+		}}
+	}
+	for i := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+		term := &pv.Spec.NodeAffinity.Required.NodeSelectorTerms[i]
+		hasZone := false
+		for j := range term.MatchExpressions {
+			expr := &term.MatchExpressions[j]
+			switch {
+			case expr.Key == util.NodeZoneKey:
+				expr.Operator = v1.NodeSelectorOpIn
+				expr.Values = []string{m.Spec.TargetZone}
+				hasZone = true
+			case m.Spec.VolumeType != "" && oldType != "" && expr.Key == fmt.Sprintf(nodeStorageLabel, oldType):
+				expr.Key = fmt.Sprintf(nodeStorageLabel, m.Spec.VolumeType)
+			}
+		}
+		if !hasZone {
+			term.MatchExpressions = append(term.MatchExpressions, v1.NodeSelectorRequirement{
+				Key:      util.NodeZoneKey,
+				Operator: v1.NodeSelectorOpIn,
+				Values:   []string{m.Spec.TargetZone},
+			})
+		}
+	}
+	return pv
+}
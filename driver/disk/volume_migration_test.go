@@ -0,0 +1,316 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	ebsClient "csi-plugin/pkg/ebs-client"
+	"csi-plugin/util"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+)
+
+func newVolumeMigration(name string, spec map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": VolumeMigrationResource.GroupVersion().String(),
+		"kind":       "VolumeMigration",
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": "default",
+			"uid":       "0a1b2c3d-4e5f-6789-abcd-ef0123456789",
+		},
+		"spec": spec,
+	}}
+}
+
+// newMigrationTestPVC returns the PVC db-0 bound to the PV of volume
+// vol-db-0 of type SSD3.0 in zone cn-beijing-6a
+func newMigrationTestPVC() (*v1.PersistentVolumeClaim, *v1.PersistentVolume) {
+	pvc, pv := newBoundTestPVC("db-0", driverName, "vol-db-0")
+	pvc.UID = "pvc-uid"
+	pvc.Labels = map[string]string{"app": "db"}
+	pvc.Annotations = map[string]string{
+		"pv.kubernetes.io/bind-completed":               "yes",
+		"volume.beta.kubernetes.io/storage-provisioner": driverName,
+	}
+	pvc.Spec.AccessModes = []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce}
+	pvc.Spec.Resources = v1.ResourceRequirements{
+		Requests: v1.ResourceList{v1.ResourceStorage: resource.MustParse("20Gi")},
+	}
+	pv.Labels = map[string]string{util.NodeZoneKey: "cn-beijing-6a"}
+	pv.Spec.PersistentVolumeReclaimPolicy = v1.PersistentVolumeReclaimDelete
+	pv.Spec.ClaimRef.UID = pvc.UID
+	pv.Spec.CSI.VolumeAttributes = map[string]string{"type": ebsClient.SSD3_0}
+	pv.Spec.NodeAffinity = &v1.VolumeNodeAffinity{Required: &v1.NodeSelector{
+		NodeSelectorTerms: []v1.NodeSelectorTerm{{MatchExpressions: []v1.NodeSelectorRequirement{
+			{Key: util.NodeZoneKey, Operator: v1.NodeSelectorOpIn, Values: []string{"cn-beijing-6a"}},
+			{Key: "com.ksc.csi.node/disktype.SSD3.0", Operator: v1.NodeSelectorOpExists},
+		}}},
+	}}
+	return pvc, pv
+}
+
+func newMigrationTestController(t *testing.T, migration *unstructured.Unstructured) (*VolumeMigrationController, *FakeStorageClient, *fake.Clientset) {
+	t.Helper()
+	pvc, pv := newMigrationTestPVC()
+	storageClient := NewFakeStorageClient()
+	storageClient.volumes["vol-db-0"] = &ebsClient.Volume{
+		VolumeId:         "vol-db-0",
+		VolumeName:       "db-0",
+		VolumeType:       ebsClient.SSD3_0,
+		Size:             20,
+		AvailabilityZone: "cn-beijing-6a",
+		VolumeStatus:     ebsClient.INUSE_STATUS,
+	}
+	k8sClient := fake.NewSimpleClientset(pvc, pv)
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), migration)
+	c := NewVolumeMigrationController(driverName, "cluster-1", k8sClient, dynamicClient, storageClient, record.NewFakeRecorder(100))
+	return c, storageClient, k8sClient
+}
+
+// syncMigration syncs the migration until it is in phase, and returns it
+func syncMigration(t *testing.T, c *VolumeMigrationController, phase string) *VolumeMigration {
+	t.Helper()
+	ctx := context.Background()
+	var m *VolumeMigration
+	for i := 0; i < 10; i++ {
+		if err := c.sync(ctx); err != nil {
+			t.Fatalf("sync() error = %v", err)
+		}
+		obj, err := c.dynamicClient.Resource(VolumeMigrationResource).Namespace("default").Get(ctx, "db-0", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m, err = decodeVolumeMigration(obj); err != nil {
+			t.Fatal(err)
+		}
+		if m.Status.Phase == phase {
+			return m
+		}
+	}
+	t.Fatalf("volume migration status = %+v, want phase %s", m.Status, phase)
+	return nil
+}
+
+func TestVolumeMigrationController(t *testing.T) {
+	migration := newVolumeMigration("db-0", map[string]interface{}{
+		"persistentVolumeClaimName": "db-0",
+		"targetZone":                "cn-beijing-6b",
+		"volumeType":                ebsClient.ESSD_PL1,
+	})
+	c, storageClient, k8sClient := newMigrationTestController(t, migration)
+	ctx := context.Background()
+
+	// waits for the disk to be detached
+	m := syncMigration(t, c, MigrationPhasePending)
+	if !strings.Contains(m.Status.Message, "detached") {
+		t.Errorf("message of an attached volume = %q", m.Status.Message)
+	}
+	storageClient.volumes["vol-db-0"].VolumeStatus = ebsClient.AVAILABLE_STATUS
+
+	m = syncMigration(t, c, MigrationPhaseRebinding)
+	if m.Status.SourceZone != "cn-beijing-6a" || m.Status.Claim == nil || m.Status.Claim.UID != "pvc-uid" {
+		t.Errorf("source of the migration = %+v", m.Status)
+	}
+	snapshot := storageClient.snapshots[m.Status.SnapshotID]
+	if snapshot == nil || snapshot.VolumeID != "vol-db-0" || snapshot.SnapshotName != migrationResourceName(m) {
+		t.Fatalf("snapshot of the migration = %+v", snapshot)
+	}
+	restored := storageClient.volumes[m.Status.VolumeID]
+	if restored == nil || restored.AvailabilityZone != "cn-beijing-6b" || restored.VolumeType != ebsClient.ESSD_PL1 ||
+		restored.SnapshotId != m.Status.SnapshotID || restored.Size != 20 {
+		t.Fatalf("restored volume = %+v", restored)
+	}
+	if tags := storageClient.volumeTags[m.Status.VolumeID]; tags[CsiClusterIDTag] != "cluster-1" || tags[CsiRequestNameTag] != migrationResourceName(m) {
+		t.Errorf("tags of the restored volume = %v", tags)
+	}
+
+	m = syncMigration(t, c, MigrationPhaseVerifying)
+	pv, err := k8sClient.CoreV1().PersistentVolumes().Get(ctx, m.Status.PersistentVolumeName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expressions := pv.Spec.NodeAffinity.Required.NodeSelectorTerms[0].MatchExpressions
+	if pv.Spec.CSI.VolumeHandle != m.Status.VolumeID || pv.Spec.CSI.VolumeAttributes["type"] != ebsClient.ESSD_PL1 ||
+		pv.Labels[util.NodeZoneKey] != "cn-beijing-6b" || pv.Annotations[AnnMigratedFrom] != "pv-db-0" ||
+		expressions[0].Values[0] != "cn-beijing-6b" || expressions[1].Key != "com.ksc.csi.node/disktype.ESSD_PL1" ||
+		pv.Spec.ClaimRef.UID != "" || pv.Spec.ClaimRef.Name != "db-0" {
+		t.Errorf("pv of the restored volume = %+v", pv)
+	}
+	oldPV, _ := k8sClient.CoreV1().PersistentVolumes().Get(ctx, "pv-db-0", metav1.GetOptions{})
+	if oldPV.Spec.PersistentVolumeReclaimPolicy != v1.PersistentVolumeReclaimRetain {
+		t.Errorf("reclaim policy of the source pv = %s, want Retain", oldPV.Spec.PersistentVolumeReclaimPolicy)
+	}
+	pvc, _ := k8sClient.CoreV1().PersistentVolumeClaims("default").Get(ctx, "db-0", metav1.GetOptions{})
+	if pvc.UID == "pvc-uid" || pvc.Spec.VolumeName != m.Status.PersistentVolumeName || pvc.Labels["app"] != "db" ||
+		pvc.Annotations["pv.kubernetes.io/bind-completed"] != "" {
+		t.Errorf("recreated pvc = %+v", pvc)
+	}
+
+	// the source is kept until the pvc is bound
+	m = syncMigration(t, c, MigrationPhaseVerifying)
+	if _, ok := storageClient.volumes["vol-db-0"]; !ok {
+		t.Fatal("source volume deleted before the pvc is bound")
+	}
+	pvc.Status.Phase = v1.ClaimBound
+	if _, err := k8sClient.CoreV1().PersistentVolumeClaims("default").UpdateStatus(ctx, pvc, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	m = syncMigration(t, c, MigrationPhaseSucceeded)
+	if _, ok := storageClient.volumes["vol-db-0"]; ok {
+		t.Error("source volume is not deleted")
+	}
+	if _, ok := storageClient.snapshots[m.Status.SnapshotID]; ok {
+		t.Error("snapshot of the migration is not deleted")
+	}
+	if _, err := k8sClient.CoreV1().PersistentVolumes().Get(ctx, "pv-db-0", metav1.GetOptions{}); err == nil {
+		t.Error("source pv is not deleted")
+	}
+}
+
+func TestVolumeMigrationRollback(t *testing.T) {
+	migration := newVolumeMigration("db-0", map[string]interface{}{
+		"persistentVolumeClaimName": "db-0",
+		"targetZone":                "cn-beijing-6b",
+	})
+	c, storageClient, k8sClient := newMigrationTestController(t, migration)
+	storageClient.volumes["vol-db-0"].VolumeStatus = ebsClient.AVAILABLE_STATUS
+
+	m := syncMigration(t, c, MigrationPhaseRebinding)
+	// the disk is attached again after the snapshot
+	storageClient.volumes["vol-db-0"].VolumeStatus = ebsClient.INUSE_STATUS
+	m = syncMigration(t, c, MigrationPhaseFailed)
+	if _, ok := storageClient.volumes[m.Status.VolumeID]; ok {
+		t.Error("restored volume is not deleted on failure")
+	}
+	if _, ok := storageClient.snapshots[m.Status.SnapshotID]; ok {
+		t.Error("snapshot is not deleted on failure")
+	}
+	pvc, err := k8sClient.CoreV1().PersistentVolumeClaims("default").Get(context.Background(), "db-0", metav1.GetOptions{})
+	if err != nil || pvc.UID != "pvc-uid" {
+		t.Errorf("pvc of a failed migration = %+v, %v", pvc, err)
+	}
+
+	// a failed migration is not synced again
+	storageClient.volumes["vol-db-0"].VolumeStatus = ebsClient.AVAILABLE_STATUS
+	syncMigration(t, c, MigrationPhaseFailed)
+}
+
+func TestVolumeMigrationAttachedBeforeRebind(t *testing.T) {
+	migration := newVolumeMigration("db-0", map[string]interface{}{
+		"persistentVolumeClaimName": "db-0",
+		"targetZone":                "cn-beijing-6b",
+	})
+	c, storageClient, k8sClient := newMigrationTestController(t, migration)
+	storageClient.volumes["vol-db-0"].VolumeStatus = ebsClient.AVAILABLE_STATUS
+	syncMigration(t, c, MigrationPhaseRebinding)
+	// creates the pv of the restored volume
+	if err := c.sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the pvc is used again before it is deleted
+	storageClient.volumes["vol-db-0"].VolumeStatus = ebsClient.INUSE_STATUS
+	m := syncMigration(t, c, MigrationPhaseFailed)
+	if m.Status.PersistentVolumeName == "" || !strings.Contains(m.Status.Message, "left to delete") {
+		t.Errorf("status of the failed migration = %+v", m.Status)
+	}
+	pvc, err := k8sClient.CoreV1().PersistentVolumeClaims("default").Get(context.Background(), "db-0", metav1.GetOptions{})
+	if err != nil || pvc.UID != "pvc-uid" {
+		t.Errorf("pvc of a failed migration = %+v, %v", pvc, err)
+	}
+}
+
+func TestVolumeMigrationVerifyRetry(t *testing.T) {
+	for _, sourceDeleted := range []bool{false, true} {
+		migration := newVolumeMigration("db-0", map[string]interface{}{
+			"persistentVolumeClaimName": "db-0",
+			"targetZone":                "cn-beijing-6b",
+		})
+		c, storageClient, k8sClient := newMigrationTestController(t, migration)
+		storageClient.volumes["vol-db-0"].VolumeStatus = ebsClient.AVAILABLE_STATUS
+		m := syncMigration(t, c, MigrationPhaseVerifying)
+		ctx := context.Background()
+		pvc, _ := k8sClient.CoreV1().PersistentVolumeClaims("default").Get(ctx, "db-0", metav1.GetOptions{})
+		pvc.Status.Phase = v1.ClaimBound
+		if _, err := k8sClient.CoreV1().PersistentVolumeClaims("default").UpdateStatus(ctx, pvc, metav1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+
+		if sourceDeleted {
+			// deleted by a sync which failed to save the status
+			delete(storageClient.volumes, "vol-db-0")
+		} else {
+			failed := false
+			k8sClient.PrependReactor("delete", "persistentvolumes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				if failed {
+					return false, nil, nil
+				}
+				failed = true
+				return true, nil, errors.New("connection refused")
+			})
+			if err := c.sync(ctx); err != nil {
+				t.Fatal(err)
+			}
+			obj, _ := c.dynamicClient.Resource(VolumeMigrationResource).Namespace("default").Get(ctx, "db-0", metav1.GetOptions{})
+			m, _ = decodeVolumeMigration(obj)
+			if m.Status.Phase != MigrationPhaseVerifying || !m.Status.SourceVolumeDeleted || m.Status.SourcePersistentVolumeDeleted {
+				t.Fatalf("status after the pv deletion failed = %+v", m.Status)
+			}
+		}
+
+		m = syncMigration(t, c, MigrationPhaseSucceeded)
+		if !m.Status.SourceVolumeDeleted || !m.Status.SourcePersistentVolumeDeleted || !m.Status.SnapshotDeleted {
+			t.Errorf("cleanup steps of the migration with source deleted %v = %+v", sourceDeleted, m.Status)
+		}
+		if _, err := k8sClient.CoreV1().PersistentVolumes().Get(ctx, "pv-db-0", metav1.GetOptions{}); err == nil {
+			t.Errorf("source pv is not deleted with source deleted %v", sourceDeleted)
+		}
+	}
+}
+
+func TestVolumeMigrationInvalid(t *testing.T) {
+	cases := []struct {
+		name string
+		spec map[string]interface{}
+	}{
+		{
+			name: "same zone",
+			spec: map[string]interface{}{"persistentVolumeClaimName": "db-0", "targetZone": "cn-beijing-6a"},
+		},
+		{
+			name: "invalid volume type",
+			spec: map[string]interface{}{"persistentVolumeClaimName": "db-0", "targetZone": "cn-beijing-6b", "volumeType": "HDD"},
+		},
+		{
+			name: "pvc not found",
+			spec: map[string]interface{}{"persistentVolumeClaimName": "db-1", "targetZone": "cn-beijing-6b"},
+		},
+		{
+			name: "no target zone",
+			spec: map[string]interface{}{"persistentVolumeClaimName": "db-0"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, storageClient, _ := newMigrationTestController(t, newVolumeMigration("db-0", tc.spec))
+			m := syncMigration(t, c, MigrationPhaseFailed)
+			if len(storageClient.snapshots) != 0 || len(storageClient.volumes) != 1 {
+				t.Errorf("invalid migration created snapshots %v or volumes %v", storageClient.snapshots, storageClient.volumes)
+			}
+			if m.Status.Message == "" {
+				t.Error("no message of the failure")
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package driver
+
+import (
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// VolumeMigrationResource is the VolumeMigration custom resource, defined by
+// deploy/chart/crds/storage.ksyun.com_volumemigrations.yaml
+var VolumeMigrationResource = schema.GroupVersionResource{
+	Group:    "storage.ksyun.com",
+	Version:  "v1alpha1",
+	Resource: "volumemigrations",
+}
+
+// phases of a VolumeMigration, in order
+const (
+	MigrationPhasePending      = "Pending"
+	MigrationPhaseSnapshotting = "Snapshotting"
+	MigrationPhaseRestoring    = "Restoring"
+	MigrationPhaseRebinding    = "Rebinding"
+	MigrationPhaseVerifying    = "Verifying"
+	MigrationPhaseSucceeded    = "Succeeded"
+	MigrationPhaseFailed       = "Failed"
+)
+
+// VolumeMigration moves the disk of a PVC in its namespace to another zone
+// by restoring a snapshot of it, and binds the PVC to the restored disk.
+type VolumeMigration struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   VolumeMigrationSpec   `json:"spec"`
+	Status VolumeMigrationStatus `json:"status,omitempty"`
+}
+
+type VolumeMigrationSpec struct {
+	// PersistentVolumeClaimName is the PVC to migrate, its pods must be
+	// stopped for the disk to be detached
+	PersistentVolumeClaimName string `json:"persistentVolumeClaimName"`
+	// TargetZone is the availability zone the disk is moved to
+	TargetZone string `json:"targetZone"`
+	// VolumeType of the restored disk, the type of the source disk when
+	// empty
+	VolumeType string `json:"volumeType,omitempty"`
+	// RetainSource keeps the source disk, its PV and the snapshot after the
+	// migration is verified, they are deleted by default
+	RetainSource bool `json:"retainSource,omitempty"`
+}
+
+type VolumeMigrationStatus struct {
+	Phase   string `json:"phase,omitempty"`
+	Message string `json:"message,omitempty"`
+
+	SourcePersistentVolumeName string `json:"sourcePersistentVolumeName,omitempty"`
+	SourceVolumeID             string `json:"sourceVolumeId,omitempty"`
+	SourceZone                 string `json:"sourceZone,omitempty"`
+	// Claim is the PVC when the migration started, it is recreated from
+	// Claim bound to the PV of the restored disk
+	Claim *MigrationClaim `json:"claim,omitempty"`
+
+	SnapshotID           string `json:"snapshotId,omitempty"`
+	VolumeID             string `json:"volumeId,omitempty"`
+	PersistentVolumeName string `json:"persistentVolumeName,omitempty"`
+
+	// the cleanup steps done after the migration is verified
+	SourceVolumeDeleted           bool `json:"sourceVolumeDeleted,omitempty"`
+	SourcePersistentVolumeDeleted bool `json:"sourcePersistentVolumeDeleted,omitempty"`
+	SnapshotDeleted               bool `json:"snapshotDeleted,omitempty"`
+}
+
+// MigrationClaim is what a migrated PVC is recreated from
+type MigrationClaim struct {
+	UID         string                       `json:"uid"`
+	Labels      map[string]string            `json:"labels,omitempty"`
+	Annotations map[string]string            `json:"annotations,omitempty"`
+	Spec        v1.PersistentVolumeClaimSpec `json:"spec"`
+}
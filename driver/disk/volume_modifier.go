@@ -0,0 +1,235 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	ebsClient "csi-plugin/pkg/ebs-client"
+	"csi-plugin/util"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// VolumeModifierLeaseName is the lease of the controller replica running
+	// the volume modifier
+	VolumeModifierLeaseName = "com-ksc-csi-diskplugin-volume-modifier"
+
+	volumeModifierResync = 10 * time.Minute
+	// modifyVolumePollInterval is how often a modifying volume is checked
+	modifyVolumePollInterval = 30 * time.Second
+	// modifyVolumeTimeout is how long a volume may stay Modifying before the
+	// modification is Failed
+	modifyVolumeTimeout = time.Hour
+)
+
+// VolumeModifier changes the type of the bound disk volumes whose PVC is
+// annotated with AnnTargetPerformanceLevel, and reports the progress with
+// the AnnModifyStatus annotations and events of the PVC. A Failed target is
+// not retried until AnnTargetPerformanceLevel is changed.
+type VolumeModifier struct {
+	driverName string
+	k8sClient  kubernetes.Interface
+	ebsClient  ebsClient.StorageService
+	recorder   record.EventRecorder
+}
+
+func NewVolumeModifier(driverName string, k8sClient kubernetes.Interface, ebsClient ebsClient.StorageService, recorder record.EventRecorder) *VolumeModifier {
+	return &VolumeModifier{
+		driverName: driverName,
+		k8sClient:  k8sClient,
+		ebsClient:  ebsClient,
+		recorder:   recorder,
+	}
+}
+
+// Run watches the PVCs until ctx is done
+func (vm *VolumeModifier) Run(ctx context.Context) {
+	factory := informers.NewSharedInformerFactory(vm.k8sClient, volumeModifierResync)
+	pvcInformer := factory.Core().V1().PersistentVolumeClaims()
+	queue := workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "volume-modifier")
+	defer queue.ShutDown()
+
+	enqueue := func(obj interface{}) {
+		pvc, ok := obj.(*v1.PersistentVolumeClaim)
+		if !ok || pvc.Annotations[AnnTargetPerformanceLevel] == "" {
+			return
+		}
+		if key, err := cache.MetaNamespaceKeyFunc(pvc); err == nil {
+			queue.Add(key)
+		}
+	}
+	pvcInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    enqueue,
+		UpdateFunc: func(_, obj interface{}) { enqueue(obj) },
+	})
+
+	klog.Infof("VolumeModifier:: starting")
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), pvcInformer.Informer().HasSynced) {
+		klog.Errorf("VolumeModifier:: failed to sync the pvc cache")
+		return
+	}
+
+	lister := pvcInformer.Lister()
+	go wait.Until(func() {
+		for vm.processNextItem(ctx, queue, lister) {
+		}
+	}, time.Second, ctx.Done())
+
+	<-ctx.Done()
+	klog.Infof("VolumeModifier:: stopped")
+}
+
+func (vm *VolumeModifier) processNextItem(ctx context.Context, queue workqueue.RateLimitingInterface, lister corelisters.PersistentVolumeClaimLister) bool {
+	key, quit := queue.Get()
+	if quit {
+		return false
+	}
+	defer queue.Done(key)
+
+	namespace, name, err := cache.SplitMetaNamespaceKey(key.(string))
+	if err != nil {
+		queue.Forget(key)
+		return true
+	}
+	pvc, err := lister.PersistentVolumeClaims(namespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		queue.Forget(key)
+		return true
+	}
+	if err == nil {
+		var requeueAfter time.Duration
+		if requeueAfter, err = vm.syncPVC(ctx, pvc); err == nil {
+			queue.Forget(key)
+			if requeueAfter > 0 {
+				queue.AddAfter(key, requeueAfter)
+			}
+			return true
+		}
+	}
+	klog.Errorf("VolumeModifier:: failed to sync pvc %s: %v", key, err)
+	queue.AddRateLimited(key)
+	return true
+}
+
+// syncPVC starts or checks the modification of the volume of pvc, it
+// returns how long to wait before checking the volume again.
+func (vm *VolumeModifier) syncPVC(ctx context.Context, pvc *v1.PersistentVolumeClaim) (time.Duration, error) {
+	value := strings.TrimSpace(pvc.Annotations[AnnTargetPerformanceLevel])
+	if value == "" || pvc.Status.Phase != v1.ClaimBound || pvc.Spec.VolumeName == "" {
+		return 0, nil
+	}
+	pv, err := vm.k8sClient.CoreV1().PersistentVolumes().Get(ctx, pvc.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return 0, err
+	}
+	if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != vm.driverName {
+		return 0, nil
+	}
+	volumeID := pv.Spec.CSI.VolumeHandle
+	status, statusTarget := pvc.Annotations[AnnModifyStatus], pvc.Annotations[AnnModifyTarget]
+	// a failed target is only tried again when the user sets a new one
+	if status == ModifyStatusFailed && statusTarget == value {
+		return 0, nil
+	}
+	failed := func(msg string) error {
+		return vm.setModifyStatus(ctx, pvc, ModifyStatusFailed, value, "", v1.EventTypeWarning, volumeModifyFailed, msg)
+	}
+
+	target, err := getModifyVolumeType(value)
+	if err != nil {
+		return 0, failed(err.Error())
+	}
+
+	vol, err := vm.ebsClient.GetVolume(&ebsClient.ListVolumesReq{VolumeIds: []string{volumeID}})
+	if err != nil {
+		return 0, err
+	}
+	if vol.VolumeType == target {
+		if status == ModifyStatusCompleted && statusTarget == value {
+			return 0, nil
+		}
+		msg := fmt.Sprintf("volume %s is modified to %s", volumeID, target)
+		return 0, vm.setModifyStatus(ctx, pvc, ModifyStatusCompleted, value, target, v1.EventTypeNormal, volumeModified, msg)
+	}
+	if vol.VolumeStatus == ebsClient.ERROR_STATUS {
+		return 0, failed(fmt.Sprintf("volume %s is in error status, it can not be modified to %s", volumeID, target))
+	}
+	if status == ModifyStatusModifying && statusTarget == value {
+		startTime, err := time.Parse(time.RFC3339, pvc.Annotations[AnnModifyStartTime])
+		if err == nil && time.Since(startTime) > modifyVolumeTimeout {
+			return 0, failed(fmt.Sprintf("volume %s is still %s, not modified to %s within %v", volumeID, vol.VolumeType, target, modifyVolumeTimeout))
+		}
+		klog.V(4).Infof("VolumeModifier:: volume %s is still %s, waiting for %s", volumeID, vol.VolumeType, target)
+		return modifyVolumePollInterval, nil
+	}
+
+	klog.V(2).Infof("VolumeModifier:: modifying volume %s of pvc %s/%s from %s to %s", volumeID, pvc.Namespace, pvc.Name, vol.VolumeType, target)
+	if _, err := vm.ebsClient.ModifyVolume(&ebsClient.ModifyVolumeReq{VolumeId: volumeID, VolumeType: target}); err != nil {
+		return 0, failed(fmt.Sprintf("failed to modify volume %s from %s to %s: %v", volumeID, vol.VolumeType, target, err))
+	}
+	msg := fmt.Sprintf("modifying volume %s from %s to %s", volumeID, vol.VolumeType, target)
+	if err := vm.setModifyStatus(ctx, pvc, ModifyStatusModifying, value, "", v1.EventTypeNormal, volumeModifying, msg); err != nil {
+		return 0, err
+	}
+	return modifyVolumePollInterval, nil
+}
+
+// setModifyStatus records the modification state in the annotations of pvc
+// and an event with message
+func (vm *VolumeModifier) setModifyStatus(ctx context.Context, pvc *v1.PersistentVolumeClaim, status, target, volumeType, eventType, reason, message string) error {
+	newPVC := pvc.DeepCopy()
+	newPVC.Annotations[AnnModifyStatus] = status
+	newPVC.Annotations[AnnModifyTarget] = target
+	if status == ModifyStatusModifying {
+		newPVC.Annotations[AnnModifyStartTime] = time.Now().Format(time.RFC3339)
+	} else {
+		delete(newPVC.Annotations, AnnModifyStartTime)
+	}
+	if volumeType != "" {
+		newPVC.Annotations[AnnPerformanceLevel] = volumeType
+	}
+	if _, err := vm.k8sClient.CoreV1().PersistentVolumeClaims(pvc.Namespace).Update(ctx, newPVC, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update pvc %s/%s to %s: %v", pvc.Namespace, pvc.Name, status, err)
+	}
+
+	if vm.recorder != nil {
+		ref := &v1.ObjectReference{
+			Kind:      "PersistentVolumeClaim",
+			Name:      pvc.Name,
+			Namespace: pvc.Namespace,
+			UID:       pvc.UID,
+		}
+		util.CreateEvent(vm.recorder, ref, eventType, reason, message)
+	}
+	return nil
+}
+
+// getModifyVolumeType returns the volume type of the target performance
+// level annotation, either a performance level of ESSD such as PL2, or a
+// volume type such as ESSD_PL2 or SSD3.0
+func getModifyVolumeType(value string) (string, error) {
+	for _, volumeType := range ebsClient.VolumeTypes {
+		if strings.EqualFold(value, volumeType) {
+			return volumeType, nil
+		}
+	}
+	switch pl := strings.ToUpper(value); pl {
+	case DISK_PERFORMANCE_LEVEL0, DISK_PERFORMANCE_LEVEL1, DISK_PERFORMANCE_LEVEL2, DISK_PERFORMANCE_LEVEL3:
+		return ESSD + "_" + pl, nil
+	}
+	return "", fmt.Errorf("invalid %s %q, expect one of PL0-PL3 or a volume type of %v", AnnTargetPerformanceLevel, value, ebsClient.VolumeTypes)
+}
@@ -0,0 +1,193 @@
+package driver
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	ebsClient "csi-plugin/pkg/ebs-client"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestVolumeModifierSyncPVC(t *testing.T) {
+	tests := []struct {
+		name       string
+		driver     string
+		target     string
+		volumeType string
+		// the status after each sync, "" if the pvc is not touched
+		wantStatus []string
+		wantType   string
+		wantErr    bool
+		wantEvents []string
+	}{
+		{
+			name:       "performance level",
+			driver:     driverName,
+			target:     "PL2",
+			volumeType: ESSD_PL1,
+			wantStatus: []string{ModifyStatusModifying, ModifyStatusCompleted, ModifyStatusCompleted},
+			wantType:   ESSD_PL2,
+			wantEvents: []string{volumeModifying, volumeModified},
+		},
+		{
+			name:       "volume type",
+			driver:     driverName,
+			target:     "SSD3.0",
+			volumeType: SATA3_0,
+			wantStatus: []string{ModifyStatusModifying, ModifyStatusCompleted},
+			wantType:   SSD3_0,
+			wantEvents: []string{volumeModifying, volumeModified},
+		},
+		{
+			name:       "essd from other type",
+			driver:     driverName,
+			target:     "ESSD_PL1",
+			volumeType: SSD3_0,
+			wantStatus: []string{ModifyStatusModifying, ModifyStatusCompleted},
+			wantType:   ESSD_PL1,
+			wantEvents: []string{volumeModifying, volumeModified},
+		},
+		{
+			name:       "invalid target",
+			driver:     driverName,
+			target:     "PL9",
+			volumeType: ESSD_PL1,
+			wantStatus: []string{ModifyStatusFailed, ModifyStatusFailed},
+			wantType:   ESSD_PL1,
+			wantEvents: []string{volumeModifyFailed},
+		},
+		{
+			name:       "modify error",
+			driver:     driverName,
+			target:     "PL3",
+			volumeType: ESSD_PL1,
+			wantStatus: []string{ModifyStatusFailed, ModifyStatusFailed},
+			wantType:   ESSD_PL1,
+			wantEvents: []string{volumeModifyFailed},
+		},
+		{
+			name:       "other driver",
+			driver:     "com.ksc.csi.nfsplugin",
+			target:     "PL2",
+			volumeType: ESSD_PL1,
+			wantStatus: []string{""},
+			wantType:   ESSD_PL1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storageClient := NewFakeStorageClient()
+			storageClient.unavailableTypes = map[string]bool{ESSD_PL3: true}
+			resp, err := storageClient.CreateVolume(&ebsClient.CreateVolumeReq{VolumeType: tt.volumeType})
+			if err != nil {
+				t.Fatal(err)
+			}
+			pvc, pv := newBoundTestPVC("disk-pvc", tt.driver, resp.VolumeId)
+			pvc.Annotations = map[string]string{AnnTargetPerformanceLevel: tt.target}
+			k8sClient := fake.NewSimpleClientset(pv, pvc)
+			recorder := record.NewFakeRecorder(10)
+			vm := NewVolumeModifier(driverName, k8sClient, storageClient, recorder)
+
+			ctx := context.Background()
+			for i, wantStatus := range tt.wantStatus {
+				pvc, err = k8sClient.CoreV1().PersistentVolumeClaims(pvc.Namespace).Get(ctx, pvc.Name, metav1.GetOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = vm.syncPVC(ctx, pvc)
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("sync %d: syncPVC() error = %v, wantErr %v", i, err, tt.wantErr)
+				}
+				pvc, _ = k8sClient.CoreV1().PersistentVolumeClaims(pvc.Namespace).Get(ctx, pvc.Name, metav1.GetOptions{})
+				if got := pvc.Annotations[AnnModifyStatus]; got != wantStatus {
+					t.Errorf("sync %d: status = %q, want %q", i, got, wantStatus)
+				}
+			}
+			if got := storageClient.volumes[resp.VolumeId].VolumeType; got != tt.wantType {
+				t.Errorf("volume type = %s, want %s", got, tt.wantType)
+			}
+			if tt.wantStatus[len(tt.wantStatus)-1] == ModifyStatusCompleted && pvc.Annotations[AnnPerformanceLevel] != tt.wantType {
+				t.Errorf("%s = %q, want %q", AnnPerformanceLevel, pvc.Annotations[AnnPerformanceLevel], tt.wantType)
+			}
+
+			close(recorder.Events)
+			var events []string
+			for event := range recorder.Events {
+				events = append(events, event)
+			}
+			if len(events) != len(tt.wantEvents) {
+				t.Fatalf("events = %v, want reasons %v", events, tt.wantEvents)
+			}
+			for i, reason := range tt.wantEvents {
+				if !strings.Contains(events[i], reason) {
+					t.Errorf("event %d = %q, want reason %s", i, events[i], reason)
+				}
+			}
+		})
+	}
+}
+
+func TestVolumeModifierTimeout(t *testing.T) {
+	storageClient := NewFakeStorageClient()
+	resp, err := storageClient.CreateVolume(&ebsClient.CreateVolumeReq{VolumeType: ESSD_PL1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pvc, pv := newBoundTestPVC("disk-pvc", driverName, resp.VolumeId)
+	pvc.Annotations = map[string]string{
+		AnnTargetPerformanceLevel: "PL2",
+		AnnModifyStatus:           ModifyStatusModifying,
+		AnnModifyTarget:           "PL2",
+	}
+	k8sClient := fake.NewSimpleClientset(pv, pvc)
+	recorder := record.NewFakeRecorder(10)
+	vm := NewVolumeModifier(driverName, k8sClient, storageClient, recorder)
+	ctx := context.Background()
+
+	pvc.Annotations[AnnModifyStartTime] = time.Now().Add(-modifyVolumeTimeout / 2).Format(time.RFC3339)
+	requeue, err := vm.syncPVC(ctx, pvc)
+	if err != nil || requeue != modifyVolumePollInterval {
+		t.Fatalf("syncPVC() within timeout = %v, %v, want %v", requeue, err, modifyVolumePollInterval)
+	}
+
+	pvc.Annotations[AnnModifyStartTime] = time.Now().Add(-2 * modifyVolumeTimeout).Format(time.RFC3339)
+	if _, err := vm.syncPVC(ctx, pvc); err != nil {
+		t.Fatal(err)
+	}
+	pvc, _ = k8sClient.CoreV1().PersistentVolumeClaims(pvc.Namespace).Get(ctx, pvc.Name, metav1.GetOptions{})
+	if got := pvc.Annotations[AnnModifyStatus]; got != ModifyStatusFailed {
+		t.Errorf("status after timeout = %q, want %q", got, ModifyStatusFailed)
+	}
+	if _, ok := pvc.Annotations[AnnModifyStartTime]; ok {
+		t.Errorf("%s is kept after the modification failed", AnnModifyStartTime)
+	}
+	if event := <-recorder.Events; !strings.Contains(event, volumeModifyFailed) {
+		t.Errorf("event = %q, want reason %s", event, volumeModifyFailed)
+	}
+}
+
+func Test_getModifyVolumeType(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{value: "PL2", want: ESSD_PL2},
+		{value: "pl0", want: ESSD_PL0},
+		{value: "ESSD_PL3", want: ESSD_PL3},
+		{value: "SSD3.0", want: SSD3_0},
+		{value: "ESSD", wantErr: true},
+		{value: "PL4", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := getModifyVolumeType(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("getModifyVolumeType(%q) = %q, %v, want %q, wantErr %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
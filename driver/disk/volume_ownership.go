@@ -0,0 +1,81 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// groupRWMask is what the group may do on the files of a volume of its
+	// fsGroup, groupExecMask is added on the directories
+	groupRWMask   = 0060
+	groupExecMask = 0010
+)
+
+// parseVolumeMountGroup returns the GID of the VolumeMountGroup of a mount
+// capability, kubelet passes the fsGroup of the pod
+func parseVolumeMountGroup(group string) (int, error) {
+	gid, err := strconv.Atoi(group)
+	if err != nil || gid < 0 {
+		return 0, fmt.Errorf("invalid volume mount group %q, it must be a GID", group)
+	}
+	return gid, nil
+}
+
+// setVolumeOwnership gives gid the files of the filesystem mounted at path,
+// like kubelet does with the fsGroup of a pod: they are chowned to gid and
+// made readable and writable by the group, and the directories get the
+// setgid bit so that the new files inherit the group. The tree is only
+// walked when its root is not given to gid yet, so the later mounts for the
+// same group are cheap.
+func setVolumeOwnership(path string, gid int) error {
+	root, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if isOwnedByGroup(root, gid) {
+		return nil
+	}
+
+	klog.V(2).Infof("setting the ownership of volume %s to group %d", path, gid)
+	return filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// the links are left alone, their targets are walked if they are
+		// in the volume
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		if err := os.Lchown(file, -1, gid); err != nil {
+			return fmt.Errorf("failed to chown %s to group %d: %v", file, gid, err)
+		}
+		mask := os.FileMode(groupRWMask)
+		if info.IsDir() {
+			mask |= groupExecMask | os.ModeSetgid
+		}
+		if info.Mode()&mask == mask {
+			return nil
+		}
+		if err := os.Chmod(file, info.Mode()|mask); err != nil {
+			return fmt.Errorf("failed to chmod %s: %v", file, err)
+		}
+		return nil
+	})
+}
+
+// isOwnedByGroup returns whether the directory dir is given to gid by
+// setVolumeOwnership
+func isOwnedByGroup(dir os.FileInfo, gid int) bool {
+	stat, ok := dir.Sys().(*syscall.Stat_t)
+	if !ok || int(stat.Gid) != gid {
+		return false
+	}
+	mask := os.FileMode(groupRWMask|groupExecMask) | os.ModeSetgid
+	return dir.Mode()&mask == mask
+}
@@ -0,0 +1,61 @@
+package driver
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestSetVolumeOwnership(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing the group of the files needs root")
+	}
+	const gid = 3000
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "lost+found"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "lost+found", "file"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/etc/passwd", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := setVolumeOwnership(dir, gid); err != nil {
+		t.Fatalf("setVolumeOwnership() error = %v", err)
+	}
+	want := map[string]os.FileMode{
+		"":                os.ModeDir | os.ModeSetgid | 0770,
+		"lost+found":      os.ModeDir | os.ModeSetgid | 0770,
+		"lost+found/file": 0660,
+	}
+	for name, mode := range want {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode()&mode != mode || int(fi.Sys().(*syscall.Stat_t).Gid) != gid {
+			t.Errorf("setVolumeOwnership() %q mode %v gid %d, want %v of group %d", name, fi.Mode(), fi.Sys().(*syscall.Stat_t).Gid, mode, gid)
+		}
+	}
+	if fi, err := os.Stat("/etc/passwd"); err == nil && int(fi.Sys().(*syscall.Stat_t).Gid) == gid {
+		t.Error("setVolumeOwnership() followed a link out of the volume")
+	}
+
+	// the tree is not walked again for the same group
+	if err := os.Chmod(filepath.Join(dir, "lost+found", "file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := setVolumeOwnership(dir, gid); err != nil {
+		t.Fatalf("setVolumeOwnership() again error = %v", err)
+	}
+	if fi, _ := os.Stat(filepath.Join(dir, "lost+found", "file")); fi.Mode().Perm() != 0600 {
+		t.Errorf("setVolumeOwnership() walked a volume of its group, file mode %v", fi.Mode())
+	}
+
+	if _, err := parseVolumeMountGroup("-1"); err == nil {
+		t.Error("parseVolumeMountGroup(-1) error = nil")
+	}
+}
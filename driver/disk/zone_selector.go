@@ -0,0 +1,205 @@
+package driver
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+
+	"csi-plugin/util"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// zoneSelectionPolicyKey is the storage class parameter of the zone selection policy
+	zoneSelectionPolicyKey = "zoneSelectionPolicy"
+
+	// ZonePolicyPreferred keeps the zones in the order of the storage class
+	// zone list, or the Preferred and then Requisite topologies
+	ZonePolicyPreferred = "preferred"
+	// ZonePolicyRoundRobin rotates the first zone among the candidates on
+	// every request, it is the default of a comma separated zone list
+	ZonePolicyRoundRobin = "roundRobin"
+	// ZonePolicyNodeCount orders the candidates randomly, weighted by the
+	// number of ready nodes in each zone
+	ZonePolicyNodeCount = "nodeCount"
+)
+
+// ZoneSelector returns the zones a volume may be created in, in the order
+// they should be tried
+type ZoneSelector interface {
+	SelectZones(req *csi.CreateVolumeRequest) ([]string, error)
+}
+
+type zoneSelector struct {
+	k8sClient K8sClientWrapper
+
+	mutex sync.Mutex
+	// the map of multizone and index
+	storageClassZonePos map[string]int
+}
+
+func NewZoneSelector(k8sClient K8sClientWrapper) ZoneSelector {
+	return &zoneSelector{
+		k8sClient:           k8sClient,
+		storageClassZonePos: map[string]int{},
+	}
+}
+
+// SelectZones takes the candidates from the zone parameter of the storage
+// class, limited to the Requisite topologies, or from the Preferred and
+// Requisite topologies which carry the allowedTopologies of the storage class.
+// Without any of them all the zones with nodes are candidates.
+//
+// The first Preferred zone is always tried first when it is a candidate, it
+// is the zone of the node the pod is scheduled to with WaitForFirstConsumer,
+// and the policy only orders the other candidates.
+func (zs *zoneSelector) SelectZones(req *csi.CreateVolumeRequest) ([]string, error) {
+	params := req.GetParameters()
+	policy := params[zoneSelectionPolicyKey]
+	switch policy {
+	case "", ZonePolicyPreferred, ZonePolicyRoundRobin, ZonePolicyNodeCount:
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "CreateVolume: unsupported %s: %s", zoneSelectionPolicyKey, policy)
+	}
+
+	requisite := topologyZones(req.GetAccessibilityRequirements().GetRequisite())
+	var zones []string
+	if zoneParam := params["zone"]; zoneParam != "" {
+		for _, zone := range uniqueZones(strings.Split(zoneParam, ",")) {
+			if len(requisite) == 0 || containsString(requisite, zone) {
+				zones = append(zones, zone)
+			}
+		}
+		if len(zones) == 0 {
+			return nil, status.Errorf(codes.ResourceExhausted, "CreateVolume: none of the zones %q is in the accessible topology %v", zoneParam, requisite)
+		}
+		if len(zones) > 1 && policy == "" {
+			policy = ZonePolicyRoundRobin
+		}
+	} else {
+		zones = topologyZones(req.GetAccessibilityRequirements().GetPreferred())
+		for _, zone := range requisite {
+			if !containsString(zones, zone) {
+				zones = append(zones, zone)
+			}
+		}
+	}
+
+	var nodeCounts map[string]int
+	if len(zones) == 0 || policy == ZonePolicyNodeCount {
+		var err error
+		if nodeCounts, err = zs.k8sClient.GetZoneNodeCounts(); err != nil {
+			return nil, status.Errorf(codes.Internal, "CreateVolume: failed to count nodes of zones: %v", err)
+		}
+	}
+	if len(zones) == 0 {
+		for zone := range nodeCounts {
+			zones = append(zones, zone)
+		}
+		sort.Strings(zones)
+		if policy == "" {
+			policy = ZonePolicyNodeCount
+		}
+	}
+	if len(zones) == 0 {
+		return nil, status.Error(codes.ResourceExhausted, "CreateVolume: no zone is available, set zone in storage class or check the topology of the nodes")
+	}
+
+	var first []string
+	if preferred := topologyZones(req.GetAccessibilityRequirements().GetPreferred()); len(preferred) > 0 && containsString(zones, preferred[0]) {
+		first = []string{preferred[0]}
+		zones = removeString(zones, preferred[0])
+	}
+	if len(zones) > 0 {
+		switch policy {
+		case ZonePolicyRoundRobin:
+			zones = zs.rotate(zones)
+		case ZonePolicyNodeCount:
+			zones = weightByNodeCount(zones, nodeCounts)
+		}
+	}
+	zones = append(first, zones...)
+	klog.V(2).Infof("SelectZones:: request %s zones %v, policy %q", req.GetName(), zones, policy)
+	return zones, nil
+}
+
+// rotate starts the zones from the next position of the same zone list
+func (zs *zoneSelector) rotate(zones []string) []string {
+	zoneStr := strings.Join(zones, ",")
+	zs.mutex.Lock()
+	zoneIndex := zs.storageClassZonePos[zoneStr] % len(zones)
+	zs.storageClassZonePos[zoneStr] = zoneIndex + 1
+	zs.mutex.Unlock()
+
+	return append(append([]string{}, zones[zoneIndex:]...), zones[:zoneIndex]...)
+}
+
+// weightByNodeCount picks the zones one by one with a probability in
+// proportion to their node count, zones without nodes are tried last
+func weightByNodeCount(zones []string, nodeCounts map[string]int) []string {
+	remaining := append([]string{}, zones...)
+	ordered := make([]string, 0, len(zones))
+	for len(remaining) > 0 {
+		total := 0
+		for _, zone := range remaining {
+			total += nodeCounts[zone]
+		}
+		if total == 0 {
+			break
+		}
+		n := rand.Intn(total)
+		for i, zone := range remaining {
+			if n < nodeCounts[zone] {
+				ordered = append(ordered, zone)
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				break
+			}
+			n -= nodeCounts[zone]
+		}
+	}
+	return append(ordered, remaining...)
+}
+
+func topologyZones(topologies []*csi.Topology) []string {
+	var zones []string
+	for _, topology := range topologies {
+		zones = append(zones, topology.GetSegments()[util.NodeZoneKey])
+	}
+	return uniqueZones(zones)
+}
+
+func uniqueZones(zones []string) []string {
+	var unique []string
+	for _, zone := range zones {
+		zone = strings.TrimSpace(zone)
+		if zone != "" && !containsString(unique, zone) {
+			unique = append(unique, zone)
+		}
+	}
+	return unique
+}
+
+// removeString returns a copy of slice without s
+func removeString(slice []string, s string) []string {
+	var removed []string
+	for _, v := range slice {
+		if v != s {
+			removed = append(removed, v)
+		}
+	}
+	return removed
+}
+
+func containsString(slice []string, s string) bool {
+	for _, v := range slice {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,204 @@
+package driver
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"csi-plugin/util"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+)
+
+type fakeZoneNodeCounts map[string]int
+
+func (fz fakeZoneNodeCounts) GetZoneNodeCounts() (map[string]int, error) {
+	return fz, nil
+}
+
+func (fz fakeZoneNodeCounts) GetPersistentVolumeClaim(namespace, name string) (*v1.PersistentVolumeClaim, error) {
+	return nil, fmt.Errorf("pvc %s/%s not found", namespace, name)
+}
+
+func (fz fakeZoneNodeCounts) IsNodeStatusReady(nodename string) (bool, error) {
+	return true, nil
+}
+
+func (fz fakeZoneNodeCounts) GetNodeByInstanceID(instanceID string) (*v1.Node, error) {
+	return nodeByInstanceID(nil, instanceID)
+}
+
+func (fz fakeZoneNodeCounts) GetVolumeAttachment(driverName, volumeID, nodeName string) (*storagev1.VolumeAttachment, error) {
+	return nil, nil
+}
+
+func zoneTopologies(zones ...string) []*csi.Topology {
+	var topologies []*csi.Topology
+	for _, zone := range zones {
+		topologies = append(topologies, &csi.Topology{Segments: map[string]string{util.NodeZoneKey: zone}})
+	}
+	return topologies
+}
+
+func TestSelectZones(t *testing.T) {
+	tests := []struct {
+		name      string
+		params    map[string]string
+		requisite []string
+		preferred []string
+		want      []string
+		wantCode  codes.Code
+	}{
+		{
+			name:      "preferred then requisite",
+			requisite: []string{"cn-beijing-6a", "cn-beijing-6b", "cn-beijing-6c"},
+			preferred: []string{"cn-beijing-6b", "cn-beijing-6a"},
+			want:      []string{"cn-beijing-6b", "cn-beijing-6a", "cn-beijing-6c"},
+		},
+		{
+			name:   "single zone parameter",
+			params: map[string]string{"zone": "cn-beijing-6a"},
+			want:   []string{"cn-beijing-6a"},
+		},
+		{
+			name:      "zone parameter limited by requisite",
+			params:    map[string]string{"zone": "cn-beijing-6a,cn-beijing-6b", zoneSelectionPolicyKey: ZonePolicyPreferred},
+			requisite: []string{"cn-beijing-6b", "cn-beijing-6c"},
+			want:      []string{"cn-beijing-6b"},
+		},
+		{
+			name:      "zone parameter with preferred",
+			params:    map[string]string{"zone": "cn-beijing-6a,cn-beijing-6b"},
+			preferred: []string{"cn-beijing-6b"},
+			want:      []string{"cn-beijing-6b", "cn-beijing-6a"},
+		},
+		{
+			name:      "preferred outside zone parameter",
+			params:    map[string]string{"zone": "cn-beijing-6a"},
+			preferred: []string{"cn-beijing-6b"},
+			want:      []string{"cn-beijing-6a"},
+		},
+		{
+			name:      "zone parameter outside requisite",
+			params:    map[string]string{"zone": "cn-beijing-6a"},
+			requisite: []string{"cn-beijing-6b"},
+			wantCode:  codes.ResourceExhausted,
+		},
+		{
+			name:     "unknown policy",
+			params:   map[string]string{zoneSelectionPolicyKey: "random"},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "no zone",
+			wantCode: codes.ResourceExhausted,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			zs := NewZoneSelector(fakeZoneNodeCounts{})
+			req := &csi.CreateVolumeRequest{
+				Name:       "disk-pvc",
+				Parameters: tt.params,
+				AccessibilityRequirements: &csi.TopologyRequirement{
+					Requisite: zoneTopologies(tt.requisite...),
+					Preferred: zoneTopologies(tt.preferred...),
+				},
+			}
+			got, err := zs.SelectZones(req)
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("SelectZones() error = %v, want code %v", err, tt.wantCode)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SelectZones() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectZonesRoundRobin(t *testing.T) {
+	zs := NewZoneSelector(fakeZoneNodeCounts{})
+	req := &csi.CreateVolumeRequest{
+		Parameters: map[string]string{"zone": "cn-beijing-6a,cn-beijing-6b,cn-beijing-6c"},
+	}
+	var firsts []string
+	for i := 0; i < 4; i++ {
+		zones, err := zs.SelectZones(req)
+		if err != nil {
+			t.Fatalf("SelectZones() error = %v", err)
+		}
+		if len(zones) != 3 {
+			t.Fatalf("SelectZones() = %v, want all the 3 zones", zones)
+		}
+		firsts = append(firsts, zones[0])
+	}
+	want := []string{"cn-beijing-6a", "cn-beijing-6b", "cn-beijing-6c", "cn-beijing-6a"}
+	if !reflect.DeepEqual(firsts, want) {
+		t.Errorf("SelectZones() first zones = %v, want %v", firsts, want)
+	}
+
+	// the zone of the scheduled node stays first, the others are rotated
+	req.Parameters[zoneSelectionPolicyKey] = ZonePolicyRoundRobin
+	req.AccessibilityRequirements = &csi.TopologyRequirement{Preferred: zoneTopologies("cn-beijing-6c")}
+	var seconds []string
+	for i := 0; i < 3; i++ {
+		zones, err := zs.SelectZones(req)
+		if err != nil {
+			t.Fatalf("SelectZones() with preferred error = %v", err)
+		}
+		if len(zones) != 3 || zones[0] != "cn-beijing-6c" {
+			t.Fatalf("SelectZones() with preferred = %v, want cn-beijing-6c first", zones)
+		}
+		seconds = append(seconds, zones[1])
+	}
+	want = []string{"cn-beijing-6a", "cn-beijing-6b", "cn-beijing-6a"}
+	if !reflect.DeepEqual(seconds, want) {
+		t.Errorf("SelectZones() with preferred second zones = %v, want %v", seconds, want)
+	}
+}
+
+func TestSelectZonesNodeCount(t *testing.T) {
+	zs := NewZoneSelector(fakeZoneNodeCounts{"cn-beijing-6a": 3, "cn-beijing-6b": 1})
+
+	// without any topology all the zones with nodes are candidates
+	zones, err := zs.SelectZones(&csi.CreateVolumeRequest{})
+	if err != nil {
+		t.Fatalf("SelectZones() error = %v", err)
+	}
+	if len(zones) != 2 || !containsString(zones, "cn-beijing-6a") || !containsString(zones, "cn-beijing-6b") {
+		t.Errorf("SelectZones() = %v, want the zones with nodes", zones)
+	}
+
+	// zones without nodes are tried last
+	req := &csi.CreateVolumeRequest{
+		Parameters: map[string]string{zoneSelectionPolicyKey: ZonePolicyNodeCount},
+		AccessibilityRequirements: &csi.TopologyRequirement{
+			Requisite: zoneTopologies("cn-beijing-6c", "cn-beijing-6a", "cn-beijing-6b"),
+		},
+	}
+	for i := 0; i < 10; i++ {
+		zones, err := zs.SelectZones(req)
+		if err != nil {
+			t.Fatalf("SelectZones() error = %v", err)
+		}
+		if len(zones) != 3 || zones[2] != "cn-beijing-6c" {
+			t.Errorf("SelectZones() = %v, want cn-beijing-6c last", zones)
+		}
+	}
+
+	// the preferred zone is not weighted
+	req.AccessibilityRequirements.Preferred = zoneTopologies("cn-beijing-6c")
+	for i := 0; i < 10; i++ {
+		zones, err := zs.SelectZones(req)
+		if err != nil {
+			t.Fatalf("SelectZones() error = %v", err)
+		}
+		if len(zones) != 3 || zones[0] != "cn-beijing-6c" {
+			t.Errorf("SelectZones() = %v, want the preferred cn-beijing-6c first", zones)
+		}
+	}
+}
@@ -11,12 +11,14 @@ import (
 
 // IdentityServer driver
 type IdentityServer struct {
+	csi.UnimplementedIdentityServer
+
 	d *Driver
 }
 
 // NewIdentityServer new IdentityServer
 func NewIdentityServer(driver *Driver) *IdentityServer {
-	return &IdentityServer{driver}
+	return &IdentityServer{d: driver}
 }
 
 // GetPluginInfo return info of the plugin
@@ -14,6 +14,8 @@ import (
 
 // NodeServer driver
 type NodeServer struct {
+	csi.UnimplementedNodeServer
+
 	d *Driver
 }
 
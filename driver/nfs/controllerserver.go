@@ -35,6 +35,8 @@ import (
 
 // ControllerServer controller server setting
 type ControllerServer struct {
+	csi.UnimplementedControllerServer
+
 	Driver *Driver
 }
 
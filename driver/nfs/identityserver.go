@@ -25,6 +25,8 @@ import (
 )
 
 type IdentityServer struct {
+	csi.UnimplementedIdentityServer
+
 	Driver *Driver
 }
 
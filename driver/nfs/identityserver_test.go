@@ -73,7 +73,6 @@ func TestProbe(t *testing.T) {
 	resp, err := fakeIdentityServer.Probe(context.Background(), &req)
 	assert.NoError(t, err)
 	assert.NotNil(t, resp)
-	assert.Equal(t, resp.XXX_sizecache, int32(0))
 	assert.Equal(t, resp.Ready.Value, true)
 }
 
@@ -96,7 +95,6 @@ func TestGetPluginCapabilities(t *testing.T) {
 	resp, err := fakeIdentityServer.GetPluginCapabilities(context.Background(), &req)
 	assert.NoError(t, err)
 	assert.NotNil(t, resp)
-	assert.Equal(t, resp.XXX_sizecache, int32(0))
 	assert.Equal(t, resp.Capabilities, expectedCap)
 
 }
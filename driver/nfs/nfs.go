@@ -17,6 +17,7 @@ limitations under the License.
 package nfs
 
 import (
+	"csi-plugin/util"
 	"k8s.io/client-go/kubernetes"
 	"runtime"
 	"strings"
@@ -54,7 +55,7 @@ type Driver struct {
 	ns          *NodeServer
 	cscap       []*csi.ControllerServiceCapability
 	nscap       []*csi.NodeServiceCapability
-	volumeLocks *VolumeLocks
+	volumeLocks *util.VolumeLocks
 
 	// a timed cache storing volume stats <volumeID, volumeStats>
 	volStatsCache                azcache.Resource
@@ -109,7 +110,7 @@ func NewDriver(options *DriverOptions) *Driver {
 		csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
 		csi.NodeServiceCapability_RPC_UNKNOWN,
 	})
-	n.volumeLocks = NewVolumeLocks()
+	n.volumeLocks = util.NewVolumeLocks()
 
 	if options.VolStatsCacheExpireInMinutes <= 0 {
 		options.VolStatsCacheExpireInMinutes = 10 // default expire in 10 minutes
@@ -22,6 +22,8 @@ import (
 	"path/filepath"
 	"testing"
 
+	"csi-plugin/util"
+
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/stretchr/testify/assert"
 )
@@ -52,7 +54,7 @@ func NewEmptyDriver(emptyField string) *Driver {
 			nodeID:  fakeNodeID,
 		}
 	}
-	d.volumeLocks = NewVolumeLocks()
+	d.volumeLocks = util.NewVolumeLocks()
 	return d
 }
 
@@ -151,7 +153,7 @@ func TestNewControllerServiceCapability(t *testing.T) {
 	for _, test := range tests {
 		resp := NewControllerServiceCapability(test.cap)
 		assert.NotNil(t, resp)
-		assert.Equal(t, resp.XXX_sizecache, int32(0))
+		assert.Equal(t, resp.GetRpc().GetType(), test.cap)
 	}
 }
 
@@ -175,7 +177,7 @@ func TestNewNodeServiceCapability(t *testing.T) {
 	for _, test := range tests {
 		resp := NewNodeServiceCapability(test.cap)
 		assert.NotNil(t, resp)
-		assert.Equal(t, resp.XXX_sizecache, int32(0))
+		assert.Equal(t, resp.GetRpc().GetType(), test.cap)
 	}
 }
 
@@ -35,6 +35,8 @@ import (
 
 // NodeServer driver
 type NodeServer struct {
+	csi.UnimplementedNodeServer
+
 	Driver  *Driver
 	mounter mount.Interface
 }
@@ -216,9 +218,8 @@ func (ns *NodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVo
 		return nil, status.Errorf(codes.Internal, err.Error())
 	}
 	if cache != nil {
-		resp := cache.(csi.NodeGetVolumeStatsResponse)
 		klog.V(6).Infof("NodeGetVolumeStats: volume stats for volume %s path %s is cached", req.VolumeId, req.VolumePath)
-		return &resp, nil
+		return cache.(*csi.NodeGetVolumeStatsResponse), nil
 	}
 
 	if _, err := os.Lstat(req.VolumePath); err != nil {
@@ -259,7 +260,7 @@ func (ns *NodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVo
 		return nil, status.Errorf(codes.Internal, "failed to transform disk inodes used(%v)", volumeMetrics.InodesUsed)
 	}
 
-	resp := csi.NodeGetVolumeStatsResponse{
+	resp := &csi.NodeGetVolumeStatsResponse{
 		Usage: []*csi.VolumeUsage{
 			{
 				Unit:      csi.VolumeUsage_BYTES,
@@ -278,7 +279,7 @@ func (ns *NodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVo
 
 	// cache the volume stats per volume
 	ns.Driver.volStatsCache.Set(req.VolumeId, resp)
-	return &resp, err
+	return resp, err
 }
 
 // NodeUnstageVolume unstage volume
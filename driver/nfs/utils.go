@@ -20,13 +20,11 @@ import (
 	"fmt"
 	"os"
 	"strings"
-	"sync"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
-	"k8s.io/apimachinery/pkg/util/sets"
 
 	"k8s.io/klog/v2"
 	netutil "k8s.io/utils/net"
@@ -116,33 +114,6 @@ func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, h
 	return resp, err
 }
 
-type VolumeLocks struct {
-	locks sets.String //nolint:staticcheck
-	mux   sync.Mutex
-}
-
-func NewVolumeLocks() *VolumeLocks {
-	return &VolumeLocks{
-		locks: sets.NewString(),
-	}
-}
-
-func (vl *VolumeLocks) TryAcquire(volumeID string) bool {
-	vl.mux.Lock()
-	defer vl.mux.Unlock()
-	if vl.locks.Has(volumeID) {
-		return false
-	}
-	vl.locks.Insert(volumeID)
-	return true
-}
-
-func (vl *VolumeLocks) Release(volumeID string) {
-	vl.mux.Lock()
-	defer vl.mux.Unlock()
-	vl.locks.Delete(volumeID)
-}
-
 // getMountOptions get mountOptions value from a map
 func getMountOptions(context map[string]string) string {
 	for k, v := range context {
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 	//	"strconv"
 	"time"
 
@@ -19,6 +20,7 @@ import (
 
 const (
 	serviceName                = "ebs"
+	tagServiceName             = "tag"
 	clientDeleteVolumeStatus   = "VolumeCanNotFoundError"
 	clientDeleteSnapshotStatus = "SnapshotCanNotFoundError"
 )
@@ -40,6 +42,52 @@ func (cli *Client) DescribeInstanceVolumes(describeInstanceVolumesReq *DescribeI
 	return ValidateAttachInstanceResp, nil
 }
 
+func (cli *Client) DescribeVolumeQuota(describeVolumeQuotaReq *DescribeVolumeQuotaReq) (*DescribeVolumeQuotaResp, error) {
+	describeVolumeQuotaResp := &DescribeVolumeQuotaResp{}
+	query := describeVolumeQuotaReq.ToQuery()
+	resp, err := cli.DoRequest(serviceName, query)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(resp, describeVolumeQuotaResp); err != nil {
+		return nil, err
+	}
+	return describeVolumeQuotaResp, nil
+}
+
+// VolumeTypeUnavailableError means the volume type can not be created in the
+// zone for now, because of stock, quota or zone support, another volume type
+// may still succeed
+type VolumeTypeUnavailableError struct {
+	VolumeType       string
+	AvailabilityZone string
+	Code             string
+	Message          string
+}
+
+func (e *VolumeTypeUnavailableError) Error() string {
+	return fmt.Sprintf("volume type %s is unavailable in %s: %s(%s)", e.VolumeType, e.AvailabilityZone, e.Message, e.Code)
+}
+
+// volumeTypeUnavailableCodes are the fragments of the CreateVolume error codes
+// about stock, quota and zone support
+var volumeTypeUnavailableCodes = []string{"Stock", "Quota", "NotSupport", "Insufficient", "NotAvailable"}
+
+func isVolumeTypeUnavailableCode(code string) bool {
+	for _, fragment := range volumeTypeUnavailableCodes {
+		if strings.Contains(code, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsVolumeTypeUnavailable reports whether err is a VolumeTypeUnavailableError
+func IsVolumeTypeUnavailable(err error) bool {
+	var unavailableErr *VolumeTypeUnavailableError
+	return errors.As(err, &unavailableErr)
+}
+
 func New(config *api.ClientConfig) *Client {
 	return &Client{
 		Client: api.New(config),
@@ -55,6 +103,25 @@ func (cli *Client) CreateVolume(createVolumeReq *CreateVolumeReq) (*CreateVolume
 	query := createVolumeReq.ToQuery()
 	resp, err := cli.DoRequest(serviceName, query)
 	if err != nil {
+		type ErrorResponse struct {
+			RequestID string
+			Error     struct {
+				Code    string
+				Message string
+			}
+		}
+		var errorResp ErrorResponse
+		if errs := json.Unmarshal(resp, &errorResp); errs != nil {
+			klog.Error("JSON unmarshal failed:", errs)
+		}
+		if isVolumeTypeUnavailableCode(errorResp.Error.Code) {
+			return nil, &VolumeTypeUnavailableError{
+				VolumeType:       createVolumeReq.VolumeType,
+				AvailabilityZone: createVolumeReq.AvailabilityZone,
+				Code:             errorResp.Error.Code,
+				Message:          err.Error(),
+			}
+		}
 		return nil, err
 	}
 
@@ -164,6 +231,69 @@ func (cli *Client) ExpandVolume(expandVolumeReq *ExpandVolumeReq) (*ExpandVolume
 	return expandVolumeResp, nil
 }
 
+func (cli *Client) ModifyVolume(modifyVolumeReq *ModifyVolumeReq) (*ModifyVolumeResp, error) {
+	if !validateReqParams(VolumeIdRegexp, modifyVolumeReq.VolumeId) {
+		return nil, status.Errorf(codes.InvalidArgument, "Volume id (%v) is invalid", modifyVolumeReq.VolumeId)
+	}
+	if !validateReqParams(VolumeTypeRegexp, modifyVolumeReq.VolumeType) {
+		return nil, status.Errorf(codes.InvalidArgument, "Volume type (%v) is invalid", modifyVolumeReq.VolumeType)
+	}
+
+	query := modifyVolumeReq.ToQuery()
+	resp, err := cli.DoRequest(serviceName, query)
+	if err != nil {
+		return nil, err
+	}
+	modifyVolumeResp := &ModifyVolumeResp{}
+	if err := json.Unmarshal(resp, modifyVolumeResp); err != nil {
+		return nil, err
+	}
+	if !modifyVolumeResp.Return {
+		return nil, errors.New("ModifyVolumeType return False")
+	}
+
+	return modifyVolumeResp, nil
+}
+
+func (cli *Client) TagVolume(tagVolumeReq *TagVolumeReq) (*TagVolumeResp, error) {
+	if !validateReqParams(VolumeIdRegexp, tagVolumeReq.VolumeId) {
+		return nil, status.Errorf(codes.InvalidArgument, "Volume id (%v) is invalid", tagVolumeReq.VolumeId)
+	}
+
+	query := tagVolumeReq.ToQuery()
+	resp, err := cli.DoRequest(tagServiceName, query)
+	if err != nil {
+		return nil, err
+	}
+	tagVolumeResp := &TagVolumeResp{}
+	if err := json.Unmarshal(resp, tagVolumeResp); err != nil {
+		return nil, err
+	}
+	if !tagVolumeResp.Return {
+		return nil, errors.New("CreateTags return False")
+	}
+
+	return tagVolumeResp, nil
+}
+
+func (cli *Client) DescribeVolumeTags(describeVolumeTagsReq *DescribeVolumeTagsReq) (*DescribeVolumeTagsResp, error) {
+	if !validateReqParams(VolumeIdRegexp, describeVolumeTagsReq.VolumeId) {
+		return nil, status.Errorf(codes.InvalidArgument, "Volume id (%v) is invalid", describeVolumeTagsReq.VolumeId)
+	}
+
+	query := describeVolumeTagsReq.ToQuery()
+	resp, err := cli.DoRequest(tagServiceName, query)
+	if err != nil {
+		return nil, err
+	}
+	describeVolumeTagsResp := &DescribeVolumeTagsResp{}
+	if err := json.Unmarshal(resp, describeVolumeTagsResp); err != nil {
+		return nil, err
+	}
+
+	return describeVolumeTagsResp, nil
+}
+
 func (cli *Client) Attach(attachVolumeReq *AttachVolumeReq) (*AttachVolumeResp, error) {
 	attachVolumeResp := &AttachVolumeResp{}
 
@@ -224,30 +354,62 @@ func WaitVolumeStatus(storageService StorageService, volumeId string, targetStat
 	ticker := time.NewTicker(time.Second * 5)
 	defer ticker.Stop()
 
+	// the status is checked at once, a volume may be done already
 	for {
-		select {
-		case <-ticker.C:
-			listVolumesReq := &ListVolumesReq{
-				VolumeIds: []string{volumeId},
-			}
-			listVolumesResp, err := storageService.ListVolumes(listVolumesReq)
-			if err != nil {
-				klog.Errorf("waitVolumeStatus:ListVolumes %v error: %v", volumeId, err)
-				continue
-			}
-			if len(listVolumesResp.Volumes) == 0 {
-				klog.Errorf("waitVolumeStatus:ListVolumes error: volume %v not found", volumeId)
-				continue
-			}
+		listVolumesReq := &ListVolumesReq{
+			VolumeIds: []string{volumeId},
+		}
+		listVolumesResp, err := storageService.ListVolumes(listVolumesReq)
+		switch {
+		case err != nil:
+			klog.Errorf("waitVolumeStatus:ListVolumes %v error: %v", volumeId, err)
+		case len(listVolumesResp.Volumes) == 0:
+			klog.Errorf("waitVolumeStatus:ListVolumes error: volume %v not found", volumeId)
+		default:
 			vol := listVolumesResp.Volumes[0]
 			klog.V(5).Infof("volumeID: %s,nodeID: %s, wating for volume status: %v, current status: %v", volumeId, nodeID, targetStatus, vol.VolumeStatus)
 			if vol.VolumeStatus == targetStatus {
 				return nil
 			}
+		}
+		select {
+		case <-ticker.C:
 		case <-ctx.Done():
 			return fmt.Errorf("timeout occured waiting for EBS %v volume: %q", action, volumeId)
 		}
+	}
+}
+
+func WaitSnapshotStatus(storageService StorageService, snapshotId string, targetStatus string, duration time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
 
+	ticker := time.NewTicker(time.Second * 5)
+	defer ticker.Stop()
+
+	for {
+		snapshot, err := storageService.GetSnapshot(&DescribeSnapshotsReq{
+			SnapshotId: snapshotId,
+		})
+		if err != nil {
+			klog.Errorf("waitSnapshotStatus:GetSnapshot %v error: %v", snapshotId, err)
+		} else if snapshot == nil {
+			klog.Errorf("waitSnapshotStatus:GetSnapshot error: snapshot %v not found", snapshotId)
+		} else {
+			klog.V(5).Infof("snapshotID: %s, wating for snapshot status: %v, current status: %v, progress: %v", snapshotId, targetStatus, snapshot.SnapshotStatus, snapshot.Progress)
+			if snapshot.SnapshotStatus == targetStatus {
+				return nil
+			}
+			if snapshot.SnapshotStatus == SNAPSHOT_ERROR_STATUS {
+				return fmt.Errorf("snapshot %q is in error status", snapshotId)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("timeout occured waiting for EBS snapshot %q to be %v", snapshotId, targetStatus)
+		}
 	}
 }
 
@@ -2,6 +2,7 @@ package ebsClient
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 
 	"k8s.io/klog/v2"
@@ -13,6 +14,9 @@ type StorageService interface {
 	CreateVolume(*CreateVolumeReq) (*CreateVolumeResp, error)
 	DeleteVolume(*DeleteVolumeReq) (*DeleteVolumeResp, error)
 	ExpandVolume(*ExpandVolumeReq) (*ExpandVolumeResp, error)
+	ModifyVolume(*ModifyVolumeReq) (*ModifyVolumeResp, error)
+	TagVolume(*TagVolumeReq) (*TagVolumeResp, error)
+	DescribeVolumeTags(*DescribeVolumeTagsReq) (*DescribeVolumeTagsResp, error)
 
 	Attach(*AttachVolumeReq) (*AttachVolumeResp, error)
 	Detach(*DetachVolumeReq) (*DetachVolumeResp, error)
@@ -20,6 +24,7 @@ type StorageService interface {
 	ValidateAttachInstance(*ValidateAttachInstanceReq) (*ValidateAttachInstanceResp, error)
 	GetVolumeByName(getVolumesReq *ListVolumesReq) (*ListVolumesResp, error)
 	DescribeInstanceVolumes(describeInstanceVolumesReq *DescribeInstanceVolumesReq) (*InstanceVolumes, error)
+	DescribeVolumeQuota(*DescribeVolumeQuotaReq) (*DescribeVolumeQuotaResp, error)
 
 	CreateSnapshot(*CreateSnapshotReq) (*CreateSnapshotResp, error)
 	GetSnapshot(*DescribeSnapshotsReq) (*Snapshot, error)
@@ -71,6 +76,11 @@ const (
 	EXTENDING_STATUS VolumeStatusType = "extending"
 	DELETING_STATUS  VolumeStatusType = "deleting"
 	ERROR_STATUS     VolumeStatusType = "error"
+
+	// snapshot status
+	SNAPSHOT_CREATING_STATUS  string = "creating"
+	SNAPSHOT_AVAILABLE_STATUS string = "available"
+	SNAPSHOT_ERROR_STATUS     string = "error"
 )
 
 type InstanceVolumes struct {
@@ -91,6 +101,9 @@ type Volume struct {
 	AvailabilityZone   string           `json:"AvailabilityZone"`
 	ProjectId          int              `json:"ProjectId"`
 	DeleteWithInstance bool             `json:"DeleteWithInstance"`
+	SnapshotId         string           `json:"SnapshotId"` //创建云硬盘时使用的快照ID
+	Encrypted          bool             `json:"Encrypted"`  //云硬盘是否加密
+	KmsKeyId           string           `json:"KmsKeyId"`   //加密云硬盘使用的KMS密钥ID
 	Attachments        []*Attachment    `json:"Attachment"` //硬盘的当前挂载信息
 }
 
@@ -111,6 +124,10 @@ type CreateVolumeReq struct {
 	PurchaseTime     int
 	ProjectId        string
 	Tags             map[string]string
+	// Encrypted creates an encrypted volume with KmsKeyId, or the default
+	// key of the account if KmsKeyId is empty
+	Encrypted bool
+	KmsKeyId  string
 }
 
 func (cv *CreateVolumeReq) ToQuery() string {
@@ -160,6 +177,13 @@ func (cv *CreateVolumeReq) ToQuery() string {
 		querySlice = append(querySlice, fmt.Sprintf("SnapshotId=%v", cv.SnapshotId))
 	}
 
+	if cv.Encrypted {
+		querySlice = append(querySlice, "Encrypted=true")
+		if cv.KmsKeyId != "" {
+			querySlice = append(querySlice, fmt.Sprintf("KmsKeyId=%v", cv.KmsKeyId))
+		}
+	}
+
 	if cv.Size <= MIN_VOLUME_SIZE {
 		cv.Size = MIN_VOLUME_SIZE
 	}
@@ -223,6 +247,91 @@ func (ev *ExpandVolumeReq) ToQuery() string {
 	return strings.Join(querySlice, Separator)
 }
 
+// ModifyVolumeReq changes the type of a volume, e.g. from ESSD_PL1 to
+// ESSD_PL2 or from SSD3.0 to ESSD_PL1. The volume keeps serving IO while
+// the change is in progress.
+type ModifyVolumeReq struct {
+	VolumeId   string `json:"VolumeId"`
+	VolumeType string `json:"VolumeType"`
+}
+
+type ModifyVolumeResp struct {
+	RequestId string `json:"RequestId"`
+	Return    bool   `json:"Return"`
+}
+
+func (mv *ModifyVolumeReq) ToQuery() string {
+	querySlice := []string{"Action=ModifyVolumeType"}
+	querySlice = append(querySlice, fmt.Sprintf("VolumeId=%s", mv.VolumeId))
+	querySlice = append(querySlice, fmt.Sprintf("VolumeType=%s", mv.VolumeType))
+
+	return strings.Join(querySlice, Separator)
+}
+
+// TagVolumeReq adds tags to an existing volume through the tag service, the
+// value of a tag already on the volume is replaced
+type TagVolumeReq struct {
+	VolumeId string
+	Tags     map[string]string
+}
+
+type TagVolumeResp struct {
+	RequestId string `json:"RequestId"`
+	Return    bool   `json:"Return"`
+}
+
+func (tv *TagVolumeReq) ToQuery() string {
+	querySlice := []string{"Action=CreateTags", "ResourceType=volume"}
+	querySlice = append(querySlice, fmt.Sprintf("ResourceIds.1=%s", tv.VolumeId))
+	keys := make([]string, 0, len(tv.Tags))
+	for k := range tv.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		querySlice = append(querySlice, fmt.Sprintf("Tag.%d.Key=%s", i+1, k))
+		querySlice = append(querySlice, fmt.Sprintf("Tag.%d.Value=%s", i+1, tv.Tags[k]))
+	}
+
+	return strings.Join(querySlice, Separator)
+}
+
+// DescribeVolumeTagsReq lists the tags of a volume through the tag service
+type DescribeVolumeTagsReq struct {
+	VolumeId string
+}
+
+type ResourceTag struct {
+	ResourceType string `json:"ResourceType"`
+	ResourceId   string `json:"ResourceId"`
+	Key          string `json:"Key"`
+	Value        string `json:"Value"`
+}
+
+type DescribeVolumeTagsResp struct {
+	RequestId string         `json:"RequestId"`
+	TagSet    []*ResourceTag `json:"TagSet"`
+}
+
+func (dt *DescribeVolumeTagsReq) ToQuery() string {
+	querySlice := []string{"Action=DescribeTags"}
+	querySlice = append(querySlice, "Filter.1.Name=resource-type", "Filter.1.Value.1=volume")
+	querySlice = append(querySlice, "Filter.2.Name=resource-id", fmt.Sprintf("Filter.2.Value.1=%s", dt.VolumeId))
+
+	return strings.Join(querySlice, Separator)
+}
+
+// Tags returns the tags of the volume as a map
+func (dt *DescribeVolumeTagsResp) Tags(volumeId string) map[string]string {
+	tags := make(map[string]string, len(dt.TagSet))
+	for _, tag := range dt.TagSet {
+		if tag.ResourceId == volumeId {
+			tags[tag.Key] = tag.Value
+		}
+	}
+	return tags
+}
+
 type ListVolumesReq struct {
 	VolumeIds        []string
 	VolumeCategory   string
@@ -230,6 +339,12 @@ type ListVolumesReq struct {
 	VolumeType       string
 	VolumeCreateDate string
 	VolumeExactName  string
+	// Tags only matches the volumes carrying all the given tags
+	Tags map[string]string
+	// Marker is the offset of the first volume to return, MaxResults limits
+	// the volumes of one page, both are ignored when not positive
+	Marker     int
+	MaxResults int
 }
 
 func (lv *ListVolumesReq) ToQuery() string {
@@ -264,6 +379,23 @@ func (lv *ListVolumesReq) ToQuery() string {
 	if len(lv.VolumeExactName) > 0 {
 		querySlice = append(querySlice, fmt.Sprintf("VolumeExactName=%v", lv.VolumeExactName))
 	}
+	if len(lv.Tags) > 0 {
+		keys := make([]string, 0, len(lv.Tags))
+		for k := range lv.Tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for i, k := range keys {
+			querySlice = append(querySlice, fmt.Sprintf("Filter.%d.Name=tag:%s", i+1, k))
+			querySlice = append(querySlice, fmt.Sprintf("Filter.%d.Value.1=%s", i+1, lv.Tags[k]))
+		}
+	}
+	if lv.Marker > 0 {
+		querySlice = append(querySlice, fmt.Sprintf("Marker=%v", lv.Marker))
+	}
+	if lv.MaxResults > 0 {
+		querySlice = append(querySlice, fmt.Sprintf("MaxResults=%v", lv.MaxResults))
+	}
 
 	return strings.Join(querySlice, Separator)
 }
@@ -274,6 +406,16 @@ type ListVolumesResp struct {
 	TotalCount int       `json:"TotalCount"`
 }
 
+// NextMarker returns the marker of the page following this response of
+// listVolumesReq, and false when this is the last page
+func (lr *ListVolumesResp) NextMarker(listVolumesReq *ListVolumesReq) (int, bool) {
+	next := listVolumesReq.Marker + len(lr.Volumes)
+	if len(lr.Volumes) == 0 || next >= lr.TotalCount {
+		return 0, false
+	}
+	return next, true
+}
+
 type AttachVolumeReq struct {
 	VolumeId           string
 	InstanceId         string
@@ -358,6 +500,37 @@ func (va *DescribeInstanceVolumesReq) ToQuery() string {
 	return strings.Join(querySlice, Separator)
 }
 
+type DescribeVolumeQuotaReq struct {
+	VolumeType       string
+	AvailabilityZone string
+}
+
+func (dq *DescribeVolumeQuotaReq) ToQuery() string {
+	querySlice := []string{"Action=DescribeVolumeQuota"}
+	if dq.VolumeType != "" {
+		querySlice = append(querySlice, fmt.Sprintf("VolumeType=%v", dq.VolumeType))
+	}
+	if dq.AvailabilityZone != "" {
+		querySlice = append(querySlice, fmt.Sprintf("AvailabilityZone=%v", dq.AvailabilityZone))
+	}
+	return strings.Join(querySlice, Separator)
+}
+
+// VolumeQuota is the account quota of one volume type, capacity is in GB
+type VolumeQuota struct {
+	VolumeType       string `json:"VolumeType"`
+	AvailabilityZone string `json:"AvailabilityZone"`
+	TotalCapacity    int64  `json:"TotalCapacity"`
+	UsedCapacity     int64  `json:"UsedCapacity"`
+	TotalCount       int    `json:"TotalCount"`
+	UsedCount        int    `json:"UsedCount"`
+}
+
+type DescribeVolumeQuotaResp struct {
+	RequestId string         `json:"RequestId"`
+	QuotaSet  []*VolumeQuota `json:"QuotaSet"`
+}
+
 type Snapshot struct {
 	SnapshotID       string `json:"SnapshotId"`
 	SnapshotName     string `json:"SnapshotName"`
@@ -372,6 +545,8 @@ type Snapshot struct {
 	AvailabilityZone string `json:"AvailabilityZone"`
 	VolumeStatus     string `json:"VolumeStatus"`
 	SnapshotType     string `json:"SnapshotType"`
+	Encrypted        bool   `json:"Encrypted"`
+	KmsKeyId         string `json:"KmsKeyId"`
 }
 
 type CreateSnapshotParams struct {
@@ -120,7 +120,7 @@ func (cli *Client) DoRequest(service string, query string, payloads ...string) (
 	}
 	s := v4.Signer{Credentials: credentials.NewStaticCredentials(ak, sk, "")}
 
-	if service == "ebs" || service == "kec" {
+	if service == "ebs" || service == "kec" || service == "tag" {
 		query = fmt.Sprintf("%v&Version=%v", query, Version)
 	} else if service == "iam" {
 		query = fmt.Sprintf("%v&Version=%v", query, "2015-11-01")
@@ -0,0 +1,69 @@
+package util
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// LeaderElectionNamespace is the namespace of the leases, the same as the
+	// sidecars of the controller
+	LeaderElectionNamespace = "kube-system"
+
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+)
+
+// RunWithLeaderElection runs run while this process holds the lease name, so
+// only one of the controller replicas runs it. The ctx passed to run is
+// cancelled when the lease is lost and the election starts over, until ctx
+// is done.
+func RunWithLeaderElection(ctx context.Context, client kubernetes.Interface, name string, run func(ctx context.Context)) {
+	identity, err := os.Hostname()
+	if err != nil || identity == "" {
+		identity = "csi-controller-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: LeaderElectionNamespace,
+		},
+		Client: client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: identity,
+		},
+	}
+
+	for {
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			ReleaseOnCancel: true,
+			LeaseDuration:   leaseDuration,
+			RenewDeadline:   renewDeadline,
+			RetryPeriod:     retryPeriod,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) {
+					klog.Infof("%s became the leader of %s", identity, name)
+					run(ctx)
+				},
+				OnStoppedLeading: func() {
+					klog.Infof("%s stopped leading %s", identity, name)
+				},
+			},
+		})
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+	}
+}